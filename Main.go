@@ -1,55 +1,456 @@
 package main
 
 import (
-	"net/http"
+	"bufio"
+	"config"
+	"context"
+	"discovery"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"server"
+	"storage"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
 )
 
-// PostFile is a method to handle post request for a file to be saved to the server.
-func PostFile(w http.ResponseWriter, req *http.Request) {
-	server.WriteFile(w, req)
+// reindex rebuilds the metadata index from the SAVE files in the root path given, or the configured root path.
+// @param args []string
+func reindex(args []string) {
+	cfg := subcommandConfig()
+	root := cfg.Root
+	if len(args) > 0 {
+		root = args[0]
+	}
+	s, err := server.New(server.Options{Root: root, Storage: openStorage(cfg)})
+	if err != nil {
+		server.LogFatal(err.Error())
+	}
+	count, err := s.Reindex()
+	if err != nil {
+		server.LogFatal("could not rebuild metadata index; " + err.Error())
+	}
+	server.Logf("indexed %d files in %s", count, root)
+}
+
+// fingerprint prints the SHA-256 fingerprint of the TLS certificate of the root path given, or the configured one,
+// generating the certificate if it does not exist yet so it can be pinned before the server is first started.
+// @param args []string
+func fingerprint(args []string) {
+	cfg := subcommandConfig()
+	if len(args) > 0 {
+		cfg.Root = args[0]
+	}
+	s, err := server.New(server.Options{Root: cfg.Root, TLS: true, CertFile: cfg.TLSCertFile, KeyFile: cfg.TLSKeyFile})
+	if err != nil {
+		server.LogFatal(err.Error())
+	}
+	fp, err := s.Fingerprint()
+	if err != nil {
+		server.LogFatal(err.Error())
+	}
+	fmt.Println(fp)
+}
+
+// relayout moves the files in the root path into the folders the folder layout gives for them while the server is stopped.
+// @param args []string The arguments after the subcommand
+func relayout(args []string) {
+	cfg := subcommandConfig()
+	flags := flag.NewFlagSet("relayout", flag.ExitOnError)
+	root := flags.String("root", cfg.Root, "the root path of the server")
+	layout := flags.String("layout", cfg.FolderLayout, "the folder layout to move the files into")
+	dryRun := flags.Bool("n", false, "only print the files that would be moved")
+	flags.Parse(args)
+	s := openServer(server.Options{Root: *root, Storage: openStorage(cfg), FolderLayout: *layout})
+	defer s.Shutdown(context.Background())
+	moved, err := s.Relayout(flags.Args(), *dryRun)
+	if err != nil {
+		server.LogFatal(err.Error())
+	}
+	if *dryRun {
+		server.Logf("would move %d files into the folder layout %s", moved, *layout)
+		return
+	}
+	server.Logf("moved %d files into the folder layout %s", moved, *layout)
+}
+
+// openServer creates a server for a subcommand and opens the metadata index of its root path
+// @param opts server.Options
+// @return *server.Server
+func openServer(opts server.Options) *server.Server {
+	s, err := server.New(opts)
+	if err != nil {
+		server.LogFatal(err.Error())
+	}
+	err = s.Open()
+	if err != nil {
+		server.LogFatal("could not open metadata index; " + err.Error())
+	}
+	return s
+}
+
+// s3StagingFolder is the folder inside the root path uploads to S3 are kept in until they are complete
+const s3StagingFolder = ".s3-staging"
+
+// openStorage creates the storage the settings keep the folders and files in,
+// or nil for the file system storage of the root path the server uses when none is given.
+// @param cfg config.Config
+// @return storage.Storage
+func openStorage(cfg config.Config) storage.Storage {
+	if cfg.Storage != "s3" {
+		return nil
+	}
+	store, err := storage.NewS3(storage.S3Options{
+		Endpoint:   cfg.S3Endpoint,
+		Bucket:     cfg.S3Bucket,
+		Region:     cfg.S3Region,
+		AccessKey:  cfg.S3AccessKey,
+		SecretKey:  cfg.S3SecretKey,
+		Prefix:     cfg.S3Prefix,
+		StagingDir: filepath.Join(cfg.Root, s3StagingFolder),
+	})
+	if err != nil {
+		server.LogFatal(err.Error())
+	}
+	return store
+}
+
+// devicesUsage is the usage of the devices subcommand and console commands
+const devicesUsage = `usage:
+  Main devices [-root path] [list]
+  Main devices [-root path] approve <id>
+  Main devices [-root path] revoke <id>`
+
+// devices lists, approves and revokes the devices paired with the root path. It can be run while the server is running.
+// @param args []string The arguments after the subcommand
+func devices(args []string) {
+	flags := flag.NewFlagSet("devices", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, devicesUsage) }
+	root := flags.String("root", subcommandConfig().Root, "the root path of the server")
+	flags.Parse(args)
+	s, err := server.New(server.Options{Root: *root})
+	if err != nil {
+		server.LogFatal(err.Error())
+	}
+	err = deviceCommand(s, flags.Args(), os.Stdout)
+	if err == errUsage {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		server.LogFatal(err.Error())
+	}
+}
+
+// errUsage is returned by deviceCommand when the command is not one it knows
+var errUsage = errors.New("error: unknown command")
+
+// deviceCommand runs a devices command: list, approve <id> or revoke <id>
+// @param s *server.Server
+// @param args []string The command and its arguments
+// @param out io.Writer Where the list of devices is written
+// @return error
+func deviceCommand(s *server.Server, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		list, err := s.Devices()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTATUS\tCODE\tNAME\tADDRESS\tREQUESTED\tAPPROVED")
+		for _, d := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", d.ID, d.Status, d.Code, d.Name, d.Address, d.Requested, d.Approved)
+		}
+		return w.Flush()
+	case args[0] == "approve" && len(args) == 2:
+		return s.ApproveDevice(args[1])
+	case args[0] == "revoke" && len(args) == 2:
+		return s.RevokeDevice(args[1])
+	}
+	return errUsage
+}
+
+// readConsole runs the devices commands typed into the console of the running server,
+// like "approve <id>", until the input ends.
+// @param s *server.Server
+// @param in io.Reader
+func readConsole(s *server.Server, in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "devices" {
+			args = args[1:]
+		}
+		err := deviceCommand(s, args, os.Stdout)
+		if err == errUsage {
+			fmt.Println("commands: devices, approve <id>, revoke <id>")
+			continue
+		}
+		if err != nil {
+			server.Logln(err.Error())
+		}
+	}
 }
 
-// GetFolders is a method to retrieve the list of folder names in the Data path.
-func GetFolders(w http.ResponseWriter, req *http.Request) {
-	server.GetFolders(w, req)
+// discover looks for servers on the LAN with mDNS and a discovery broadcast and prints the ones that answer.
+// @param args []string The arguments after the subcommand
+func discover(args []string) {
+	cfg := subcommandConfig()
+	flags := flag.NewFlagSet("discover", flag.ExitOnError)
+	mdnsAddress := flags.String("mdns", cfg.MDNSAddress, "the address to send the mDNS question to, empty to skip it")
+	broadcast := flags.String("broadcast", fmt.Sprintf("255.255.255.255:%d", cfg.DiscoveryPort), "the address to send the discovery broadcast to, empty to skip it")
+	timeout := flags.Duration("timeout", 2*time.Second, "how long to wait for answers")
+	flags.Parse(args)
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	// both are waited on at the same time, for the same timeout
+	var services []discovery.Service
+	var announcements []discovery.Announcement
+	var wg sync.WaitGroup
+	if *mdnsAddress != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			services, err = discovery.LookupMDNS(ctx, *mdnsAddress)
+			if err != nil {
+				server.Logf("could not look up mdns; %s", err)
+			}
+		}()
+	}
+	if *broadcast != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			announcements, err = discovery.Browse(ctx, *broadcast)
+			if err != nil {
+				server.Logf("could not send discovery broadcast; %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FOUND BY\tNAME\tADDRESS\tVERSION\tPATH\tFINGERPRINT")
+	for _, svc := range services {
+		for _, ip := range svc.IPs {
+			fmt.Fprintf(w, "mdns\t%s\t%s://%s\t%s\t%s\t%s\n", svc.Instance, svc.TXT["scheme"],
+				net.JoinHostPort(ip.String(), strconv.Itoa(svc.Port)), svc.TXT["version"], svc.TXT["path"], svc.TXT["fingerprint"])
+		}
+	}
+	for _, a := range announcements {
+		fmt.Fprintf(w, "broadcast\t%s\t%s://%s\t%s\t%s\t%s\n", a.Name, a.Scheme,
+			net.JoinHostPort(a.Address, strconv.Itoa(a.Port)), a.Version, a.Path, a.Fingerprint)
+	}
+	w.Flush()
 }
 
-// GetFiles is a method to accept a POST request for a specific folder in the Data path requesting files
-// from startIndex to endIndex(exclusively). Must also send a dictionary with the keys of the attributes you want to extract
-func GetFiles(w http.ResponseWriter, req *http.Request) {
-	server.GetFiles(w, req)
+// subcommandConfig returns the settings from the config file and the environment,
+// which the flags of the subcommands default to.
+// @return config.Config
+func subcommandConfig() config.Config {
+	cfg, _, err := config.Load("", nil)
+	if err != nil {
+		server.LogFatal(err.Error())
+	}
+	return cfg
 }
 
-// ValidateFile is a GET request that takes in a file hash and checks to see
-// if that file exists on the server as a whole.
-func ValidateFile(w http.ResponseWriter, req *http.Request) {
-	server.ValidateFile(w, req)
+// manageUsage is the usage of the management subcommands
+const manageUsage = `usage:
+  Main rm [-root path] <folder> <hash>...
+  Main mv [-root path] <folder> <to folder> <hash>...
+  Main mkdir [-root path] <folder>
+  Main rename [-root path] <folder> <new name>
+  Main rmdir [-root path] [-r] <folder>`
+
+// manage runs a management subcommand against the root path while the server is stopped.
+// @param command string The subcommand
+// @param args []string The arguments after the subcommand
+func manage(command string, args []string) {
+	cfg := subcommandConfig()
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, manageUsage) }
+	root := flags.String("root", cfg.Root, "the root path of the server")
+	recursive := flags.Bool("r", false, "delete the folder along with its files")
+	flags.Parse(args)
+	args = flags.Args()
+	minArgs := map[string]int{"rm": 2, "mv": 3, "mkdir": 1, "rename": 2, "rmdir": 1}[command]
+	if len(args) < minArgs {
+		flags.Usage()
+		os.Exit(2)
+	}
+	s := openServer(server.Options{Root: *root, Storage: openStorage(cfg)})
+	defer s.Shutdown(context.Background())
+	var err error
+	switch command {
+	case "rm":
+		err = forEachHash(args[1:], func(hash []byte) error { return s.DeleteSaveFile(args[0], hash) })
+	case "mv":
+		err = forEachHash(args[2:], func(hash []byte) error { return s.MoveSaveFile(args[0], args[1], hash) })
+	case "mkdir":
+		err = s.CreateFolder(args[0])
+	case "rename":
+		err = s.RenameFolder(args[0], args[1])
+	case "rmdir":
+		err = s.DeleteFolder(args[0], *recursive)
+	}
+	if err != nil {
+		server.LogFatal(err.Error())
+	}
 }
 
-// PingServ method listens for any message and sends back a response that lets
-// the user know it is hitting the right address.
-func PingServ(w http.ResponseWriter, req *http.Request) {
-	server.PingServ(w, req)
+// forEachHash runs an operation on every hex encoded hash given, stopping at the first error.
+// @param hashes []string
+// @param op func(hash []byte) error
+// @return error
+func forEachHash(hashes []string, op func(hash []byte) error) error {
+	for _, h := range hashes {
+		hash, err := hex.DecodeString(h)
+		if err != nil {
+			return fmt.Errorf("error: %q is not a hex encoded hash", h)
+		}
+		err = op(hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func main() {
-	// Check if Data Folder exists and if not, create it.
-	server.Logln("starting up server on port :8080")
 	if len(os.Args) > 1 {
-		server.RootPath = os.Args[1]
+		switch os.Args[1] {
+		case "reindex":
+			reindex(os.Args[2:])
+			return
+		case "relayout":
+			relayout(os.Args[2:])
+			return
+		case "devices":
+			devices(os.Args[2:])
+			return
+		case "discover":
+			discover(os.Args[2:])
+			return
+		case "fingerprint":
+			fingerprint(os.Args[2:])
+			return
+		case "rm", "mv", "mkdir", "rename", "rmdir":
+			manage(os.Args[1], os.Args[2:])
+			return
+		}
+	}
+	cfg, printConfig, err := config.Load(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		server.LogFatal(err.Error())
+	}
+	if printConfig {
+		fmt.Println(cfg)
+		return
+	}
+	var logOutput io.Writer = os.Stderr
+	if cfg.LogFile != "" {
+		logFile, err := server.OpenLogFile(cfg.LogFile, cfg.LogMaxSize, cfg.LogMaxFiles)
+		if err != nil {
+			server.LogFatal("could not open log file; " + err.Error())
+		}
+		defer logFile.Close()
+		logOutput = logFile
+	}
+	logger, err := server.NewLogger(logOutput, cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		server.LogFatal(err.Error())
 	}
-	_, err := os.Stat(server.RootPath)
+	server.SetLogger(logger)
+	// the file access sfile logs with the standard log package is only wanted when debugging
+	log.SetFlags(0)
+	log.SetOutput(logger.StandardLogger("debug").Writer())
+	s, err := server.New(options(cfg, logger))
 	if err != nil {
-		server.Logln("creating Initial Data folder")
-		os.Mkdir(server.RootPath, 0777)
+		server.LogFatal(err.Error())
+	}
+	go readConsole(s, os.Stdin)
+	stopped, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() {
+		served <- s.ListenAndServe()
+	}()
+	select {
+	case err = <-served:
+	case <-stopped.Done():
+		// a second signal stops the program straight away
+		stop()
+		server.Logf("shutting down, waiting up to %s for requests in progress to finish", cfg.ShutdownTimeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	shutdownErr := s.Shutdown(ctx)
+	if err != nil {
+		server.LogFatal(err.Error())
+	}
+	if shutdownErr != nil {
+		server.LogFatal("server did not shut down cleanly; " + shutdownErr.Error())
+	}
+	server.Logln("server stopped")
+}
+
+// options returns the options of the server from the settings
+// @param cfg config.Config
+// @param logger *server.Logger
+// @return server.Options
+func options(cfg config.Config, logger *server.Logger) server.Options {
+	opts := server.Options{
+		Root:              cfg.Root,
+		Storage:           openStorage(cfg),
+		Address:           cfg.ListenAddress(),
+		TLS:               cfg.EnableTLS,
+		CertFile:          cfg.TLSCertFile,
+		KeyFile:           cfg.TLSKeyFile,
+		HTTPAddress:       cfg.HTTPListenAddress(),
+		Logger:            logger,
+		FolderLayout:      cfg.FolderLayout,
+		AdminToken:        cfg.AdminToken,
+		DisableAuth:       !cfg.EnableAuth,
+		MaxFileSize:       cfg.MaxFileSize,
+		MaxChunkSize:      cfg.MaxChunkSize,
+		MinFreeSpace:      cfg.MinFreeSpace,
+		FolderQuota:       cfg.FolderQuota,
+		DeviceQuota:       cfg.DeviceQuota,
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+		DisableGallery:    !cfg.EnableGallery,
+		DisableThumbnails: !cfg.EnableThumbnails,
+		DisableMetadata:   !cfg.EnableMetadata,
+		DisableZip:        !cfg.EnableZip,
+		DisableMetrics:    !cfg.EnableMetrics,
+		DiscoveryAddress:  cfg.DiscoveryListenAddress(),
+	}
+	if cfg.EnableDiscovery {
+		opts.MDNSAddress = cfg.MDNSAddress
 	}
-	// register functions
-	http.HandleFunc("/ping", PingServ)
-	http.HandleFunc("/post_file", PostFile)
-	http.HandleFunc("/get_folders", GetFolders)
-	http.HandleFunc("/get_files", GetFiles)
-	http.HandleFunc("/validate_file", ValidateFile)
-	http.ListenAndServe(":8080", nil)
+	return opts
 }
@@ -1,2 +1,3 @@
 export GOPATH=`pwd`
 go build Main.go
+go build lanfs
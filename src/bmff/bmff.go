@@ -0,0 +1,344 @@
+package bmff
+
+// bmff file to read metadata out of ISO base media files (MP4 and QuickTime MOV) without any outside packages
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// boxes that only hold other boxes and need to be walked into
+var containerBoxes = map[string]bool{
+	"moov": true,
+	"trak": true,
+	"mdia": true,
+	"minf": true,
+	"stbl": true,
+	"udta": true,
+}
+
+// top level boxes a file is allowed to start with
+var topLevelBoxes = map[string]bool{
+	"ftyp": true,
+	"moov": true,
+	"mdat": true,
+	"free": true,
+	"skip": true,
+	"wide": true,
+	"pnot": true,
+}
+
+// maxBoxRead is the largest box body that will be read into memory.
+// Only small metadata boxes are read, mdat and other large boxes are skipped over.
+const maxBoxRead = 1 << 20
+
+// epoch1904 is the number of seconds between 1904-01-01, which the mvhd creation time counts from, and the unix epoch.
+const epoch1904 = 2082844800
+
+// ErrNotBMFF is returned when the data given is not an ISO base media file.
+var ErrNotBMFF = errors.New("error: data is not an mp4 or mov file")
+
+var errMalformed = errors.New("error: box is not formatted properly")
+
+// Metadata is an object that holds the fields read out of an MP4 or MOV file.
+// Fields that were not found are left at their zero value.
+type Metadata struct {
+	// Brand from the ftyp box, for example "isom" or "qt  "
+	Brand string
+	// Time the movie was created, zero if not set
+	CreationTime time.Time
+	// Length of the movie
+	Duration time.Duration
+	// Size of the first video track
+	Width  int
+	Height int
+	// Rotation of the first video track in degrees, taken from its matrix
+	Rotation int
+	// Sample entry format of the first video and audio tracks, for example "avc1" or "mp4a"
+	VideoCodec string
+	AudioCodec string
+	// HasGPS is true when Latitude and Longitude are set
+	HasGPS    bool
+	Latitude  float64
+	Longitude float64
+	// HasAltitude is true when Altitude is set
+	HasAltitude bool
+	Altitude    float64
+}
+
+// box is the header of a single box
+type box struct {
+	boxType string
+	// offset and size of the box body, after the header
+	offset int64
+	size   int64
+}
+
+// track holds what is known about a trak box while walking it
+type track struct {
+	handler  string
+	width    int
+	height   int
+	rotation int
+	codec    string
+}
+
+// reader walks the boxes of a file
+type reader struct {
+	r    io.ReaderAt
+	meta *Metadata
+	// track currently being walked
+	trak *track
+}
+
+// Read is a method to read the metadata out of an MP4 or MOV file.
+// @param r io.ReaderAt The file data
+// @param size int64 The size of the file data
+// @return *Metadata
+// @return error ErrNotBMFF if the data is not an ISO base media file
+func Read(r io.ReaderAt, size int64) (*Metadata, error) {
+	rd := &reader{r: r, meta: &Metadata{}}
+	first, err := rd.readBoxHeader(0, size)
+	if err != nil || !topLevelBoxes[first.boxType] {
+		return nil, ErrNotBMFF
+	}
+	err = rd.walk(0, size)
+	if err != nil {
+		return nil, err
+	}
+	return rd.meta, nil
+}
+
+// readBoxHeader reads the header of the box starting at offset
+// @param offset int64 Where the box starts
+// @param end int64 Where the box's parent ends
+// @return box
+// @return error
+func (rd *reader) readBoxHeader(offset, end int64) (box, error) {
+	header := make([]byte, 16)
+	if end-offset < 8 {
+		return box{}, errMalformed
+	}
+	_, err := rd.r.ReadAt(header[:8], offset)
+	if err != nil {
+		return box{}, err
+	}
+	b := box{boxType: string(header[4:8]), offset: offset + 8}
+	size := int64(binary.BigEndian.Uint32(header[0:4]))
+	switch size {
+	case 0:
+		// box runs to the end of its parent
+		size = end - offset
+	case 1:
+		// 64 bit size follows the type
+		if end-offset < 16 {
+			return box{}, errMalformed
+		}
+		_, err = rd.r.ReadAt(header[8:16], offset+8)
+		if err != nil {
+			return box{}, err
+		}
+		size = int64(binary.BigEndian.Uint64(header[8:16]))
+		b.offset += 8
+	}
+	if size < b.offset-offset || size > end-offset {
+		return box{}, errMalformed
+	}
+	b.size = size - (b.offset - offset)
+	return b, nil
+}
+
+// walk reads every box between offset and end, walking into container boxes
+// @param offset int64
+// @param end int64
+// @return error
+func (rd *reader) walk(offset, end int64) error {
+	for offset+8 <= end {
+		b, err := rd.readBoxHeader(offset, end)
+		if err != nil {
+			return err
+		}
+		err = rd.handleBox(b)
+		if err != nil {
+			return err
+		}
+		offset = b.offset + b.size
+	}
+	return nil
+}
+
+// handleBox reads the box given if it is one we pull metadata from
+// @param b box
+// @return error
+func (rd *reader) handleBox(b box) error {
+	if b.boxType == "trak" {
+		// a trak inside a trak is not valid, but it must not lose the track it is in
+		parent, t := rd.trak, &track{}
+		rd.trak = t
+		err := rd.walk(b.offset, b.offset+b.size)
+		rd.trak = parent
+		if err != nil {
+			return err
+		}
+		rd.finishTrack(t)
+		return nil
+	}
+	if containerBoxes[b.boxType] {
+		return rd.walk(b.offset, b.offset+b.size)
+	}
+	switch b.boxType {
+	case "ftyp", "mvhd", "tkhd", "hdlr", "stsd", "\xa9xyz":
+	default:
+		return nil
+	}
+	if b.size > maxBoxRead {
+		return nil
+	}
+	body := make([]byte, b.size)
+	_, err := rd.r.ReadAt(body, b.offset)
+	if err != nil {
+		return err
+	}
+	switch b.boxType {
+	case "ftyp":
+		if len(body) >= 4 {
+			rd.meta.Brand = string(body[0:4])
+		}
+	case "mvhd":
+		rd.readMovieHeader(body)
+	case "tkhd":
+		rd.readTrackHeader(body)
+	case "hdlr":
+		// version and flags, pre defined, then handler type.
+		// QuickTime files also have a data handler in minf, which comes after the one in mdia
+		if rd.trak != nil && rd.trak.handler == "" && len(body) >= 12 {
+			rd.trak.handler = string(body[8:12])
+		}
+	case "stsd":
+		// version and flags, entry count, then the first entry's size and format
+		if rd.trak != nil && len(body) >= 16 {
+			rd.trak.codec = string(body[12:16])
+		}
+	case "\xa9xyz":
+		rd.readLocation(body)
+	}
+	return nil
+}
+
+// readMovieHeader reads the creation time and duration out of an mvhd box body
+func (rd *reader) readMovieHeader(body []byte) {
+	var created, timescale, duration uint64
+	if len(body) < 1 {
+		return
+	}
+	if body[0] == 1 {
+		if len(body) < 32 {
+			return
+		}
+		created = binary.BigEndian.Uint64(body[4:12])
+		timescale = uint64(binary.BigEndian.Uint32(body[20:24]))
+		duration = binary.BigEndian.Uint64(body[24:32])
+	} else {
+		if len(body) < 20 {
+			return
+		}
+		created = uint64(binary.BigEndian.Uint32(body[4:8]))
+		timescale = uint64(binary.BigEndian.Uint32(body[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(body[16:20]))
+	}
+	if created != 0 {
+		rd.meta.CreationTime = time.Unix(int64(created)-epoch1904, 0).UTC()
+	}
+	if timescale != 0 {
+		rd.meta.Duration = time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+	}
+}
+
+// readTrackHeader reads the rotation and size of a track out of a tkhd box body
+func (rd *reader) readTrackHeader(body []byte) {
+	if rd.trak == nil || len(body) < 1 {
+		return
+	}
+	// the matrix and size sit at the end of the box, after fields that are longer in version 1
+	matrix := 40
+	if body[0] == 1 {
+		matrix = 52
+	}
+	if len(body) < matrix+44 {
+		return
+	}
+	a := int32(binary.BigEndian.Uint32(body[matrix : matrix+4]))
+	b := int32(binary.BigEndian.Uint32(body[matrix+4 : matrix+8]))
+	rd.trak.rotation = (360 + int(math.Round(math.Atan2(float64(b), float64(a))*180/math.Pi))) % 360
+	// width and height are 16.16 fixed point numbers
+	rd.trak.width = int(binary.BigEndian.Uint32(body[matrix+36:matrix+40]) >> 16)
+	rd.trak.height = int(binary.BigEndian.Uint32(body[matrix+40:matrix+44]) >> 16)
+}
+
+// readLocation reads an ISO 6709 location string such as "+48.8577+002.2950+035.000/"
+// out of a udta ©xyz box body
+func (rd *reader) readLocation(body []byte) {
+	// string size and language come before the string
+	if len(body) < 4 {
+		return
+	}
+	size := int(binary.BigEndian.Uint16(body[0:2]))
+	if size > len(body)-4 {
+		size = len(body) - 4
+	}
+	values := splitISO6709(string(body[4 : 4+size]))
+	if len(values) < 2 {
+		return
+	}
+	rd.meta.HasGPS = true
+	rd.meta.Latitude = values[0]
+	rd.meta.Longitude = values[1]
+	if len(values) > 2 {
+		rd.meta.HasAltitude = true
+		rd.meta.Altitude = values[2]
+	}
+}
+
+// finishTrack fills in the metadata from the first video and audio tracks
+func (rd *reader) finishTrack(t *track) {
+	switch t.handler {
+	case "vide":
+		if rd.meta.VideoCodec == "" {
+			rd.meta.VideoCodec = t.codec
+			rd.meta.Width = t.width
+			rd.meta.Height = t.height
+			rd.meta.Rotation = t.rotation
+		}
+	case "soun":
+		if rd.meta.AudioCodec == "" {
+			rd.meta.AudioCodec = t.codec
+		}
+	}
+}
+
+// splitISO6709 splits an ISO 6709 string into its signed decimal numbers
+func splitISO6709(location string) []float64 {
+	values := make([]float64, 0, 3)
+	start := -1
+	for i := 0; i <= len(location); i++ {
+		if i < len(location) && location[i] != '+' && location[i] != '-' && location[i] != '/' {
+			continue
+		}
+		if start >= 0 {
+			v, err := strconv.ParseFloat(location[start:i], 64)
+			if err != nil {
+				return values
+			}
+			values = append(values, v)
+		}
+		if i == len(location) || location[i] == '/' {
+			break
+		}
+		start = i
+	}
+	return values
+}
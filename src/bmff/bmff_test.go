@@ -0,0 +1,194 @@
+package bmff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// mkbox returns a box with a 32 bit size holding the bodies given one after another
+func mkbox(boxType string, bodies ...[]byte) []byte {
+	body := bytes.Join(bodies, nil)
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	b = append(b, boxType...)
+	return append(b, body...)
+}
+
+// mvhd returns a version 0 movie header body
+func mvhd(created uint32, timescale, duration uint32) []byte {
+	body := make([]byte, 100)
+	binary.BigEndian.PutUint32(body[4:], created)
+	binary.BigEndian.PutUint32(body[12:], timescale)
+	binary.BigEndian.PutUint32(body[16:], duration)
+	return body
+}
+
+// tkhd returns a track header body of a version with a rotation matrix and a size
+func tkhd(version byte, degrees float64, width, height uint32) []byte {
+	matrix := 40
+	if version == 1 {
+		matrix = 52
+	}
+	body := make([]byte, matrix+44)
+	body[0] = version
+	// a and b of the matrix are 16.16 fixed point cos and sin of the rotation
+	rad := degrees * math.Pi / 180
+	binary.BigEndian.PutUint32(body[matrix:], uint32(int32(math.Round(math.Cos(rad)*65536))))
+	binary.BigEndian.PutUint32(body[matrix+4:], uint32(int32(math.Round(math.Sin(rad)*65536))))
+	binary.BigEndian.PutUint32(body[matrix+36:], width<<16)
+	binary.BigEndian.PutUint32(body[matrix+40:], height<<16)
+	return body
+}
+
+// hdlr returns a handler box body
+func hdlr(handler string) []byte {
+	return append(append(make([]byte, 8), handler...), make([]byte, 12)...)
+}
+
+// stsd returns a sample description box body with one entry of a format
+func stsd(format string) []byte {
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint32(body[4:], 1)
+	body = binary.BigEndian.AppendUint32(body, 16)
+	return append(append(body, format...), make([]byte, 8)...)
+}
+
+// trak returns a track box with a header, a handler and a sample description
+func trak(header []byte, handler, format string) []byte {
+	return mkbox("trak",
+		mkbox("tkhd", header),
+		mkbox("mdia",
+			mkbox("hdlr", hdlr(handler)),
+			mkbox("minf",
+				// QuickTime files have a data handler here too, which is not the track's handler
+				mkbox("hdlr", hdlr("alis")),
+				mkbox("stbl", mkbox("stsd", stsd(format))),
+			),
+		),
+	)
+}
+
+// xyz returns a location box body
+func xyz(location string) []byte {
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(location)))
+	body = append(body, 0x15, 0xc7)
+	return append(body, location...)
+}
+
+// testMovie returns a small movie with a video track rotated 90 degrees, an audio track and a location
+func testMovie() []byte {
+	return bytes.Join([][]byte{
+		mkbox("ftyp", []byte("isom\x00\x00\x02\x00isomiso2avc1mp41")),
+		mkbox("moov",
+			mkbox("mvhd", mvhd(3803241600, 600, 6300)),
+			// the audio track comes first so the video track's codec is not taken from it
+			trak(tkhd(0, 0, 0, 0), "soun", "mp4a"),
+			trak(tkhd(1, 90, 1920, 1080), "vide", "avc1"),
+			trak(tkhd(0, 0, 640, 480), "vide", "hvc1"),
+			mkbox("udta", mkbox("\xa9xyz", xyz("+48.8577+002.2950+035.000/"))),
+		),
+		// mdat runs to the end of the file
+		{0, 0, 0, 0, 'm', 'd', 'a', 't', 1, 2, 3, 4},
+	}, nil)
+}
+
+func TestRead(t *testing.T) {
+	data := testMovie()
+	meta, err := Read(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Metadata{
+		Brand:        "isom",
+		CreationTime: time.Date(2024, 7, 8, 0, 0, 0, 0, time.UTC),
+		Duration:     10500 * time.Millisecond,
+		Width:        1920,
+		Height:       1080,
+		Rotation:     90,
+		VideoCodec:   "avc1",
+		AudioCodec:   "mp4a",
+		HasGPS:       true,
+		Latitude:     48.8577,
+		Longitude:    2.295,
+		HasAltitude:  true,
+		Altitude:     35,
+	}
+	if *meta != want {
+		t.Errorf("got %+v\nwant %+v", *meta, want)
+	}
+}
+
+func TestReadLargeSize(t *testing.T) {
+	// a box with a 64 bit size
+	body := mvhd(0, 1000, 2000)
+	large := binary.BigEndian.AppendUint32(nil, 1)
+	large = append(large, "mvhd"...)
+	large = binary.BigEndian.AppendUint64(large, uint64(16+len(body)))
+	large = append(large, body...)
+	data := mkbox("moov", large)
+	meta, err := Read(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Duration != 2*time.Second || !meta.CreationTime.IsZero() {
+		t.Errorf("got %+v", *meta)
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	tests := map[string]struct {
+		data []byte
+		err  error
+	}{
+		"empty":            {nil, ErrNotBMFF},
+		"not a movie":      {[]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), ErrNotBMFF},
+		"unknown first":    {mkbox("abcd", make([]byte, 8)), ErrNotBMFF},
+		"past the end":     {append(mkbox("ftyp", []byte("isom")), 0, 0, 1, 0, 'm', 'o', 'o', 'v'), errMalformed},
+		"past the parent":  {mkbox("moov", []byte{0, 0, 1, 0, 'm', 'v', 'h', 'd'}), errMalformed},
+		"smaller than hdr": {mkbox("moov", []byte{0, 0, 0, 4, 'm', 'v', 'h', 'd'}), errMalformed},
+		"cut large size":   {mkbox("moov", []byte{0, 0, 0, 1, 'm', 'v', 'h', 'd', 0, 0}), errMalformed},
+	}
+	for name, test := range tests {
+		_, err := Read(bytes.NewReader(test.data), int64(len(test.data)))
+		if err != test.err {
+			t.Errorf("%s: got %v, want %v", name, err, test.err)
+		}
+	}
+	// every cut of a good movie either parses or gives an error, without panicking
+	data := testMovie()
+	for n := range data {
+		Read(bytes.NewReader(data[:n]), int64(n))
+	}
+}
+
+func TestSplitISO6709(t *testing.T) {
+	tests := map[string][]float64{
+		"+48.8577+002.2950+035.000/": {48.8577, 2.295, 35},
+		"-33.8688+151.2093/":         {-33.8688, 151.2093},
+		"+48.8577-002.2950":          {48.8577, -2.295},
+		"+48.8577":                   {48.8577},
+		"":                           {},
+		"+4x.8/":                     {},
+	}
+	for location, want := range tests {
+		got := splitISO6709(location)
+		if len(got) != len(want) {
+			t.Errorf("%q: got %v, want %v", location, got, want)
+			continue
+		}
+		for i := range got {
+			if math.Abs(got[i]-want[i]) > 1e-9 {
+				t.Errorf("%q: got %v, want %v", location, got, want)
+			}
+		}
+	}
+}
+
+func FuzzRead(f *testing.F) {
+	f.Add(testMovie())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Read(bytes.NewReader(data), int64(len(data)))
+	})
+}
@@ -0,0 +1,467 @@
+package client
+
+// client file to hold the Client type programs talk to a file server with, and the typed wrappers of its paths
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"server"
+	"strings"
+	"time"
+)
+
+// defaultChunkSize is the ChunkSize used when none is set
+const defaultChunkSize = 4 << 20
+
+// the retries used when none are set
+const (
+	defaultRetries    = 5
+	defaultBackoff    = 500 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+)
+
+// searchPageSize is how many files are asked for at a time when a folder is listed, the most the server sends
+const searchPageSize = 1000
+
+// ErrHashMismatch is returned when the data of a file does not match its hash,
+// after it was uploaded or while it is downloaded
+var ErrHashMismatch = errors.New("error: the file does not match its hash")
+
+// Options is an object that holds the settings a Client is created with.
+type Options struct {
+	// URL is the address of the server with the prefix it is mounted under, like "https://192.168.1.20:8080"
+	// or "http://nas.local:8080/files"
+	URL string
+	// Token is the token of a paired device or the admin token, empty when the server does not need one
+	Token string
+	// Fingerprint is the SHA-256 fingerprint of the certificate of the server, like the one in its mDNS TXT record.
+	// When it is set the certificate is pinned to it instead of being checked against the system roots,
+	// so the self-signed certificate the server generates can be used. It can be in upper or lower case,
+	// with or without the colons, and the URL has to be an https one.
+	Fingerprint string
+	// HTTPClient sends the requests, one that pins Fingerprint when nil. It is used as is when set.
+	HTTPClient *http.Client
+	// ChunkSize is how many bytes of a file are sent to /post_file at a time, 4MB when 0.
+	// It has to be at most the max chunk size of the server.
+	ChunkSize int
+	// Retries is how many times a request that failed because of the network or a busy server is tried again,
+	// 5 when 0 and none when negative
+	Retries int
+	// Backoff is how long the first retry waits, 500 milliseconds when 0. It doubles with every retry up to MaxBackoff.
+	Backoff time.Duration
+	// MaxBackoff is the longest a retry waits, 30 seconds when 0
+	MaxBackoff time.Duration
+}
+
+// Client is an object that talks to one file server. It is safe to use from more than one goroutine.
+type Client struct {
+	opts Options
+	base *url.URL
+	http *http.Client
+}
+
+// Progress is an object that holds how far an upload or download of a file has got.
+// Done is the bytes the server has, or the bytes downloaded so far, out of Size.
+type Progress struct {
+	Path string
+	Hash string
+	Done int64
+	Size int64
+}
+
+// ProgressFunc is called with the progress of an upload or download after each chunk
+type ProgressFunc func(Progress)
+
+// New is a method to create a Client from its options. Nothing is sent until it is used.
+// @param opts Options
+// @return *Client
+// @return error
+func New(opts Options) (*Client, error) {
+	base, err := url.Parse(strings.TrimSuffix(opts.URL, "/"))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("error: server URL %q is not an http or https URL", opts.URL)
+	}
+	if opts.Fingerprint != "" {
+		if base.Scheme != "https" {
+			return nil, fmt.Errorf("error: a certificate fingerprint can only be pinned for an https URL, not %q", opts.URL)
+		}
+		opts.Fingerprint, err = normalizeFingerprint(opts.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.ChunkSize < 0 || opts.Backoff < 0 || opts.MaxBackoff < 0 {
+		return nil, errors.New("error: chunk size and backoff can not be negative")
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = defaultChunkSize
+	}
+	if opts.Retries == 0 {
+		opts.Retries = defaultRetries
+	}
+	if opts.Backoff == 0 {
+		opts.Backoff = defaultBackoff
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Transport: pinnedTransport(opts.Fingerprint)}
+	}
+	return &Client{opts: opts, base: base, http: httpClient}, nil
+}
+
+// normalizeFingerprint returns a SHA-256 fingerprint written the way server.CertificateFingerprint writes it,
+// in upper case with a colon between every byte
+// @param fingerprint string In upper or lower case, with or without colons and spaces
+// @return string
+// @return error
+func normalizeFingerprint(fingerprint string) (string, error) {
+	sum, err := hex.DecodeString(strings.NewReplacer(":", "", " ", "").Replace(fingerprint))
+	if err != nil || len(sum) != 32 {
+		return "", fmt.Errorf("error: fingerprint %q is not a SHA-256 fingerprint", fingerprint)
+	}
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":"), nil
+}
+
+// ErrFingerprintMismatch is returned when the certificate of the server is not the one with the pinned fingerprint,
+// which can mean the connection is being intercepted
+var ErrFingerprintMismatch = errors.New("error: the certificate of the server does not match the pinned fingerprint")
+
+// pinnedTransport returns a transport that only trusts the certificate with a fingerprint,
+// or the default checks when the fingerprint is empty
+// @param fingerprint string The fingerprint from normalizeFingerprint
+// @return http.RoundTripper
+func pinnedTransport(fingerprint string) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if fingerprint == "" {
+		return transport
+	}
+	transport.TLSClientConfig = &tls.Config{
+		// the certificate is checked against the fingerprint below instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || server.CertificateFingerprint(rawCerts[0]) != fingerprint {
+				return ErrFingerprintMismatch
+			}
+			return nil
+		},
+	}
+	return transport
+}
+
+// url returns the URL of a path of the server with a query
+// @param path string Like "/get_folders"
+// @param query url.Values
+// @return string
+func (c *Client) url(path string, query url.Values) string {
+	u := *c.base
+	u.Path += path
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// newRequest creates a request to a path of the server with the token of the client
+// @param ctx context.Context
+// @param method string
+// @param path string
+// @param query url.Values
+// @param body []byte The json body, nil for none
+// @return *http.Request
+// @return error
+func (c *Client) newRequest(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path, query), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+	return req, nil
+}
+
+// send sends a request made by newReq, trying it again with a backoff while it fails in a way that can pass.
+// The response has a 2xx status code unless keepErrors is set, then it is any response with a json body.
+// @param ctx context.Context
+// @param newReq func() (*http.Request, error) Creates the request for every try, since a body can only be read once
+// @param keepErrors bool
+// @return *http.Response
+// @return error
+func (c *Client) send(ctx context.Context, newReq func() (*http.Request, error), keepErrors bool) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.http.Do(req)
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		if err == nil {
+			err = responseError(resp)
+			if keepErrors && !retryable(err) && isJSON(resp) {
+				return resp, nil
+			}
+			resp.Body.Close()
+		}
+		if !retryable(err) || attempt >= c.opts.Retries || ctx.Err() != nil {
+			return nil, err
+		}
+		err = c.wait(ctx, attempt)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// wait sleeps for the backoff of a retry, with some jitter so clients that failed together do not retry together
+// @param ctx context.Context
+// @param attempt int How many tries failed before, from 0
+// @return error The error of the context if it is done first
+func (c *Client) wait(ctx context.Context, attempt int) error {
+	backoff := c.opts.Backoff
+	for i := 0; i < attempt && backoff < c.opts.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > c.opts.MaxBackoff {
+		backoff = c.opts.MaxBackoff
+	}
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retryable returns whether a request that failed with an error can pass when it is sent again:
+// errors of the network, and a server that is busy, unavailable or failed.
+// A certificate that fails verification or does not match the pinned fingerprint is never retried.
+// @param err error
+// @return bool
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || certificateError(err) {
+		return false
+	}
+	var apiErr *server.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Status == http.StatusTooManyRequests || apiErr.Status >= 500 && apiErr.Status != http.StatusInsufficientStorage
+	}
+	var netErr net.Error
+	var urlErr *url.Error
+	return errors.As(err, &netErr) || errors.As(err, &urlErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// certificateError returns whether an error is the TLS certificate of the server failing verification,
+// or the server not speaking TLS at all, which sending the request again does not change
+// @param err error
+// @return bool
+func certificateError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	return errors.Is(err, ErrFingerprintMismatch) || errors.As(err, &verifyErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) || errors.As(err, &recordErr)
+}
+
+// isJSON returns whether a response has a json body
+// @param resp *http.Response
+// @return bool
+func isJSON(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json")
+}
+
+// responseError reads the error a server sent back into a *server.APIError, without closing the body.
+// The body is read into a buffer, so a json body can still be decoded afterwards.
+// @param resp *http.Response
+// @return error
+func responseError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	var errResp server.ErrorResponse
+	if json.Unmarshal(data, &errResp) != nil || errResp.ErrorCode == "" {
+		return &server.APIError{Status: resp.StatusCode, Code: statusCode(resp.StatusCode), Message: fmt.Sprintf("error: server sent back %s", resp.Status)}
+	}
+	return &server.APIError{Status: resp.StatusCode, Code: errResp.ErrorCode, Message: errResp.Error}
+}
+
+// statusCode returns the ErrorCode of a status code, for servers that do not send a code back
+// @param status int
+// @return server.ErrorCode
+func statusCode(status int) server.ErrorCode {
+	switch status {
+	case http.StatusUnauthorized:
+		return server.CodeUnauthorized
+	case http.StatusNotFound:
+		return server.CodeNotFound
+	case http.StatusTooManyRequests:
+		return server.CodeTooManyRequests
+	case http.StatusServiceUnavailable:
+		return server.CodeUnavailable
+	}
+	if status >= 500 {
+		return server.CodeInternal
+	}
+	return server.CodeBadRequest
+}
+
+// ErrorCode is a method to get the ErrorCode of an error the server sent back, empty for other errors.
+// @param err error
+// @return server.ErrorCode
+func ErrorCode(err error) server.ErrorCode {
+	var apiErr *server.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return ""
+}
+
+// getJSON sends a GET request to a path and decodes the json response into result
+// @param ctx context.Context
+// @param path string
+// @param query url.Values
+// @param result interface{}
+// @return error
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, result interface{}) error {
+	resp, err := c.send(ctx, func() (*http.Request, error) {
+		return c.newRequest(ctx, http.MethodGet, path, query, nil)
+	}, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// postJSON sends a json body to a path and decodes the json response into result
+// @param ctx context.Context
+// @param path string
+// @param body interface{}
+// @param result interface{}
+// @return error
+func (c *Client) postJSON(ctx context.Context, path string, body, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.send(ctx, func() (*http.Request, error) {
+		return c.newRequest(ctx, http.MethodPost, path, nil, data)
+	}, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Ping is a method to check that the server can be reached.
+// @param ctx context.Context
+// @return error
+func (c *Client) Ping(ctx context.Context) error {
+	resp, err := c.send(ctx, func() (*http.Request, error) {
+		return c.newRequest(ctx, http.MethodGet, "/ping", nil, nil)
+	}, false)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Folders is a method to list the folders of the server with how many files are in each.
+// @param ctx context.Context
+// @return []server.Folder
+// @return error
+func (c *Client) Folders(ctx context.Context) ([]server.Folder, error) {
+	var list server.FoldersList
+	err := c.getJSON(ctx, "/get_folders", nil, &list)
+	if err != nil {
+		return nil, err
+	}
+	return list.Folders, nil
+}
+
+// Files is a method to list every file in a folder, without their data, in the order the server keeps them.
+// @param ctx context.Context
+// @param folder string
+// @return []server.FileMetadata
+// @return error
+func (c *Client) Files(ctx context.Context, folder string) ([]server.FileMetadata, error) {
+	files := make([]server.FileMetadata, 0)
+	for {
+		results, err := c.Search(ctx, server.SearchRequest{Folders: []string{folder}, StartIndex: len(files), EndIndex: len(files) + searchPageSize})
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, results.Files...)
+		if len(results.Files) == 0 || len(files) >= results.Total {
+			return files, nil
+		}
+	}
+}
+
+// Search is a method to search the files of every folder by their metadata, one page at a time.
+// @param ctx context.Context
+// @param search server.SearchRequest
+// @return server.SearchResults
+// @return error
+func (c *Client) Search(ctx context.Context, search server.SearchRequest) (server.SearchResults, error) {
+	var results server.SearchResults
+	err := c.postJSON(ctx, "/search", search, &results)
+	return results, err
+}
+
+// GetFiles is a method to get a range of the files of a folder with their data and attributes.
+// @param ctx context.Context
+// @param request server.GetFilesWithAttributes
+// @return []server.FileData
+// @return error
+func (c *Client) GetFiles(ctx context.Context, request server.GetFilesWithAttributes) ([]server.FileData, error) {
+	var list server.FileDataList
+	err := c.postJSON(ctx, "/get_files", request, &list)
+	if err != nil {
+		return nil, err
+	}
+	return list.Files, nil
+}
+
+// Validate is a method to check that a file in a folder is uploaded whole and that its data matches its hash.
+// It returns an error with the hash_mismatch code when it does not match, and the upload_in_progress code
+// when the file is not whole yet.
+// @param ctx context.Context
+// @param folder string
+// @param hash string The hex encoded sha256 hash of the file
+// @return error
+func (c *Client) Validate(ctx context.Context, folder, hash string) error {
+	var result server.ErrorResponse
+	return c.getJSON(ctx, "/validate_file", url.Values{"Folder": {folder}, "Hash": {hash}}, &result)
+}
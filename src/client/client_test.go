@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"server"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNormalizeFingerprint(t *testing.T) {
+	want := strings.TrimSuffix(strings.Repeat("AB:", 32), ":")
+	tests := []struct {
+		fingerprint string
+		ok          bool
+	}{
+		{fingerprint: want, ok: true},
+		{fingerprint: strings.ToLower(want), ok: true},
+		{fingerprint: strings.Repeat("ab", 32), ok: true},
+		{fingerprint: strings.Repeat("AB ", 32), ok: true},
+		{fingerprint: strings.Repeat("AB", 31), ok: false},
+		{fingerprint: strings.Repeat("AB", 33), ok: false},
+		{fingerprint: strings.Repeat("XY", 32), ok: false},
+	}
+	for _, test := range tests {
+		got, err := normalizeFingerprint(test.fingerprint)
+		if test.ok && (err != nil || got != want) || !test.ok && err == nil {
+			t.Errorf("%q gave %q, %v", test.fingerprint, got, err)
+		}
+	}
+}
+
+func TestNewFingerprint(t *testing.T) {
+	fingerprint := strings.Repeat("ab", 32)
+	if _, err := New(Options{URL: "http://nas.local:8080", Fingerprint: fingerprint}); err == nil {
+		t.Error("pinned a fingerprint for an http URL")
+	}
+	if _, err := New(Options{URL: "https://nas.local:8080", Fingerprint: "ab:cd"}); err == nil {
+		t.Error("pinned a fingerprint that is too short")
+	}
+	if _, err := New(Options{URL: "http://nas.local:8080"}); err != nil {
+		t.Errorf("http URL without a fingerprint gave %v", err)
+	}
+}
+
+func TestPinnedFingerprint(t *testing.T) {
+	var connections atomic.Int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	ts.StartTLS()
+	defer ts.Close()
+	// the fingerprint matches whatever case and separators it is written with
+	fingerprint := strings.ToLower(strings.Replace(server.CertificateFingerprint(ts.Certificate().Raw), ":", "", -1))
+	c, err := New(Options{URL: ts.URL, Fingerprint: fingerprint, Retries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ping(context.Background()); err != nil {
+		t.Errorf("ping with the fingerprint of the server gave %v", err)
+	}
+	// another certificate could be someone in the middle, so it fails straight away instead of being retried
+	connections.Store(0)
+	c, err = New(Options{URL: ts.URL, Fingerprint: strings.Repeat("ab", 32), Retries: 3, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ping(context.Background()); !errors.Is(err, ErrFingerprintMismatch) || connections.Load() != 1 {
+		t.Errorf("ping with another fingerprint gave %v after %d connections", err, connections.Load())
+	}
+	// so does a certificate that is not trusted when nothing is pinned
+	connections.Store(0)
+	c, err = New(Options{URL: ts.URL, Retries: 3, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ping(context.Background()); err == nil || connections.Load() != 1 {
+		t.Errorf("ping with an untrusted certificate gave %v after %d connections", err, connections.Load())
+	}
+}
@@ -0,0 +1,193 @@
+package client
+
+// download file to hold the logic that downloads a file, resuming it after a broken connection, and checks its hash
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"server"
+	"strconv"
+	"strings"
+)
+
+// Download is a method to download a file into a writer. A download that breaks off is carried on from where it
+// stopped with a range request, and ErrHashMismatch is returned if the data does not match the hash once it is all read.
+// @param ctx context.Context
+// @param folder string The folder the file is in
+// @param hash string The hex encoded sha256 hash of the file
+// @param w io.Writer
+// @param progress ProgressFunc Called as the data is read, nil for none
+// @return int64 The size of the file
+// @return error
+func (c *Client) Download(ctx context.Context, folder, hash string, w io.Writer, progress ProgressFunc) (int64, error) {
+	return c.download(ctx, folder, hash, w, sha256.New(), 0, progress)
+}
+
+// DownloadFile is a method to download a file to a path. The data is written to the path with ".part" added
+// until it is all there and matches the hash, so a download that was stopped carries on from where the part ends
+// the next time, even from another run of the program.
+// @param ctx context.Context
+// @param folder string The folder the file is in
+// @param hash string The hex encoded sha256 hash of the file
+// @param path string Where to save the file
+// @param progress ProgressFunc Called as the data is read, nil for none
+// @return int64 The size of the file
+// @return error
+func (c *Client) DownloadFile(ctx context.Context, folder, hash, path string, progress ProgressFunc) (int64, error) {
+	if progress != nil {
+		report := progress
+		progress = func(p Progress) {
+			p.Path = path
+			report(p)
+		}
+	}
+	part := path + ".part"
+	file, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return 0, err
+	}
+	// the part is hashed as it is read, which leaves the file at its end to carry on writing from
+	hasher := sha256.New()
+	offset, err := io.Copy(hasher, file)
+	if err == nil {
+		offset, err = c.download(ctx, folder, hash, file, hasher, offset, progress)
+	}
+	if errors.Is(err, ErrHashMismatch) {
+		// start over the next time
+		file.Truncate(0)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return offset, err
+	}
+	return offset, os.Rename(part, path)
+}
+
+// download reads a file from an offset into a writer, carrying on from where it stopped when the connection breaks,
+// and checks the hash of the whole file once it is read
+// @param ctx context.Context
+// @param folder string
+// @param hash string The hex encoded sha256 hash of the file
+// @param w io.Writer
+// @param hasher hash.Hash Has the data before the offset written to it already
+// @param offset int64 Where in the file to start
+// @param progress ProgressFunc
+// @return int64 The size of the file
+// @return error
+func (c *Client) download(ctx context.Context, folder, hash string, w io.Writer, hasher hash.Hash, offset int64, progress ProgressFunc) (int64, error) {
+	want, err := hex.DecodeString(hash)
+	if err != nil || len(want) != sha256.Size {
+		return 0, fmt.Errorf("error: %q is not a hex encoded sha256 hash", hash)
+	}
+	out := &progressWriter{w: io.MultiWriter(w, hasher), progress: progress, Progress: Progress{Hash: hash, Done: offset, Size: -1}}
+	for attempt := 0; ; attempt++ {
+		err = c.downloadRange(ctx, folder, hash, out)
+		if err == nil {
+			break
+		}
+		if !retryable(err) || attempt >= c.opts.Retries || ctx.Err() != nil {
+			return out.Done, err
+		}
+		err = c.wait(ctx, attempt)
+		if err != nil {
+			return out.Done, err
+		}
+	}
+	if !bytes.Equal(hasher.Sum(nil), want) {
+		return out.Done, ErrHashMismatch
+	}
+	return out.Done, nil
+}
+
+// downloadRange sends one request for the rest of a file from where the progress writer is and copies it there
+// @param ctx context.Context
+// @param folder string
+// @param hash string
+// @param out *progressWriter
+// @return error
+func (c *Client) downloadRange(ctx context.Context, folder, hash string, out *progressWriter) error {
+	offset := out.Done
+	query := url.Values{"Folder": {folder}, "Hash": {hash}}
+	resp, err := c.send(ctx, func() (*http.Request, error) {
+		req, err := c.newRequest(ctx, http.MethodGet, "/download_file", query, nil)
+		if err == nil && offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		return req, err
+	}, false)
+	var apiErr *server.APIError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusRequestedRangeNotSatisfiable {
+		// there is nothing after the offset, so the file was all read before
+		out.Size = offset
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		out.Size = contentRangeSize(resp.Header.Get("Content-Range"))
+	case offset > 0:
+		// the range was not used so the data before the offset is skipped
+		out.Size = resp.ContentLength
+		_, err = io.CopyN(io.Discard, resp.Body, offset)
+		if err != nil {
+			return err
+		}
+	default:
+		out.Size = resp.ContentLength
+	}
+	_, err = io.Copy(out, resp.Body)
+	if err == nil && out.Size >= 0 && out.Done < out.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// contentRangeSize returns the size of the whole file from a Content-Range header like "bytes 100-199/200",
+// -1 when it is not known
+// @param header string
+// @return int64
+func contentRangeSize(header string) int64 {
+	i := strings.LastIndex(header, "/")
+	if i < 0 {
+		return -1
+	}
+	size, err := strconv.ParseInt(header[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// progressWriter is a writer that counts the bytes written to it and reports them to a ProgressFunc
+type progressWriter struct {
+	w        io.Writer
+	progress ProgressFunc
+	Progress
+}
+
+// Write writes to the writer and reports the progress
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.Done += int64(n)
+	if p.progress != nil && n > 0 {
+		p.progress(p.Progress)
+	}
+	return n, err
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestDownloadFileResumes(t *testing.T) {
+	ranges := make([]string, 0)
+	c := startTestServer(t, func(req *http.Request) {
+		if req.URL.Path == "/download_file" {
+			ranges = append(ranges, req.Header.Get("Range"))
+		}
+	})
+	ctx := context.Background()
+	uploaded, err := c.Upload(ctx, writeTestFile(t, "a.txt", "abcdefghij"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestFile(t, "a.txt", "")
+	os.Remove(path)
+	// a download that was stopped left the start of the file in the part
+	err = os.WriteFile(path+".part", []byte("abcd"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := c.DownloadFile(ctx, uploaded.Folder, uploaded.Hash, path, nil)
+	if err != nil || size != 10 || len(ranges) != 1 || ranges[0] != "bytes=4-" {
+		t.Fatalf("resumed download gave %d, %v with ranges %q", size, err, ranges)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "abcdefghij" {
+		t.Errorf("downloaded file is %q, %v", data, err)
+	}
+	if _, err := os.Stat(path + ".part"); !os.IsNotExist(err) {
+		t.Errorf("part is still there; %v", err)
+	}
+}
+
+func TestDownloadFileHashMismatch(t *testing.T) {
+	c := startTestServer(t, nil)
+	ctx := context.Background()
+	uploaded, err := c.Upload(ctx, writeTestFile(t, "a.txt", "abcdefghij"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestFile(t, "a.txt", "")
+	os.Remove(path)
+	// the part does not hold the start of the file, so the whole file does not match its hash
+	err = os.WriteFile(path+".part", []byte("WXYZ"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.DownloadFile(ctx, uploaded.Folder, uploaded.Hash, path, nil)
+	if !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("download onto a bad part gave %v", err)
+	}
+	// the part is emptied so the next download starts over
+	if info, err := os.Stat(path + ".part"); err != nil || info.Size() != 0 {
+		t.Fatalf("part after the mismatch is %v, %v", info, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file was saved after the mismatch; %v", err)
+	}
+	_, err = c.DownloadFile(ctx, uploaded.Folder, uploaded.Hash, path, nil)
+	if data, _ := os.ReadFile(path); err != nil || string(data) != "abcdefghij" {
+		t.Errorf("download after the mismatch gave %q, %v", data, err)
+	}
+}
@@ -0,0 +1,179 @@
+package client
+
+// upload file to hold the logic that uploads a file in chunks and resumes it from where the server is
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"server"
+)
+
+// UploadedFile is an object that holds where a file was uploaded to
+type UploadedFile struct {
+	Folder string
+	// Hash is the hex encoded sha256 hash of the file
+	Hash string
+	Size int64
+	// Resumed is where on the server the upload started from, 0 when the whole file was sent
+	Resumed int64
+}
+
+// UploadOptions is an object that holds the settings of one upload. The zero value uploads into the
+// folder the folder layout of the server gives and does not report progress.
+type UploadOptions struct {
+	// Folder is the folder to upload the file into, the one the folder layout gives when empty
+	Folder string
+	// Progress is called after every chunk the server has taken
+	Progress ProgressFunc
+}
+
+// Upload is a method to upload a file into the folder the folder layout of the server gives for it.
+// See UploadWithOptions.
+// @param ctx context.Context
+// @param path string The path of the file
+// @param attrs map[string]string The attributes to save in the header of the file
+// @return UploadedFile
+// @return error
+func (c *Client) Upload(ctx context.Context, path string, attrs map[string]string) (UploadedFile, error) {
+	return c.UploadWithOptions(ctx, path, attrs, UploadOptions{})
+}
+
+// UploadWithOptions is a method to upload a file in chunks. The file is hashed first, and an upload of it the
+// server already started, or already has whole, is carried on from where the server is instead of sent again.
+// Chunks that fail because of the network or a busy server are sent again after a backoff.
+// Once the server has the whole file it is validated against its hash, and ErrHashMismatch is returned
+// if it changed while it was uploaded. The "Name" attribute is the name of the file when it is not set.
+// @param ctx context.Context
+// @param path string The path of the file
+// @param attrs map[string]string The attributes to save in the header of the file
+// @param opts UploadOptions
+// @return UploadedFile
+// @return error
+func (c *Client) UploadWithOptions(ctx context.Context, path string, attrs map[string]string, opts UploadOptions) (UploadedFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return UploadedFile{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return UploadedFile{}, err
+	}
+	if info.IsDir() {
+		return UploadedFile{}, fmt.Errorf("error: %s is a folder", path)
+	}
+	hash, err := HashFile(path)
+	if err != nil {
+		return UploadedFile{}, err
+	}
+	attributes := map[string]string{"Name": filepath.Base(path)}
+	for k, v := range attrs {
+		attributes[k] = v
+	}
+	uploaded := UploadedFile{Folder: opts.Folder, Hash: hex.EncodeToString(hash), Size: info.Size()}
+	data := server.FileData{
+		ValidateFile: hash,
+		Size:         info.Size(),
+		ContentType:  mime.TypeByExtension(filepath.Ext(path)),
+		Folder:       opts.Folder,
+		Attributes:   attributes,
+	}
+	buf := make([]byte, c.opts.ChunkSize)
+	pos := int64(0)
+	for first := true; first || pos < info.Size(); first = false {
+		n, err := file.ReadAt(buf, pos)
+		if err != nil && err != io.EOF {
+			return uploaded, err
+		}
+		if n == 0 && pos < info.Size() {
+			return uploaded, fmt.Errorf("error: %s got shorter while it was uploaded", path)
+		}
+		data.Data = buf[:n]
+		data.StartIndex = int(pos)
+		result, err := c.postChunk(ctx, data)
+		switch ErrorCode(err) {
+		case "":
+			if err != nil {
+				return uploaded, err
+			}
+		case server.CodeOffsetMismatch:
+			// the server has more, or less, of the file than was sent, so carry on from where it is
+			if first {
+				uploaded.Resumed = int64(result.Count)
+			}
+		case server.CodeAlreadyComplete:
+			result.Count = int(info.Size())
+			if first {
+				uploaded.Resumed = info.Size()
+			}
+		default:
+			return uploaded, err
+		}
+		pos = int64(result.Count)
+		// later chunks go to the folder the upload went to, wherever the folder layout puts it
+		data.Folder, uploaded.Folder = result.Folder, result.Folder
+		if opts.Progress != nil {
+			opts.Progress(Progress{Path: path, Hash: uploaded.Hash, Done: pos, Size: info.Size()})
+		}
+	}
+	err = c.Validate(ctx, uploaded.Folder, uploaded.Hash)
+	if ErrorCode(err) == server.CodeHashMismatch {
+		return uploaded, fmt.Errorf("%w; %s", ErrHashMismatch, err)
+	}
+	return uploaded, err
+}
+
+// postChunk sends a chunk of a file to /post_file. The UploadResult is sent back along with
+// the offset_mismatch and already_complete errors, so the upload can carry on from its Count.
+// @param ctx context.Context
+// @param data server.FileData
+// @return server.UploadResult
+// @return error
+func (c *Client) postChunk(ctx context.Context, data server.FileData) (server.UploadResult, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return server.UploadResult{}, err
+	}
+	resp, err := c.send(ctx, func() (*http.Request, error) {
+		return c.newRequest(ctx, http.MethodPost, "/post_file", nil, body)
+	}, true)
+	if err != nil {
+		return server.UploadResult{}, err
+	}
+	defer resp.Body.Close()
+	var result server.UploadResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return result, fmt.Errorf("error: could not read the result of the upload; %s", err)
+	}
+	if result.ErrorCode != "" {
+		return result, &server.APIError{Status: resp.StatusCode, Code: result.ErrorCode, Message: result.Error}
+	}
+	return result, nil
+}
+
+// HashFile is a method to get the sha256 hash of a file, which is what the server knows the file by.
+// @param path string
+// @return []byte
+// @return error
+func HashFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"server"
+	"storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestServer starts a server with its files kept in memory behind an httptest server,
+// with every request it gets passed to inspect first when it is not nil
+// @return *Client A client of the server with chunks of 4 bytes
+func startTestServer(t *testing.T, inspect func(req *http.Request)) *Client {
+	t.Helper()
+	logger, err := server.NewLogger(io.Discard, "error", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.New(server.Options{Storage: storage.NewMemory(), Logger: logger, DisableAuth: true, DisableThumbnails: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if inspect != nil {
+			inspect(req)
+		}
+		s.Handler().ServeHTTP(w, req)
+	}))
+	t.Cleanup(ts.Close)
+	c, err := New(Options{URL: ts.URL, ChunkSize: 4, Retries: 2, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// writeTestFile writes data to a file in a temporary folder and returns its path
+func writeTestFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(data), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestUploadResumes(t *testing.T) {
+	c := startTestServer(t, nil)
+	ctx := context.Background()
+	path := writeTestFile(t, "a.txt", "abcdefghij")
+	hash, err := HashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another run of the program got the first chunk to the server
+	first, err := c.postChunk(ctx, server.FileData{ValidateFile: hash, Size: 10, Data: []byte("abcd"), Attributes: map[string]string{"Name": "a.txt"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// so the first chunk sent is an offset_mismatch and the upload carries on from where the server is
+	sent := 0
+	uploaded, err := c.UploadWithOptions(ctx, path, nil, UploadOptions{Progress: func(Progress) { sent++ }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploaded.Resumed != 4 || uploaded.Size != 10 || uploaded.Folder != first.Folder || sent != 3 {
+		t.Errorf("resumed upload is %+v after %d chunks", uploaded, sent)
+	}
+	// a file the server already has whole is an already_complete error that is not sent again
+	again, err := c.Upload(ctx, path, nil)
+	if err != nil || again.Resumed != 10 || again.Hash != uploaded.Hash {
+		t.Errorf("upload of a complete file gave %+v, %v", again, err)
+	}
+	files, err := c.Files(ctx, uploaded.Folder)
+	if err != nil || len(files) != 1 || files[0].Attributes["Name"] != "a.txt" || !files[0].Complete {
+		t.Errorf("files are %+v, %v", files, err)
+	}
+}
+
+func TestUploadFileChanged(t *testing.T) {
+	c := startTestServer(t, nil)
+	ctx := context.Background()
+	// the file is changed after its hash was taken, so the server ends up with data that does not match it
+	path := writeTestFile(t, "a.txt", "abcdefghij")
+	changed := false
+	_, err := c.UploadWithOptions(ctx, path, nil, UploadOptions{Progress: func(Progress) {
+		if !changed {
+			changed = true
+			os.WriteFile(path, []byte("abcdXXXXXX"), 0666)
+		}
+	}})
+	if !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("upload of a file that changed gave %v", err)
+	}
+	// a file that gets shorter is stopped before it is sent whole
+	path = writeTestFile(t, "b.txt", "9876543210")
+	_, err = c.UploadWithOptions(ctx, path, nil, UploadOptions{Progress: func(Progress) { os.Truncate(path, 4) }})
+	if err == nil || !strings.Contains(err.Error(), "shorter") {
+		t.Errorf("upload of a file that got shorter gave %v", err)
+	}
+}
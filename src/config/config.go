@@ -0,0 +1,494 @@
+package config
+
+// config file to hold the settings of the server and the logic to read them from a file, the environment and flags
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// EnvPrefix is the prefix of the environment variables that override settings,
+// like LANFILES_PORT for Port.
+const EnvPrefix = "LANFILES_"
+
+// ConfigEnv is the environment variable the config file can be given in instead of the -config flag.
+const ConfigEnv = EnvPrefix + "CONFIG"
+
+// Config is an object that holds every setting of the server.
+// Every field can be set in the config file, by an environment variable and by a flag. The names are
+// derived from the field name, so MaxFileSize is "MaxFileSize" in a JSON file, "max_file_size" in a TOML
+// file, LANFILES_MAX_FILE_SIZE in the environment and -max-file-size on the command line.
+type Config struct {
+	// Address is the address to listen on, empty for every address
+	Address string
+	// Port is the port to listen on
+	Port int
+	// Root is the root path files are saved under
+	Root string
+	// Storage is where the folders and files are kept, "filesystem" for Root or "s3" for a bucket of an S3 compatible store
+	Storage string
+	// S3Endpoint is the URL of the S3 compatible store, like "http://nas.local:9000"
+	S3Endpoint string
+	// S3Bucket is the bucket the files are kept in
+	S3Bucket string
+	// S3Region is the region requests to the store are signed for
+	S3Region string
+	// S3AccessKey is the access key requests to the store are signed with, empty to not sign them
+	S3AccessKey string
+	// S3SecretKey is the secret key of S3AccessKey
+	S3SecretKey string
+	// S3Prefix is put in front of the key of every object, so the bucket can be shared
+	S3Prefix string
+	// EnableTLS serves Port over HTTPS with the certificate in TLSCertFile, or a generated self-signed one.
+	// It is off by default so clients of servers from before HTTPS keep working until they are moved over
+	EnableTLS bool
+	// TLSCertFile is the PEM certificate file to serve, empty to generate a self-signed one under Root
+	TLSCertFile string
+	// TLSKeyFile is the PEM key file of TLSCertFile
+	TLSKeyFile string
+	// HTTPPort is a port to also serve plain HTTP on when TLS is on, 0 for none
+	HTTPPort int
+	// LogLevel is one of "debug", "info", "warn" or "error"
+	LogLevel string
+	// LogFormat is "text" or "json"
+	LogFormat string
+	// LogFile is the file the log is written to, empty for standard error
+	LogFile string
+	// LogMaxSize is the size in bytes the log file is rotated at, 0 to never rotate it
+	LogMaxSize int64
+	// LogMaxFiles is how many rotated log files are kept
+	LogMaxFiles int
+	// MaxFileSize is the largest file in bytes that can be uploaded, 0 for no limit
+	MaxFileSize int64
+	// MaxChunkSize is the largest chunk of a file in bytes that can be sent in one request
+	MaxChunkSize int64
+	// MinFreeSpace is the disk space in bytes kept free under the root path, new uploads that would leave less are rejected
+	MinFreeSpace int64
+	// FolderQuota is the most bytes the files of a folder can take up, 0 for no limit
+	FolderQuota int64
+	// DeviceQuota is the most bytes the files uploaded by one device can take up, 0 for no limit
+	DeviceQuota int64
+	// FolderLayout is the template that decides which folder new uploads are put into
+	FolderLayout string
+	// AdminToken is the token the management endpoints need, they are turned off when it is empty
+	AdminToken string
+	// EnableAuth makes every request need the token of a paired device.
+	// It is off by default so clients of servers from before pairing keep working until they are paired
+	EnableAuth bool
+	// EnableDiscovery advertises the server on the LAN with mDNS and answers discovery broadcasts
+	EnableDiscovery bool
+	// MDNSAddress is the address mDNS is answered on, the mDNS multicast group or a unicast address for testing
+	MDNSAddress string
+	// DiscoveryPort is the UDP port discovery broadcasts are answered on, 0 for none
+	DiscoveryPort int
+	// ShutdownTimeout is how long uploads and downloads in progress are waited on when the server is stopped
+	ShutdownTimeout Duration
+	// ReadTimeout is how long a request, with its body, can take to read
+	ReadTimeout Duration
+	// WriteTimeout is how long a response can take to write, downloads can take longer while the client reads
+	WriteTimeout Duration
+	// IdleTimeout is how long a kept alive connection waits for the next request
+	IdleTimeout Duration
+	// EnableGallery turns the web gallery on or off
+	EnableGallery bool
+	// EnableThumbnails turns thumbnail generation on or off
+	EnableThumbnails bool
+	// EnableMetadata turns reading EXIF and video metadata after uploads on or off
+	EnableMetadata bool
+	// EnableZip turns ZIP downloads on or off
+	EnableZip bool
+	// EnableMetrics turns the /metrics path on or off
+	EnableMetrics bool
+}
+
+// Duration is a time.Duration that is written as text like "30s" in config files, the environment and flags.
+type Duration time.Duration
+
+// String is a method to get the duration as text like "30s".
+// @return string
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Set is a method to read the duration from text like "30s", so it can be a flag.
+// @param text string
+// @return error
+func (d *Duration) Set(text string) error {
+	v, err := time.ParseDuration(text)
+	if err != nil {
+		return fmt.Errorf("%q is not a duration like 30s or 5m", text)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON is a method to write the duration as text in JSON.
+// @return []byte
+// @return error
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON is a method to read the duration from text in JSON.
+// @param b []byte
+// @return error
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var text string
+	err := json.Unmarshal(b, &text)
+	if err != nil {
+		return errors.New("durations must be text like \"30s\"")
+	}
+	return d.Set(text)
+}
+
+// usages are the descriptions of the flags of each field
+var usages = map[string]string{
+	"Address":          "the address to listen on, empty for every address",
+	"Port":             "the port to listen on",
+	"Root":             "the root path files are saved under",
+	"Storage":          `where the folders and files are kept, "filesystem" for the root path or "s3" for an S3 compatible bucket`,
+	"S3Endpoint":       `the URL of the S3 compatible store, like "http://nas.local:9000"`,
+	"S3Bucket":         "the bucket the files are kept in",
+	"S3Region":         "the region requests to the S3 compatible store are signed for",
+	"S3AccessKey":      "the access key requests to the S3 compatible store are signed with, empty to not sign them",
+	"S3SecretKey":      "the secret key of the S3 access key",
+	"S3Prefix":         "put in front of the key of every object, so the bucket can be shared",
+	"EnableTLS":        "serve HTTPS with the TLS certificate files, or a generated self-signed certificate",
+	"TLSCertFile":      "the PEM certificate file to serve, empty to generate a self-signed one under the root path",
+	"TLSKeyFile":       "the PEM key file of the certificate file",
+	"HTTPPort":         "a port to also serve plain HTTP on when TLS is on, 0 for none",
+	"LogLevel":         `the lowest level logged, one of "debug", "info", "warn" or "error"`,
+	"LogFormat":        `the format of the log, "text" or "json"`,
+	"LogFile":          "the file the log is written to, empty for standard error",
+	"LogMaxSize":       "the size in bytes the log file is rotated at, 0 to never rotate it",
+	"LogMaxFiles":      "how many rotated log files are kept",
+	"MaxFileSize":      "the largest file in bytes that can be uploaded, 0 for no limit",
+	"MaxChunkSize":     "the largest chunk of a file in bytes that can be sent in one request",
+	"MinFreeSpace":     "the disk space in bytes kept free, new uploads that would leave less are rejected",
+	"FolderQuota":      "the most bytes the files of a folder can take up, 0 for no limit",
+	"DeviceQuota":      "the most bytes the files uploaded by one device can take up, 0 for no limit",
+	"FolderLayout":     "the template that decides which folder new uploads are put into",
+	"AdminToken":       "the token the management endpoints need, they are turned off when it is empty",
+	"EnableAuth":       "make every request need the token of a paired device",
+	"EnableDiscovery":  "advertise the server on the LAN with mDNS and answer discovery broadcasts",
+	"MDNSAddress":      "the address mDNS is answered on, the mDNS multicast group or a unicast address for testing",
+	"DiscoveryPort":    "the UDP port discovery broadcasts are answered on, 0 for none",
+	"ShutdownTimeout":  "how long uploads and downloads in progress are waited on when the server is stopped, like 30s",
+	"ReadTimeout":      "how long a request, with its body, can take to read",
+	"WriteTimeout":     "how long a response can take to write, downloads can take longer while the client reads",
+	"IdleTimeout":      "how long a kept alive connection waits for the next request",
+	"EnableGallery":    "turn the web gallery on",
+	"EnableThumbnails": "turn thumbnail generation on",
+	"EnableMetadata":   "turn reading EXIF and video metadata after uploads on",
+	"EnableZip":        "turn ZIP downloads on",
+	"EnableMetrics":    "turn the Prometheus /metrics path on",
+}
+
+// secrets are the fields that are hidden when the config is printed
+var secrets = map[string]bool{"AdminToken": true, "S3SecretKey": true}
+
+// Default is a method to get the settings the server uses when nothing else is set.
+// @return Config
+func Default() Config {
+	return Config{
+		Port:             8080,
+		Root:             "Data",
+		Storage:          "filesystem",
+		S3Region:         "us-east-1",
+		LogLevel:         "info",
+		LogFormat:        "text",
+		LogMaxSize:       10 << 20,
+		LogMaxFiles:      5,
+		MaxChunkSize:     64 << 20,
+		MinFreeSpace:     1 << 30,
+		FolderLayout:     "{year}-{month}-{day}",
+		ShutdownTimeout:  Duration(30 * time.Second),
+		ReadTimeout:      Duration(5 * time.Minute),
+		WriteTimeout:     Duration(2 * time.Minute),
+		IdleTimeout:      Duration(2 * time.Minute),
+		EnableDiscovery:  true,
+		MDNSAddress:      "224.0.0.251:5353",
+		DiscoveryPort:    8089,
+		EnableGallery:    true,
+		EnableThumbnails: true,
+		EnableMetadata:   true,
+		EnableZip:        true,
+		EnableMetrics:    true,
+	}
+}
+
+// ListenAddress is a method to get the address and port to listen on joined together, like ":8080".
+// @return string
+func (c Config) ListenAddress() string {
+	return fmt.Sprintf("%s:%d", c.Address, c.Port)
+}
+
+// HTTPListenAddress is a method to get the address and port to also serve plain HTTP on,
+// or empty when there is none.
+// @return string
+func (c Config) HTTPListenAddress() string {
+	if !c.EnableTLS || c.HTTPPort == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", c.Address, c.HTTPPort)
+}
+
+// DiscoveryListenAddress is a method to get the address discovery broadcasts are answered on,
+// or empty when discovery is turned off. It is every address, since broadcasts are not sent to one.
+// @return string
+func (c Config) DiscoveryListenAddress() string {
+	if !c.EnableDiscovery || c.DiscoveryPort == 0 {
+		return ""
+	}
+	return fmt.Sprintf(":%d", c.DiscoveryPort)
+}
+
+// Validate is a method to check that the settings are usable.
+// @return error
+func (c Config) Validate() error {
+	switch {
+	case c.Port < 0 || c.Port > 65535:
+		return fmt.Errorf("error: port %d is not between 0 and 65535", c.Port)
+	case c.DiscoveryPort < 0 || c.DiscoveryPort > 65535:
+		return fmt.Errorf("error: discovery port %d is not between 0 and 65535", c.DiscoveryPort)
+	case c.HTTPPort < 0 || c.HTTPPort > 65535:
+		return fmt.Errorf("error: HTTP port %d is not between 0 and 65535", c.HTTPPort)
+	case c.EnableTLS && c.HTTPPort != 0 && c.HTTPPort == c.Port:
+		return errors.New("error: HTTP port can not be the same as the port")
+	case (c.TLSCertFile == "") != (c.TLSKeyFile == ""):
+		return errors.New("error: a TLS certificate file and key file have to be given together")
+	case c.Root == "":
+		return errors.New("error: root path is empty")
+	case c.MaxFileSize < 0:
+		return errors.New("error: max file size can not be negative")
+	case c.MaxChunkSize <= 0:
+		return errors.New("error: max chunk size must be more than 0")
+	case c.MinFreeSpace < 0 || c.FolderQuota < 0 || c.DeviceQuota < 0:
+		return errors.New("error: free space kept and quotas can not be negative")
+	case c.LogMaxSize < 0 || c.LogMaxFiles < 0:
+		return errors.New("error: log file size and files kept can not be negative")
+	case c.ShutdownTimeout <= 0 || c.ReadTimeout <= 0 || c.WriteTimeout <= 0 || c.IdleTimeout <= 0:
+		return errors.New("error: timeouts must be more than 0")
+	}
+	switch c.Storage {
+	case "filesystem":
+	case "s3":
+		if c.S3Endpoint == "" || c.S3Bucket == "" {
+			return errors.New("error: S3 storage needs an S3 endpoint and bucket")
+		}
+	default:
+		return fmt.Errorf("error: storage %q is not filesystem or s3", c.Storage)
+	}
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("error: log level %q is not one of debug, info, warn or error", c.LogLevel)
+	}
+	switch c.LogFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("error: log format %q is not text or json", c.LogFormat)
+	}
+	return nil
+}
+
+// String is a method to get the settings as indented JSON with the secrets hidden.
+// @return string
+func (c Config) String() string {
+	v := reflect.ValueOf(&c).Elem()
+	for name := range secrets {
+		if field := v.FieldByName(name); field.String() != "" {
+			field.SetString("********")
+		}
+	}
+	b, _ := json.MarshalIndent(c, "", "  ")
+	return string(b)
+}
+
+// Load is a method to build the settings from the defaults, then the config file, then the environment
+// and then the flags in args, each one overriding the one before.
+// The config file is the one given by -config or LANFILES_CONFIG and is read as JSON when its name ends
+// in ".json" and as TOML otherwise. For compatibility a single argument left after the flags is the root path.
+// @param name string The name of the program, for the usage message
+// @param args []string The command line arguments after the program name
+// @return Config
+// @return bool true if --print-config was given
+// @return error
+func Load(name string, args []string) (Config, bool, error) {
+	c := Default()
+	flagged := Default()
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv(ConfigEnv), "the TOML or JSON config file to read")
+	printConfig := flags.Bool("print-config", false, "print the settings in effect and exit")
+	fieldFlags := bindFlags(flags, &flagged)
+	err := flags.Parse(args)
+	if err != nil {
+		return c, false, err
+	}
+	if *configPath != "" {
+		err = c.readFile(*configPath)
+		if err != nil {
+			return c, false, err
+		}
+	}
+	err = c.readEnv(os.LookupEnv)
+	if err != nil {
+		return c, false, err
+	}
+	// only the flags that were given override the file and the environment
+	src := reflect.ValueOf(&flagged).Elem()
+	dst := reflect.ValueOf(&c).Elem()
+	flags.Visit(func(f *flag.Flag) {
+		if field, ok := fieldFlags[f.Name]; ok {
+			dst.FieldByName(field).Set(src.FieldByName(field))
+		}
+	})
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		c.Root = flags.Arg(0)
+	default:
+		return c, false, fmt.Errorf("error: unexpected arguments %v", flags.Args()[1:])
+	}
+	return c, *printConfig, c.Validate()
+}
+
+// bindFlags adds a flag for every field of a Config to a flag set
+// @param flags *flag.FlagSet
+// @param c *Config The Config the flags are written into
+// @return map[string]string The flag names to the field names
+func bindFlags(flags *flag.FlagSet, c *Config) map[string]string {
+	fieldFlags := make(map[string]string)
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := splitWords(field.Name, "-")
+		fieldFlags[name] = field.Name
+		switch ptr := v.Field(i).Addr().Interface().(type) {
+		case *string:
+			flags.StringVar(ptr, name, *ptr, usages[field.Name])
+		case *int:
+			flags.IntVar(ptr, name, *ptr, usages[field.Name])
+		case *int64:
+			flags.Int64Var(ptr, name, *ptr, usages[field.Name])
+		case *bool:
+			flags.BoolVar(ptr, name, *ptr, usages[field.Name])
+		case *Duration:
+			flags.Var(ptr, name, usages[field.Name])
+		}
+	}
+	return fieldFlags
+}
+
+// readFile reads a JSON or TOML config file over the settings
+// @param path string
+// @return error
+func (c *Config) readFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(strings.NewReader(string(data)))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(c)
+		if err != nil {
+			return fmt.Errorf("error: could not read config file %s; %s", path, err)
+		}
+		return nil
+	}
+	values, err := parseTOML(string(data))
+	if err != nil {
+		return fmt.Errorf("error: could not read config file %s; %s", path, err)
+	}
+	for _, value := range values {
+		err = c.set(value.key, value.value)
+		if err != nil {
+			return fmt.Errorf("error: config file %s line %d; %s", path, value.line, err)
+		}
+	}
+	return nil
+}
+
+// readEnv reads the environment variables of the fields over the settings
+// @param lookup func(string) (string, bool) How to look up an environment variable
+// @return error
+func (c *Config) readEnv(lookup func(string) (string, bool)) error {
+	t := reflect.TypeOf(*c)
+	for i := 0; i < t.NumField(); i++ {
+		name := EnvPrefix + strings.ToUpper(splitWords(t.Field(i).Name, "_"))
+		if value, ok := lookup(name); ok {
+			err := c.set(t.Field(i).Name, value)
+			if err != nil {
+				return fmt.Errorf("error: environment variable %s; %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// set sets a field from its text value. The key matches the field name ignoring case and underscores.
+// @param key string
+// @param value string
+// @return error
+func (c *Config) set(key, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	normalized := strings.ReplaceAll(key, "_", "")
+	for i := 0; i < v.NumField(); i++ {
+		if !strings.EqualFold(v.Type().Field(i).Name, normalized) {
+			continue
+		}
+		field := v.Field(i)
+		if d, ok := field.Addr().Interface().(*Duration); ok {
+			err := d.Set(value)
+			if err != nil {
+				return fmt.Errorf("%s must be a duration like 30s", key)
+			}
+			return nil
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(strings.ReplaceAll(value, "_", ""), 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s must be a whole number", key)
+			}
+			field.SetInt(n)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s must be true or false", key)
+			}
+			field.SetBool(b)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown setting %q", key)
+}
+
+// splitWords splits a CamelCase name into lower case words joined by sep, like "max-file-size"
+// @param name string
+// @param sep string
+// @return string
+func splitWords(name, sep string) string {
+	var b strings.Builder
+	runes := []rune(name)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			b.WriteString(sep)
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
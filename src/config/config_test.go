@@ -0,0 +1,14 @@
+package config
+
+import "testing"
+
+func TestDefault(t *testing.T) {
+	c := Default()
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// servers from before HTTPS and pairing keep answering their clients over plain HTTP without a token
+	if c.EnableTLS || c.EnableAuth || c.ListenAddress() != ":8080" || c.HTTPListenAddress() != "" {
+		t.Errorf("default config serves %s with TLS %t and auth %t", c.ListenAddress(), c.EnableTLS, c.EnableAuth)
+	}
+}
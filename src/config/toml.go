@@ -0,0 +1,115 @@
+package config
+
+// toml file to hold a small reader for the part of TOML config files use: tables and keys with
+// string, whole number and boolean values
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tomlValue is an object that holds a key read from a TOML file with its value as text.
+// Keys inside a table are prefixed with the table name and an underscore.
+type tomlValue struct {
+	key   string
+	value string
+	line  int
+}
+
+// parseTOML reads the keys and values of a TOML document
+// @param text string
+// @return []tomlValue
+// @return error
+func parseTOML(text string) ([]tomlValue, error) {
+	values := make([]tomlValue, 0)
+	seen := make(map[string]bool)
+	prefix := ""
+	for i, line := range strings.Split(text, "\n") {
+		lineNumber := i + 1
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			end := strings.Index(line, "]")
+			if end < 0 || strings.HasPrefix(line, "[[") || !isTOMLComment(line[end+1:]) {
+				return nil, fmt.Errorf("line %d; only simple [table] headers are supported", lineNumber)
+			}
+			table := strings.TrimSpace(line[1:end])
+			if table == "" {
+				return nil, fmt.Errorf("line %d; table name is empty", lineNumber)
+			}
+			prefix = strings.ReplaceAll(table, ".", "_") + "_"
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d; expected key = value", lineNumber)
+		}
+		key := strings.Trim(strings.TrimSpace(line[:eq]), `"'`)
+		if key == "" {
+			return nil, fmt.Errorf("line %d; key is empty", lineNumber)
+		}
+		value, err := parseTOMLValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d; %s", lineNumber, err)
+		}
+		key = prefix + key
+		if seen[key] {
+			return nil, fmt.Errorf("line %d; %s is set twice", lineNumber, key)
+		}
+		seen[key] = true
+		values = append(values, tomlValue{key: key, value: value, line: lineNumber})
+	}
+	return values, nil
+}
+
+// parseTOMLValue reads a single value and the comment after it
+// @param text string
+// @return string The value as text, without quotes
+// @return error
+func parseTOMLValue(text string) (string, error) {
+	switch {
+	case text == "":
+		return "", fmt.Errorf("value is missing")
+	case strings.HasPrefix(text, `"""`) || strings.HasPrefix(text, "'''"):
+		return "", fmt.Errorf("multi-line strings are not supported")
+	case strings.HasPrefix(text, `"`):
+		end := 1
+		for end < len(text) && text[end] != '"' {
+			if text[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(text) || !isTOMLComment(text[end+1:]) {
+			return "", fmt.Errorf("string %s is not closed", text)
+		}
+		value, err := strconv.Unquote(text[:end+1])
+		if err != nil {
+			return "", fmt.Errorf("string %s is not valid", text[:end+1])
+		}
+		return value, nil
+	case strings.HasPrefix(text, "'"):
+		end := strings.Index(text[1:], "'")
+		if end < 0 || !isTOMLComment(text[end+2:]) {
+			return "", fmt.Errorf("string %s is not closed", text)
+		}
+		return text[1 : end+1], nil
+	case strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{"):
+		return "", fmt.Errorf("arrays and inline tables are not supported")
+	}
+	if i := strings.Index(text, "#"); i >= 0 {
+		text = strings.TrimSpace(text[:i])
+	}
+	return text, nil
+}
+
+// isTOMLComment checks that the rest of a line is empty or a comment
+// @param rest string
+// @return bool
+func isTOMLComment(rest string) bool {
+	rest = strings.TrimSpace(rest)
+	return rest == "" || strings.HasPrefix(rest, "#")
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []tomlValue
+		// errText is part of the error the text gives, empty when it is valid
+		errText string
+	}{
+		{name: "empty", text: "", want: []tomlValue{}},
+		{name: "comments", text: "# a comment\n\n   # another\n", want: []tomlValue{}},
+		{
+			name: "values",
+			text: "port = 8080\nroot = \"/srv/files\" # where\nenable_tls = true\nlog_level = 'debug'\nmax_file_size = 1_000_000",
+			want: []tomlValue{
+				{key: "port", value: "8080", line: 1},
+				{key: "root", value: "/srv/files", line: 2},
+				{key: "enable_tls", value: "true", line: 3},
+				{key: "log_level", value: "debug", line: 4},
+				{key: "max_file_size", value: "1_000_000", line: 5},
+			},
+		},
+		{
+			name: "tables",
+			text: "root = \"a\"\n[s3] # the store\nbucket = \"b\"\n[ log.file ]\nmax_size = 10\n",
+			want: []tomlValue{
+				{key: "root", value: "a", line: 1},
+				{key: "s3_bucket", value: "b", line: 3},
+				{key: "log_file_max_size", value: "10", line: 5},
+			},
+		},
+		{
+			name: "strings",
+			text: "a = \"tab\\there \\\"quoted\\\" # not a comment\"\nb = 'C:\\path # kept'\n\"c\" = \"\"\nd = \"é\\u00e9\"",
+			want: []tomlValue{
+				{key: "a", value: "tab\there \"quoted\" # not a comment", line: 1},
+				{key: "b", value: `C:\path # kept`, line: 2},
+				{key: "c", value: "", line: 3},
+				{key: "d", value: "éé", line: 4},
+			},
+		},
+		{name: "windows line endings", text: "port = 1\r\n[s3]\r\nbucket = 'b'\r\n", want: []tomlValue{{key: "port", value: "1", line: 1}, {key: "s3_bucket", value: "b", line: 3}}},
+		{name: "no equals", text: "port 8080", errText: "line 1; expected key = value"},
+		{name: "no key", text: "\n = 1", errText: "line 2; key is empty"},
+		{name: "no value", text: "port =", errText: "value is missing"},
+		{name: "set twice", text: "port = 1\nport = 2", errText: "line 2; port is set twice"},
+		{name: "set twice in a table", text: "[s3]\nbucket = 'a'\n[s3]\nbucket = 'b'", errText: "s3_bucket is set twice"},
+		{name: "unclosed table", text: "[s3", errText: "simple [table]"},
+		{name: "array of tables", text: "[[s3]]", errText: "simple [table]"},
+		{name: "text after table", text: "[s3] bucket = 'a'", errText: "simple [table]"},
+		{name: "empty table", text: "[ ]", errText: "table name is empty"},
+		{name: "unclosed string", text: "root = \"abc", errText: "not closed"},
+		{name: "escaped end of string", text: "root = \"abc\\\"", errText: "not closed"},
+		{name: "text after string", text: "root = \"a\" b", errText: "not closed"},
+		{name: "unclosed literal string", text: "root = 'abc", errText: "not closed"},
+		{name: "bad escape", text: "root = \"\\q\"", errText: "not valid"},
+		{name: "multi-line string", text: "root = \"\"\"a\"\"\"", errText: "multi-line"},
+		{name: "array", text: "ports = [1, 2]", errText: "arrays"},
+		{name: "inline table", text: "s3 = { bucket = 'a' }", errText: "inline tables"},
+	}
+	for _, test := range tests {
+		got, err := parseTOML(test.text)
+		if test.errText != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errText) {
+				t.Errorf("%s: got %v, want an error about %q", test.name, err, test.errText)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReadTOMLFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lanfiles.toml")
+	text := "port = 9000\nenable_tls = true\nread_timeout = \"90s\"\nmax_file_size = 2_000\n[s3]\nendpoint = 'http://nas.local:9000'\n"
+	err := os.WriteFile(path, []byte(text), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Default()
+	err = c.readFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != 9000 || !c.EnableTLS || time.Duration(c.ReadTimeout) != 90*time.Second || c.MaxFileSize != 2000 || c.S3Endpoint != "http://nas.local:9000" {
+		t.Errorf("got %+v", c)
+	}
+	tests := map[string]string{
+		"port = 'many'":       "line 1; port must be a whole number",
+		"\nenable_tls = 2":    "line 2; enable_tls must be true or false",
+		"read_timeout = 5":    "read_timeout must be a duration",
+		"[s3]\nsecret = 'x'":  `unknown setting "s3_secret"`,
+		"not toml at all ===": `unknown setting "not toml at all"`,
+	}
+	for text, errText := range tests {
+		err = os.WriteFile(path, []byte(text), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := Default()
+		err = c.readFile(path)
+		if err == nil || !strings.Contains(err.Error(), errText) {
+			t.Errorf("%q: got %v, want an error about %q", text, err, errText)
+		}
+	}
+}
+
+func FuzzParseTOML(f *testing.F) {
+	f.Add("port = 8080\n[s3]\nbucket = \"b\" # c\nkey = 'k'\n")
+	f.Add("a = \"\\u00e9\\\"\"\n")
+	f.Fuzz(func(t *testing.T, text string) {
+		values, err := parseTOML(text)
+		if err != nil {
+			return
+		}
+		// every key read is set once and comes from a line of the text
+		lines := strings.Count(text, "\n") + 1
+		seen := make(map[string]bool)
+		for _, v := range values {
+			if seen[v.key] || v.line < 1 || v.line > lines {
+				t.Errorf("%q gave %+v", text, values)
+			}
+			seen[v.key] = true
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package discovery
+
+// broadcast file to hold the UDP broadcast responder clients can find the server with on networks that drop mDNS
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+)
+
+// Probe is the datagram clients broadcast to find servers. Anything else sent to a BroadcastResponder is ignored.
+const Probe = "LANFILES_DISCOVER"
+
+// Announcement is an object that holds what a server answers a Probe with.
+// Address is not sent, it is filled in by Browse with the address the answer came from.
+type Announcement struct {
+	Name        string
+	Host        string
+	Port        int
+	HTTPPort    int
+	Version     string
+	Scheme      string
+	Path        string
+	Fingerprint string
+	Address     string
+}
+
+// BroadcastResponder is an object that answers Probe datagrams with an Announcement.
+type BroadcastResponder struct {
+	conn  *net.UDPConn
+	reply []byte
+	logf  func(format string, args ...interface{})
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewBroadcastResponder is a method to start answering probes.
+// @param address string The address to listen on, like ":8089", which gets broadcasts to every address
+// @param announcement Announcement
+// @param logf func(format string, args ...interface{}) Where errors are logged
+// @return *BroadcastResponder
+// @return error
+func NewBroadcastResponder(address string, announcement Announcement, logf func(format string, args ...interface{})) (*BroadcastResponder, error) {
+	announcement.Address = ""
+	reply, err := json.Marshal(announcement)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r := &BroadcastResponder{conn: conn, reply: reply, logf: logf, done: make(chan struct{})}
+	r.wg.Add(1)
+	go r.serve()
+	return r, nil
+}
+
+// Addr is a method to get the address the responder listens on.
+// @return net.Addr
+func (r *BroadcastResponder) Addr() net.Addr {
+	return r.conn.LocalAddr()
+}
+
+// Close is a method to stop answering probes.
+// @return error
+func (r *BroadcastResponder) Close() error {
+	close(r.done)
+	err := r.conn.Close()
+	r.wg.Wait()
+	return err
+}
+
+// serve reads probes until the responder is closed
+func (r *BroadcastResponder) serve() {
+	defer r.wg.Done()
+	buf := make([]byte, 512)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-r.done:
+				return
+			default:
+			}
+			r.logf("broadcast discovery responder stopped; %s", err)
+			return
+		}
+		if string(buf[:n]) != Probe {
+			continue
+		}
+		_, err = r.conn.WriteToUDP(r.reply, from)
+		if err != nil {
+			r.logf("could not answer discovery probe from %s; %s", from, err)
+		}
+	}
+}
+
+// Browse is a method to send a Probe and collect the answers until the context ends.
+// @param ctx context.Context Usually with a timeout of a second or two
+// @param address string The address to send the probe to, like "255.255.255.255:8089" or "127.0.0.1:8089"
+// @return []Announcement The servers that answered, each one once
+// @return error
+func Browse(ctx context.Context, address string) ([]Announcement, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp4"
+	if addr.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_, err = conn.WriteToUDP([]byte(Probe), addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+	announcements := make([]Announcement, 0)
+	found := make(map[string]bool)
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return announcements, nil
+			}
+			return announcements, err
+		}
+		var announcement Announcement
+		if json.Unmarshal(buf[:n], &announcement) != nil || found[from.String()] {
+			continue
+		}
+		found[from.String()] = true
+		announcement.Address = from.IP.String()
+		announcements = append(announcements, announcement)
+	}
+}
@@ -0,0 +1,41 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBrowseLoopback(t *testing.T) {
+	announcement := Announcement{Name: "files", Host: "nas", Port: 8443, HTTPPort: 8081, Version: "1.2", Scheme: "https", Path: "/files", Fingerprint: "AB:CD", Address: "10.0.0.1"}
+	r, err := NewBroadcastResponder("127.0.0.1:0", announcement, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// anything that is not a probe is not answered
+	conn, err := net.DialUDP("udp", nil, r.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 512)); err == nil {
+		t.Errorf("got a %d byte answer to something that is not a probe", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	found, err := Browse(ctx, r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the address is the one the answer came from, not the one the responder was given
+	want := announcement
+	want.Address = "127.0.0.1"
+	if len(found) != 1 || found[0] != want {
+		t.Errorf("got %+v, want %+v", found, want)
+	}
+}
@@ -0,0 +1,313 @@
+package discovery
+
+// dns file to hold a small reader and writer for the part of the DNS message format mDNS uses
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// the record types mDNS answers with and asks for
+const (
+	typeA    = 1
+	typePTR  = 12
+	typeTXT  = 16
+	typeAAAA = 28
+	typeSRV  = 33
+	typeANY  = 255
+)
+
+// classIN is the internet class
+const classIN = 1
+
+// classTopBit is the top bit of a class, which asks for a unicast answer in a question
+// and tells caches to flush older records in an answer
+const classTopBit = 0x8000
+
+// flagResponse is the bit of the header flags set on responses
+const flagResponse = 0x8000
+
+// flagAuthoritative is the bit of the header flags set on authoritative answers
+const flagAuthoritative = 0x0400
+
+// errShortMessage is returned when a message ends before the part being read
+var errShortMessage = errors.New("error: dns message is too short")
+
+// question is an object that holds a question of a DNS message
+type question struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+// record is an object that holds a resource record of a DNS message.
+// Which of target, port, txt and ip is used depends on the type.
+type record struct {
+	name   string
+	rtype  uint16
+	class  uint16
+	ttl    uint32
+	target string
+	port   uint16
+	txt    []string
+	ip     net.IP
+}
+
+// message is an object that holds a DNS message. The authority records are not kept.
+type message struct {
+	id          uint16
+	flags       uint16
+	questions   []question
+	answers     []record
+	additionals []record
+}
+
+// pack writes a message in the DNS wire format, without name compression
+// @return []byte
+// @return error
+func (m message) pack() ([]byte, error) {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], m.id)
+	binary.BigEndian.PutUint16(b[2:], m.flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.answers)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.additionals)))
+	var err error
+	for _, q := range m.questions {
+		b, err = appendName(b, q.name)
+		if err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, q.qtype)
+		b = binary.BigEndian.AppendUint16(b, q.qclass)
+	}
+	for _, r := range append(append([]record(nil), m.answers...), m.additionals...) {
+		b, err = appendRecord(b, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// appendRecord writes a resource record
+// @param b []byte
+// @param r record
+// @return []byte
+// @return error
+func appendRecord(b []byte, r record) ([]byte, error) {
+	b, err := appendName(b, r.name)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, r.rtype)
+	b = binary.BigEndian.AppendUint16(b, r.class)
+	b = binary.BigEndian.AppendUint32(b, r.ttl)
+	lengthAt := len(b)
+	b = append(b, 0, 0)
+	switch r.rtype {
+	case typePTR:
+		b, err = appendName(b, r.target)
+	case typeSRV:
+		b = binary.BigEndian.AppendUint16(b, 0)
+		b = binary.BigEndian.AppendUint16(b, 0)
+		b = binary.BigEndian.AppendUint16(b, r.port)
+		b, err = appendName(b, r.target)
+	case typeTXT:
+		if len(r.txt) == 0 {
+			b = append(b, 0)
+		}
+		for _, s := range r.txt {
+			if len(s) > 255 {
+				return nil, errors.New("error: txt string is longer than 255 bytes")
+			}
+			b = append(b, byte(len(s)))
+			b = append(b, s...)
+		}
+	case typeA:
+		b = append(b, r.ip.To4()...)
+	case typeAAAA:
+		b = append(b, r.ip.To16()...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(b[lengthAt:], uint16(len(b)-lengthAt-2))
+	return b, nil
+}
+
+// appendName writes a domain name like "_lanfiles._tcp.local." as its labels
+// @param b []byte
+// @param name string
+// @return []byte
+// @return error
+func appendName(b []byte, name string) ([]byte, error) {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		if len(label) > 63 {
+			return nil, errors.New("error: dns label " + label + " is longer than 63 bytes")
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0), nil
+}
+
+// parseMessage reads a message in the DNS wire format
+// @param b []byte
+// @return message
+// @return error
+func parseMessage(b []byte) (message, error) {
+	var m message
+	if len(b) < 12 {
+		return m, errShortMessage
+	}
+	m.id = binary.BigEndian.Uint16(b[0:])
+	m.flags = binary.BigEndian.Uint16(b[2:])
+	counts := []int{
+		int(binary.BigEndian.Uint16(b[4:])),
+		int(binary.BigEndian.Uint16(b[6:])),
+		int(binary.BigEndian.Uint16(b[8:])),
+		int(binary.BigEndian.Uint16(b[10:])),
+	}
+	off := 12
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := readName(b, off)
+		if err != nil {
+			return m, err
+		}
+		if next+4 > len(b) {
+			return m, errShortMessage
+		}
+		m.questions = append(m.questions, question{
+			name:   name,
+			qtype:  binary.BigEndian.Uint16(b[next:]),
+			qclass: binary.BigEndian.Uint16(b[next+2:]),
+		})
+		off = next + 4
+	}
+	for section := 1; section < 4; section++ {
+		for i := 0; i < counts[section]; i++ {
+			r, next, err := readRecord(b, off)
+			if err != nil {
+				return m, err
+			}
+			off = next
+			switch section {
+			case 1:
+				m.answers = append(m.answers, r)
+			case 3:
+				m.additionals = append(m.additionals, r)
+			}
+		}
+	}
+	return m, nil
+}
+
+// readRecord reads a resource record
+// @param b []byte The whole message
+// @param off int Where the record starts
+// @return record
+// @return int Where the next part of the message starts
+// @return error
+func readRecord(b []byte, off int) (record, int, error) {
+	var r record
+	name, off, err := readName(b, off)
+	if err != nil {
+		return r, 0, err
+	}
+	if off+10 > len(b) {
+		return r, 0, errShortMessage
+	}
+	r.name = name
+	r.rtype = binary.BigEndian.Uint16(b[off:])
+	r.class = binary.BigEndian.Uint16(b[off+2:])
+	r.ttl = binary.BigEndian.Uint32(b[off+4:])
+	length := int(binary.BigEndian.Uint16(b[off+8:]))
+	start := off + 10
+	end := start + length
+	if end > len(b) {
+		return r, 0, errShortMessage
+	}
+	data := b[start:end]
+	switch r.rtype {
+	case typePTR:
+		r.target, _, err = readName(b, start)
+	case typeSRV:
+		if length < 7 {
+			return r, 0, errShortMessage
+		}
+		r.port = binary.BigEndian.Uint16(data[4:])
+		r.target, _, err = readName(b, start+6)
+	case typeTXT:
+		for i := 0; i < len(data); {
+			n := int(data[i])
+			if i+1+n > len(data) {
+				return r, 0, errShortMessage
+			}
+			if n > 0 {
+				r.txt = append(r.txt, string(data[i+1:i+1+n]))
+			}
+			i += 1 + n
+		}
+	case typeA:
+		if length == net.IPv4len {
+			r.ip = net.IP(append([]byte(nil), data...))
+		}
+	case typeAAAA:
+		if length == net.IPv6len {
+			r.ip = net.IP(append([]byte(nil), data...))
+		}
+	}
+	if err != nil {
+		return r, 0, err
+	}
+	return r, end, nil
+}
+
+// readName reads a domain name, following compression pointers
+// @param b []byte The whole message
+// @param off int Where the name starts
+// @return string The name with a trailing dot
+// @return int Where the part after the name starts
+// @return error
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	// a name can not point at itself forever
+	for jumps := 0; jumps < 64; {
+		if off >= len(b) {
+			return "", 0, errShortMessage
+		}
+		n := int(b[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(b) {
+				return "", 0, errShortMessage
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+			jumps++
+		case n&0xC0 != 0:
+			return "", 0, errors.New("error: dns name has an unknown label type")
+		default:
+			if off+1+n > len(b) {
+				return "", 0, errShortMessage
+			}
+			labels = append(labels, string(b[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+	return "", 0, errors.New("error: dns name has too many compression pointers")
+}
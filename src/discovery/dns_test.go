@@ -0,0 +1,163 @@
+package discovery
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testMessage returns a response with a record of every type mDNS uses
+func testMessage() message {
+	return message{
+		id:        7,
+		flags:     flagResponse | flagAuthoritative,
+		questions: []question{{name: "_lanfiles._tcp.local.", qtype: typePTR, qclass: classIN | classTopBit}},
+		answers: []record{
+			{name: "_lanfiles._tcp.local.", rtype: typePTR, class: classIN, ttl: 4500, target: "files._lanfiles._tcp.local."},
+		},
+		additionals: []record{
+			{name: "files._lanfiles._tcp.local.", rtype: typeSRV, class: classIN | classTopBit, ttl: 120, target: "nas.local.", port: 8080},
+			{name: "files._lanfiles._tcp.local.", rtype: typeTXT, class: classIN, ttl: 4500, txt: []string{"version=1", "path=/files"}},
+			{name: "nas.local.", rtype: typeA, class: classIN, ttl: 120, ip: net.IPv4(192, 168, 1, 2).To4()},
+			{name: "nas.local.", rtype: typeAAAA, class: classIN, ttl: 120, ip: net.ParseIP("fe80::1")},
+		},
+	}
+}
+
+func TestPackParse(t *testing.T) {
+	want := testMessage()
+	b, err := want.pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+	_, err = message{questions: []question{{name: strings.Repeat("a", 64) + ".local."}}}.pack()
+	if err == nil {
+		t.Error("packed a label longer than 63 bytes")
+	}
+	_, err = message{answers: []record{{name: "a.local.", rtype: typeTXT, txt: []string{strings.Repeat("a", 256)}}}}.pack()
+	if err == nil {
+		t.Error("packed a txt string longer than 255 bytes")
+	}
+}
+
+// header returns a DNS header with the counts of each section
+func header(questions, answers, authorities, additionals byte) []byte {
+	return []byte{0, 0, 0x84, 0, 0, questions, 0, answers, 0, authorities, 0, additionals}
+}
+
+// join joins the parts of a message
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestReadName(t *testing.T) {
+	// "local." at 0, "nas" pointing to it at 7, "a" pointing to "nas" at 13
+	names := []byte("\x05local\x00\x03nas\xc0\x00\x01a\xc0\x07")
+	tests := []struct {
+		b    []byte
+		off  int
+		name string
+		next int
+		err  bool
+	}{
+		{b: names, off: 0, name: "local.", next: 7},
+		{b: names, off: 7, name: "nas.local.", next: 13},
+		{b: names, off: 13, name: "a.nas.local.", next: 17},
+		{b: []byte{0}, off: 0, name: ".", next: 1},
+		{b: names, off: len(names), err: true},
+		{b: []byte("\x05loc"), off: 0, err: true},
+		{b: []byte("\x05local"), off: 0, err: true},
+		// a pointer cut in half
+		{b: []byte("\x01a\xc0"), off: 0, err: true},
+		// a pointer past the end of the message
+		{b: []byte("\x01a\xc0\xff"), off: 0, err: true},
+		// a pointer to itself, and two pointers to each other
+		{b: []byte("\xc0\x00"), off: 0, err: true},
+		{b: []byte("\x01a\xc0\x04\x01b\xc0\x00"), off: 0, err: true},
+		// the label types RFC 6891 took over
+		{b: []byte("\x41a\x00"), off: 0, err: true},
+		{b: []byte("\x81a\x00"), off: 0, err: true},
+	}
+	for _, test := range tests {
+		name, next, err := readName(test.b, test.off)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q at %d: got %q, want an error", test.b, test.off, name)
+			}
+			continue
+		}
+		if err != nil || name != test.name || next != test.next {
+			t.Errorf("%q at %d: got %q, %d, %v, want %q, %d", test.b, test.off, name, next, err, test.name, test.next)
+		}
+	}
+}
+
+func TestParseMessageMalformed(t *testing.T) {
+	name := []byte("\x03nas\x05local\x00")
+	rr := func(rtype byte, data []byte) []byte {
+		return join(name, []byte{0, rtype, 0, 1, 0, 0, 0, 120, 0, byte(len(data))}, data)
+	}
+	tests := map[string][]byte{
+		"short header":         {0, 0, 0x84, 0},
+		"missing question":     header(1, 0, 0, 0),
+		"cut question":         join(header(1, 0, 0, 0), name, []byte{0, 1, 0}),
+		"missing answer":       join(header(0, 1, 0, 0), rr(typeA, []byte{1, 2, 3, 4})[:12]),
+		"data past the end":    join(header(0, 1, 0, 0), rr(typeA, []byte{1, 2, 3, 4})[:len(name)+12]),
+		"short srv":            join(header(0, 1, 0, 0), rr(typeSRV, []byte{0, 0, 0, 0, 0, 80})),
+		"txt past its data":    join(header(0, 1, 0, 0), rr(typeTXT, []byte{5, 'a', 'b'})),
+		"ptr target loop":      join(header(0, 1, 0, 0), rr(typePTR, []byte{0xc0, byte(12 + len(name) + 10)})),
+		"missing authority":    join(header(0, 1, 1, 0), rr(typeA, []byte{1, 2, 3, 4})),
+		"question name loop":   join(header(1, 0, 0, 0), []byte{0xc0, 12, 0, 1, 0, 1}),
+		"more counted than in": join(header(0, 2, 0, 0), rr(typeA, []byte{1, 2, 3, 4})),
+	}
+	for name, b := range tests {
+		_, err := parseMessage(b)
+		if err == nil {
+			t.Errorf("%s: parsed without an error", name)
+		}
+	}
+	// an address of the wrong length is left out instead of failing the message
+	m, err := parseMessage(join(header(0, 1, 0, 0), rr(typeA, []byte{1, 2, 3})))
+	if err != nil || len(m.answers) != 1 || m.answers[0].ip != nil {
+		t.Errorf("short address record gave %+v, %v", m, err)
+	}
+	// every cut of a good message either parses or gives an error, without panicking
+	b, err := testMessage().pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := range b {
+		parseMessage(b[:n])
+	}
+}
+
+func FuzzParseMessage(f *testing.F) {
+	b, err := testMessage().pack()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(b)
+	f.Add([]byte("\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\xc0\x0c\x00\x0c\x00\x01"))
+	responder := &MDNSResponder{service: Service{Instance: "files", Host: "nas", Port: 8080, IPs: []net.IP{net.IPv4(192, 168, 1, 2)}}}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := parseMessage(b)
+		if err != nil {
+			return
+		}
+		// whatever a message holds, answering it and reading services out of it does not panic
+		for _, legacy := range []bool{false, true} {
+			response, _ := responder.answer(m, legacy)
+			response.pack()
+		}
+		responseServices(m, net.IPv4(127, 0, 0, 1))
+	})
+}
@@ -0,0 +1,390 @@
+package discovery
+
+// mdns file to hold the mDNS responder that advertises the server with DNS-SD, and the lookup clients find it with
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MDNSAddress is the address of the mDNS multicast group.
+const MDNSAddress = "224.0.0.251:5353"
+
+// ServiceType is the DNS-SD service type the server is advertised as.
+const ServiceType = "_lanfiles._tcp"
+
+// mdnsPort is the port mDNS queriers send from. Queries from any other port are answered straight back to the sender.
+const mdnsPort = 5353
+
+// servicesName is the name DNS-SD browsers ask for to list every service type
+const servicesName = "_services._dns-sd._udp.local."
+
+// the times records are kept in caches for, as RFC 6762 recommends
+const (
+	hostTTL    = 120
+	serviceTTL = 4500
+	// legacyTTL is the longest time given to queriers that are not mDNS responders themselves
+	legacyTTL = 10
+)
+
+// Service is an object that holds a server advertised with mDNS.
+// TXT holds the keys and values of its TXT record, like "version" and "fingerprint".
+type Service struct {
+	Instance string
+	Host     string
+	Port     int
+	IPs      []net.IP
+	TXT      map[string]string
+}
+
+// serviceName returns the name of the service type in the local domain
+// @return string
+func serviceName() string {
+	return ServiceType + ".local."
+}
+
+// instanceName returns the name of the service instance
+// @return string
+func (s Service) instanceName() string {
+	return s.Instance + "." + serviceName()
+}
+
+// hostName returns the name of the host in the local domain
+// @return string
+func (s Service) hostName() string {
+	return s.Host + ".local."
+}
+
+// records returns the records that advertise the service
+// @param ttl uint32 The time the host records are kept for, 0 to say goodbye
+// @return []record The PTR record of the service type
+// @return []record The SRV, TXT and address records of the instance
+func (s Service) records(ttl uint32) ([]record, []record) {
+	longTTL := uint32(0)
+	if ttl > 0 {
+		longTTL = serviceTTL
+	}
+	txt := make([]string, 0, len(s.TXT))
+	for key, value := range s.TXT {
+		txt = append(txt, key+"="+value)
+	}
+	sort.Strings(txt)
+	ptr := []record{{name: serviceName(), rtype: typePTR, class: classIN, ttl: longTTL, target: s.instanceName()}}
+	rest := []record{
+		{name: s.instanceName(), rtype: typeSRV, class: classIN | classTopBit, ttl: ttl, target: s.hostName(), port: uint16(s.Port)},
+		{name: s.instanceName(), rtype: typeTXT, class: classIN | classTopBit, ttl: longTTL, txt: txt},
+	}
+	return ptr, append(rest, s.addressRecords(ttl)...)
+}
+
+// addressRecords returns the A and AAAA records of the host
+// @param ttl uint32
+// @return []record
+func (s Service) addressRecords(ttl uint32) []record {
+	records := make([]record, 0, len(s.IPs))
+	for _, ip := range s.IPs {
+		r := record{name: s.hostName(), rtype: typeAAAA, class: classIN | classTopBit, ttl: ttl, ip: ip}
+		if ip.To4() != nil {
+			r.rtype = typeA
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// MDNSResponder is an object that answers mDNS questions about a Service.
+// When it listens on the mDNS multicast group it also announces the service when it starts and says goodbye when it
+// is closed. On any other address, like a loopback address for testing, it only answers the queries sent to it.
+type MDNSResponder struct {
+	conn    *net.UDPConn
+	group   *net.UDPAddr
+	service Service
+	logf    func(format string, args ...interface{})
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewMDNSResponder is a method to start answering mDNS questions about a service.
+// @param address string MDNSAddress, or a unicast address like "127.0.0.1:5354"
+// @param service Service
+// @param logf func(format string, args ...interface{}) Where errors are logged
+// @return *MDNSResponder
+// @return error
+func NewMDNSResponder(address string, service Service, logf func(format string, args ...interface{})) (*MDNSResponder, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	service.Instance = strings.ReplaceAll(service.Instance, ".", " ")
+	if service.Host == "" || strings.Contains(service.Host, ".") {
+		return nil, errors.New("error: mdns host name must be a single label")
+	}
+	r := &MDNSResponder{service: service, logf: logf, done: make(chan struct{})}
+	if addr.IP.IsMulticast() {
+		r.group = addr
+		r.conn, err = net.ListenMulticastUDP("udp4", nil, addr)
+	} else {
+		r.conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.wg.Add(1)
+	go r.serve()
+	if r.group != nil {
+		r.wg.Add(1)
+		go r.announce()
+	}
+	return r, nil
+}
+
+// Addr is a method to get the address the responder listens on.
+// @return net.Addr
+func (r *MDNSResponder) Addr() net.Addr {
+	return r.conn.LocalAddr()
+}
+
+// Close is a method to say goodbye on the multicast group, so caches forget the service, and stop answering.
+// @return error
+func (r *MDNSResponder) Close() error {
+	close(r.done)
+	if r.group != nil {
+		ptr, rest := r.service.records(0)
+		r.send(message{flags: flagResponse | flagAuthoritative, answers: append(ptr, rest...)}, r.group)
+	}
+	err := r.conn.Close()
+	r.wg.Wait()
+	return err
+}
+
+// announce sends the records of the service to the multicast group twice, a second apart, as RFC 6762 asks
+func (r *MDNSResponder) announce() {
+	defer r.wg.Done()
+	for i := 0; i < 2; i++ {
+		ptr, rest := r.service.records(hostTTL)
+		r.send(message{flags: flagResponse | flagAuthoritative, answers: append(ptr, rest...)}, r.group)
+		select {
+		case <-r.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// serve reads queries until the responder is closed
+func (r *MDNSResponder) serve() {
+	defer r.wg.Done()
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-r.done:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			r.logf("mdns responder stopped; %s", err)
+			return
+		}
+		query, err := parseMessage(buf[:n])
+		if err != nil || query.flags&flagResponse != 0 {
+			continue
+		}
+		response, unicast := r.answer(query, from.Port != mdnsPort)
+		if len(response.answers) == 0 {
+			continue
+		}
+		to := from
+		if !unicast && r.group != nil {
+			to = r.group
+		}
+		r.send(response, to)
+	}
+}
+
+// answer builds the response to a query
+// @param query message
+// @param legacy bool true when the query came from a querier that is not an mDNS responder,
+// which gets the question back with short lived records like a normal DNS answer
+// @return message
+// @return bool true if the response is sent straight back to the querier
+func (r *MDNSResponder) answer(query message, legacy bool) (message, bool) {
+	ttl := uint32(hostTTL)
+	response := message{flags: flagResponse | flagAuthoritative}
+	if legacy {
+		response.id = query.id
+		response.questions = query.questions
+	}
+	unicast := legacy
+	seen := make(map[string]bool)
+	add := func(list *[]record, records ...record) {
+		for _, rec := range records {
+			key := rec.name + "|" + strconv.Itoa(int(rec.rtype)) + "|" + rec.target + "|" + rec.ip.String()
+			if !seen[key] {
+				seen[key] = true
+				*list = append(*list, rec)
+			}
+		}
+	}
+	ptr, rest := r.service.records(ttl)
+	srvTXT, addresses := rest[:2], rest[2:]
+	for _, q := range query.questions {
+		if q.qclass&classTopBit != 0 {
+			unicast = true
+		}
+		name := strings.ToLower(q.name)
+		switch {
+		case name == strings.ToLower(serviceName()) && (q.qtype == typePTR || q.qtype == typeANY):
+			add(&response.answers, ptr...)
+			add(&response.additionals, rest...)
+		case name == servicesName && (q.qtype == typePTR || q.qtype == typeANY):
+			add(&response.answers, record{name: servicesName, rtype: typePTR, class: classIN, ttl: serviceTTL, target: serviceName()})
+		case name == strings.ToLower(r.service.instanceName()):
+			for _, rec := range srvTXT {
+				if q.qtype == rec.rtype || q.qtype == typeANY {
+					add(&response.answers, rec)
+				}
+			}
+			add(&response.additionals, addresses...)
+		case name == strings.ToLower(r.service.hostName()):
+			for _, rec := range addresses {
+				if q.qtype == rec.rtype || q.qtype == typeANY {
+					add(&response.answers, rec)
+				}
+			}
+		}
+	}
+	if legacy {
+		for _, list := range [][]record{response.answers, response.additionals} {
+			for i := range list {
+				list[i].class &^= classTopBit
+				if list[i].ttl > legacyTTL {
+					list[i].ttl = legacyTTL
+				}
+			}
+		}
+	}
+	return response, unicast
+}
+
+// send writes a message to an address, logging when it can not
+// @param m message
+// @param to *net.UDPAddr
+func (r *MDNSResponder) send(m message, to *net.UDPAddr) {
+	b, err := m.pack()
+	if err == nil {
+		_, err = r.conn.WriteToUDP(b, to)
+	}
+	if err != nil {
+		r.logf("could not send mdns response to %s; %s", to, err)
+	}
+}
+
+// LookupMDNS is a method to ask for the servers advertised with mDNS and collect the answers until the context ends.
+// The question is sent from a port other than 5353, so responders answer straight back instead of to the group.
+// @param ctx context.Context Usually with a timeout of a second or two
+// @param address string MDNSAddress, or the address of a single responder
+// @return []Service The servers that answered, each one once
+// @return error
+func LookupMDNS(ctx context.Context, address string) ([]Service, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp4"
+	if addr.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	query, err := message{questions: []question{{name: serviceName(), qtype: typePTR, qclass: classIN}}}.pack()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.WriteToUDP(query, addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+	services := make([]Service, 0)
+	found := make(map[string]bool)
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return services, nil
+			}
+			return services, err
+		}
+		response, err := parseMessage(buf[:n])
+		if err != nil || response.flags&flagResponse == 0 {
+			continue
+		}
+		for _, service := range responseServices(response, from.IP) {
+			key := service.Instance + "|" + service.Host
+			if !found[key] {
+				found[key] = true
+				services = append(services, service)
+			}
+		}
+	}
+}
+
+// responseServices pulls the services out of an mDNS response
+// @param response message
+// @param from net.IP The address the response came from, used when it has no address records
+// @return []Service
+func responseServices(response message, from net.IP) []Service {
+	records := append(append([]record(nil), response.answers...), response.additionals...)
+	byName := make(map[string][]record)
+	for _, r := range records {
+		key := strings.ToLower(r.name)
+		byName[key] = append(byName[key], r)
+	}
+	services := make([]Service, 0)
+	for _, r := range records {
+		if r.rtype != typePTR || !strings.EqualFold(r.name, serviceName()) {
+			continue
+		}
+		service := Service{Instance: strings.TrimSuffix(r.target, "."+serviceName()), TXT: make(map[string]string)}
+		for _, rec := range byName[strings.ToLower(r.target)] {
+			switch rec.rtype {
+			case typeSRV:
+				service.Host = strings.TrimSuffix(strings.TrimSuffix(rec.target, "."), ".local")
+				service.Port = int(rec.port)
+				for _, addr := range byName[strings.ToLower(rec.target)] {
+					if addr.ip != nil {
+						service.IPs = append(service.IPs, addr.ip)
+					}
+				}
+			case typeTXT:
+				for _, s := range rec.txt {
+					key, value, _ := strings.Cut(s, "=")
+					service.TXT[strings.ToLower(key)] = value
+				}
+			}
+		}
+		if service.Port == 0 {
+			continue
+		}
+		if len(service.IPs) == 0 {
+			service.IPs = []net.IP{from}
+		}
+		services = append(services, service)
+	}
+	return services
+}
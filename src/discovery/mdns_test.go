@@ -0,0 +1,81 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLookupMDNSLoopback(t *testing.T) {
+	service := Service{
+		Instance: "Files on nas.lan",
+		Host:     "nas",
+		Port:     8443,
+		IPs:      []net.IP{net.IPv4(192, 168, 1, 2).To4(), net.ParseIP("fd00::2")},
+		TXT:      map[string]string{"version": "1.2", "fingerprint": "AB:CD"},
+	}
+	r, err := NewMDNSResponder("127.0.0.1:0", service, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	services, err := LookupMDNS(ctx, r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// dots in the instance name would make it more than one label
+	want := service
+	want.Instance = "Files on nas lan"
+	if len(services) != 1 || !reflect.DeepEqual(services[0], want) {
+		t.Errorf("got %+v, want %+v", services, want)
+	}
+}
+
+func TestNewMDNSResponderHost(t *testing.T) {
+	for _, host := range []string{"", "nas.local"} {
+		r, err := NewMDNSResponder("127.0.0.1:0", Service{Instance: "files", Host: host, Port: 1}, t.Logf)
+		if err == nil {
+			r.Close()
+			t.Errorf("host %q was accepted", host)
+		}
+	}
+}
+
+func TestAnswer(t *testing.T) {
+	r := &MDNSResponder{service: Service{Instance: "files", Host: "nas", Port: 8080, IPs: []net.IP{net.IPv4(192, 168, 1, 2)}}}
+	tests := []struct {
+		name     string
+		question question
+		legacy   bool
+		answers  []uint16
+		unicast  bool
+	}{
+		{name: "service type", question: question{name: "_LANFILES._tcp.local.", qtype: typePTR, qclass: classIN}, answers: []uint16{typePTR}},
+		{name: "services", question: question{name: servicesName, qtype: typeANY, qclass: classIN}, answers: []uint16{typePTR}},
+		{name: "instance srv", question: question{name: "files._lanfiles._tcp.local.", qtype: typeSRV, qclass: classIN | classTopBit}, answers: []uint16{typeSRV}, unicast: true},
+		{name: "instance any", question: question{name: "files._lanfiles._tcp.local.", qtype: typeANY, qclass: classIN}, answers: []uint16{typeSRV, typeTXT}},
+		{name: "host", question: question{name: "nas.local.", qtype: typeA, qclass: classIN}, legacy: true, answers: []uint16{typeA}, unicast: true},
+		{name: "host aaaa", question: question{name: "nas.local.", qtype: typeAAAA, qclass: classIN}},
+		{name: "other", question: question{name: "printer.local.", qtype: typeANY, qclass: classIN}},
+	}
+	for _, test := range tests {
+		response, unicast := r.answer(message{id: 9, questions: []question{test.question}}, test.legacy)
+		types := make([]uint16, 0)
+		for _, rec := range response.answers {
+			types = append(types, rec.rtype)
+			if test.legacy && (rec.ttl > legacyTTL || rec.class&classTopBit != 0) {
+				t.Errorf("%s: legacy answer %+v is cached too long or flushes caches", test.name, rec)
+			}
+		}
+		if !reflect.DeepEqual(types, append([]uint16{}, test.answers...)) || unicast != test.unicast {
+			t.Errorf("%s: got %v unicast %v, want %v unicast %v", test.name, types, unicast, test.answers, test.unicast)
+		}
+		if test.legacy && (response.id != 9 || len(response.questions) != 1) {
+			t.Errorf("%s: legacy answer does not carry the query id and question", test.name)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package exif
+
+// exif file to pull the EXIF fields we care about out of JPEG files without any outside packages
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// EXIF tags read out of IFD0
+const (
+	tagMake           = 0x010F
+	tagModel          = 0x0110
+	tagOrientation    = 0x0112
+	tagDateTime       = 0x0132
+	tagExifIFD        = 0x8769
+	tagGPSIFD         = 0x8825
+	tagDateTimeOrig   = 0x9003
+	tagOffsetTimeOrig = 0x9011
+	tagPixelX         = 0xA002
+	tagPixelY         = 0xA003
+	tagDNGVersion     = 0xC612
+)
+
+// GPS tags read out of the GPS IFD
+const (
+	tagGPSLatitudeRef  = 0x0001
+	tagGPSLatitude     = 0x0002
+	tagGPSLongitudeRef = 0x0003
+	tagGPSLongitude    = 0x0004
+	tagGPSAltitudeRef  = 0x0005
+	tagGPSAltitude     = 0x0006
+)
+
+// sizes of each TIFF field type in bytes, indexed by type
+var typeSizes = []int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+// ErrNoExif is returned when the data given does not have an EXIF block
+var ErrNoExif = errors.New("error: no exif data found")
+
+var errMalformed = errors.New("error: exif data is not formatted properly")
+
+// Exif is an object that holds the fields read out of an EXIF block.
+// Fields that were not in the EXIF block are left at their zero value.
+type Exif struct {
+	// Camera manufacturer
+	Make string
+	// Camera model
+	Model string
+	// Orientation of the image, 1 through 8. 0 if not set
+	Orientation int
+	// Capture time in the EXIF "2006:01:02 15:04:05" format
+	DateTime string
+	// UTC offset of the capture time in "+07:00" format, if the camera recorded it
+	OffsetTime string
+	// Pixel dimensions of the image
+	Width  int
+	Height int
+	// HasGPS is true when Latitude and Longitude are set
+	HasGPS    bool
+	Latitude  float64
+	Longitude float64
+	// HasAltitude is true when Altitude is set
+	HasAltitude bool
+	Altitude    float64
+	// IsDNG is true when the data is from a DNG raw file
+	IsDNG bool
+}
+
+// ifdEntry is a single field of an IFD
+type ifdEntry struct {
+	fieldType uint16
+	count     uint32
+	value     []byte
+}
+
+// tiffReader reads IFDs out of TIFF structured EXIF data
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// ReadJPEG is a method to find the EXIF block in JPEG data and parse it.
+// The image dimensions are taken from the JPEG frame header when the EXIF block does not have them.
+// The data can be just the start of the file, as long as the EXIF block is in it.
+// @param data []byte The JPEG file data
+// @return *Exif
+// @return error ErrNoExif if the JPEG has no EXIF block
+func ReadJPEG(data []byte) (*Exif, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("error: data is not a jpeg")
+	}
+	var ex *Exif
+	width, height := 0, 0
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, errMalformed
+		}
+		marker := data[pos+1]
+		pos += 2
+		// markers without a length
+		if marker == 0xFF || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD8) {
+			if marker == 0xFF {
+				pos--
+			}
+			continue
+		}
+		// start of scan or end of image means there are no more headers
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos : pos+2]))
+		if length < 2 {
+			return nil, errMalformed
+		}
+		if pos+length > len(data) {
+			if ex != nil {
+				// the data was cut off after the EXIF block
+				break
+			}
+			return nil, errMalformed
+		}
+		segment := data[pos+2 : pos+length]
+		switch {
+		case marker == 0xE1 && ex == nil && bytes.HasPrefix(segment, []byte("Exif\x00\x00")):
+			parsed, err := Read(segment[6:])
+			if err != nil {
+				return nil, err
+			}
+			ex = parsed
+		case marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC:
+			// start of frame holds precision, height and width
+			if len(segment) >= 5 {
+				height = int(binary.BigEndian.Uint16(segment[1:3]))
+				width = int(binary.BigEndian.Uint16(segment[3:5]))
+			}
+		}
+		pos += length
+	}
+	if ex == nil {
+		return nil, ErrNoExif
+	}
+	if ex.Width == 0 || ex.Height == 0 {
+		ex.Width, ex.Height = width, height
+	}
+	return ex, nil
+}
+
+// Read is a method to parse TIFF structured EXIF data, which is what follows the
+// "Exif\0\0" identifier in a JPEG APP1 segment.
+// @param data []byte
+// @return *Exif
+// @return error
+func Read(data []byte) (*Exif, error) {
+	if len(data) < 8 {
+		return nil, errMalformed
+	}
+	tr := &tiffReader{data: data}
+	switch string(data[0:2]) {
+	case "II":
+		tr.order = binary.LittleEndian
+	case "MM":
+		tr.order = binary.BigEndian
+	default:
+		return nil, errMalformed
+	}
+	if tr.order.Uint16(data[2:4]) != 42 {
+		return nil, errMalformed
+	}
+	ifd0, err := tr.readIFD(tr.order.Uint32(data[4:8]))
+	if err != nil {
+		return nil, err
+	}
+	ex := &Exif{
+		Make:        tr.str(ifd0[tagMake]),
+		Model:       tr.str(ifd0[tagModel]),
+		Orientation: tr.integer(ifd0[tagOrientation]),
+		DateTime:    tr.str(ifd0[tagDateTime]),
+	}
+	_, ex.IsDNG = ifd0[tagDNGVersion]
+	if e, ok := ifd0[tagExifIFD]; ok {
+		sub, err := tr.readIFD(uint32(tr.integer(e)))
+		if err == nil {
+			if dt := tr.str(sub[tagDateTimeOrig]); dt != "" {
+				ex.DateTime = dt
+			}
+			ex.OffsetTime = tr.str(sub[tagOffsetTimeOrig])
+			ex.Width = tr.integer(sub[tagPixelX])
+			ex.Height = tr.integer(sub[tagPixelY])
+		}
+	}
+	if e, ok := ifd0[tagGPSIFD]; ok {
+		gps, err := tr.readIFD(uint32(tr.integer(e)))
+		if err == nil {
+			tr.readGPS(gps, ex)
+		}
+	}
+	return ex, nil
+}
+
+// readIFD reads all of the entries of the IFD at the offset given
+func (tr *tiffReader) readIFD(offset uint32) (map[uint16]ifdEntry, error) {
+	if uint64(offset)+2 > uint64(len(tr.data)) {
+		return nil, errMalformed
+	}
+	count := int(tr.order.Uint16(tr.data[offset : offset+2]))
+	pos := int(offset) + 2
+	if pos+count*12 > len(tr.data) {
+		return nil, errMalformed
+	}
+	entries := make(map[uint16]ifdEntry, count)
+	for i := 0; i < count; i++ {
+		raw := tr.data[pos : pos+12]
+		pos += 12
+		fieldType := tr.order.Uint16(raw[2:4])
+		if int(fieldType) >= len(typeSizes) || typeSizes[fieldType] == 0 {
+			continue
+		}
+		fieldCount := tr.order.Uint32(raw[4:8])
+		size := uint64(typeSizes[fieldType]) * uint64(fieldCount)
+		value := raw[8:12]
+		if size > 4 {
+			valueOffset := uint64(tr.order.Uint32(raw[8:12]))
+			if valueOffset+size > uint64(len(tr.data)) {
+				continue
+			}
+			value = tr.data[valueOffset : valueOffset+size]
+		} else {
+			value = value[:size]
+		}
+		entries[tr.order.Uint16(raw[0:2])] = ifdEntry{fieldType: fieldType, count: fieldCount, value: value}
+	}
+	return entries, nil
+}
+
+// readGPS sets the GPS fields of ex from the GPS IFD entries
+func (tr *tiffReader) readGPS(gps map[uint16]ifdEntry, ex *Exif) {
+	lat, latOk := tr.degrees(gps[tagGPSLatitude])
+	lon, lonOk := tr.degrees(gps[tagGPSLongitude])
+	if latOk && lonOk {
+		if strings.ToUpper(tr.str(gps[tagGPSLatitudeRef])) == "S" {
+			lat = -lat
+		}
+		if strings.ToUpper(tr.str(gps[tagGPSLongitudeRef])) == "W" {
+			lon = -lon
+		}
+		ex.HasGPS = true
+		ex.Latitude = lat
+		ex.Longitude = lon
+	}
+	if alt := tr.rationals(gps[tagGPSAltitude]); len(alt) == 1 {
+		ex.HasAltitude = true
+		ex.Altitude = alt[0]
+		ref := gps[tagGPSAltitudeRef]
+		if len(ref.value) > 0 && ref.value[0] == 1 {
+			ex.Altitude = -ex.Altitude
+		}
+	}
+}
+
+// str returns an ASCII entry as a string
+func (tr *tiffReader) str(e ifdEntry) string {
+	if e.fieldType != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+// integer returns the first value of a BYTE, SHORT or LONG entry
+func (tr *tiffReader) integer(e ifdEntry) int {
+	switch e.fieldType {
+	case 1:
+		if len(e.value) >= 1 {
+			return int(e.value[0])
+		}
+	case 3:
+		if len(e.value) >= 2 {
+			return int(tr.order.Uint16(e.value))
+		}
+	case 4:
+		if len(e.value) >= 4 {
+			return int(tr.order.Uint32(e.value))
+		}
+	}
+	return 0
+}
+
+// rationals returns the values of a RATIONAL entry
+func (tr *tiffReader) rationals(e ifdEntry) []float64 {
+	if e.fieldType != 5 {
+		return nil
+	}
+	values := make([]float64, 0, e.count)
+	for i := 0; i+8 <= len(e.value); i += 8 {
+		num := tr.order.Uint32(e.value[i : i+4])
+		den := tr.order.Uint32(e.value[i+4 : i+8])
+		if den == 0 {
+			return nil
+		}
+		values = append(values, float64(num)/float64(den))
+	}
+	return values
+}
+
+// degrees converts a degrees, minutes, seconds RATIONAL entry into decimal degrees
+func (tr *tiffReader) degrees(e ifdEntry) (float64, bool) {
+	dms := tr.rationals(e)
+	if len(dms) != 3 {
+		return 0, false
+	}
+	return dms[0] + dms[1]/60 + dms[2]/3600, true
+}
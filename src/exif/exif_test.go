@@ -0,0 +1,275 @@
+package exif
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// testOrder is a byte order test data can be built with
+type testOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// testEntry is a field of an IFD to build test EXIF data with
+type testEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	// value is written in the entry when it is 4 bytes or less, and after the IFDs otherwise
+	value []byte
+	// ifd is the index of the IFD whose offset is the value, when it is more than 0
+	ifd int
+}
+
+func ascii(tag uint16, s string) testEntry {
+	return testEntry{tag: tag, typ: 2, count: uint32(len(s) + 1), value: []byte(s + "\x00")}
+}
+
+func short(order testOrder, tag uint16, v uint16) testEntry {
+	return testEntry{tag: tag, typ: 3, count: 1, value: order.AppendUint16(nil, v)}
+}
+
+func rational(order testOrder, tag uint16, pairs ...uint32) testEntry {
+	value := make([]byte, 0, len(pairs)*4)
+	for _, v := range pairs {
+		value = order.AppendUint32(value, v)
+	}
+	return testEntry{tag: tag, typ: 5, count: uint32(len(pairs) / 2), value: value}
+}
+
+func pointer(tag uint16, ifd int) testEntry {
+	return testEntry{tag: tag, typ: 4, count: 1, ifd: ifd}
+}
+
+// buildTIFF lays out a TIFF header followed by the IFDs and then the values that do not fit in their entries
+func buildTIFF(order testOrder, ifds ...[]testEntry) []byte {
+	offsets := make([]int, len(ifds))
+	end := 8
+	for i, ifd := range ifds {
+		offsets[i] = end
+		end += 2 + 12*len(ifd) + 4
+	}
+	data := make([]byte, 8, end)
+	if order == binary.LittleEndian {
+		copy(data, "II")
+	} else {
+		copy(data, "MM")
+	}
+	order.PutUint16(data[2:], 42)
+	order.PutUint32(data[4:], uint32(offsets[0]))
+	extra := make([]byte, 0)
+	for _, ifd := range ifds {
+		data = order.AppendUint16(data, uint16(len(ifd)))
+		for _, e := range ifd {
+			data = order.AppendUint16(data, e.tag)
+			data = order.AppendUint16(data, e.typ)
+			data = order.AppendUint32(data, e.count)
+			switch {
+			case e.ifd > 0:
+				data = order.AppendUint32(data, uint32(offsets[e.ifd]))
+			case len(e.value) > 4:
+				data = order.AppendUint32(data, uint32(end+len(extra)))
+				extra = append(extra, e.value...)
+			default:
+				data = append(data, e.value...)
+				data = append(data, make([]byte, 4-len(e.value))...)
+			}
+		}
+		// no next IFD
+		data = order.AppendUint32(data, 0)
+	}
+	return append(data, extra...)
+}
+
+// fullTIFF builds EXIF data with every field Read looks at
+func fullTIFF(order testOrder, latRef, lonRef string, altRef byte) []byte {
+	return buildTIFF(order,
+		[]testEntry{
+			ascii(tagMake, "Canon"),
+			ascii(tagModel, "EOS R5 "),
+			short(order, tagOrientation, 6),
+			ascii(tagDateTime, "2020:01:01 00:00:00"),
+			pointer(tagExifIFD, 1),
+			pointer(tagGPSIFD, 2),
+		},
+		[]testEntry{
+			ascii(tagDateTimeOrig, "2024:07:14 18:30:05"),
+			ascii(tagOffsetTimeOrig, "+02:00"),
+			short(order, tagPixelX, 8192),
+			short(order, tagPixelY, 5464),
+		},
+		[]testEntry{
+			ascii(tagGPSLatitudeRef, latRef),
+			rational(order, tagGPSLatitude, 48, 1, 51, 1, 2400, 100),
+			ascii(tagGPSLongitudeRef, lonRef),
+			rational(order, tagGPSLongitude, 2, 1, 21, 1, 0, 1),
+			{tag: tagGPSAltitudeRef, typ: 1, count: 1, value: []byte{altRef}},
+			rational(order, tagGPSAltitude, 355, 10),
+		},
+	)
+}
+
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestRead(t *testing.T) {
+	for _, order := range []testOrder{binary.LittleEndian, binary.BigEndian} {
+		ex, err := Read(fullTIFF(order, "N", "E", 0))
+		if err != nil {
+			t.Fatalf("%s: %s", order, err)
+		}
+		want := Exif{
+			Make: "Canon", Model: "EOS R5", Orientation: 6, DateTime: "2024:07:14 18:30:05", OffsetTime: "+02:00",
+			Width: 8192, Height: 5464, HasGPS: true, HasAltitude: true, Altitude: 35.5,
+		}
+		got := *ex
+		got.Latitude, got.Longitude = 0, 0
+		if got != want {
+			t.Errorf("%s: got %+v, want %+v", order, got, want)
+		}
+		if !closeTo(ex.Latitude, 48+51.0/60+24.0/3600) || !closeTo(ex.Longitude, 2+21.0/60) {
+			t.Errorf("%s: got %f,%f", order, ex.Latitude, ex.Longitude)
+		}
+	}
+}
+
+func TestReadGPSReferences(t *testing.T) {
+	ex, err := Read(fullTIFF(binary.LittleEndian, "S", "W", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.Latitude >= 0 || ex.Longitude >= 0 || ex.Altitude != -35.5 {
+		t.Errorf("southern, western and below sea level came out as %f,%f,%f", ex.Latitude, ex.Longitude, ex.Altitude)
+	}
+}
+
+func TestReadBadFields(t *testing.T) {
+	order := binary.LittleEndian
+	ex, err := Read(buildTIFF(order,
+		[]testEntry{
+			// a string where a number should be and a number where a string should be are left out
+			ascii(tagOrientation, "six"),
+			short(order, tagMake, 1),
+			// a value that points past the end of the data is left out
+			{tag: tagModel, typ: 2, count: 1000, value: make([]byte, 8)},
+			// an unknown type is skipped
+			{tag: tagDateTime, typ: 99, count: 1, value: []byte{1}},
+			// a sub IFD that points past the end of the data is ignored
+			{tag: tagExifIFD, typ: 4, count: 1, value: order.AppendUint32(nil, 1<<30)},
+			pointer(tagGPSIFD, 1),
+			{tag: tagDNGVersion, typ: 1, count: 4, value: []byte{1, 4, 0, 0}},
+		},
+		[]testEntry{
+			// a zero denominator gives no position
+			rational(order, tagGPSLatitude, 1, 0, 0, 1, 0, 1),
+			rational(order, tagGPSLongitude, 1, 1, 0, 1, 0, 1),
+			// the wrong number of values gives no altitude
+			rational(order, tagGPSAltitude, 1, 1, 2, 1),
+		},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Exif{IsDNG: true}
+	if *ex != want {
+		t.Errorf("got %+v, want %+v", *ex, want)
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":            nil,
+		"short":            []byte("II*\x00"),
+		"bad byte order":   []byte("XX*\x00\x08\x00\x00\x00"),
+		"bad magic":        []byte("II+\x00\x08\x00\x00\x00"),
+		"ifd past the end": []byte("II*\x00\xff\x00\x00\x00"),
+		"entries past end": []byte("II*\x00\x08\x00\x00\x00\x05\x00"),
+	}
+	for name, data := range tests {
+		_, err := Read(data)
+		if err != errMalformed {
+			t.Errorf("%s: got %v, want errMalformed", name, err)
+		}
+	}
+	// every cut of good data either parses or gives an error, without panicking
+	full := fullTIFF(binary.BigEndian, "N", "E", 0)
+	for n := range full {
+		Read(full[:n])
+	}
+}
+
+// jpegSegment returns a JPEG marker segment with its length
+func jpegSegment(marker byte, data []byte) []byte {
+	segment := []byte{0xFF, marker}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(data)+2))
+	return append(segment, data...)
+}
+
+// testJPEG returns the headers of a JPEG file with an APP1 EXIF segment when tiff is set and a frame of a size
+func testJPEG(tiff []byte, width, height uint16) []byte {
+	data := []byte{0xFF, 0xD8}
+	// an APP0 segment before the EXIF one is skipped
+	data = append(data, jpegSegment(0xE0, []byte("JFIF\x00\x01\x02"))...)
+	if tiff != nil {
+		data = append(data, jpegSegment(0xE1, append([]byte("Exif\x00\x00"), tiff...))...)
+	}
+	frame := []byte{8}
+	frame = binary.BigEndian.AppendUint16(frame, height)
+	frame = binary.BigEndian.AppendUint16(frame, width)
+	frame = append(frame, 3)
+	data = append(data, jpegSegment(0xC0, frame)...)
+	data = append(data, jpegSegment(0xDA, []byte{0, 0, 0})...)
+	return append(data, 0xFF, 0xD9)
+}
+
+func TestReadJPEG(t *testing.T) {
+	ex, err := ReadJPEG(testJPEG(fullTIFF(binary.LittleEndian, "N", "E", 0), 640, 480))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.Make != "Canon" || ex.Width != 8192 || ex.Height != 5464 {
+		t.Errorf("the EXIF dimensions should be kept, got %+v", ex)
+	}
+	// without dimensions in the EXIF block the frame header gives them
+	order := binary.BigEndian
+	ex, err = ReadJPEG(testJPEG(buildTIFF(order, []testEntry{short(order, tagOrientation, 3)}), 640, 480))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.Orientation != 3 || ex.Width != 640 || ex.Height != 480 {
+		t.Errorf("got %+v, want orientation 3 and 640x480", ex)
+	}
+	// the data can be cut off after the EXIF block
+	data := testJPEG(fullTIFF(binary.LittleEndian, "N", "E", 0), 640, 480)
+	ex, err = ReadJPEG(data[:len(data)-12])
+	if err != nil || ex.Make != "Canon" {
+		t.Errorf("data cut off in the frame header gave %+v, %v", ex, err)
+	}
+	_, err = ReadJPEG(testJPEG(nil, 640, 480))
+	if err != ErrNoExif {
+		t.Errorf("a JPEG without EXIF gave %v, want ErrNoExif", err)
+	}
+	_, err = ReadJPEG([]byte("\x89PNG\r\n\x1a\n"))
+	if err == nil {
+		t.Error("a PNG was read as a JPEG")
+	}
+	// a segment that runs past the end of the data
+	_, err = ReadJPEG([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0x10, 0x00, 'E', 'x'})
+	if err != errMalformed {
+		t.Errorf("a cut off segment gave %v, want errMalformed", err)
+	}
+}
+
+func FuzzReadJPEG(f *testing.F) {
+	f.Add(testJPEG(fullTIFF(binary.LittleEndian, "N", "E", 0), 640, 480))
+	f.Add(testJPEG(fullTIFF(binary.BigEndian, "S", "W", 1), 1, 1))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ReadJPEG(data)
+		if len(data) > 2 {
+			Read(data[2:])
+		}
+	})
+}
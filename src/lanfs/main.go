@@ -0,0 +1,339 @@
+package main
+
+// main file to hold the lanfs command that pushes, pulls, lists and verifies files on a file server over its paths
+
+import (
+	"client"
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"server"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// the environment variables the connection flags default to
+const (
+	urlEnv         = "LANFS_URL"
+	tokenEnv       = "LANFS_TOKEN"
+	fingerprintEnv = "LANFS_FINGERPRINT"
+)
+
+// searchPageSize is how many files are asked for at a time when every folder is searched, the most the server sends
+const searchPageSize = 1000
+
+// usage is the usage of the command
+const usage = `usage:
+  lanfs push [flags] [-folder folder] [-attr key=value]... <file or folder>...
+  lanfs pull [flags] [-o path] [-folder folder] <folder or hash>...
+  lanfs ls [flags] [-l] [folder]
+  lanfs verify [flags] [-folder folder] <file or folder>...
+
+push uploads files, and the files in folders, carrying on uploads that were stopped.
+pull downloads every file of a folder, or the files with a hash, carrying on downloads that were stopped.
+ls lists the folders of the server, or the files in a folder.
+verify checks that the server has whole copies of local files that match their hash.
+
+flags:
+  -url string          the address of the server, like https://192.168.1.20:8080 (` + urlEnv + `)
+  -token string        the token of a paired device or the admin token (` + tokenEnv + `)
+  -fingerprint string  the fingerprint of the certificate of the server to pin (` + fingerprintEnv + `)
+  -q                   do not show progress`
+
+// settings is an object that holds the flags every subcommand has
+type settings struct {
+	url         string
+	token       string
+	fingerprint string
+	quiet       bool
+}
+
+// newFlags creates the flag set of a subcommand with the flags every subcommand has
+// @param name string The subcommand
+// @return *flag.FlagSet
+// @return *settings
+func newFlags(name string) (*flag.FlagSet, *settings) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, usage) }
+	s := &settings{}
+	flags.StringVar(&s.url, "url", os.Getenv(urlEnv), "the address of the server")
+	flags.StringVar(&s.token, "token", os.Getenv(tokenEnv), "the token of a paired device or the admin token")
+	flags.StringVar(&s.fingerprint, "fingerprint", os.Getenv(fingerprintEnv), "the fingerprint of the certificate of the server to pin")
+	flags.BoolVar(&s.quiet, "q", false, "do not show progress")
+	return flags, s
+}
+
+// client creates the client the settings are for
+// @return *client.Client
+func (s *settings) client() *client.Client {
+	if s.url == "" {
+		fatal(fmt.Errorf("error: the address of the server is not set, use -url or %s", urlEnv))
+	}
+	c, err := client.New(client.Options{URL: s.url, Token: s.token, Fingerprint: s.fingerprint})
+	if err != nil {
+		fatal(err)
+	}
+	return c
+}
+
+// fatal prints an error and exits
+// @param err error
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// ls prints the folders of the server with how many files are in each, or the files in a folder.
+// @param ctx context.Context
+// @param args []string The arguments after the subcommand
+func ls(ctx context.Context, args []string) {
+	flags, s := newFlags("ls")
+	long := flags.Bool("l", false, "also print the upload time, content type and attributes of the files")
+	flags.Parse(args)
+	c := s.client()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	if flags.NArg() == 0 {
+		folders, err := c.Folders(ctx)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Fprintln(w, "FOLDER\tFILES")
+		for _, folder := range folders {
+			fmt.Fprintf(w, "%s\t%d\n", folder.Name, folder.Count)
+		}
+		return
+	}
+	for _, folder := range flags.Args() {
+		files, err := c.Files(ctx, folder)
+		if err != nil {
+			fatal(err)
+		}
+		if flags.NArg() > 1 {
+			fmt.Fprintf(w, "%s:\n", folder)
+		}
+		if *long {
+			fmt.Fprintln(w, "HASH\tSIZE\tNAME\tUPLOADED\tTYPE\tATTRIBUTES")
+		} else {
+			fmt.Fprintln(w, "HASH\tSIZE\tNAME")
+		}
+		for _, file := range files {
+			size := formatSize(file.Size)
+			if !file.Complete {
+				size += " (uploading)"
+			}
+			if *long {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", file.Hash, size, file.Attributes["Name"], file.Uploaded, file.ContentType, formatAttributes(file.Attributes))
+			} else {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", file.Hash, size, file.Attributes["Name"])
+			}
+		}
+	}
+}
+
+// formatAttributes returns the attributes of a file other than its name as key=value pairs in key order
+// @param attrs map[string]string
+// @return string
+func formatAttributes(attrs map[string]string) string {
+	pairs := make([]string, 0, len(attrs))
+	for k, v := range attrs {
+		if k != "Name" {
+			pairs = append(pairs, k+"="+v)
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// verify checks that the server has a whole copy of every local file given that matches its hash,
+// in the folder given or in any folder, and exits with an error when one does not.
+// @param ctx context.Context
+// @param args []string The arguments after the subcommand
+func verify(ctx context.Context, args []string) {
+	flags, s := newFlags("verify")
+	folder := flags.String("folder", "", "the folder the files should be in, any folder when empty")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	c := s.client()
+	paths, err := walkFiles(flags.Args())
+	if err != nil {
+		fatal(err)
+	}
+	hashes := make([]string, len(paths))
+	for i, path := range paths {
+		hash, err := client.HashFile(path)
+		if err != nil {
+			fatal(err)
+		}
+		hashes[i] = hex.EncodeToString(hash)
+	}
+	// without a folder the files are looked for in every folder
+	var found map[string][]string
+	if *folder == "" {
+		found, err = findFolders(ctx, c, hashes)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	failed := 0
+	for i, path := range paths {
+		ok := true
+		folders := []string{*folder}
+		if *folder == "" {
+			folders = found[hashes[i]]
+		}
+		if len(folders) == 0 {
+			fmt.Fprintf(w, "missing\t%s\t%s\n", path, hashes[i])
+			failed++
+			continue
+		}
+		// a file in more than one folder has to verify in each of them
+		for _, f := range folders {
+			err := c.Validate(ctx, f, hashes[i])
+			switch client.ErrorCode(err) {
+			case "":
+				if err != nil {
+					w.Flush()
+					fatal(err)
+				}
+				fmt.Fprintf(w, "ok\t%s\t%s\n", path, f)
+				continue
+			case server.CodeNotFound:
+				fmt.Fprintf(w, "missing\t%s\t%s\n", path, f)
+			case server.CodeUploadInProgress:
+				fmt.Fprintf(w, "incomplete\t%s\t%s\n", path, f)
+			case server.CodeHashMismatch:
+				fmt.Fprintf(w, "mismatch\t%s\t%s\n", path, f)
+			default:
+				w.Flush()
+				fatal(err)
+			}
+			ok = false
+		}
+		if !ok {
+			failed++
+		}
+	}
+	w.Flush()
+	if failed > 0 {
+		fatal(fmt.Errorf("error: %d of %d files did not verify", failed, len(paths)))
+	}
+}
+
+// walkFiles returns the files given along with the files in the folders given, however deep,
+// leaving out hidden files and folders and downloads that are not finished
+// @param paths []string
+// @return []string
+// @return error
+func walkFiles(paths []string) ([]string, error) {
+	files := make([]string, 0, len(paths))
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// the files and folders given are used as they are
+			skip := path != root && (strings.HasPrefix(d.Name(), ".") || strings.HasSuffix(d.Name(), ".part"))
+			switch {
+			case d.IsDir() && skip:
+				return filepath.SkipDir
+			case d.IsDir(), skip, path != root && !d.Type().IsRegular():
+				return nil
+			}
+			files = append(files, path)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// findFiles looks for files with hashes in every folder of the server
+// @param ctx context.Context
+// @param c *client.Client
+// @param hashes []string Hex encoded hashes
+// @return map[string][]server.FileMetadata The files with each hash, in the order the server keeps them
+// @return error
+func findFiles(ctx context.Context, c *client.Client, hashes []string) (map[string][]server.FileMetadata, error) {
+	found := make(map[string][]server.FileMetadata, len(hashes))
+	for _, hash := range hashes {
+		found[strings.ToLower(hash)] = nil
+	}
+	for start := 0; ; {
+		results, err := c.Search(ctx, server.SearchRequest{StartIndex: start, EndIndex: start + searchPageSize})
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range results.Files {
+			if files, ok := found[file.Hash]; ok {
+				found[file.Hash] = append(files, file)
+			}
+		}
+		start += len(results.Files)
+		if len(results.Files) == 0 || start >= results.Total {
+			return found, nil
+		}
+	}
+}
+
+// findFolders looks for the folders of the server that have files with hashes
+// @param ctx context.Context
+// @param c *client.Client
+// @param hashes []string Hex encoded hashes
+// @return map[string][]string The folders with each hash
+// @return error
+func findFolders(ctx context.Context, c *client.Client, hashes []string) (map[string][]string, error) {
+	found, err := findFiles(ctx, c, hashes)
+	if err != nil {
+		return nil, err
+	}
+	folders := make(map[string][]string, len(found))
+	for hash, files := range found {
+		for _, file := range files {
+			folders[hash] = append(folders[hash], file.Folder)
+		}
+	}
+	return folders, nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	// an interrupted push or pull is carried on from where it stopped the next time
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	switch os.Args[1] {
+	case "push":
+		push(ctx, os.Args[2:])
+	case "pull":
+		pull(ctx, os.Args[2:])
+	case "ls":
+		ls(ctx, os.Args[2:])
+	case "verify":
+		verify(ctx, os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Println(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "error: unknown command %q\n%s\n", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		os.Exit(130)
+	}
+}
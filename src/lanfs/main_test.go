@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"server"
+	"storage"
+	"strings"
+	"testing"
+)
+
+// mainEnv is set when the test binary is run to be the lanfs command instead of running the tests
+const mainEnv = "LANFS_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(mainEnv) != "" {
+		os.Args = append([]string{"lanfs"}, strings.Fields(os.Getenv(mainEnv))...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// startTestServer starts a server with its files kept in memory and returns its URL
+func startTestServer(t *testing.T) string {
+	t.Helper()
+	logger, err := server.NewLogger(io.Discard, "error", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.New(server.Options{Storage: storage.NewMemory(), Logger: logger, DisableAuth: true, DisableThumbnails: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+// run runs the lanfs command with arguments, which can not have spaces in them, against a server
+// @return string What it printed to stdout
+// @return string What it printed to stderr
+// @return int The exit code
+func run(t *testing.T, url string, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), mainEnv+"="+strings.Join(args, " "), urlEnv+"="+url)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+}
+
+// writeFile writes a file and the folders it is in
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err == nil {
+		err = os.WriteFile(path, []byte(data), 0666)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushLsVerifyPull(t *testing.T) {
+	url := startTestServer(t)
+	dir := t.TempDir()
+	local := filepath.Join(dir, "local")
+	writeFile(t, filepath.Join(local, "a.txt"), "first file")
+	writeFile(t, filepath.Join(local, "sub", "b.txt"), "second file")
+	// hidden files and downloads that are not finished are left out
+	writeFile(t, filepath.Join(local, ".hidden"), "hidden")
+	writeFile(t, filepath.Join(local, "c.txt.part"), "part")
+	out, errOut, code := run(t, url, "push", "-q", "-folder", "photos", local)
+	if code != 0 || strings.Count(out, "\n") != 2 || !strings.Contains(out, "photos/") {
+		t.Fatalf("push gave %d, %q, %q", code, out, errOut)
+	}
+	if out, _, code = run(t, url, "push", "-q", "-folder", "photos", local); code != 0 || strings.Count(out, "already uploaded") != 2 {
+		t.Errorf("second push gave %d, %q", code, out)
+	}
+	if out, _, code = run(t, url, "ls"); code != 0 || !strings.Contains(out, "photos") || !strings.Contains(out, "2") {
+		t.Errorf("ls gave %d, %q", code, out)
+	}
+	if out, _, code = run(t, url, "ls", "-l", "photos"); code != 0 || !strings.Contains(out, "a.txt") || !strings.Contains(out, "b.txt") || !strings.Contains(out, "text/plain") {
+		t.Errorf("ls -l gave %d, %q", code, out)
+	}
+	if out, _, code = run(t, url, "verify", local); code != 0 || strings.Count(out, "ok") != 2 {
+		t.Errorf("verify gave %d, %q", code, out)
+	}
+	// a local file that changed is not on the server
+	writeFile(t, filepath.Join(local, "a.txt"), "first file, changed")
+	if out, errOut, code = run(t, url, "verify", "-folder", "photos", local); code != 1 || !strings.Contains(out, "missing") || !strings.Contains(errOut, "1 of 2") {
+		t.Errorf("verify of a changed file gave %d, %q, %q", code, out, errOut)
+	}
+	pulled := filepath.Join(dir, "pulled")
+	if out, errOut, code = run(t, url, "pull", "-q", "-o", pulled, "photos"); code != 0 {
+		t.Fatalf("pull gave %d, %q, %q", code, out, errOut)
+	}
+	for name, want := range map[string]string{"a.txt": "first file", "b.txt": "second file"} {
+		if data, err := os.ReadFile(filepath.Join(pulled, "photos", name)); err != nil || string(data) != want {
+			t.Errorf("pulled %s is %q, %v", name, data, err)
+		}
+	}
+	if out, _, code = run(t, url, "pull", "-q", "-o", pulled, "photos"); code != 0 || strings.Count(out, "already downloaded") != 2 {
+		t.Errorf("second pull gave %d, %q", code, out)
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	dir := t.TempDir()
+	hash := strings.Repeat("ab", 32)
+	used := make(map[string]bool)
+	path, done, err := localPath(dir, server.FileMetadata{Hash: hash, Attributes: map[string]string{"Name": "../a.txt"}}, used)
+	if err != nil || done || path != filepath.Join(dir, "a.txt") {
+		t.Errorf("first file gave %q, %t, %v", path, done, err)
+	}
+	// another file with the same name gets the start of its hash in front of it
+	other := strings.Repeat("cd", 32)
+	path, _, err = localPath(dir, server.FileMetadata{Hash: other, Attributes: map[string]string{"Name": "a.txt"}}, used)
+	if err != nil || path != filepath.Join(dir, other[:12]+"-a.txt") {
+		t.Errorf("second file gave %q, %v", path, err)
+	}
+	// a server that sends back a short hash is an error instead of a panic
+	if _, _, err = localPath(dir, server.FileMetadata{Hash: "abc", Attributes: map[string]string{"Name": "b.txt"}}, used); err == nil {
+		t.Error("a short hash gave a path")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+// transfer file to hold the push and pull subcommands and the progress bar they show
+
+import (
+	"bytes"
+	"client"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"server"
+	"strings"
+	"time"
+)
+
+// progressWidth is how many characters wide the bar of the progress bar is
+const progressWidth = 30
+
+// progressInterval is the least time between redraws of the progress bar, so small chunks do not flood the terminal
+const progressInterval = 100 * time.Millisecond
+
+// attrFlag is a flag that can be given more than once to set attributes as key=value
+type attrFlag map[string]string
+
+// String returns the attributes as key=value pairs
+func (a attrFlag) String() string {
+	return formatAttributes(a)
+}
+
+// Set adds a key=value attribute
+func (a attrFlag) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("error: attribute %q is not key=value", value)
+	}
+	a[k] = v
+	return nil
+}
+
+// push uploads the files given, and the files in the folders given, into the folder given or the folder
+// the folder layout of the server gives, carrying on uploads the server already started.
+// @param ctx context.Context
+// @param args []string The arguments after the subcommand
+func push(ctx context.Context, args []string) {
+	flags, s := newFlags("push")
+	folder := flags.String("folder", "", "the folder to upload into, the one the folder layout gives when empty")
+	attrs := attrFlag{}
+	flags.Var(attrs, "attr", "an attribute to save with the files as key=value, can be given more than once")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	c := s.client()
+	paths, err := walkFiles(flags.Args())
+	if err != nil {
+		fatal(err)
+	}
+	failed := 0
+	for _, path := range paths {
+		bar := newProgressBar(path, s.quiet)
+		uploaded, err := c.UploadWithOptions(ctx, path, attrs, client.UploadOptions{Folder: *folder, Progress: bar.update})
+		bar.finish()
+		switch {
+		case ctx.Err() != nil:
+			fatal(fmt.Errorf("error: stopped, push again to carry on; %s", err))
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			failed++
+		case uploaded.Resumed == uploaded.Size:
+			fmt.Printf("%s\t%s/%s\talready uploaded\n", path, uploaded.Folder, uploaded.Hash)
+		case uploaded.Resumed > 0:
+			fmt.Printf("%s\t%s/%s\tresumed from %s\n", path, uploaded.Folder, uploaded.Hash, formatSize(uploaded.Resumed))
+		default:
+			fmt.Printf("%s\t%s/%s\n", path, uploaded.Folder, uploaded.Hash)
+		}
+	}
+	if failed > 0 {
+		fatal(fmt.Errorf("error: %d of %d files could not be uploaded", failed, len(paths)))
+	}
+}
+
+// pull downloads every file of the folders given, and the files with the hashes given, into a path.
+// The files of a folder go into a folder of the same name, and are named by their "Name" attribute.
+// Files that are already there are skipped, and downloads that were stopped carry on from where they ended.
+// @param ctx context.Context
+// @param args []string The arguments after the subcommand
+func pull(ctx context.Context, args []string) {
+	flags, s := newFlags("pull")
+	out := flags.String("o", ".", "the path to download into")
+	folder := flags.String("folder", "", "the folder to look for the hashes in, every folder when empty")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	c := s.client()
+	type download struct {
+		file server.FileMetadata
+		dir  string
+	}
+	downloads := make([]download, 0)
+	hashes := make([]string, 0)
+	for _, arg := range flags.Args() {
+		if !isHash(arg) {
+			files, err := c.Files(ctx, arg)
+			if err != nil {
+				fatal(err)
+			}
+			for _, file := range files {
+				downloads = append(downloads, download{file, filepath.Join(*out, arg)})
+			}
+			continue
+		}
+		hashes = append(hashes, strings.ToLower(arg))
+	}
+	if len(hashes) > 0 {
+		found := make(map[string][]server.FileMetadata)
+		if *folder != "" {
+			files, err := c.Files(ctx, *folder)
+			if err != nil {
+				fatal(err)
+			}
+			for _, file := range files {
+				found[file.Hash] = append(found[file.Hash], file)
+			}
+		} else {
+			var err error
+			found, err = findFiles(ctx, c, hashes)
+			if err != nil {
+				fatal(err)
+			}
+		}
+		for _, hash := range hashes {
+			if len(found[hash]) == 0 {
+				fatal(fmt.Errorf("error: no file %s on the server", hash))
+			}
+			// a file in more than one folder is the same data, so one copy is enough
+			downloads = append(downloads, download{found[hash][0], *out})
+		}
+	}
+	failed := 0
+	used := make(map[string]bool)
+	for _, d := range downloads {
+		if !d.file.Complete {
+			fmt.Fprintf(os.Stderr, "%s/%s: skipped, it is still being uploaded\n", d.file.Folder, d.file.Hash)
+			failed++
+			continue
+		}
+		path, done, err := localPath(d.dir, d.file, used)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s/%s: %s\n", d.file.Folder, d.file.Hash, err)
+			failed++
+			continue
+		}
+		if done {
+			fmt.Printf("%s\t%s/%s\talready downloaded\n", path, d.file.Folder, d.file.Hash)
+			continue
+		}
+		bar := newProgressBar(path, s.quiet)
+		_, err = c.DownloadFile(ctx, d.file.Folder, d.file.Hash, path, bar.update)
+		bar.finish()
+		switch {
+		case ctx.Err() != nil:
+			fatal(fmt.Errorf("error: stopped, pull again to carry on; %s", err))
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "%s/%s: %s\n", d.file.Folder, d.file.Hash, err)
+			failed++
+		default:
+			fmt.Printf("%s\t%s/%s\n", path, d.file.Folder, d.file.Hash)
+		}
+	}
+	if failed > 0 {
+		fatal(fmt.Errorf("error: %d of %d files could not be downloaded", failed, len(downloads)))
+	}
+}
+
+// isHash returns whether an argument is a hex encoded sha256 hash rather than a folder
+// @param arg string
+// @return bool
+func isHash(arg string) bool {
+	b, err := hex.DecodeString(arg)
+	return err == nil && len(b) == 32
+}
+
+// localPath returns the path a file is downloaded to in a folder, named by its "Name" attribute or by its hash when
+// it has none. A name that is used by another file gets the start of the hash in front of it.
+// @param dir string
+// @param file server.FileMetadata
+// @param used map[string]bool The paths given so far
+// @return string The path
+// @return bool Whether the file is already there
+// @return error
+func localPath(dir string, file server.FileMetadata, used map[string]bool) (string, bool, error) {
+	if !isHash(file.Hash) {
+		return "", false, fmt.Errorf("error: the server sent back %q, which is not a hex encoded sha256 hash", file.Hash)
+	}
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return "", false, err
+	}
+	hash, _ := hex.DecodeString(file.Hash)
+	name := filepath.Base(filepath.FromSlash(file.Attributes["Name"]))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		name = file.Hash
+	}
+	for _, candidate := range []string{name, file.Hash[:12] + "-" + name} {
+		path := filepath.Join(dir, candidate)
+		if used[path] {
+			continue
+		}
+		localHash, err := client.HashFile(path)
+		if os.IsNotExist(err) {
+			used[path] = true
+			return path, false, nil
+		}
+		if err == nil && bytes.Equal(localHash, hash) {
+			used[path] = true
+			return path, true, nil
+		}
+	}
+	return "", false, fmt.Errorf("error: %s is already there and is another file", filepath.Join(dir, name))
+}
+
+// progressBar is an object that draws the progress of a transfer on one line of stderr
+type progressBar struct {
+	name  string
+	quiet bool
+	drawn time.Time
+	last  client.Progress
+}
+
+// newProgressBar is a method to create the progress bar of a file.
+// @param name string The name shown in front of the bar
+// @param quiet bool Whether nothing is drawn
+// @return *progressBar
+func newProgressBar(name string, quiet bool) *progressBar {
+	return &progressBar{name: name, quiet: quiet}
+}
+
+// update is a client.ProgressFunc that redraws the bar, at most once every progressInterval
+func (b *progressBar) update(p client.Progress) {
+	b.last = p
+	if b.quiet || time.Since(b.drawn) < progressInterval {
+		return
+	}
+	b.draw(os.Stderr)
+}
+
+// draw writes the bar over the line it was drawn on before
+// @param w io.Writer
+func (b *progressBar) draw(w io.Writer) {
+	b.drawn = time.Now()
+	p := b.last
+	// the size of a download is not known until the server answers
+	percent, size := 0, "?"
+	switch {
+	case p.Size > 0:
+		percent, size = int(p.Done*100/p.Size), formatSize(p.Size)
+	case p.Size == 0:
+		percent, size = 100, formatSize(0)
+	}
+	filled := percent * progressWidth / 100
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressWidth-filled)
+	name := b.name
+	if len(name) > 30 {
+		name = "..." + name[len(name)-27:]
+	}
+	fmt.Fprintf(w, "\r%-30s [%s] %3d%% %s/%s  ", name, bar, percent, formatSize(p.Done), size)
+}
+
+// finish draws the bar as it ended and moves to the next line, when it was drawn at all
+func (b *progressBar) finish() {
+	if b.quiet || b.drawn.IsZero() {
+		return
+	}
+	b.draw(os.Stderr)
+	fmt.Fprintln(os.Stderr)
+}
+
+// formatSize returns a size in bytes in the largest unit it is at least one of, like "4.2MB"
+// @param size int64
+// @return string
+func formatSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%dB", size)
+	}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < 4 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%s", value, []string{"B", "KB", "MB", "GB", "TB"}[unit])
+}
@@ -0,0 +1,108 @@
+package server
+
+// advertise file to hold the logic that advertises the server on the LAN so clients can find it without an address
+
+import (
+	"discovery"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Version is the version of the server, advertised to clients. It can be set when building with
+// -ldflags "-X server.Version=...".
+var Version = "1.0.0"
+
+// advertisement returns what the server advertises itself with
+// @return discovery.Announcement
+func (s *Server) advertisement() discovery.Announcement {
+	hostname, _ := os.Hostname()
+	host, _, _ := strings.Cut(hostname, ".")
+	if host == "" {
+		host = "lanfiles"
+	}
+	a := discovery.Announcement{
+		Name:    "LAN File Server on " + host,
+		Host:    host,
+		Version: Version,
+		Scheme:  "http",
+		Path:    s.prefix + "/",
+	}
+	if addr, ok := s.Addr().(*net.TCPAddr); ok {
+		a.Port = addr.Port
+	}
+	if addr, ok := s.HTTPAddr().(*net.TCPAddr); ok {
+		a.HTTPPort = addr.Port
+	}
+	if s.opts.TLS {
+		a.Scheme = "https"
+		a.Fingerprint, _ = s.Fingerprint()
+	}
+	return a
+}
+
+// startDiscovery starts the mDNS and UDP broadcast responders that are turned on
+// @return error
+func (s *Server) startDiscovery() error {
+	a := s.advertisement()
+	if s.opts.MDNSAddress != "" {
+		txt := map[string]string{"txtvers": "1", "version": a.Version, "path": a.Path, "scheme": a.Scheme}
+		if a.Fingerprint != "" {
+			txt["fingerprint"] = a.Fingerprint
+		}
+		if a.HTTPPort != 0 {
+			txt["http_port"] = strconv.Itoa(a.HTTPPort)
+		}
+		service := discovery.Service{Instance: a.Name, Host: a.Host, Port: a.Port, IPs: advertisedAddresses(s.opts.MDNSAddress), TXT: txt}
+		responder, err := discovery.NewMDNSResponder(s.opts.MDNSAddress, service, s.log.LogWarnf)
+		if err != nil {
+			return err
+		}
+		s.log.Logf("advertising %s as %s on mdns %s", a.Name, discovery.ServiceType, responder.Addr())
+		s.mdns = responder
+	}
+	if s.opts.DiscoveryAddress != "" {
+		responder, err := discovery.NewBroadcastResponder(s.opts.DiscoveryAddress, a, s.log.LogWarnf)
+		if err != nil {
+			s.stopDiscovery()
+			return err
+		}
+		s.log.Logf("answering discovery broadcasts on %s", responder.Addr())
+		s.broadcast = responder
+	}
+	return nil
+}
+
+// stopDiscovery stops the responders that were started
+func (s *Server) stopDiscovery() {
+	if s.mdns != nil {
+		s.mdns.Close()
+		s.mdns = nil
+	}
+	if s.broadcast != nil {
+		s.broadcast.Close()
+		s.broadcast = nil
+	}
+}
+
+// advertisedAddresses returns the addresses of this machine given out in mDNS answers. When the responder
+// listens on a loopback address for testing that address is given, otherwise every address but loopback ones.
+// @param mdnsAddress string The address the mDNS responder listens on
+// @return []net.IP
+func advertisedAddresses(mdnsAddress string) []net.IP {
+	if addr, err := net.ResolveUDPAddr("udp", mdnsAddress); err == nil && addr.IP.IsLoopback() {
+		return []net.IP{addr.IP}
+	}
+	ips := make([]net.IP, 0)
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	if len(ips) == 0 {
+		ips = append(ips, net.IPv4(127, 0, 0, 1))
+	}
+	return ips
+}
@@ -0,0 +1,241 @@
+package server
+
+// archive file to hold the logic for streaming ZIP downloads of folders and selections of files
+
+import (
+	"archive/zip"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sfile"
+	"strings"
+	"time"
+)
+
+// FileNameAttributes are the header attributes a file's name is taken from, in order of preference.
+var FileNameAttributes = []string{"Name", "FileName", "Filename", "name", "filename", "fileName"}
+
+// mimeExtensions maps content types to the extension given to files that do not have a name attribute
+var mimeExtensions = map[string]string{
+	"image/jpeg":            ".jpg",
+	"image/png":             ".png",
+	"image/gif":             ".gif",
+	"image/webp":            ".webp",
+	"image/bmp":             ".bmp",
+	"image/tiff":            ".tif",
+	"image/heic":            ".heic",
+	"image/heif":            ".heif",
+	"image/avif":            ".avif",
+	"image/x-canon-cr2":     ".cr2",
+	"image/x-canon-cr3":     ".cr3",
+	"image/x-nikon-nef":     ".nef",
+	"image/x-sony-arw":      ".arw",
+	"image/x-adobe-dng":     ".dng",
+	"image/x-olympus-orf":   ".orf",
+	"image/x-panasonic-rw2": ".rw2",
+	"image/x-fuji-raf":      ".raf",
+	"image/x-pentax-pef":    ".pef",
+	"video/mp4":             ".mp4",
+	"video/quicktime":       ".mov",
+	"video/3gpp":            ".3gp",
+	"video/3gpp2":           ".3g2",
+	"video/webm":            ".webm",
+	"video/avi":             ".avi",
+	"audio/mp4":             ".m4a",
+	"audio/mpeg":            ".mp3",
+	"audio/wave":            ".wav",
+	"application/pdf":       ".pdf",
+	"application/zip":       ".zip",
+	"text/plain":            ".txt",
+}
+
+// storedPrefixes are the content types that are already compressed and are stored in archives as is
+var storedPrefixes = []string{"image/", "video/", "audio/", "application/zip", "application/x-gzip", "application/pdf"}
+
+// fileDisplayName returns the name a file should be saved as, taken from its name attribute
+// or made from its hash and content type when it does not have one.
+// @param file FileMetadata
+// @return string
+func fileDisplayName(file FileMetadata) string {
+	for _, key := range FileNameAttributes {
+		// only keep the last part of a path so names can not point outside of the archive
+		name := path.Base(filepath.ToSlash(strings.Replace(file.Attributes[key], "\\", "/", -1)))
+		if name != "" && name != "." && name != ".." && name != "/" {
+			return name
+		}
+	}
+	mediaType := strings.TrimSpace(strings.SplitN(file.ContentType, ";", 2)[0])
+	return file.Hash + mimeExtensions[mediaType]
+}
+
+// fileTime returns the capture time of a file, or the time it was uploaded if it does not have one
+// @param file FileMetadata
+// @return time.Time
+func fileTime(file FileMetadata) time.Time {
+	if captured, ok := parseCaptureTime(file.Attributes[CaptureTimeAttribute]); ok {
+		return captured
+	}
+	uploaded, err := time.Parse(time.RFC3339, file.Uploaded)
+	if err != nil {
+		return time.Now()
+	}
+	return uploaded
+}
+
+// isCompressedType checks if files of the content type are already compressed
+// @param contentType string
+// @return bool
+func isCompressedType(contentType string) bool {
+	for _, prefix := range storedPrefixes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueName returns name, or name with a number added before its extension if it has already been used
+// @param name string
+// @param used map[string]bool The names already used, name is added to it
+// @return string
+func uniqueName(name string, used map[string]bool) string {
+	unique := name
+	ext := path.Ext(name)
+	for i := 2; used[strings.ToLower(unique)]; i++ {
+		unique = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	used[strings.ToLower(unique)] = true
+	return unique
+}
+
+// writeZip streams the files given into a ZIP archive written to w.
+// Media files are stored as they are, other files are deflated.
+// @param w io.Writer
+// @param files []FileMetadata
+// @param withFolders bool If the entries should be put in a directory named after their folder
+// @return error
+func (s *Server) writeZip(w io.Writer, files []FileMetadata, withFolders bool) error {
+	zipWriter := zip.NewWriter(w)
+	used := make(map[string]bool)
+	for _, file := range files {
+		name := fileDisplayName(file)
+		if withFolders {
+			name = file.Folder + "/" + name
+		}
+		header := &zip.FileHeader{Name: uniqueName(name, used), Method: zip.Deflate, Modified: fileTime(file)}
+		if isCompressedType(file.ContentType) {
+			header.Method = zip.Store
+		}
+		err := s.writeZipEntry(zipWriter, header, file)
+		if err != nil {
+			return err
+		}
+	}
+	return zipWriter.Close()
+}
+
+// writeZipEntry copies the data of a single SAVE file into the archive
+// @param zipWriter *zip.Writer
+// @param header *zip.FileHeader
+// @param file FileMetadata
+// @return error
+func (s *Server) writeZipEntry(zipWriter *zip.Writer, header *zip.FileHeader, file FileMetadata) error {
+	hash, err := hex.DecodeString(file.Hash)
+	if err != nil {
+		return err
+	}
+	reader, err := sfile.OpenSaveFile(s.store, saveFileName(file.Folder, hash), nil)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	entry, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, reader)
+	return err
+}
+
+// zipFilesForRequest finds the complete files a ZipRequest asks for
+// @param data ZipRequest
+// @return []FileMetadata
+// @return error
+func (s *Server) zipFilesForRequest(data ZipRequest) ([]FileMetadata, error) {
+	files := make([]FileMetadata, 0)
+	if len(data.Hashes) == 0 {
+		folderFiles, ok := s.index.files(data.Folder)
+		if !ok {
+			return nil, newAPIError(http.StatusNotFound, CodeNotFound, "error: folder %s does not exist", data.Folder)
+		}
+		for _, file := range folderFiles {
+			if file.Complete {
+				files = append(files, file)
+			}
+		}
+		return files, nil
+	}
+	for _, hashParam := range data.Hashes {
+		hash, err := decodeHashParam(hashParam)
+		if err != nil {
+			return nil, err
+		}
+		var file FileMetadata
+		var ok bool
+		if data.Folder != "" {
+			file, ok = s.index.file(data.Folder, hex.EncodeToString(hash))
+		} else {
+			file, ok = s.index.findFile(hex.EncodeToString(hash))
+		}
+		if !ok || !file.Complete {
+			return nil, newAPIError(http.StatusNotFound, CodeNotFound, "error: no complete file matches hash %s", hashParam)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// DownloadZip is a method that streams a ZIP archive of files back to the client.
+// A GET request with a Folder parameter downloads the whole folder.
+// A POST request takes a ZipRequest to download a list of files.
+func (s *Server) DownloadZip(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "DownloadZip")
+	w = s.streaming(w)
+	var data ZipRequest
+	if req.Method == http.MethodPost {
+		decoder := json.NewDecoder(req.Body)
+		err := decoder.Decode(&data)
+		defer req.Body.Close()
+		if err != nil {
+			s.writeError(w, req, newAPIError(http.StatusBadRequest, CodeBadRequest, "error: could not parse zip request; %s", err))
+			return
+		}
+	} else {
+		data.Folder = req.URL.Query().Get("Folder")
+	}
+	files, err := s.zipFilesForRequest(data)
+	if err != nil {
+		s.writeError(w, req, err)
+		return
+	}
+	archiveName := "files.zip"
+	withFolders := false
+	if len(data.Hashes) == 0 {
+		archiveName = data.Folder + ".zip"
+	} else {
+		for _, file := range files {
+			withFolders = withFolders || file.Folder != files[0].Folder
+		}
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", archiveName))
+	err = s.writeZip(w, files, withFolders)
+	if err != nil {
+		// the response has already started so all that can be done is to stop writing the archive
+		s.log.LogWarnf("zip download stopped; %s", err)
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// readZip reads the entries of a ZIP archive
+// @return map[string]string The data of each entry by its name
+// @return map[string]uint16 The method of each entry by its name
+func readZip(t *testing.T, data []byte) (map[string]string, map[string]uint16) {
+	t.Helper()
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]string)
+	methods := make(map[string]uint16)
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[f.Name] = string(b)
+		methods[f.Name] = f.Method
+	}
+	return entries, methods
+}
+
+func TestDownloadZip(t *testing.T) {
+	s := openTestServer(t)
+	png := testPNG(t, 4, 4)
+	uploadTestFile(t, s, "a", []byte("first note"), map[string]string{"Name": "x.txt"})
+	second := uploadTestFile(t, s, "a", []byte("second note"), map[string]string{"Name": "x.txt"})
+	uploadTestFile(t, s, "a", png, map[string]string{"Name": "p.png"})
+	other := uploadTestFile(t, s, "b", []byte("note in b"), map[string]string{"Name": "y.txt"})
+	// a file that is still being uploaded is left out
+	partial := []byte("not all here yet")
+	sum := sha256.Sum256(partial)
+	_, _, err := s.saveFileChunk(FileData{Data: partial[:4], ValidateFile: sum[:], Size: int64(len(partial)), Folder: "a", Attributes: map[string]string{"Name": "partial.txt"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/download_zip?Folder=a", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Disposition") != `attachment; filename="a.zip"` {
+		t.Fatalf("folder zip gave %d with headers %v", w.Code, w.Header())
+	}
+	entries, methods := readZip(t, w.Body.Bytes())
+	// files with the same name get a number, in the order the folder is read in
+	notes := []string{entries["x.txt"], entries["x (2).txt"]}
+	sort.Strings(notes)
+	if len(entries) != 3 || !reflect.DeepEqual(notes, []string{"first note", "second note"}) || entries["p.png"] != string(png) {
+		t.Errorf("folder zip has %v", entries)
+	}
+	// media files are stored without compressing them again
+	if methods["p.png"] != zip.Store || methods["x.txt"] != zip.Deflate {
+		t.Errorf("entries are compressed with %v", methods)
+	}
+	// files from more than one folder are put in a directory of their folder
+	w = postJSON(t, s, "/download_zip", ZipRequest{Hashes: []string{hex.EncodeToString(second), hex.EncodeToString(other)}})
+	entries, _ = readZip(t, w.Body.Bytes())
+	if !reflect.DeepEqual(entries, map[string]string{"a/x.txt": "second note", "b/y.txt": "note in b"}) {
+		t.Errorf("selection zip has %v", entries)
+	}
+	w = postJSON(t, s, "/download_zip", ZipRequest{Hashes: []string{hex.EncodeToString(sum[:])}})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("zip of a file still being uploaded gave %d", w.Code)
+	}
+}
@@ -0,0 +1,534 @@
+package server
+
+// devices file to hold the logic for pairing devices with the server and checking the tokens they are given
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeviceFolder is the name of the folder inside the root path the paired devices are kept in.
+const DeviceFolder = ".devices"
+
+// devicesFileName is the name of the file inside DeviceFolder the devices are kept in
+const devicesFileName = "devices.json"
+
+// the states a device can be in
+const (
+	DevicePending  = "pending"
+	DeviceApproved = "approved"
+	DeviceRevoked  = "revoked"
+)
+
+// maxPendingDevices is how many devices can be waiting for approval at once,
+// so a device on the LAN can not fill the list with requests
+const maxPendingDevices = 20
+
+// maxPendingPerAddress is how many devices from the same address can be waiting for approval at once,
+// so one host can not take every pending slot
+const maxPendingPerAddress = 3
+
+// pendingDeviceTimeout is how long a request to be paired waits for approval before it is dropped
+const pendingDeviceTimeout = 10 * time.Minute
+
+// maxDeviceNameLength is the longest name a device can ask to be paired with
+const maxDeviceNameLength = 64
+
+// tokenCookie is the name of the cookie the web gallery keeps its token in
+const tokenCookie = "lanfiles_token"
+
+// adminDevice is the device requests made with the admin token are made as
+var adminDevice = Device{ID: "admin", Name: "admin", Status: DeviceApproved}
+
+// deviceKey is the key the device a request is made by is kept under in the request context
+type deviceKey struct{}
+
+// deviceStore is an object that holds the devices paired with a root path. They are kept in a JSON file
+// that is read again whenever it changes, so the devices subcommand can approve and revoke devices
+// while the server is running. Without a root path they are only kept in memory.
+type deviceStore struct {
+	// path is the path of the devices file, empty when the devices are only kept in memory
+	path    string
+	mu      sync.Mutex
+	devices []Device
+	modTime time.Time
+	size    int64
+}
+
+// openDeviceStore reads the devices of a root path
+// @param root string The root path, or empty
+// @return *deviceStore
+// @return error
+func openDeviceStore(root string) (*deviceStore, error) {
+	d := &deviceStore{}
+	if root != "" {
+		d.path = filepath.Join(root, DeviceFolder, devicesFileName)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.reload()
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// reload reads the devices file again if it changed since it was last read. The store must be locked.
+// @return error
+func (d *deviceStore) reload() error {
+	if d.path == "" {
+		return nil
+	}
+	info, err := os.Stat(d.path)
+	if os.IsNotExist(err) {
+		d.devices = nil
+		d.modTime = time.Time{}
+		d.size = 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(d.modTime) && info.Size() == d.size {
+		return nil
+	}
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return err
+	}
+	var devices []Device
+	err = json.Unmarshal(data, &devices)
+	if err != nil {
+		return fmt.Errorf("error: could not read devices file %s; %s", d.path, err)
+	}
+	d.devices = devices
+	d.modTime = info.ModTime()
+	d.size = info.Size()
+	return nil
+}
+
+// save writes the devices file, replacing the old one in a single rename. The store must be locked.
+// @return error
+func (d *deviceStore) save() error {
+	if d.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(d.devices, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(d.path), 0700)
+	if err != nil {
+		return err
+	}
+	tmpPath := d.path + ".tmp"
+	err = os.WriteFile(tmpPath, append(data, '\n'), 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, d.path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return err
+	}
+	d.modTime = info.ModTime()
+	d.size = info.Size()
+	return nil
+}
+
+// update reads the devices again, runs a change on them and saves them
+// @param change func(devices []Device) ([]Device, error)
+// @return error
+func (d *deviceStore) update(change func(devices []Device) ([]Device, error)) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.reload()
+	if err != nil {
+		return err
+	}
+	devices, err := change(append([]Device(nil), d.devices...))
+	if err != nil {
+		return err
+	}
+	d.devices = devices
+	return d.save()
+}
+
+// list returns every device
+// @return []Device
+// @return error
+func (d *deviceStore) list() ([]Device, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.reload()
+	if err != nil {
+		return nil, err
+	}
+	return append([]Device(nil), d.devices...), nil
+}
+
+// byToken finds the device a token was given to
+// @param token string
+// @return Device
+// @return bool
+// @return error
+func (d *deviceStore) byToken(token string) (Device, bool, error) {
+	devices, err := d.list()
+	if err != nil {
+		return Device{}, false, err
+	}
+	sum := sha256.Sum256([]byte(token))
+	tokenHash := []byte(hex.EncodeToString(sum[:]))
+	for _, device := range devices {
+		if subtle.ConstantTimeCompare(tokenHash, []byte(device.TokenHash)) == 1 {
+			return device, true, nil
+		}
+	}
+	return Device{}, false, nil
+}
+
+// setStatus changes the status of a device
+// @param id string
+// @param status string
+// @param now time.Time
+// @return Device The device after the change
+// @return error
+func (d *deviceStore) setStatus(id, status string, now time.Time) (Device, error) {
+	var changed Device
+	err := d.update(func(devices []Device) ([]Device, error) {
+		for i := range devices {
+			if devices[i].ID != id {
+				continue
+			}
+			if devices[i].Status == DeviceRevoked {
+				return nil, newAPIError(http.StatusConflict, CodeRevoked, "error: device %s is revoked and has to pair again", id)
+			}
+			if status == DeviceApproved && pendingExpired(devices[i], now) {
+				return nil, newAPIError(http.StatusNotFound, CodeNotFound, "error: the request of device %s has expired, it has to pair again", id)
+			}
+			devices[i].Status = status
+			if status == DeviceApproved {
+				devices[i].Approved = now.UTC().Format(time.RFC3339)
+			}
+			changed = devices[i]
+			return devices, nil
+		}
+		return nil, newAPIError(http.StatusNotFound, CodeNotFound, "error: no device with the id %s", id)
+	})
+	return changed, err
+}
+
+// openDevices returns the device store of the server, reading it the first time
+// @return *deviceStore
+// @return error
+func (s *Server) openDevices() (*deviceStore, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.devices != nil {
+		return s.devices, nil
+	}
+	devices, err := openDeviceStore(s.root)
+	if err != nil {
+		return nil, err
+	}
+	s.devices = devices
+	return devices, nil
+}
+
+// Devices is a method to get every device that asked to be paired with the server.
+// @return []Device
+// @return error
+func (s *Server) Devices() ([]Device, error) {
+	devices, err := s.openDevices()
+	if err != nil {
+		return nil, err
+	}
+	return devices.list()
+}
+
+// ApproveDevice is a method to give a device that asked to be paired access to the server.
+// @param id string The ID of the device
+// @return error
+func (s *Server) ApproveDevice(id string) error {
+	devices, err := s.openDevices()
+	if err != nil {
+		return err
+	}
+	device, err := devices.setStatus(id, DeviceApproved, s.now())
+	if err != nil {
+		return err
+	}
+	s.log.Logf("approved device %s (%s)", device.ID, device.Name)
+	return nil
+}
+
+// RevokeDevice is a method to take access away from a device, or turn down its request to be paired.
+// Its token stops working straight away and it has to pair again.
+// @param id string The ID of the device
+// @return error
+func (s *Server) RevokeDevice(id string) error {
+	devices, err := s.openDevices()
+	if err != nil {
+		return err
+	}
+	device, err := devices.setStatus(id, DeviceRevoked, s.now())
+	if err != nil {
+		return err
+	}
+	s.log.Logf("revoked device %s (%s)", device.ID, device.Name)
+	return nil
+}
+
+// requestPairing adds a device that asks to be paired, waiting for the operator to approve it
+// @param name string The name the device gave
+// @param address string The address the request came from
+// @return Device
+// @return string The token of the device
+// @return error
+func (s *Server) requestPairing(name, address string) (Device, string, error) {
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if name == "" || len(name) > maxDeviceNameLength {
+		return Device{}, "", newAPIError(http.StatusBadRequest, CodeBadRequest, "error: device name must be between 1 and %d characters", maxDeviceNameLength)
+	}
+	devices, err := s.openDevices()
+	if err != nil {
+		return Device{}, "", err
+	}
+	token, err := randomText(32)
+	if err != nil {
+		return Device{}, "", err
+	}
+	sum := sha256.Sum256([]byte(token))
+	device := Device{
+		Name:      name,
+		Status:    DevicePending,
+		Code:      fmt.Sprintf("%06d", binary.BigEndian.Uint32(sum[:4])%1000000),
+		Address:   address,
+		Requested: s.now().UTC().Format(time.RFC3339),
+		TokenHash: hex.EncodeToString(sum[:]),
+	}
+	host := addressHost(address)
+	now := s.now()
+	err = devices.update(func(list []Device) ([]Device, error) {
+		pending, fromHost := 0, 0
+		ids := make(map[string]bool)
+		kept := list[:0]
+		for _, d := range list {
+			// requests that were never approved are dropped so they do not hold a pending slot forever
+			if pendingExpired(d, now) {
+				continue
+			}
+			kept = append(kept, d)
+			ids[d.ID] = true
+			if d.Status == DevicePending {
+				pending++
+				if addressHost(d.Address) == host {
+					fromHost++
+				}
+			}
+		}
+		if pending >= maxPendingDevices || fromHost >= maxPendingPerAddress {
+			return nil, errTooManyPending
+		}
+		list = kept
+		for device.ID == "" || ids[device.ID] {
+			id := make([]byte, 4)
+			_, err := rand.Read(id)
+			if err != nil {
+				return nil, err
+			}
+			device.ID = hex.EncodeToString(id)
+		}
+		return append(list, device), nil
+	})
+	if err != nil {
+		return Device{}, "", err
+	}
+	s.log.Logf("device %s (%s) from %s asks to be paired with the code %s, approve it with: devices approve %s",
+		device.ID, device.Name, address, device.Code, device.ID)
+	return device, token, nil
+}
+
+// pendingExpired checks whether a device has waited for approval for longer than pendingDeviceTimeout
+// @param device Device
+// @param now time.Time
+// @return bool
+func pendingExpired(device Device, now time.Time) bool {
+	if device.Status != DevicePending {
+		return false
+	}
+	requested, err := time.Parse(time.RFC3339, device.Requested)
+	return err == nil && now.Sub(requested) > pendingDeviceTimeout
+}
+
+// addressHost returns the host of an address a request came from, without its port
+// @param address string
+// @return string
+func addressHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+// errTooManyPending is returned when too many devices, or too many from one address, are already waiting for approval
+var errTooManyPending = errors.New("error: too many devices are waiting for approval, try again later")
+
+// randomText returns random bytes encoded as URL safe base64
+// @param n int The number of random bytes
+// @return string
+// @return error
+func randomText(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// requestToken returns the token a request was made with, from its Authorization header or the gallery cookie
+// @param req *http.Request
+// @return string
+func requestToken(req *http.Request) string {
+	if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	if cookie, err := req.Cookie(tokenCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// authorizeDevice finds the device a request was made by
+// @param req *http.Request
+// @return Device The device, or the admin device when made with the admin token
+// @return int http.StatusOK if the device has access, otherwise the status code to answer with
+func (s *Server) authorizeDevice(req *http.Request) (Device, int) {
+	token := requestToken(req)
+	if token == "" {
+		return Device{}, http.StatusUnauthorized
+	}
+	if s.opts.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.AdminToken)) == 1 {
+		return adminDevice, http.StatusOK
+	}
+	devices, err := s.openDevices()
+	if err != nil {
+		s.log.LogWarnf("could not read devices; %s", err)
+		return Device{}, http.StatusInternalServerError
+	}
+	device, ok, err := devices.byToken(token)
+	switch {
+	case err != nil:
+		s.log.LogWarnf("could not read devices; %s", err)
+		return Device{}, http.StatusInternalServerError
+	case !ok:
+		return Device{}, http.StatusUnauthorized
+	case device.Status != DeviceApproved:
+		return device, http.StatusForbidden
+	}
+	return device, http.StatusOK
+}
+
+// authenticate wraps a handler so it is only called for requests made with the token of an approved device
+// or the admin token. The device is put in the request context.
+// @param next http.HandlerFunc
+// @return http.HandlerFunc
+func (s *Server) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.opts.DisableAuth {
+			next(w, req)
+			return
+		}
+		device, status := s.authorizeDevice(req)
+		switch status {
+		case http.StatusOK:
+			next(w, req.WithContext(context.WithValue(req.Context(), deviceKey{}, device)))
+		case http.StatusUnauthorized:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			s.writeError(w, req, newAPIError(status, CodeUnauthorized, "error: missing or unknown token, pair the device with /pair first"))
+		case http.StatusForbidden:
+			if device.Status == DeviceRevoked {
+				s.writeError(w, req, newAPIError(status, CodeRevoked, "error: device is revoked, it has to pair again"))
+				return
+			}
+			s.writeError(w, req, newAPIError(status, CodePendingApproval, "error: device is waiting for the operator to approve it"))
+		default:
+			s.writeError(w, req, newAPIError(status, CodeInternal, "error: could not check token"))
+		}
+	}
+}
+
+// requestDevice returns the device a request was made by, if it was checked by authenticate
+// @param req *http.Request
+// @return Device
+// @return bool
+func requestDevice(req *http.Request) (Device, bool) {
+	device, ok := req.Context().Value(deviceKey{}).(Device)
+	return device, ok
+}
+
+// Pair is a POST request that takes in a PairRequest with the name of a device and asks the operator to approve it.
+// The device gets back its token straight away, which works once the operator approves the device.
+func (s *Server) Pair(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "Pair")
+	if req.Method != http.MethodPost {
+		s.writeError(w, req, newAPIError(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "error: pairing requests have to be POST requests"))
+		return
+	}
+	var data PairRequest
+	defer req.Body.Close()
+	err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 4096)).Decode(&data)
+	if err != nil {
+		s.writeError(w, req, newAPIError(http.StatusBadRequest, CodeBadRequest, "error: could not parse pairing request; %s", err))
+		return
+	}
+	device, token, err := s.requestPairing(data.Name, req.RemoteAddr)
+	if err != nil {
+		s.writeError(w, req, err)
+		return
+	}
+	s.log.WriteOutJSONMessage(PairResult{DeviceID: device.ID, Token: token, Code: device.Code, Status: device.Status}, w)
+}
+
+// PairStatus is a GET request made with the token a device was given that returns whether
+// the device is still waiting for approval, approved or revoked.
+func (s *Server) PairStatus(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "PairStatus")
+	device, status := s.authorizeDevice(req)
+	switch status {
+	case http.StatusUnauthorized:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		s.writeError(w, req, newAPIError(status, CodeUnauthorized, "error: missing or unknown token"))
+		return
+	case http.StatusInternalServerError:
+		s.writeError(w, req, newAPIError(status, CodeInternal, "error: could not check token"))
+		return
+	}
+	s.log.WriteOutJSONMessage(PairResult{DeviceID: device.ID, Code: device.Code, Status: device.Status}, w)
+}
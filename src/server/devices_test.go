@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startAuthServer starts a server that needs the token of a paired device, with its clock set by now
+func startAuthServer(t *testing.T, now *time.Time) *Server {
+	t.Helper()
+	s, err := New(Options{Root: t.TempDir(), Storage: storage.NewMemory(), Logger: testLogger(t), AdminToken: "admin-token", Clock: func() time.Time { return *now }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+// pairDevice asks a server to pair a device from an address
+// @return int The status code
+// @return PairResult
+func pairDevice(t *testing.T, s *Server, name, address string) (int, PairResult) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/pair", strings.NewReader(fmt.Sprintf(`{"Name":%q}`, name)))
+	req.RemoteAddr = address
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	var result PairResult
+	json.NewDecoder(w.Body).Decode(&result)
+	return w.Code, result
+}
+
+// getWithToken makes a GET request to a path of a server with a bearer token
+// @return int The status code
+// @return ErrorResponse The error sent back, if any
+func getWithToken(t *testing.T, s *Server, path, token string) (int, ErrorResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	var result ErrorResponse
+	json.NewDecoder(w.Body).Decode(&result)
+	return w.Code, result
+}
+
+func TestDeviceAuth(t *testing.T) {
+	now := time.Date(2024, 7, 14, 10, 0, 0, 0, time.UTC)
+	s := startAuthServer(t, &now)
+	status, paired := pairDevice(t, s, "Phone", "192.168.1.20:43378")
+	if status != http.StatusOK || paired.Token == "" || paired.Status != DevicePending || len(paired.Code) != 6 {
+		t.Fatalf("pairing gave %d, %+v", status, paired)
+	}
+	// only the hash of the token is kept
+	data, err := os.ReadFile(filepath.Join(s.root, DeviceFolder, devicesFileName))
+	if err != nil || strings.Contains(string(data), paired.Token) || !strings.Contains(string(data), paired.DeviceID) {
+		t.Errorf("devices file is %s, %v", data, err)
+	}
+	steps := []struct {
+		name   string
+		change func() error
+		token  string
+		status int
+		code   ErrorCode
+	}{
+		{name: "no token", status: http.StatusUnauthorized, code: CodeUnauthorized},
+		{name: "bad token", token: "not-a-token", status: http.StatusUnauthorized, code: CodeUnauthorized},
+		{name: "pending", token: paired.Token, status: http.StatusForbidden, code: CodePendingApproval},
+		{name: "admin token", token: "admin-token", status: http.StatusOK},
+		{name: "approved", change: func() error { return s.ApproveDevice(paired.DeviceID) }, token: paired.Token, status: http.StatusOK},
+		{name: "revoked", change: func() error { return s.RevokeDevice(paired.DeviceID) }, token: paired.Token, status: http.StatusForbidden, code: CodeRevoked},
+	}
+	for _, step := range steps {
+		if step.change != nil {
+			if err := step.change(); err != nil {
+				t.Fatalf("%s: %s", step.name, err)
+			}
+		}
+		status, result := getWithToken(t, s, "/get_folders", step.token)
+		if status != step.status || result.ErrorCode != step.code {
+			t.Errorf("%s: got %d %q, want %d %q", step.name, status, result.ErrorCode, step.status, step.code)
+		}
+	}
+	// a revoked device has to pair again, and its token still tells it so
+	if err := s.ApproveDevice(paired.DeviceID); asAPIError(err).Code != CodeRevoked {
+		t.Errorf("approving a revoked device gave %v", err)
+	}
+	if status, _ := getWithToken(t, s, "/pair_status", paired.Token); status != http.StatusOK {
+		t.Errorf("pair_status of a revoked device gave %d", status)
+	}
+}
+
+func TestPairingLimits(t *testing.T) {
+	now := time.Date(2024, 7, 14, 10, 0, 0, 0, time.UTC)
+	s := startAuthServer(t, &now)
+	// one host can only have a few requests waiting
+	for i := 0; i < maxPendingPerAddress; i++ {
+		if status, _ := pairDevice(t, s, "Phone", fmt.Sprintf("192.168.1.20:%d", 40000+i)); status != http.StatusOK {
+			t.Fatalf("request %d from one host gave %d", i, status)
+		}
+	}
+	if status, _ := pairDevice(t, s, "Phone", "192.168.1.20:50000"); status != http.StatusTooManyRequests {
+		t.Errorf("request past the limit of one host gave %d", status)
+	}
+	// and the list of requests waiting is full once other hosts fill the rest
+	var last PairResult
+	for i := maxPendingPerAddress; i < maxPendingDevices; i++ {
+		var status int
+		status, last = pairDevice(t, s, "Phone", fmt.Sprintf("192.168.1.%d:40000", 100+i))
+		if status != http.StatusOK {
+			t.Fatalf("request %d gave %d", i, status)
+		}
+	}
+	if status, _ := pairDevice(t, s, "Laptop", "192.168.1.99:40000"); status != http.StatusTooManyRequests {
+		t.Errorf("request past the full list gave %d", status)
+	}
+	// requests that are never approved expire and make room again
+	now = now.Add(pendingDeviceTimeout + time.Minute)
+	if err := s.ApproveDevice(last.DeviceID); asAPIError(err).Code != CodeNotFound {
+		t.Errorf("approving an expired request gave %v", err)
+	}
+	status, paired := pairDevice(t, s, "Laptop", "192.168.1.99:40000")
+	if status != http.StatusOK {
+		t.Fatalf("request after the others expired gave %d", status)
+	}
+	devices, err := s.Devices()
+	if err != nil || len(devices) != 1 || devices[0].ID != paired.DeviceID {
+		t.Errorf("devices are %+v, %v", devices, err)
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+// download file to hold the logic for downloading the data of a single file
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sfile"
+	"strings"
+	"time"
+)
+
+// DownloadFile is a GET request that takes in a folder and file hash and writes back the data of the file
+// with its detected content type. Range requests are supported so videos can be streamed.
+// The file is sent as an attachment named after its name attribute unless Inline is set and it is an image or a video.
+// Every download is sandboxed and can not be sniffed as another type, so a file that holds a page or a script
+// does not run on the origin of the server.
+func (s *Server) DownloadFile(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "DownloadFile")
+	w = s.streaming(w)
+	folder := req.URL.Query().Get("Folder")
+	hash, err := decodeHashParam(req.URL.Query().Get("Hash"))
+	if err != nil {
+		s.writeError(w, req, err)
+		return
+	}
+	file, ok := s.index.file(folder, hex.EncodeToString(hash))
+	if !ok {
+		s.writeError(w, req, newAPIError(http.StatusNotFound, CodeNotFound, "error: no file matches hash given"))
+		return
+	}
+	reader, err := sfile.OpenSaveFile(s.store, saveFileName(file.Folder, hash), nil)
+	if err != nil {
+		s.writeError(w, req, fmt.Errorf("error: could not open %x in %s for download; %s", hash, folder, err))
+		return
+	}
+	defer reader.Close()
+	contentType := file.ContentType
+	if contentType == "" {
+		// ServeContent would sniff the type from the data otherwise
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	disposition := "attachment"
+	if req.URL.Query().Get("Inline") != "" && (strings.HasPrefix(contentType, "image/") || strings.HasPrefix(contentType, "video/")) {
+		disposition = "inline"
+	}
+	name := fileDisplayName(file)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, name))
+	// the hash never changes for the same data so it makes a good etag
+	w.Header().Set("ETag", fmt.Sprintf("%q", file.Hash))
+	uploaded, _ := time.Parse(time.RFC3339, file.Uploaded)
+	http.ServeContent(w, req, name, uploaded, reader)
+}
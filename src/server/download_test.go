@@ -0,0 +1,39 @@
+package server
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDownloadFileInline(t *testing.T) {
+	s := openTestServer(t)
+	png := uploadTestFile(t, s, "f", testPNG(t, 4, 4), map[string]string{"Name": "a.png"})
+	page := uploadTestFile(t, s, "f", []byte("<html><script>alert(document.cookie)</script></html>"), map[string]string{"Name": "a.html"})
+	tests := []struct {
+		name        string
+		hash        []byte
+		inline      bool
+		disposition string
+	}{
+		{name: "image inline", hash: png, inline: true, disposition: `inline; filename="a.png"`},
+		{name: "image", hash: png, disposition: `attachment; filename="a.png"`},
+		{name: "page inline", hash: page, inline: true, disposition: `attachment; filename="a.html"`},
+	}
+	for _, test := range tests {
+		url := "/download_file?Folder=f&Hash=" + hex.EncodeToString(test.hash)
+		if test.inline {
+			url += "&Inline=1"
+		}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, %s", test.name, w.Code, w.Body)
+		}
+		header := w.Header()
+		if header.Get("Content-Disposition") != test.disposition || header.Get("X-Content-Type-Options") != "nosniff" || header.Get("Content-Security-Policy") != "sandbox" {
+			t.Errorf("%s: headers are %v", test.name, header)
+		}
+	}
+}
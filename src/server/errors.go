@@ -0,0 +1,152 @@
+package server
+
+// errors file to hold the error codes and error responses every endpoint fails with
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sfile"
+)
+
+// ErrorCode is a machine readable code of why a request failed. The codes do not change between versions,
+// so clients can act on them, while the message that comes with them is meant for people.
+type ErrorCode string
+
+// the codes requests fail with
+const (
+	// CodeBadRequest is a request that could not be parsed or is missing a parameter
+	CodeBadRequest ErrorCode = "bad_request"
+	// CodeInvalidFolder is a folder name that is empty, has an empty part or a part that starts with a dot
+	CodeInvalidFolder ErrorCode = "invalid_folder"
+	// CodeInvalidHash is a file hash that is not a hex or base64 encoded sha256 hash
+	CodeInvalidHash ErrorCode = "invalid_hash"
+	// CodeNotFound is a folder or file that does not exist
+	CodeNotFound ErrorCode = "not_found"
+	// CodeOutOfRange is an index or range of indexes outside of a folder or list
+	CodeOutOfRange ErrorCode = "out_of_range"
+	// CodeHashMismatch is a stored file whose data does not match its hash
+	CodeHashMismatch ErrorCode = "hash_mismatch"
+	// CodeAlreadyComplete is a chunk of a file that has already been uploaded whole
+	CodeAlreadyComplete ErrorCode = "already_complete"
+	// CodeOffsetMismatch is a chunk that does not start where the file uploaded so far ends
+	CodeOffsetMismatch ErrorCode = "offset_mismatch"
+	// CodeUploadInProgress is a file or folder that can not be changed while it is being uploaded
+	CodeUploadInProgress ErrorCode = "upload_in_progress"
+	// CodeAlreadyExists is a folder or file that is in the way of a create, move or rename
+	CodeAlreadyExists ErrorCode = "already_exists"
+	// CodeNotEmpty is a folder that still has files or folders in it
+	CodeNotEmpty ErrorCode = "not_empty"
+	// CodeTooLarge is a file or chunk bigger than the limits of the server
+	CodeTooLarge ErrorCode = "too_large"
+	// CodeInsufficientStorage is a file that would leave less free disk space than the server keeps in reserve
+	CodeInsufficientStorage ErrorCode = "insufficient_storage"
+	// CodeQuotaExceeded is a file that does not fit in the quota of its folder or of the device uploading it
+	CodeQuotaExceeded ErrorCode = "quota_exceeded"
+	// CodeUnauthorized is a request without a token, or with a token the server does not know
+	CodeUnauthorized ErrorCode = "unauthorized"
+	// CodePendingApproval is a device that is still waiting for the operator to approve it
+	CodePendingApproval ErrorCode = "pending_approval"
+	// CodeRevoked is a device that was revoked and has to pair again
+	CodeRevoked ErrorCode = "revoked"
+	// CodeDisabled is an endpoint that is turned off
+	CodeDisabled ErrorCode = "disabled"
+	// CodeHTTPSRequired is a request to the plain HTTP port for a path that is only served over HTTPS
+	CodeHTTPSRequired ErrorCode = "https_required"
+	// CodeMethodNotAllowed is a request with the wrong HTTP method
+	CodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	// CodeTooManyRequests is a request that has to wait, like pairing while too many devices wait for approval
+	CodeTooManyRequests ErrorCode = "too_many_requests"
+	// CodeUnavailable is a request made while the server is starting up or shutting down
+	CodeUnavailable ErrorCode = "unavailable"
+	// CodeInternal is a failure of the server, like a file that could not be read or written
+	CodeInternal ErrorCode = "internal"
+)
+
+// APIError is an error that carries the HTTP status code and ErrorCode a client gets for it.
+// Methods of the Server return it when they fail because of what they were asked to do.
+type APIError struct {
+	Status  int
+	Code    ErrorCode
+	Message string
+	// cause is the error an internal error stands for, which is logged but not sent to the client
+	cause error
+}
+
+// internalErrorMessage is the message a client is sent for an error that is the server's fault,
+// since the error itself can have paths and other details of the server in it
+const internalErrorMessage = "error: internal server error"
+
+// newAPIError is a method to create an APIError with a message that has the args placed in it
+// @param status int The HTTP status code
+// @param code ErrorCode
+// @param format string
+// @param args ...interface{}
+// @return *APIError
+func newAPIError(status int, code ErrorCode, format string, args ...interface{}) *APIError {
+	return &APIError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Error is a method to get the message of the error
+// @return string
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// response returns what a client is sent for the error
+// @return ErrorResponse
+func (e *APIError) response() ErrorResponse {
+	return ErrorResponse{ErrorCode: e.Code, Error: e.Message}
+}
+
+// asAPIError returns the APIError an error is, or the one it stands for. Errors that are not known
+// are the server's fault and become internal errors, which keep the error to log and only have a fixed message.
+// @param err error
+// @return *APIError
+func asAPIError(err error) *APIError {
+	var apiErr *APIError
+	var offsetErr *sfile.OffsetError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.Is(err, errShuttingDown):
+		return &APIError{Status: http.StatusServiceUnavailable, Code: CodeUnavailable, Message: err.Error()}
+	case errors.Is(err, sfile.ErrComplete):
+		return &APIError{Status: http.StatusConflict, Code: CodeAlreadyComplete, Message: err.Error()}
+	case errors.Is(err, sfile.ErrSizeMismatch), errors.Is(err, sfile.ErrPastEnd):
+		return &APIError{Status: http.StatusBadRequest, Code: CodeBadRequest, Message: err.Error()}
+	case errors.As(err, &offsetErr):
+		return &APIError{Status: http.StatusConflict, Code: CodeOffsetMismatch, Message: err.Error()}
+	case errors.Is(err, errTooManyPending):
+		return &APIError{Status: http.StatusTooManyRequests, Code: CodeTooManyRequests, Message: err.Error()}
+	case errors.Is(err, os.ErrNotExist):
+		return &APIError{Status: http.StatusNotFound, Code: CodeNotFound, Message: "error: file or folder does not exist", cause: err}
+	}
+	return &APIError{Status: http.StatusInternalServerError, Code: CodeInternal, Message: internalErrorMessage, cause: err}
+}
+
+// writeError writes an error back as an ErrorResponse with its status code.
+// @param w http.ResponseWriter
+// @param req *http.Request
+// @param err error
+func (s *Server) writeError(w http.ResponseWriter, req *http.Request, err error) {
+	apiErr := asAPIError(err)
+	s.logServerError(req, apiErr)
+	s.log.WriteOutJSONStatus(apiErr.response(), apiErr.Status, w)
+}
+
+// logServerError logs an error a request failed with when it is the server's fault,
+// since the client can not do anything about it
+// @param req *http.Request
+// @param apiErr *APIError
+func (s *Server) logServerError(req *http.Request, apiErr *APIError) {
+	if apiErr.Code != CodeInternal {
+		return
+	}
+	if apiErr.cause != nil {
+		s.log.LogErrorf("request %s to %s failed; %s", requestID(req), req.URL.Path, apiErr.cause)
+		return
+	}
+	s.log.LogErrorf("request %s to %s failed; %s", requestID(req), req.URL.Path, apiErr.Message)
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sfile"
+	"strings"
+	"testing"
+)
+
+func TestAsAPIError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		status  int
+		code    ErrorCode
+		message string
+	}{
+		{"api error", newAPIError(http.StatusConflict, CodeNotEmpty, "error: folder %s is not empty", "a"), http.StatusConflict, CodeNotEmpty, "error: folder a is not empty"},
+		{"wrapped api error", fmt.Errorf("moving; %w", newAPIError(http.StatusNotFound, CodeNotFound, "error: no file")), http.StatusNotFound, CodeNotFound, "error: no file"},
+		{"shutting down", errShuttingDown, http.StatusServiceUnavailable, CodeUnavailable, errShuttingDown.Error()},
+		{"complete", sfile.ErrComplete, http.StatusConflict, CodeAlreadyComplete, sfile.ErrComplete.Error()},
+		{"offset", &sfile.OffsetError{Written: 4, Received: 8}, http.StatusConflict, CodeOffsetMismatch, "error: last received index was 4; current received index was 8"},
+		{"too many pending", errTooManyPending, http.StatusTooManyRequests, CodeTooManyRequests, errTooManyPending.Error()},
+		// errors from the storage and anything unknown do not give away the paths and details in them
+		{"not found", &fs.PathError{Op: "open", Path: "/srv/Data/a/secret", Err: fs.ErrNotExist}, http.StatusNotFound, CodeNotFound, "error: file or folder does not exist"},
+		{"unknown", &fs.PathError{Op: "write", Path: "/srv/Data/a/secret", Err: errors.New("no space left on device")}, http.StatusInternalServerError, CodeInternal, internalErrorMessage},
+	}
+	for _, test := range tests {
+		apiErr := asAPIError(test.err)
+		if apiErr.Status != test.status || apiErr.Code != test.code || apiErr.Message != test.message {
+			t.Errorf("%s: got %d %s %q, want %d %s %q", test.name, apiErr.Status, apiErr.Code, apiErr.Message, test.status, test.code, test.message)
+		}
+	}
+}
+
+func TestWriteInternalError(t *testing.T) {
+	logged := &bytes.Buffer{}
+	logger, err := NewLogger(logged, "error", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{log: logger}
+	w := httptest.NewRecorder()
+	s.writeError(w, httptest.NewRequest(http.MethodGet, "/get_files", nil), errors.New("open /srv/Data/a/secret: input/output error"))
+	var body ErrorResponse
+	err = json.NewDecoder(w.Body).Decode(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the client gets the fixed message and the log gets the error
+	if w.Code != http.StatusInternalServerError || body.ErrorCode != CodeInternal || body.Error != internalErrorMessage {
+		t.Errorf("client got %d %+v", w.Code, body)
+	}
+	if !strings.Contains(logged.String(), "/srv/Data/a/secret: input/output error") {
+		t.Errorf("the error is not in the log:\n%s", logged)
+	}
+}
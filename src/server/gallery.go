@@ -0,0 +1,358 @@
+package server
+
+// gallery file to hold the logic for the web gallery UI that is built into the server
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// galleryPageSize is the number of files shown on a page of a folder
+const galleryPageSize = 60
+
+// galleryUploadChunkSize is the size of the chunks files uploaded from the gallery are saved in
+const galleryUploadChunkSize = 4 << 20
+
+// galleryUploadMemory is how much of an upload form is kept in memory, the rest is kept in temporary files
+const galleryUploadMemory = 32 << 20
+
+// galleryUploadLimit is the biggest upload form in bytes when there is no MaxFileSize, and galleryFormOverhead
+// is how much bigger than MaxFileSize a form can be for the rest of the form around the files
+const (
+	galleryUploadLimit  = 4 << 30
+	galleryFormOverhead = 1 << 20
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// galleryPage is an object that holds everything the gallery templates show
+type galleryPage struct {
+	Title    string
+	Error    string
+	Folders  []Folder
+	Folder   string
+	Files    []FileMetadata
+	Total    int
+	First    int
+	Last     int
+	HasPrev  bool
+	HasNext  bool
+	PrevPage int
+	NextPage int
+	File     FileMetadata
+	Keys     []string
+	Uploaded []string
+	Device   Device
+}
+
+// galleryFuncs returns the functions the gallery templates can call, with the links under the server's prefix
+// @return template.FuncMap
+func (s *Server) galleryFuncs() template.FuncMap {
+	return template.FuncMap{
+		"url": func(path string) string {
+			return s.prefix + path
+		},
+		"folderURL": func(folder string, page int) string {
+			return s.prefix + "/ui/folder?" + url.Values{"Name": {folder}, "Page": {strconv.Itoa(page)}}.Encode()
+		},
+		"fileURL": func(file FileMetadata) string {
+			return s.prefix + "/ui/file?" + url.Values{"Folder": {file.Folder}, "Hash": {file.Hash}}.Encode()
+		},
+		"thumbnailURL": func(file FileMetadata, size int) string {
+			return s.prefix + "/get_thumbnail?" + url.Values{"Folder": {file.Folder}, "Hash": {file.Hash}, "Size": {strconv.Itoa(size)}}.Encode()
+		},
+		"downloadURL": func(file FileMetadata, inline bool) string {
+			values := url.Values{"Folder": {file.Folder}, "Hash": {file.Hash}}
+			if inline {
+				values.Set("Inline", "1")
+			}
+			return s.prefix + "/download_file?" + values.Encode()
+		},
+		"zipURL": func(folder string) string {
+			return s.prefix + "/download_zip?" + url.Values{"Folder": {folder}}.Encode()
+		},
+		"displayName": fileDisplayName,
+		"zipEnabled":  func() bool { return !s.opts.DisableZip },
+		"hasThumbnail": func(file FileMetadata) bool {
+			if s.opts.DisableThumbnails {
+				return false
+			}
+			switch file.ContentType {
+			case "image/jpeg", "image/png", "image/gif":
+				return file.Complete
+			}
+			return false
+		},
+		"isImage": func(file FileMetadata) bool {
+			switch file.ContentType {
+			case "image/jpeg", "image/png", "image/gif", "image/webp", "image/bmp", "image/avif":
+				return true
+			}
+			return false
+		},
+		"isVideo": func(file FileMetadata) bool {
+			switch file.ContentType {
+			case "video/mp4", "video/webm", "video/quicktime":
+				return true
+			}
+			return false
+		},
+	}
+}
+
+// parseGalleryTemplates parses a template for each page of the gallery, each one made up of the layout and the page
+func (s *Server) parseGalleryTemplates() {
+	funcs := s.galleryFuncs()
+	s.templates = make(map[string]*template.Template)
+	for name, page := range map[string]string{"folders": "folders.html", "folder": "folder.html", "file": "file.html", "upload": "upload.html", "pair": "pair.html"} {
+		s.templates[name] = template.Must(template.New(page).Funcs(funcs).ParseFS(uiFiles, "ui/templates/layout.html", "ui/templates/"+page))
+	}
+}
+
+// renderGalleryPage writes out a page of the gallery
+// @param w http.ResponseWriter
+// @param status int The HTTP status code
+// @param name string The name of the page template
+// @param page galleryPage
+func (s *Server) renderGalleryPage(w http.ResponseWriter, status int, name string, page galleryPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := s.templates[name].ExecuteTemplate(w, "layout", page)
+	if err != nil {
+		s.log.LogWarnf("could not render gallery page %s; %s", name, err)
+	}
+}
+
+// galleryPair asks for the browser to be paired as a device and keeps its token in a cookie
+// @param w http.ResponseWriter
+// @param req *http.Request
+func (s *Server) galleryPair(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Redirect(w, req, s.prefix+"/ui/", http.StatusSeeOther)
+		return
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, 4096)
+	device, token, err := s.requestPairing(req.FormValue("name"), req.RemoteAddr)
+	if err != nil {
+		apiErr := asAPIError(err)
+		s.logServerError(req, apiErr)
+		s.renderGalleryPage(w, apiErr.Status, "pair", galleryPage{Title: "Pair", Error: apiErr.Message})
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookie,
+		Value:    token,
+		Path:     s.prefix + "/",
+		MaxAge:   10 * 365 * 24 * 60 * 60,
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	s.renderGalleryPage(w, http.StatusOK, "pair", galleryPage{Title: "Pair", Device: device})
+}
+
+// Gallery is a method that serves the pages and static files of the web gallery under /ui/.
+func (s *Server) Gallery(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "Gallery")
+	path := strings.TrimPrefix(req.URL.Path, "/ui")
+	if strings.HasPrefix(path, "/static/") {
+		static, _ := fs.Sub(uiFiles, "ui/static")
+		http.StripPrefix("/ui/static/", http.FileServer(http.FS(static))).ServeHTTP(w, req)
+		return
+	}
+	if !s.opts.DisableAuth {
+		if path == "/pair" {
+			s.galleryPair(w, req)
+			return
+		}
+		device, status := s.authorizeDevice(req)
+		if status != http.StatusOK {
+			s.renderGalleryPage(w, status, "pair", galleryPage{Title: "Pair", Device: device})
+			return
+		}
+		req = req.WithContext(context.WithValue(req.Context(), deviceKey{}, device))
+	}
+	switch {
+	case path == "/" || path == "":
+		s.galleryFolders(w, req)
+	case path == "/folder":
+		s.galleryFolder(w, req)
+	case path == "/file":
+		s.galleryFile(w, req)
+	case path == "/upload":
+		s.galleryUpload(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// galleryFolders shows the list of folders
+func (s *Server) galleryFolders(w http.ResponseWriter, req *http.Request) {
+	s.renderGalleryPage(w, http.StatusOK, "folders", galleryPage{Title: "Folders", Folders: s.index.folderList()})
+}
+
+// galleryFolder shows a page of the thumbnail grid of a folder
+func (s *Server) galleryFolder(w http.ResponseWriter, req *http.Request) {
+	folder := req.URL.Query().Get("Name")
+	files, ok := s.index.files(folder)
+	if !ok {
+		s.renderGalleryPage(w, http.StatusNotFound, "folders", galleryPage{Title: "Folders", Error: "Folder " + folder + " does not exist.", Folders: s.index.folderList()})
+		return
+	}
+	pageNumber, _ := strconv.Atoi(req.URL.Query().Get("Page"))
+	if pageNumber < 0 {
+		pageNumber = 0
+	}
+	start := minInt(pageNumber*galleryPageSize, len(files))
+	end := minInt(start+galleryPageSize, len(files))
+	s.renderGalleryPage(w, http.StatusOK, "folder", galleryPage{
+		Title:    folder,
+		Folder:   folder,
+		Files:    files[start:end],
+		Total:    len(files),
+		First:    start + 1,
+		Last:     end,
+		HasPrev:  pageNumber > 0,
+		HasNext:  end < len(files),
+		PrevPage: pageNumber - 1,
+		NextPage: pageNumber + 1,
+	})
+}
+
+// galleryFile shows a single file with its attributes
+func (s *Server) galleryFile(w http.ResponseWriter, req *http.Request) {
+	folder := req.URL.Query().Get("Folder")
+	file, ok := s.index.file(folder, req.URL.Query().Get("Hash"))
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	keys := make([]string, 0, len(file.Attributes))
+	for k := range file.Attributes {
+		if k != MimeTypeAttribute && k != DeviceAttribute && k != UploadTimeAttribute {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	s.renderGalleryPage(w, http.StatusOK, "file", galleryPage{Title: fileDisplayName(file), File: file, Keys: keys})
+}
+
+// galleryUpload shows the upload form, and saves the files posted from it.
+// The form can be as big as MaxFileSize and a little more, or galleryUploadLimit when there is no MaxFileSize.
+func (s *Server) galleryUpload(w http.ResponseWriter, req *http.Request) {
+	page := galleryPage{Title: "Upload"}
+	if req.Method != http.MethodPost {
+		s.renderGalleryPage(w, http.StatusOK, "upload", page)
+		return
+	}
+	limit := int64(galleryUploadLimit)
+	if s.opts.MaxFileSize > 0 {
+		limit = s.opts.MaxFileSize + galleryFormOverhead
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, limit)
+	err := req.ParseMultipartForm(galleryUploadMemory)
+	if err != nil {
+		status := http.StatusBadRequest
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			status = http.StatusRequestEntityTooLarge
+			err = fmt.Errorf("the upload is more than the limit of %d bytes", limit)
+		}
+		page.Error = "Could not read the upload; " + err.Error()
+		s.renderGalleryPage(w, status, "upload", page)
+		return
+	}
+	defer req.MultipartForm.RemoveAll()
+	folder := req.FormValue("folder")
+	if folder != "" {
+		err = validFolderName(folder)
+		if err != nil {
+			page.Error = err.Error()
+			s.renderGalleryPage(w, http.StatusBadRequest, "upload", page)
+			return
+		}
+	}
+	device, _ := requestDevice(req)
+	status := http.StatusOK
+	for _, fileHeader := range req.MultipartForm.File["files"] {
+		page.Folder, err = s.saveUploadedFile(folder, device.ID, fileHeader)
+		if err != nil {
+			s.log.LogWarnf("gallery upload of %s failed; %s", fileHeader.Filename, err)
+			apiErr := asAPIError(err)
+			status = apiErr.Status
+			page.Error = "Could not save " + fileHeader.Filename + "; " + apiErr.Message
+			break
+		}
+		page.Uploaded = append(page.Uploaded, fileHeader.Filename)
+	}
+	s.renderGalleryPage(w, status, "upload", page)
+}
+
+// saveUploadedFile saves a file from the upload form in chunks through the same path /post_file uses.
+// A file that was already partly saved is resumed, and a file that was already completely saved is skipped.
+// @param folder string The name of the folder to save the file in, the folder layout is used when empty
+// @param device string The ID of the device uploading the file, empty when it is not known
+// @param fileHeader *multipart.FileHeader
+// @return string The name of the folder the file was saved in
+// @return error
+func (s *Server) saveUploadedFile(folder, device string, fileHeader *multipart.FileHeader) (string, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return "", err
+	}
+	hash := hasher.Sum(nil)
+	err = s.checkUploadLimits(FileData{Size: fileHeader.Size})
+	if err != nil {
+		return "", err
+	}
+	attributes := map[string]string{"Name": filepath.Base(fileHeader.Filename)}
+	if folder == "" {
+		folder = s.layoutFolder(attributes, s.now())
+	}
+	existing, ok := s.index.file(folder, hex.EncodeToString(hash))
+	if ok && existing.Complete {
+		return folder, nil
+	}
+	contentType := fileHeader.Header.Get("Content-Type")
+	buf := make([]byte, galleryUploadChunkSize)
+	pos := 0
+	for first := true; first || int64(pos) < fileHeader.Size; first = false {
+		count, err := file.ReadAt(buf, int64(pos))
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		chunk := FileData{Data: buf[:count], ValidateFile: hash, StartIndex: pos, Size: fileHeader.Size, ContentType: contentType, Folder: folder, Attributes: attributes}
+		n, _, err := s.saveFileChunk(chunk, device)
+		if err != nil {
+			if n > pos {
+				// the file was partly saved before, so carry on from where it stopped
+				pos = n
+				continue
+			}
+			return "", err
+		}
+		pos = n
+	}
+	return folder, nil
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"storage"
+	"strings"
+	"testing"
+)
+
+// uploadForm builds the body of an upload form from the gallery with a file in it
+func uploadForm(t *testing.T, folder, name string, data []byte) (*bytes.Buffer, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("folder", folder)
+	part, err := form.CreateFormFile("files", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+	return body, form.FormDataContentType()
+}
+
+func TestGalleryUpload(t *testing.T) {
+	s, err := New(Options{Root: t.TempDir(), Storage: storage.NewMemory(), Logger: testLogger(t), DisableAuth: true, MaxFileSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	data := []byte("some text")
+	body, contentType := uploadForm(t, "up", "a.txt", data)
+	req := httptest.NewRequest(http.MethodPost, "/ui/upload", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload gave %d, %s", w.Code, w.Body)
+	}
+	files, _ := s.index.files("up")
+	if len(files) != 1 || files[0].Size != int64(len(data)) || files[0].Attributes["Name"] != "a.txt" || !files[0].Complete {
+		t.Errorf("folder has %+v after the upload", files)
+	}
+	// the form is refused once it is bigger than the biggest file, without reading all of it
+	body, contentType = uploadForm(t, "up", "big.bin", bytes.Repeat([]byte("x"), galleryFormOverhead+200))
+	req = httptest.NewRequest(http.MethodPost, "/ui/upload", body)
+	req.Header.Set("Content-Type", contentType)
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "limit") {
+		t.Errorf("big upload gave %d, %s", w.Code, w.Body)
+	}
+	if files, _ := s.index.files("up"); len(files) != 1 {
+		t.Errorf("folder has %d files after the big upload", len(files))
+	}
+}
+
+func TestGalleryPairCookie(t *testing.T) {
+	s, err := New(Options{Root: t.TempDir(), Storage: storage.NewMemory(), Logger: testLogger(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	get := func(cookie *http.Cookie) int {
+		req := httptest.NewRequest(http.MethodGet, "/ui/", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, req)
+		return w.Code
+	}
+	if status := get(nil); status != http.StatusUnauthorized {
+		t.Errorf("gallery without a cookie gave %d", status)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/ui/pair", strings.NewReader(url.Values{"name": {"browser"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusOK || len(cookies) != 1 || cookies[0].Name != tokenCookie || !cookies[0].HttpOnly || cookies[0].Value == "" {
+		t.Fatalf("pairing gave %d with cookies %v", w.Code, cookies)
+	}
+	cookie := cookies[0]
+	if status := get(cookie); status != http.StatusForbidden {
+		t.Errorf("gallery with a cookie waiting for approval gave %d", status)
+	}
+	devices, err := s.Devices()
+	if err != nil || len(devices) != 1 || devices[0].Name != "browser" {
+		t.Fatalf("devices are %+v, %v", devices, err)
+	}
+	err = s.ApproveDevice(devices[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := get(cookie); status != http.StatusOK {
+		t.Errorf("gallery with an approved cookie gave %d", status)
+	}
+	// the cookie opens the API as well, since it is the token of the device
+	req = httptest.NewRequest(http.MethodGet, "/get_folders", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("get_folders with an approved cookie gave %d", w.Code)
+	}
+	err = s.RevokeDevice(devices[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := get(cookie); status != http.StatusForbidden {
+		t.Errorf("gallery with a revoked cookie gave %d", status)
+	}
+	if status := get(&http.Cookie{Name: tokenCookie, Value: hex.EncodeToString([]byte("made up"))}); status != http.StatusUnauthorized {
+		t.Errorf("gallery with an unknown cookie gave %d", status)
+	}
+}
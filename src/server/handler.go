@@ -6,231 +6,421 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
-	"os"
-	"path/filepath"
+	"path"
 	"sfile"
 	"strconv"
-	"strings"
 	"time"
 )
 
-var RootPath string = "Data"
+// checkUploadLimits checks a chunk of a file against the server's upload limits
+// @param data FileData The chunk of the file
+// @return error
+func (s *Server) checkUploadLimits(data FileData) error {
+	if data.Size < 0 || data.StartIndex < 0 {
+		return newAPIError(http.StatusBadRequest, CodeBadRequest, "error: Size %d and StartIndex %d can not be negative", data.Size, data.StartIndex)
+	}
+	if int64(data.StartIndex)+int64(len(data.Data)) > data.Size {
+		return newAPIError(http.StatusBadRequest, CodeBadRequest, "error: a chunk of %d bytes at %d runs past the end of a file of %d bytes", len(data.Data), data.StartIndex, data.Size)
+	}
+	if s.opts.MaxFileSize > 0 && data.Size > s.opts.MaxFileSize {
+		return newAPIError(http.StatusRequestEntityTooLarge, CodeTooLarge, "error: file size %d is more than the limit of %d bytes", data.Size, s.opts.MaxFileSize)
+	}
+	if int64(len(data.Data)) > s.opts.MaxChunkSize {
+		return newAPIError(http.StatusRequestEntityTooLarge, CodeTooLarge, "error: chunk size %d is more than the limit of %d bytes", len(data.Data), s.opts.MaxChunkSize)
+	}
+	return nil
+}
 
-// CreateTodaysFolder is a method to create a folder with the current date as its name.
-// @return string  The folder path
-func CreateTodaysFolder() string {
-	// Grab date
-	year, month, day := time.Now().Date()
-	// format string to desired file name
-	name := fmt.Sprintf(filepath.Join(RootPath, "%d-%d-%d"), year, month, day)
+// saveFileName returns the storage name of the SAVE file of a file in a folder.
+// Folder names use "/" to separate nested folders, like "2024/07/14", and are also their storage names.
+// @param folder string The name of the folder
+// @param hash []byte The raw hash of the file
+// @return []byte
+func saveFileName(folder string, hash []byte) []byte {
+	return []byte(path.Join(folder, string(hash)))
+}
+
+// createFolder creates a folder in the server's storage, along with any parent folders, if it does not exist
+// and adds it to the metadata index.
+// @param folder string The name of the folder
+// @return string The name of the folder
+// @return error
+func (s *Server) createFolder(folder string) (string, error) {
 	// check if folder already exists
-	_, err := os.Stat(name)
+	_, err := s.store.Stat(folder)
 	// if it doesn't exist, create it.
 	if err != nil {
-		Logf("Created folder %s", name)
-		os.Mkdir(name, 0777)
+		s.log.Logf("Created folder %s", folder)
+		err = s.store.MkdirAll(folder)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = s.index.addFolder(folder)
+	if err != nil {
+		s.log.LogWarnf("could not add folder %s to the metadata index; %s", folder, err)
+	}
+	return folder, nil
+}
+
+// uploadFolder returns the folder a chunk of a file is written to, creating it if it does not exist.
+// Chunks go to the folder the client asked for, otherwise a started upload carries on in the folder it was
+// started in, even when the client starts it over from the beginning, and a new upload goes to the folder
+// the folder layout gives for its attributes.
+// @param data FileData The chunk of the file
+// @return string The name of the folder
+// @return error
+func (s *Server) uploadFolder(data FileData) (string, error) {
+	folder := data.Folder
+	if folder == "" {
+		if file, ok := s.index.findUpload(hex.EncodeToString(data.ValidateFile)); ok {
+			return file.Folder, nil
+		}
+		folder = s.layoutFolder(data.Attributes, s.now())
+	}
+	err := validFolderName(folder)
+	if err != nil {
+		return "", err
+	}
+	return s.createFolder(folder)
+}
+
+// decodeHashParam decodes a file hash passed in a URL.
+// The hash can either be hex encoded or base64 encoded, like the ValidateFile field of FileData.
+// @param hash string
+// @return []byte The raw hash
+// @return error
+func decodeHashParam(hash string) ([]byte, error) {
+	if b, err := hex.DecodeString(hash); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(hash); err == nil && len(b) == sha256.Size {
+		return b, nil
 	}
-	return name
+	if b, err := base64.URLEncoding.DecodeString(hash); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	return nil, newAPIError(http.StatusBadRequest, CodeInvalidHash, "error: hash must be a hex or base64 encoded sha256 value")
 }
 
-// createHeaderObject creates a sfile.SimpleHeader object with default attributes
-// @param data FileData object passed in to set the Attribute keys in the SimpleHeader object
-// @return *sfile.SimpleHeader object
-func createHeaderObject(data map[string]string) *sfile.SimpleHeader {
-	headerObj := &sfile.SimpleHeader{Attributes: make(map[string]interface{})}
+// createHeaderObject creates a sfile.KeyedHeader object with default attributes
+// @param data FileData object passed in to set the Attribute keys in the KeyedHeader object
+// @return *sfile.KeyedHeader object
+func createHeaderObject(data map[string]string) *sfile.KeyedHeader {
+	headerObj := &sfile.KeyedHeader{Attributes: make(map[string]interface{})}
 	for k, v := range data {
 		headerObj.Attributes[k] = v
 	}
 	return headerObj
 }
 
+// selectAttributes returns the attributes of a header that were requested.
+// Every attribute in the header is returned when no keys are requested.
+// @param headerObj *sfile.KeyedHeader The header read from a SAVE file
+// @param requested map[string]string The map with the keys of the attributes requested
+// @return map[string]string
+func selectAttributes(headerObj *sfile.KeyedHeader, requested map[string]string) map[string]string {
+	attributes := make(map[string]string)
+	if len(requested) == 0 {
+		for k, v := range headerObj.Attributes {
+			attributes[k] = fmt.Sprintf("%s", v)
+		}
+		return attributes
+	}
+	for k := range requested {
+		if v, ok := headerObj.Attributes[k]; ok {
+			attributes[k] = fmt.Sprintf("%s", v)
+		} else {
+			attributes[k] = ""
+		}
+	}
+	return attributes
+}
+
 // PingServ method listens for any message and sends back a response that lets
 // the user know it is hitting the right address.
-func PingServ(w http.ResponseWriter, req *http.Request) {
-	LogServerCall(req, "PingServ")
+func (s *Server) PingServ(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "PingServ")
 	w.Write([]byte("connected"))
 }
 
 // WriteFile is a method to handle post request for a file to be saved to the
-func WriteFile(w http.ResponseWriter, req *http.Request) {
-	LogServerCall(req, "WriteFile")
+func (s *Server) WriteFile(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "WriteFile")
+	// the chunk is base64 encoded in the request, which makes it a third bigger
+	req.Body = http.MaxBytesReader(w, req.Body, s.opts.MaxChunkSize/3*4+64<<10)
 	// create json decoder
 	decoder := json.NewDecoder(req.Body)
 	var data FileData
 	err := decoder.Decode(&data)
+	defer req.Body.Close()
 	if err != nil {
-		LoglnArgs("Post File Error:", err)
+		s.log.LoglnArgs("Post File Error:", err)
+		apiErr := newAPIError(http.StatusBadRequest, CodeBadRequest, "error: could not read file data; %s", err)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			apiErr.Status, apiErr.Code = http.StatusRequestEntityTooLarge, CodeTooLarge
+		}
+		s.writeError(w, req, apiErr)
+		return
 	}
-	defer req.Body.Close()
-	headerObj := createHeaderObject(data.Attributes)
-	filePath := bytes.NewBufferString(filepath.Join(CreateTodaysFolder(), string(data.ValidateFile)))
-	n, err := sfile.WriteSaveFile(filePath.Bytes(), data.Data, headerObj, data.StartIndex, data.Size)
+	err = s.checkUploadLimits(data)
+	if err == nil && data.Folder != "" {
+		err = validFolderName(data.Folder)
+	}
+	if err != nil {
+		s.writeError(w, req, err)
+		return
+	}
+	device, _ := requestDevice(req)
+	n, folder, err := s.saveFileChunk(data, device.ID)
 	if err != nil {
-		log.Fatal(err)
-		errReturn := map[string]interface{}{"Count": n, "Error": fmt.Sprintf("Error while writing file %s; %s", data.ValidateFile, err)}
-		WriteOutJSONMessage(errReturn, w)
+		// the client is sent where the file ends along with the error, so it can resume from there
+		apiErr := asAPIError(err)
+		s.logServerError(req, apiErr)
+		errReturn := UploadResult{Count: n, Folder: folder, ErrorResponse: ErrorResponse{ErrorCode: apiErr.Code, Error: fmt.Sprintf("Error while writing file %x; %s", data.ValidateFile, apiErr.Message)}}
+		s.log.WriteOutJSONStatus(errReturn, apiErr.Status, w)
 		return
 	}
-	Logf("File data, Name: %s. Wrote %d bytes", data.ValidateFile, n)
-	WriteOutJSONMessage(map[string]interface{}{"Count": n, "Error": ""}, w)
+	s.log.LogDebugf("File data, Name: %x. Wrote %d bytes", data.ValidateFile, n)
+	s.log.WriteOutJSONMessage(UploadResult{Count: n, Folder: folder}, w)
+}
+
+// saveFileChunk writes a chunk of a file to its SAVE file and keeps the metadata index current.
+// Once the whole file is written its metadata is extracted and its thumbnails are created in the background.
+// A file that is not on the server yet is only created when it passes checkNewUpload.
+// @param data FileData The chunk of the file
+// @param device string The ID of the device uploading the file, empty when it is not known
+// @return int The position in the file written up to
+// @return string The name of the folder the file is in
+// @return error
+func (s *Server) saveFileChunk(data FileData, device string) (int, string, error) {
+	headerObj := createHeaderObject(data.Attributes)
+	// the content type, device and upload time are reserved and are set from the first chunk of the file
+	delete(headerObj.Attributes, MimeTypeAttribute)
+	delete(headerObj.Attributes, DeviceAttribute)
+	delete(headerObj.Attributes, UploadTimeAttribute)
+	if data.StartIndex == 0 {
+		mimeType, ok := checkDeclaredMimeType(data.ContentType, DetectMimeType(data.Data))
+		if !ok {
+			s.log.LogWarnf("declared content type %s of %x does not match detected type %s", data.ContentType, data.ValidateFile, mimeType)
+		}
+		headerObj.Attributes[MimeTypeAttribute] = mimeType
+	}
+	if data.StartIndex == 0 {
+		// a file is created and put in the index before its folder can be moved or deleted,
+		// which then see it as an upload in progress
+		s.manageMu.Lock()
+		defer s.manageMu.Unlock()
+	}
+	folder, err := s.uploadFolder(data)
+	if err != nil {
+		return 0, "", err
+	}
+	if data.StartIndex == 0 {
+		if _, ok := s.index.file(folder, hex.EncodeToString(data.ValidateFile)); !ok {
+			s.uploadMu.Lock()
+			defer s.uploadMu.Unlock()
+			err = s.checkNewUpload(folder, device, data.Size)
+			if err != nil {
+				return 0, folder, err
+			}
+			if device != "" {
+				headerObj.Attributes[DeviceAttribute] = device
+			}
+			headerObj.Attributes[UploadTimeAttribute] = s.now().UTC().Format(time.RFC3339)
+		}
+	}
+	err = s.beginWrite()
+	if err != nil {
+		return 0, "", err
+	}
+	defer s.endWrite()
+	n, err := sfile.WriteSaveFile(s.store, saveFileName(folder, data.ValidateFile), data.Data, headerObj, data.StartIndex, data.Size)
+	if err != nil {
+		return n, folder, err
+	}
+	s.metrics.uploaded.Add(int64(n - data.StartIndex))
+	if data.StartIndex == 0 || int64(n) == data.Size {
+		// keep the metadata index current when a file is created and when it is completed
+		err = s.index.indexSaveFile(folder, data.ValidateFile)
+		if err != nil {
+			s.log.LogWarnf("could not update metadata index for %x; %s", data.ValidateFile, err)
+		}
+	}
+	if int64(n) == data.Size {
+		// upload is complete so pull out its metadata and create the thumbnails in the background
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			defer s.recoverBackground(fmt.Sprintf("processing upload %x", data.ValidateFile))
+			s.processCompletedUpload(folder, data.ValidateFile)
+		}()
+	}
+	return n, folder, nil
 }
 
 // ValidateFile is a GET request that takes in a file hash and checks to see
 // if that file exists on the server as a whole.
-func ValidateFile(w http.ResponseWriter, req *http.Request) {
-	LogServerCall(req, "ValidateFile")
-	errMsg := map[string]interface{}{"Error": "", "Size": 0}
+func (s *Server) ValidateFile(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "ValidateFile")
 	folder := req.URL.Query().Get("Folder")
 	fileHash := req.URL.Query().Get("Hash")
 	if fileHash == "" {
 		index, err := strconv.Atoi(req.URL.Query().Get("Index"))
 		if err != nil {
-			errMsg["Error"] = err
-			WriteOutJSONMessage(errMsg, w)
+			s.writeError(w, req, newAPIError(http.StatusBadRequest, CodeBadRequest, "error: Hash or Index has to be given; %s", err))
 			return
 		}
-		validateFileWithIndex(w, req, folder, index)
+		s.validateFileWithIndex(w, req, folder, index)
 	} else {
-		validateFileWithHash(w, req, folder, fileHash)
+		s.validateFileWithHash(w, req, folder, fileHash)
 	}
 }
 
-//
-func validateFileWithIndex(w http.ResponseWriter, req *http.Request, folder string, index int) {
-	Logf("validating %d from %s", index, folder)
-	errMsg := map[string]interface{}{"Error": ""}
-	files, err := ioutil.ReadDir(filepath.Join(RootPath, folder))
-	if err != nil {
-		errMsg["Error"] = err
-		WriteOutJSONMessage(errMsg, w)
+// validateFileWithIndex validates the file at an index of the list of files in a folder
+func (s *Server) validateFileWithIndex(w http.ResponseWriter, req *http.Request, folder string, index int) {
+	s.log.LogDebugf("validating %d from %s", index, folder)
+	files, ok := s.index.files(folder)
+	if !ok {
+		s.writeError(w, req, newAPIError(http.StatusNotFound, CodeNotFound, "error: folder %s does not exist", folder))
 		return
 	}
 	if index >= len(files) || index < 0 {
-		errMsg["Error"] = errors.New("error: index out of range")
-		WriteOutJSONMessage(errMsg, w)
+		s.writeError(w, req, newAPIError(http.StatusBadRequest, CodeOutOfRange, "error: index %d out of range, folder has %d files", index, len(files)))
 		return
 	}
-	saveFileObj, err := sfile.ReadSaveFile([]byte(files[index].Name()), nil)
+	correctHash, err := hex.DecodeString(files[index].Hash)
 	if err != nil {
-		errMsg["Error"] = err
-		WriteOutJSONMessage(errMsg, w)
+		s.writeError(w, req, fmt.Errorf("error: metadata index has a bad hash %q in %s; %s", files[index].Hash, folder, err))
 		return
 	}
-	splitFilePath := strings.Split(files[index].Name(), string(os.PathSeparator))
-	correctHash := []byte(splitFilePath[len(splitFilePath)-1])
-	checkHash := sha256.Sum256(saveFileObj.Data)
-	if bytes.Compare(correctHash, checkHash[:]) == 0 {
-		WriteOutJSONMessage(errMsg, w)
+	s.validateSaveFile(w, req, folder, correctHash)
+}
+
+// validateFileWithHash validates the file with a hash in a folder.
+// The hash is hex or base64 encoded, or the raw bytes of the hash for older clients.
+func (s *Server) validateFileWithHash(w http.ResponseWriter, req *http.Request, folder, hash string) {
+	s.log.LogDebugf("validating %s from %s", hash, folder)
+	correctHash, err := decodeHashParam(hash)
+	if err != nil && len(hash) == sha256.Size {
+		correctHash, err = []byte(hash), nil
+	}
+	if err != nil {
+		s.writeError(w, req, err)
 		return
 	}
-	errMsg["Error"] = errors.New("error: original hash does not match current data hash")
-	WriteOutJSONMessage(errMsg, w)
+	s.validateSaveFile(w, req, folder, correctHash)
 }
 
-//
-func validateFileWithHash(w http.ResponseWriter, req *http.Request, folder, hash string) {
-	Logf("validating %s from %s", hash, folder)
-	errMsg := map[string]interface{}{"Error": ""}
-	saveFileObj, err := sfile.ReadSaveFile([]byte(filepath.Join(RootPath, folder, hash)), nil)
+// validateSaveFile checks that a file in a folder is uploaded whole and that its data matches its hash,
+// and writes back an empty ErrorResponse when it does
+// @param w http.ResponseWriter
+// @param req *http.Request
+// @param folder string
+// @param hash []byte The raw hash of the file
+func (s *Server) validateSaveFile(w http.ResponseWriter, req *http.Request, folder string, hash []byte) {
+	if _, ok := s.index.file(folder, hex.EncodeToString(hash)); !ok {
+		s.writeError(w, req, newAPIError(http.StatusNotFound, CodeNotFound, "error: no file %x in folder %s", hash, folder))
+		return
+	}
+	saveFileObj, err := sfile.ReadSaveFile(s.store, saveFileName(folder, hash), nil)
 	if err != nil {
-		errMsg["Error"] = err
-		WriteOutJSONMessage(errMsg, w)
+		s.writeError(w, req, fmt.Errorf("error: could not read file %x in %s; %s", hash, folder, err))
+		return
+	}
+	if int64(saveFileObj.Size) < saveFileObj.TotalSize {
+		s.writeError(w, req, newAPIError(http.StatusConflict, CodeUploadInProgress, "error: file %x is still being uploaded, %d of %d bytes are written", hash, saveFileObj.Size, saveFileObj.TotalSize))
 		return
 	}
-	correctHash := []byte(hash)
 	checkHash := sha256.Sum256(saveFileObj.Data)
-	if bytes.Compare(correctHash, checkHash[:]) == 0 {
-		WriteOutJSONMessage(errMsg, w)
+	if !bytes.Equal(hash, checkHash[:]) {
+		s.metrics.hashFailures.Add(1)
+		s.writeError(w, req, newAPIError(http.StatusConflict, CodeHashMismatch, "error: original hash does not match current data hash"))
 		return
 	}
-	errMsg["Error"] = errors.New("error: no file matches hash given")
-	WriteOutJSONMessage(errMsg, w)
+	s.log.WriteOutJSONMessage(ErrorResponse{}, w)
 }
 
 // GetFolders is a method to retrieve the list of folder names in the Data path.
-func GetFolders(w http.ResponseWriter, req *http.Request) {
-	LogServerCall(req, "GetFolders")
-	// Grab all folders in Data directory
-	foldersFromDir, err := ioutil.ReadDir(RootPath)
-	if err != nil {
-		LogFatal(err.Error())
-		errFolders := FoldersList{Error: "ERROR: Could not read Data directory."}
-		WriteOutJSONMessage(errFolders, w)
-		return
-	}
-
-	folders := FoldersList{Folders: make([]Folder, 0)}
-	// Grab all folder info
-	for _, obj := range foldersFromDir {
-		// Grab files in folder
-		subFiles, err := ioutil.ReadDir(filepath.Join(RootPath, obj.Name(), "."))
-		if err != nil {
-			LogFatal(err.Error())
-		}
-		// Create Folder object with its name and its file count
-		f := Folder{Name: obj.Name(), Count: len(subFiles)}
-		folders.Folders = append(folders.Folders, f)
-	}
-	WriteOutJSONMessage(folders, w)
+func (s *Server) GetFolders(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "GetFolders")
+	// Grab all folders and their file counts from the metadata index
+	folders := FoldersList{Folders: s.index.folderList()}
+	s.log.WriteOutJSONMessage(folders, w)
 }
 
 // GetFiles is a method to accept a POST request for a specific folder in the Data path requesting files
 // from startIndex to endIndex(exclusively). Must also send a dictionary with the keys of the attributes you want to extract
-func GetFiles(w http.ResponseWriter, req *http.Request) {
-	LogServerCall(req, "GetFiles")
+func (s *Server) GetFiles(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "GetFiles")
 	decoder := json.NewDecoder(req.Body)
 	var data GetFilesWithAttributes
 	err := decoder.Decode(&data)
+	defer req.Body.Close()
 	if err != nil {
-		LoglnArgs("Post File Error:", err)
+		s.log.LoglnArgs("Post File Error:", err)
+		s.writeError(w, req, newAPIError(http.StatusBadRequest, CodeBadRequest, "ERROR: could not parse files request; %s", err))
+		return
 	}
-	defer req.Body.Close()
 	// check if out of range
 	if data.StartIndex > data.EndIndex || data.StartIndex < 0 || data.EndIndex < 0 {
-		LogFatal(fmt.Sprintf("ERROR: folder: %s, startIndex: %d, endIndex: %d", data.Folder, data.StartIndex, data.EndIndex))
-		errFiles := FileDataList{Error: fmt.Sprintf("ERROR: Either start or end index is incorrect. startIndex: %d, endIndex: %d", data.StartIndex, data.EndIndex)}
-		WriteOutJSONMessage(errFiles, w)
+		s.writeError(w, req, newAPIError(http.StatusBadRequest, CodeOutOfRange, "ERROR: Either start or end index is incorrect. startIndex: %d, endIndex: %d", data.StartIndex, data.EndIndex))
 		return
 	}
-	// get list of files from folder
-	files, err := ioutil.ReadDir(filepath.Join(RootPath, data.Folder))
-	if err != nil {
-		log.Fatal(err)
-		errFiles := FileDataList{Error: "ERROR: Folder given could not be opened. Folder: " + data.Folder}
-		WriteOutJSONMessage(errFiles, w)
+	// get list of files in folder from the metadata index
+	files, ok := s.index.files(data.Folder)
+	if !ok {
+		s.writeError(w, req, newAPIError(http.StatusNotFound, CodeNotFound, "ERROR: Folder given could not be opened. Folder: %s", data.Folder))
 		return
 	}
-	// create Header object with empty FileData object because it will be populated from the read
-	headerObj := createHeaderObject(data.Attributes)
+	// an end past the last file gives the files up to the end of the folder
+	if data.EndIndex > len(files) {
+		data.EndIndex = len(files)
+	}
+	if data.StartIndex > data.EndIndex {
+		data.StartIndex = data.EndIndex
+	}
 	allFiles := FileDataList{Files: make([]FileData, 0)}
+	// sent is the bytes of the files in the response, counted as downloaded in the metrics
+	var sent int64
 	for _, obj := range files[data.StartIndex:data.EndIndex] {
+		// create Header object with the requested keys because it will be populated from the read
+		headerObj := createHeaderObject(data.Attributes)
 		// create SaveFile object from reading file
-		saveFileObj, err := sfile.ReadSaveFile([]byte(obj.Name()), headerObj)
+		fileHash, err := hex.DecodeString(obj.Hash)
 		if err != nil {
-			log.Fatal(err)
+			s.writeError(w, req, fmt.Errorf("ERROR: metadata index has a bad hash %q in %s; %s", obj.Hash, data.Folder, err))
+			return
+		}
+		saveFileObj, err := sfile.ReadSaveFile(s.store, saveFileName(data.Folder, fileHash), headerObj)
+		if err != nil {
+			s.writeError(w, req, fmt.Errorf("ERROR: could not read file %s in %s; %s", obj.Hash, data.Folder, err))
+			return
 		}
 		// base64 encode data
 		dstData := make([]byte, base64.StdEncoding.EncodedLen(len(saveFileObj.Data)))
 		base64.StdEncoding.Encode(dstData, saveFileObj.Data)
 		// map our objects
-		headerMap := saveFileObj.Header.GetHeader()
-		for i, v := range data.SortedAttributeKeys() {
-			data.Attributes[v] = headerMap[i]
+		attributes := selectAttributes(headerObj, data.Attributes)
+		contentType, ok := headerObj.Attributes[MimeTypeAttribute].(string)
+		if !ok || contentType == "" {
+			// files uploaded before content types were stored
+			contentType = DetectMimeType(saveFileObj.Data)
 		}
-		// Split on path separator to grab file hash
-		validFile := strings.Split(obj.Name(), string(os.PathSeparator))
 		// base64 encode file hash
-		dstValid := make([]byte, base64.StdEncoding.EncodedLen(len(validFile[len(validFile)-1])))
-		base64.StdEncoding.Encode(dstValid, []byte(validFile[len(validFile)-1]))
+		dstValid := make([]byte, base64.StdEncoding.EncodedLen(len(fileHash)))
+		base64.StdEncoding.Encode(dstValid, fileHash)
 		// create our object
-		f := FileData{Data: dstData, Size: int64(saveFileObj.Size), StartIndex: 0, ValidateFile: dstValid, Attributes: data.Attributes}
+		f := FileData{Data: dstData, Size: int64(saveFileObj.Size), StartIndex: 0, ValidateFile: dstValid, ContentType: contentType, Attributes: attributes}
 		allFiles.Files = append(allFiles.Files, f)
+		sent += int64(len(saveFileObj.Data))
 	}
-	WriteOutJSONMessage(allFiles, w)
+	s.log.WriteOutJSONMessage(allFiles, w)
+	s.metrics.downloaded.Add(sent)
 }
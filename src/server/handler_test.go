@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestUploadFolder(t *testing.T) {
+	s := openTestServer(t)
+	post := func(data FileData) UploadResult {
+		t.Helper()
+		w := postJSON(t, s, "/post_file", data)
+		var result UploadResult
+		err := json.Unmarshal(w.Body.Bytes(), &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// a file started in a chosen folder carries on there when later chunks leave the folder out
+	body := []byte("first half, second half")
+	sum := sha256.Sum256(body)
+	result := post(FileData{Data: body[:11], ValidateFile: sum[:], Size: int64(len(body)), Folder: "chosen/sub"})
+	if result.Error != "" || result.Folder != "chosen/sub" || result.Count != 11 {
+		t.Fatalf("first chunk gave %+v", result)
+	}
+	result = post(FileData{Data: body[11:], ValidateFile: sum[:], StartIndex: 11, Size: int64(len(body))})
+	if result.Error != "" || result.Folder != "chosen/sub" || result.Count != len(body) {
+		t.Fatalf("second chunk gave %+v", result)
+	}
+	s.background.Wait()
+	file, ok := s.index.file("chosen/sub", hex.EncodeToString(sum[:]))
+	if !ok || !file.Complete || file.Size != int64(len(body)) {
+		t.Errorf("file in chosen/sub is %+v, %t", file, ok)
+	}
+	if _, ok := s.index.files("chosen/sub"); !ok {
+		t.Error("chosen/sub is not a folder in the index")
+	}
+
+	// a new upload without a folder goes to the folder of the layout
+	body = []byte("a new upload")
+	sum = sha256.Sum256(body)
+	want := s.layoutFolder(nil, s.now())
+	result = post(FileData{Data: body, ValidateFile: sum[:], Size: int64(len(body))})
+	if result.Error != "" || result.Folder != want {
+		t.Fatalf("upload without a folder gave %+v, want folder %s", result, want)
+	}
+
+	// folders that are not valid names are refused before anything is written
+	for _, folder := range []string{".hidden", "a/../b", "a\\b", "/abs"} {
+		body = []byte("chunked upload body")
+		sum = sha256.Sum256(body)
+		w := postJSON(t, s, "/post_file", FileData{Data: body, ValidateFile: sum[:], Size: int64(len(body)), Folder: folder})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("folder %q gave status %d", folder, w.Code)
+		}
+		if _, ok := s.index.findFile(hex.EncodeToString(sum[:])); ok {
+			t.Errorf("folder %q wrote the file", folder)
+		}
+	}
+}
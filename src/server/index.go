@@ -0,0 +1,615 @@
+package server
+
+// index file to hold the persistent metadata index that folder counts, listings and searches are served from
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sfile"
+	"sort"
+	"storage"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IndexFolder is the name of the folder inside the root path the metadata index is kept in.
+// The index stays on the local disk whatever storage the files are kept in, since it can always be built again from them.
+const IndexFolder = ".index"
+
+// indexFileName is the name of the index log inside IndexFolder
+const indexFileName = "index.log"
+
+// UploadTimeAttribute is the reserved header attribute the time a file was first uploaded is stored in.
+// It is set once from the first chunk, so it does not change when the SAVE file is written to, rewritten or moved.
+const UploadTimeAttribute = "UploadTime"
+
+// indexCompactAfter is how many entries can be appended to the index log before it is compacted,
+// as long as there are also more appended entries than files in the index.
+const indexCompactAfter = 1000
+
+// operations of the entries in the index log
+const (
+	indexOpPut          = "put"
+	indexOpDelete       = "delete"
+	indexOpFolder       = "folder"
+	indexOpRemoveFolder = "remove_folder"
+)
+
+// indexEntry is an object for a single line of the index log
+type indexEntry struct {
+	Op     string
+	Folder string
+	Hash   string
+	File   *FileMetadata
+}
+
+// metadataIndex is an object that holds the metadata of every file in memory and keeps it
+// on disk as an append-only log of changes that is compacted every so often.
+// Without a root path it is only kept in memory.
+type metadataIndex struct {
+	mu     sync.RWMutex
+	store  storage.Storage
+	logger *Logger
+	// path is the path of the log, empty when the index is only kept in memory
+	path   string
+	log    *os.File
+	closed bool
+	// folder name to file hash to file metadata
+	folders map[string]map[string]FileMetadata
+	// entries appended to the log since it was last compacted
+	appended int
+}
+
+// Reindex is a method to throw away the metadata index of the server's root path and build it again
+// from the SAVE files. It can not be used while the server is started, here or in another process.
+// @return int The number of files indexed
+// @return error
+func (s *Server) Reindex() (int, error) {
+	if s.openIndex() != nil {
+		return 0, errors.New("error: the index can not be rebuilt while the server is started")
+	}
+	lock, err := lockRoot(s.root)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+	if s.root != "" {
+		err = os.Remove(filepath.Join(s.root, IndexFolder, indexFileName))
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	ix, err := openMetadataIndex(s.root, s.store, s.log)
+	if err != nil {
+		return 0, err
+	}
+	defer ix.close()
+	return ix.fileCount(), nil
+}
+
+// openMetadataIndex loads the index log of a root path, or builds it from the SAVE files in a storage if it does not exist.
+// Without a root path the index is built every time and only kept in memory.
+// @param root string The root path, or empty
+// @param store storage.Storage The storage the SAVE files are in
+// @param logger *Logger
+// @return *metadataIndex
+// @return error
+func openMetadataIndex(root string, store storage.Storage, logger *Logger) (*metadataIndex, error) {
+	ix := &metadataIndex{store: store, logger: logger, folders: make(map[string]map[string]FileMetadata)}
+	if root == "" {
+		err := ix.rebuild()
+		if err != nil {
+			return nil, err
+		}
+		return ix, nil
+	}
+	path := filepath.Join(root, IndexFolder, indexFileName)
+	ix.path = path
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		logger.Logf("building metadata index %s", path)
+		err = ix.rebuild()
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		err = ix.load(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// start every run from a compacted log
+	err = ix.compact()
+	if err != nil {
+		return nil, err
+	}
+	return ix, nil
+}
+
+// load replays the entries of the index log.
+// A broken last line, from the server stopping in the middle of a write, is skipped.
+// @param file *os.File
+// @return error
+func (ix *metadataIndex) load(file *os.File) error {
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry indexEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			ix.logger.LogWarnf("skipping broken metadata index entry; %s", err)
+			continue
+		}
+		ix.apply(entry)
+	}
+	return scanner.Err()
+}
+
+// rebuild reads the metadata of every SAVE file in every folder of the storage into the index
+// @return error
+func (ix *metadataIndex) rebuild() error {
+	ix.folders = make(map[string]map[string]FileMetadata)
+	return ix.rebuildFolder("")
+}
+
+// rebuildFolder reads the SAVE files of a folder into the index and then goes through its sub folders.
+// Folders are only added when they have files or no sub folders, so the year and month folders
+// of a nested folder layout are not listed themselves.
+// @param folder string The name of the folder, empty for the root of the storage itself
+// @return error
+func (ix *metadataIndex) rebuildFolder(folder string) error {
+	entries, err := ix.store.ReadDir(folder)
+	if err != nil {
+		return err
+	}
+	subFolders := make([]string, 0)
+	files := make([]storage.Info, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir {
+			// hidden folders such as the thumbnail cache and the index are not data folders
+			if !strings.HasPrefix(entry.Name, ".") {
+				subFolders = append(subFolders, path.Join(folder, entry.Name))
+			}
+		} else if folder != "" && !strings.HasSuffix(entry.Name, sfile.TempSuffix) {
+			// a tmp file is a header rewrite that was interrupted, the SAVE file it was replacing is still there
+			files = append(files, entry)
+		}
+	}
+	if folder != "" && (len(files) > 0 || len(subFolders) == 0) {
+		ix.apply(indexEntry{Op: indexOpFolder, Folder: folder})
+	}
+	for _, info := range files {
+		file, err := ix.readFileMetadata(folder, info)
+		if err != nil {
+			ix.logger.LogWarnf("could not index file %x in %s; %s", info.Name, folder, err)
+			continue
+		}
+		ix.apply(indexEntry{Op: indexOpPut, Folder: folder, Hash: file.Hash, File: &file})
+	}
+	for _, subFolder := range subFolders {
+		err = ix.rebuildFolder(subFolder)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply applies an entry to the in memory index
+// @param entry indexEntry
+func (ix *metadataIndex) apply(entry indexEntry) {
+	switch entry.Op {
+	case indexOpFolder:
+		if _, ok := ix.folders[entry.Folder]; !ok {
+			ix.folders[entry.Folder] = make(map[string]FileMetadata)
+		}
+	case indexOpRemoveFolder:
+		delete(ix.folders, entry.Folder)
+	case indexOpPut:
+		if entry.File == nil {
+			return
+		}
+		if _, ok := ix.folders[entry.Folder]; !ok {
+			ix.folders[entry.Folder] = make(map[string]FileMetadata)
+		}
+		ix.folders[entry.Folder][entry.Hash] = *entry.File
+	case indexOpDelete:
+		if files, ok := ix.folders[entry.Folder]; ok {
+			delete(files, entry.Hash)
+		}
+	}
+}
+
+// write applies an entry and appends it to the index log, compacting the log when it has grown too much.
+// @param entry indexEntry
+// @return error
+func (ix *metadataIndex) write(entry indexEntry) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.closed {
+		return errors.New("error: metadata index is closed")
+	}
+	ix.apply(entry)
+	if ix.path == "" {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = ix.log.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	ix.appended++
+	if ix.appended > indexCompactAfter && ix.appended > ix.fileCountLocked() {
+		return ix.compact()
+	}
+	return nil
+}
+
+// compact writes the current state of the index to a new log, replaces the old log with it
+// and opens it for appending. The caller must hold the write lock or be the only user of the index.
+// @return error
+func (ix *metadataIndex) compact() error {
+	tmpPath := ix.path + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmpFile)
+	encoder := json.NewEncoder(writer)
+	for _, folder := range ix.folderNamesLocked() {
+		err = encoder.Encode(indexEntry{Op: indexOpFolder, Folder: folder})
+		for _, file := range ix.filesLocked(folder) {
+			if err != nil {
+				break
+			}
+			f := file
+			err = encoder.Encode(indexEntry{Op: indexOpPut, Folder: folder, Hash: file.Hash, File: &f})
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, ix.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if ix.log != nil {
+		ix.log.Close()
+	}
+	ix.log, err = os.OpenFile(ix.path, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	ix.appended = 0
+	return nil
+}
+
+// close closes the index log
+func (ix *metadataIndex) close() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.closed = true
+	if ix.log == nil {
+		return nil
+	}
+	err := ix.log.Sync()
+	if closeErr := ix.log.Close(); err == nil {
+		err = closeErr
+	}
+	ix.log = nil
+	return err
+}
+
+// putFile adds or replaces the metadata of a file
+// @param file FileMetadata
+// @return error
+func (ix *metadataIndex) putFile(file FileMetadata) error {
+	return ix.write(indexEntry{Op: indexOpPut, Folder: file.Folder, Hash: file.Hash, File: &file})
+}
+
+// deleteFile removes a file from the index
+// @param folder string
+// @param hash string The hex encoded hash of the file
+// @return error
+func (ix *metadataIndex) deleteFile(folder, hash string) error {
+	return ix.write(indexEntry{Op: indexOpDelete, Folder: folder, Hash: hash})
+}
+
+// addFolder adds an empty folder to the index if it is not in it already
+// @param folder string
+// @return error
+func (ix *metadataIndex) addFolder(folder string) error {
+	ix.mu.RLock()
+	_, ok := ix.folders[folder]
+	ix.mu.RUnlock()
+	if ok {
+		return nil
+	}
+	return ix.write(indexEntry{Op: indexOpFolder, Folder: folder})
+}
+
+// removeFolder removes a folder and all of its files from the index
+// @param folder string
+// @return error
+func (ix *metadataIndex) removeFolder(folder string) error {
+	return ix.write(indexEntry{Op: indexOpRemoveFolder, Folder: folder})
+}
+
+// folderList returns every folder with its file count, in name order
+// @return []Folder
+func (ix *metadataIndex) folderList() []Folder {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	folders := make([]Folder, 0, len(ix.folders))
+	for _, name := range ix.folderNamesLocked() {
+		folders = append(folders, Folder{Name: name, Count: len(ix.folders[name])})
+	}
+	return folders
+}
+
+// folderUsage is an object that holds how many files a folder has, how many bytes they take up
+// and how many of them are still being uploaded
+type folderUsage struct {
+	Name    string
+	Files   int
+	Bytes   int64
+	Partial int
+}
+
+// usage returns the files, bytes and partial uploads of every folder, in name order.
+// A file that is still being uploaded counts with its whole size.
+// @return []folderUsage
+func (ix *metadataIndex) usage() []folderUsage {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	usages := make([]folderUsage, 0, len(ix.folders))
+	for _, name := range ix.folderNamesLocked() {
+		u := folderUsage{Name: name, Files: len(ix.folders[name])}
+		for _, file := range ix.folders[name] {
+			u.Bytes += file.Size
+			if !file.Complete {
+				u.Partial++
+			}
+		}
+		usages = append(usages, u)
+	}
+	return usages
+}
+
+// folderBytes returns the bytes the files of a folder take up, with the whole size of the ones still being uploaded
+// @param folder string
+// @return int64
+func (ix *metadataIndex) folderBytes(folder string) int64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	var size int64
+	for _, file := range ix.folders[folder] {
+		size += file.Size
+	}
+	return size
+}
+
+// deviceBytes returns the bytes the files uploaded by a device take up across every folder,
+// with the whole size of the ones still being uploaded
+// @param device string The ID of the device
+// @return int64
+func (ix *metadataIndex) deviceBytes(device string) int64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	var size int64
+	for _, files := range ix.folders {
+		for _, file := range files {
+			if file.Attributes[DeviceAttribute] == device {
+				size += file.Size
+			}
+		}
+	}
+	return size
+}
+
+// partialUploads returns the files that are still being uploaded, in every folder
+// @return []FileMetadata
+func (ix *metadataIndex) partialUploads() []FileMetadata {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	partial := make([]FileMetadata, 0)
+	for _, files := range ix.folders {
+		for _, file := range files {
+			if !file.Complete {
+				partial = append(partial, file)
+			}
+		}
+	}
+	return partial
+}
+
+// subFolders returns a folder and the folders nested in it, in name order
+// @param folder string
+// @return []string
+func (ix *metadataIndex) subFolders(folder string) []string {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	names := make([]string, 0)
+	for _, name := range ix.folderNamesLocked() {
+		if name == folder || strings.HasPrefix(name, folder+"/") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// files returns the files of a folder in hash order
+// @param folder string
+// @return []FileMetadata
+// @return bool false if the folder is not in the index
+func (ix *metadataIndex) files(folder string) ([]FileMetadata, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	if _, ok := ix.folders[folder]; !ok {
+		return nil, false
+	}
+	return ix.filesLocked(folder), true
+}
+
+// file returns the metadata of a single file
+// @param folder string
+// @param hash string The hex encoded hash of the file
+// @return FileMetadata
+// @return bool false if the file is not in the index
+func (ix *metadataIndex) file(folder, hash string) (FileMetadata, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	file, ok := ix.folders[folder][hash]
+	return file, ok
+}
+
+// findFile returns the metadata of a file in whichever folder it is in.
+// If the same file is in more than one folder the first folder by name is used.
+// @param hash string The hex encoded hash of the file
+// @return FileMetadata
+// @return bool false if the file is not in the index
+func (ix *metadataIndex) findFile(hash string) (FileMetadata, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	for _, folder := range ix.folderNamesLocked() {
+		if file, ok := ix.folders[folder][hash]; ok {
+			return file, true
+		}
+	}
+	return FileMetadata{}, false
+}
+
+// findUpload returns the metadata of a file that is still being uploaded, in whichever folder it is in.
+// @param hash string The hex encoded hash of the file
+// @return FileMetadata
+// @return bool false if no upload of the file is in progress
+func (ix *metadataIndex) findUpload(hash string) (FileMetadata, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	for _, folder := range ix.folderNamesLocked() {
+		if file, ok := ix.folders[folder][hash]; ok && !file.Complete {
+			return file, true
+		}
+	}
+	return FileMetadata{}, false
+}
+
+// allFiles returns every file in folder and then hash order
+// @return []FileMetadata
+func (ix *metadataIndex) allFiles() []FileMetadata {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	files := make([]FileMetadata, 0)
+	for _, folder := range ix.folderNamesLocked() {
+		files = append(files, ix.filesLocked(folder)...)
+	}
+	return files
+}
+
+// fileCount returns the number of files in the index
+// @return int
+func (ix *metadataIndex) fileCount() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.fileCountLocked()
+}
+
+func (ix *metadataIndex) fileCountLocked() int {
+	count := 0
+	for _, files := range ix.folders {
+		count += len(files)
+	}
+	return count
+}
+
+func (ix *metadataIndex) folderNamesLocked() []string {
+	names := make([]string, 0, len(ix.folders))
+	for name := range ix.folders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (ix *metadataIndex) filesLocked(folder string) []FileMetadata {
+	files := make([]FileMetadata, 0, len(ix.folders[folder]))
+	for _, file := range ix.folders[folder] {
+		files = append(files, file)
+	}
+	// hex keeps the byte order of the hashes, so this is the same order the folder is read in
+	sort.Slice(files, func(i, j int) bool { return files[i].Hash < files[j].Hash })
+	return files
+}
+
+// readFileMetadata reads the header of a SAVE file into a FileMetadata object.
+// The upload time is the UploadTime attribute, or the time the SAVE file was last changed for files
+// that were uploaded before it was stored.
+// @param folder string The name of the folder the file is in
+// @param info storage.Info The file's info from reading the folder
+// @return FileMetadata
+// @return error
+func (ix *metadataIndex) readFileMetadata(folder string, info storage.Info) (FileMetadata, error) {
+	headerObj := createHeaderObject(nil)
+	saveFileObj, err := sfile.ReadSaveFileHeader(ix.store, saveFileName(folder, []byte(info.Name)), headerObj)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	attributes := selectAttributes(headerObj, nil)
+	uploaded := info.ModTime.UTC().Format(time.RFC3339)
+	if t, err := time.Parse(time.RFC3339, attributes[UploadTimeAttribute]); err == nil {
+		uploaded = t.UTC().Format(time.RFC3339)
+	}
+	return FileMetadata{
+		Folder:      folder,
+		Hash:        hex.EncodeToString([]byte(info.Name)),
+		Size:        saveFileObj.TotalSize,
+		Complete:    int64(saveFileObj.Size) == saveFileObj.TotalSize,
+		Uploaded:    uploaded,
+		ContentType: attributes[MimeTypeAttribute],
+		Attributes:  attributes,
+	}, nil
+}
+
+// indexSaveFile reads the header of a SAVE file and puts its metadata in the index
+// @param folder string The name of the folder the file is in
+// @param hash []byte The hash of the file
+// @return error
+func (ix *metadataIndex) indexSaveFile(folder string, hash []byte) error {
+	info, err := ix.store.Stat(string(saveFileName(folder, hash)))
+	if err != nil {
+		return err
+	}
+	file, err := ix.readFileMetadata(folder, info)
+	if err != nil {
+		return err
+	}
+	return ix.putFile(file)
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sfile"
+	"storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLogger returns a Logger that throws its log away
+func testLogger(t *testing.T) *Logger {
+	t.Helper()
+	logger, err := NewLogger(io.Discard, "error", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logger
+}
+
+// openTestIndex opens the metadata index of a root path and closes it when the test ends
+func openTestIndex(t *testing.T, root string, store storage.Storage) *metadataIndex {
+	t.Helper()
+	ix, err := openMetadataIndex(root, store, testLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ix.close() })
+	return ix
+}
+
+// logLines returns the lines of the index log of a root path
+func logLines(t *testing.T, root string) []string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(root, IndexFolder, indexFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestIndexLogReplay(t *testing.T) {
+	root := t.TempDir()
+	store := storage.NewMemory()
+	ix := openTestIndex(t, root, store)
+	kept := FileMetadata{Folder: "a", Hash: "01", Size: 5, Complete: true, Uploaded: "2024-07-14T10:00:00Z", Attributes: map[string]string{"Name": "kept.jpg"}}
+	changes := []func() error{
+		func() error { return ix.addFolder("a") },
+		func() error { return ix.addFolder("b/c") },
+		func() error { return ix.putFile(FileMetadata{Folder: "a", Hash: "01", Size: 1}) },
+		func() error { return ix.putFile(kept) },
+		func() error { return ix.putFile(FileMetadata{Folder: "a", Hash: "02", Size: 7}) },
+		func() error { return ix.deleteFile("a", "02") },
+		func() error { return ix.putFile(FileMetadata{Folder: "b/c", Hash: "03", Size: 9}) },
+		func() error { return ix.removeFolder("b/c") },
+		func() error { return ix.addFolder("d") },
+		// adding a folder that is already there writes nothing
+		func() error { return ix.addFolder("a") },
+	}
+	for _, change := range changes {
+		err := change()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lines := logLines(t, root); len(lines) != len(changes)-1 {
+		t.Errorf("the log has %d lines, want %d", len(lines), len(changes)-1)
+	}
+	ix.close()
+	// the server stopped in the middle of writing a line
+	log, err := os.OpenFile(filepath.Join(root, IndexFolder, indexFileName), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.WriteString(`{"Op":"put","Folder":"a","Hash":"04","Fi`)
+	log.Close()
+
+	ix = openTestIndex(t, root, store)
+	want := []Folder{{Name: "a", Count: 1}, {Name: "d", Count: 0}}
+	if got := ix.folderList(); !reflect.DeepEqual(got, want) {
+		t.Errorf("folders are %v, want %v", got, want)
+	}
+	if got, _ := ix.file("a", "01"); !reflect.DeepEqual(got, kept) {
+		t.Errorf("file is %+v, want %+v", got, kept)
+	}
+	// the log is compacted when it is opened, to a folder line for each folder and a put line for each file
+	if lines := logLines(t, root); len(lines) != 3 {
+		t.Errorf("the compacted log has %d lines, want 3:\n%s", len(lines), strings.Join(lines, "\n"))
+	}
+}
+
+func TestIndexCompactsWhileWriting(t *testing.T) {
+	root := t.TempDir()
+	ix := openTestIndex(t, root, storage.NewMemory())
+	for i := 0; i <= indexCompactAfter; i++ {
+		err := ix.putFile(FileMetadata{Folder: "a", Hash: "01", Size: int64(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lines := logLines(t, root); len(lines) != 2 {
+		t.Errorf("the log has %d lines after rewriting one file %d times, want it compacted to 2", len(lines), indexCompactAfter+1)
+	}
+	// writes after the compaction go to the new log
+	err := ix.putFile(FileMetadata{Folder: "a", Hash: "02"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := logLines(t, root); len(lines) != 3 {
+		t.Errorf("the log has %d lines, want 3", len(lines))
+	}
+}
+
+func TestIndexRebuild(t *testing.T) {
+	store := storage.NewMemory()
+	data := bytes.Repeat([]byte("x"), 10)
+	hashA := bytes.Repeat([]byte{0xaa}, 32)
+	hashB := bytes.Repeat([]byte{0xbb}, 32)
+	writeSaveFileWithHash(t, store, "2024/07", hashA, map[string]string{"Name": "a.txt", UploadTimeAttribute: "2024-07-14T10:00:00+02:00"}, data, len(data))
+	writeSaveFileWithHash(t, store, "2024/07", hashB, map[string]string{"Name": "b.txt"}, data, 4)
+	// hidden folders are not data folders, and neither are files in the root or the year folder above the month
+	writeSaveFileWithHash(t, store, "2024/07/"+ThumbnailFolder, hashA, nil, data, len(data))
+	writeSaveFileWithHash(t, store, "", hashA, nil, data, len(data))
+	if err := store.MkdirAll("empty"); err != nil {
+		t.Fatal(err)
+	}
+	// a header rewrite that was interrupted leaves a tmp file next to the SAVE file
+	writeSaveFileWithHash(t, store, "2024/07", append(bytes.Repeat([]byte{0xaa}, 32), sfile.TempSuffix...), map[string]string{"Name": "a.txt"}, data, len(data))
+	ix := openTestIndex(t, t.TempDir(), store)
+	want := []Folder{{Name: "2024/07", Count: 2}, {Name: "empty", Count: 0}}
+	if got := ix.folderList(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("folders are %v, want %v", got, want)
+	}
+	a, _ := ix.file("2024/07", strings.Repeat("aa", 32))
+	if !a.Complete || a.Size != 10 || a.Attributes["Name"] != "a.txt" || a.Uploaded != "2024-07-14T08:00:00Z" {
+		t.Errorf("complete file is %+v", a)
+	}
+	b, _ := ix.file("2024/07", strings.Repeat("bb", 32))
+	if b.Complete || b.Size != 10 {
+		t.Errorf("partial file is %+v", b)
+	}
+	// a file without an upload time falls back to the time its SAVE file was written
+	if uploaded, err := time.Parse(time.RFC3339, b.Uploaded); err != nil || time.Since(uploaded) > time.Minute {
+		t.Errorf("partial file was uploaded at %q", b.Uploaded)
+	}
+}
+
+func TestUploadTimeKept(t *testing.T) {
+	store := storage.NewMemory()
+	data := []byte("some data")
+	hash := bytes.Repeat([]byte{0xcc}, 32)
+	writeSaveFileWithHash(t, store, "f", hash, map[string]string{UploadTimeAttribute: "2020-01-02T03:04:05Z"}, data, 4)
+	ix := openTestIndex(t, t.TempDir(), store)
+	// writing the rest of the file and rewriting its header do not change when it was uploaded
+	_, err := sfile.WriteSaveFile(store, saveFileName("f", hash), data[4:], createHeaderObject(nil), 4, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerObj := createHeaderObject(nil)
+	_, err = sfile.ReadSaveFileHeader(store, saveFileName("f", hash), headerObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerObj.Attributes["Name"] = "renamed.txt"
+	err = sfile.RewriteHeader(store, saveFileName("f", hash), headerObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ix.indexSaveFile("f", hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, _ := ix.file("f", strings.Repeat("cc", 32))
+	if file.Uploaded != "2020-01-02T03:04:05Z" || !file.Complete || file.Attributes["Name"] != "renamed.txt" {
+		t.Errorf("file is %+v", file)
+	}
+}
+
+func TestIndexLegacyHeader(t *testing.T) {
+	store := storage.NewMemory()
+	data := testPNG(t, 4, 4)
+	hash := bytes.Repeat([]byte{0xdd}, 32)
+	if err := store.MkdirAll("old"); err != nil {
+		t.Fatal(err)
+	}
+	// files uploaded before headers stored their keys only hold the values, in the keys' alphabetical order
+	legacy := &sfile.SimpleHeader{Attributes: map[string]interface{}{"Date": "2019-05-06", "Name": "a.png"}}
+	_, err := sfile.WriteSaveFile(store, saveFileName("old", hash), data, legacy, 0, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix := openTestIndex(t, t.TempDir(), store)
+	file, ok := ix.file("old", strings.Repeat("dd", 32))
+	want := map[string]string{"Value0": "2019-05-06", "Value1": "a.png"}
+	if !ok || !file.Complete || !reflect.DeepEqual(file.Attributes, want) {
+		t.Fatalf("legacy file is %+v, %t", file, ok)
+	}
+	if _, err := decodeImage(store, "old", hash); err != nil {
+		t.Errorf("could not decode the legacy file; %s", err)
+	}
+	// the header keeps its format, so clients can still read it by the keys they uploaded it with
+	if err := mergeFileMetadata(store, "old", hash); err != nil {
+		t.Fatal(err)
+	}
+	headerObj := createHeaderObject(map[string]string{"Date": "", "Name": ""})
+	if _, err := sfile.ReadSaveFileHeader(store, saveFileName("old", hash), headerObj); err != nil {
+		t.Fatal(err)
+	}
+	if !headerObj.Legacy || headerObj.Attributes["Name"] != "a.png" || headerObj.Attributes["Date"] != "2019-05-06" {
+		t.Errorf("legacy header read by its keys is %v", headerObj.Attributes)
+	}
+}
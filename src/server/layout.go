@@ -0,0 +1,286 @@
+package server
+
+// layout file to hold the logic for the folder layout that decides which folder new uploads are put into
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultFolderLayout is the folder layout used when none is set.
+// It gives the date folders the server has always used, like "2017-8-30".
+const DefaultFolderLayout = "{year}-{month}-{day}"
+
+// unknownLayoutValue is put in a folder name in place of an attribute the file does not have
+const unknownLayoutValue = "unknown"
+
+// layoutPart is a piece of a folder layout, either literal text or a field
+// with the zero padded width it is written with
+type layoutPart struct {
+	text  string
+	field string
+	width int
+}
+
+// folderLayout is an object that holds a parsed folder layout template
+type folderLayout struct {
+	template string
+	parts    []layoutPart
+}
+
+// ValidFolderLayout is a method to check a template that decides which folder new uploads are put into.
+// Fields in braces are filled in from the file: {year}, {month}, {day}, {hour} and {minute} come from the
+// CaptureTime attribute, or the upload time when it has none, and any other field is the attribute with
+// that name, like {CameraModel}. A field can be zero padded to a width, like {month:02}.
+// Folders are nested with "/", like "{year}/{month:02}/{day:02}".
+// @param template string
+// @return error
+func ValidFolderLayout(template string) error {
+	_, err := parseFolderLayout(template)
+	return err
+}
+
+// FolderLayout is a method to get the template that decides which folder new uploads are put into.
+// @return string
+func (s *Server) FolderLayout() string {
+	return s.layout.template
+}
+
+// parseFolderLayout parses a folder layout template and checks that it gives valid folder names.
+// @param template string
+// @return *folderLayout
+// @return error
+func parseFolderLayout(template string) (*folderLayout, error) {
+	layout := &folderLayout{template: template}
+	rest := template
+	for rest != "" {
+		start := strings.IndexAny(rest, "{}")
+		if start < 0 {
+			layout.parts = append(layout.parts, layoutPart{text: rest})
+			break
+		}
+		if rest[start] == '}' {
+			return nil, fmt.Errorf("error: folder layout %q has a } without a {", template)
+		}
+		if start > 0 {
+			layout.parts = append(layout.parts, layoutPart{text: rest[:start]})
+		}
+		end := strings.IndexAny(rest[start+1:], "{}")
+		if end < 0 || rest[start+1+end] != '}' {
+			return nil, fmt.Errorf("error: folder layout %q has a { without a }", template)
+		}
+		part, err := parseLayoutField(rest[start+1 : start+1+end])
+		if err != nil {
+			return nil, fmt.Errorf("error: folder layout %q; %s", template, err)
+		}
+		layout.parts = append(layout.parts, part)
+		rest = rest[start+2+end:]
+	}
+	err := validFolderName(layout.folder(nil, time.Unix(0, 0)))
+	if err != nil {
+		return nil, fmt.Errorf("error: folder layout %q does not give a valid folder name; %s", template, err)
+	}
+	return layout, nil
+}
+
+// parseLayoutField parses the inside of the braces of a folder layout field, like "month:02"
+// @param field string
+// @return layoutPart
+// @return error
+func parseLayoutField(field string) (layoutPart, error) {
+	name, width, padded := strings.Cut(field, ":")
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return layoutPart{}, fmt.Errorf("field {%s} does not have a valid name", field)
+	}
+	part := layoutPart{field: name}
+	if padded {
+		n, err := strconv.Atoi(width)
+		if err != nil || n < 1 || n > 20 {
+			return layoutPart{}, fmt.Errorf("field {%s} must have a width like :02", field)
+		}
+		part.width = n
+	}
+	return part, nil
+}
+
+// folder fills in the folder layout for a file
+// @param attributes map[string]string The attributes of the file
+// @param uploaded time.Time The time used when the file has no CaptureTime attribute
+// @return string The folder name
+func (l *folderLayout) folder(attributes map[string]string, uploaded time.Time) string {
+	t := uploaded
+	if captured, ok := parseCaptureTime(attributeValue(attributes, CaptureTimeAttribute)); ok {
+		t = captured
+	}
+	var name strings.Builder
+	for _, part := range l.parts {
+		switch part.field {
+		case "":
+			name.WriteString(part.text)
+		case "year":
+			name.WriteString(padLayoutValue(strconv.Itoa(t.Year()), part.width))
+		case "month":
+			name.WriteString(padLayoutValue(strconv.Itoa(int(t.Month())), part.width))
+		case "day":
+			name.WriteString(padLayoutValue(strconv.Itoa(t.Day()), part.width))
+		case "hour":
+			name.WriteString(padLayoutValue(strconv.Itoa(t.Hour()), part.width))
+		case "minute":
+			name.WriteString(padLayoutValue(strconv.Itoa(t.Minute()), part.width))
+		default:
+			name.WriteString(padLayoutValue(cleanLayoutValue(attributeValue(attributes, part.field)), part.width))
+		}
+	}
+	return name.String()
+}
+
+// attributeValue returns the value of an attribute, matching the key without case if there is no exact match
+// @param attributes map[string]string
+// @param key string
+// @return string
+func attributeValue(attributes map[string]string, key string) string {
+	if v, ok := attributes[key]; ok {
+		return v
+	}
+	for k, v := range attributes {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+// cleanLayoutValue makes an attribute value safe to use as part of a folder name
+// @param value string
+// @return string
+func cleanLayoutValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '-'
+		case r < ' ' || r == 0x7f:
+			return -1
+		}
+		return r
+	}, value)
+	value = strings.TrimLeft(strings.TrimSpace(value), ".")
+	if value == "" {
+		return unknownLayoutValue
+	}
+	return value
+}
+
+// padLayoutValue pads a number with zeros to the width given
+// @param value string
+// @param width int
+// @return string
+func padLayoutValue(value string, width int) string {
+	if _, err := strconv.Atoi(value); err != nil || len(value) >= width {
+		return value
+	}
+	return strings.Repeat("0", width-len(value)) + value
+}
+
+// layoutFolder returns the folder the server's folder layout gives for a new upload
+// @param attributes map[string]string The attributes of the file
+// @param uploaded time.Time The time used when the file has no CaptureTime attribute
+// @return string The folder name
+func (s *Server) layoutFolder(attributes map[string]string, uploaded time.Time) string {
+	return s.layout.folder(attributes, uploaded)
+}
+
+// folderDateLayouts are the date folder names Relayout reads the date of a file from
+// when it has no CaptureTime attribute
+var folderDateLayouts = []string{"2006-1-2", "2006/1/2"}
+
+// relayoutTime returns the time a file is put into a folder by when it has no CaptureTime attribute.
+// That is the date of the folder it is in when the folder is named after a date, otherwise its upload time.
+// @param file FileMetadata
+// @return time.Time
+func (s *Server) relayoutTime(file FileMetadata) time.Time {
+	for _, layout := range folderDateLayouts {
+		if t, err := time.ParseInLocation(layout, file.Folder, time.Local); err == nil {
+			return t
+		}
+	}
+	uploaded, err := time.Parse(time.RFC3339, file.Uploaded)
+	if err != nil {
+		return s.now()
+	}
+	return uploaded.Local()
+}
+
+// Relayout is a method to move complete files into the folders the server's folder layout gives for them.
+// Files are placed by their CaptureTime attribute, or by relayoutTime when they have none. Folders that
+// are left empty are deleted. Files that are still being uploaded are left where they are.
+// @param folders []string The folders to move files out of, every folder when empty
+// @param dryRun bool Only log the files that would be moved
+// @return int The number of files moved
+// @return error
+func (s *Server) Relayout(folders []string, dryRun bool) (int, error) {
+	if s.openIndex() == nil {
+		return 0, errors.New("error: metadata index is not open")
+	}
+	files := make([]FileMetadata, 0)
+	if len(folders) == 0 {
+		files = s.index.allFiles()
+	}
+	for _, folder := range folders {
+		folderFiles, ok := s.index.files(folder)
+		if !ok {
+			return 0, fmt.Errorf("error: folder %s does not exist", folder)
+		}
+		files = append(files, folderFiles...)
+	}
+	moved := 0
+	emptied := make(map[string]bool)
+	for _, file := range files {
+		toFolder := s.layoutFolder(file.Attributes, s.relayoutTime(file))
+		if toFolder == file.Folder {
+			continue
+		}
+		if !file.Complete {
+			s.log.Logf("not moving %s in %s, it is still being uploaded", file.Hash, file.Folder)
+			continue
+		}
+		if dryRun {
+			s.log.Logf("would move %s from %s to %s", file.Hash, file.Folder, toFolder)
+			moved++
+			continue
+		}
+		_, err := s.createFolder(toFolder)
+		if err != nil {
+			return moved, err
+		}
+		hash, _ := decodeHashParam(file.Hash)
+		err = s.MoveSaveFile(file.Folder, toFolder, hash)
+		if err != nil {
+			// such as the same file already being in the folder
+			s.log.LogWarnf("could not move %s from %s to %s; %s", file.Hash, file.Folder, toFolder, err)
+			continue
+		}
+		moved++
+		emptied[file.Folder] = true
+	}
+	// folders inside other folders come after them in name order, so going backwards removes them first
+	// and a folder that only held emptied folders is empty by the time it is checked
+	names := make([]string, 0, len(emptied))
+	for folder := range emptied {
+		names = append(names, folder)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, folder := range names {
+		files, _ := s.index.files(folder)
+		if len(files) == 0 && len(s.index.subFolders(folder)) == 1 {
+			err := s.DeleteFolder(folder, false)
+			if err != nil {
+				return moved, err
+			}
+		}
+	}
+	return moved, nil
+}
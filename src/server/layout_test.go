@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFolderLayout(t *testing.T) {
+	tests := []struct {
+		template string
+		// errText is part of the error the template gives, empty when it is valid
+		errText string
+	}{
+		{template: DefaultFolderLayout},
+		{template: "{year}/{month:02}/{day:02}"},
+		{template: "photos"},
+		{template: "{CameraModel}/{year}"},
+		{template: "{year}-{hour:2}h{minute:02}"},
+		{template: "", errText: "valid folder name"},
+		{template: "{year", errText: "{ without a }"},
+		{template: "{year{month}}", errText: "{ without a }"},
+		{template: "year}", errText: "} without a {"},
+		{template: "{}", errText: "valid name"},
+		{template: "{a/b}", errText: "valid name"},
+		{template: "{:02}", errText: "valid name"},
+		{template: "{month:}", errText: "width"},
+		{template: "{month:0}", errText: "width"},
+		{template: "{month:21}", errText: "width"},
+		{template: "{month:x}", errText: "width"},
+		{template: "/{year}", errText: "valid folder name"},
+		{template: "{year}/", errText: "valid folder name"},
+		{template: "{year}//{month}", errText: "valid folder name"},
+		{template: ".hidden/{year}", errText: "valid folder name"},
+		{template: "{year}\\{month}", errText: "valid folder name"},
+	}
+	for _, test := range tests {
+		err := ValidFolderLayout(test.template)
+		switch {
+		case test.errText == "" && err != nil:
+			t.Errorf("%q: %s", test.template, err)
+		case test.errText != "" && (err == nil || !strings.Contains(err.Error(), test.errText)):
+			t.Errorf("%q: got %v, want an error about %q", test.template, err, test.errText)
+		}
+	}
+}
+
+func TestFolderLayoutFolder(t *testing.T) {
+	uploaded := time.Date(2024, 3, 5, 7, 9, 0, 0, time.UTC)
+	captured := map[string]string{CaptureTimeAttribute: "2023-11-20T18:45:00+01:00", "CameraModel": "EOS R5"}
+	tests := []struct {
+		template   string
+		attributes map[string]string
+		want       string
+	}{
+		{DefaultFolderLayout, nil, "2024-3-5"},
+		{DefaultFolderLayout, captured, "2023-11-20"},
+		{"{year}/{month:02}/{day:02}", nil, "2024/03/05"},
+		{"{year}/{month:02}/{day:02}", captured, "2023/11/20"},
+		{"{hour:02}-{minute:02}", captured, "18-45"},
+		{"{year:2}", nil, "2024"},
+		// a CaptureTime that can not be parsed is passed over for the upload time
+		{"{year}-{month}", map[string]string{CaptureTimeAttribute: "last summer"}, "2024-3"},
+		{"{CameraModel}/{year}", captured, "EOS R5/2023"},
+		// attribute names are matched without case when there is no exact match
+		{"{cameramodel}", captured, "EOS R5"},
+		{"{CameraModel}", nil, unknownLayoutValue},
+		// attribute values can not add folders or hide them, and numbers in them are padded
+		{"{Album}", map[string]string{"Album": "a/b\\c"}, "a-b-c"},
+		{"{Album}", map[string]string{"Album": " ..hidden\x00 "}, "hidden"},
+		{"{Album}", map[string]string{"Album": "..."}, unknownLayoutValue},
+		{"{Roll:03}", map[string]string{"Roll": "7"}, "007"},
+		{"{Roll:03}", map[string]string{"Roll": "seven"}, "seven"},
+	}
+	for _, test := range tests {
+		layout, err := parseFolderLayout(test.template)
+		if err != nil {
+			t.Fatalf("%q: %s", test.template, err)
+		}
+		if got := layout.folder(test.attributes, uploaded); got != test.want {
+			t.Errorf("%q with %v: got %q, want %q", test.template, test.attributes, got, test.want)
+		}
+	}
+}
+
+func FuzzParseFolderLayout(f *testing.F) {
+	f.Add("{year}/{month:02}/{day:02}", "EOS R5")
+	f.Add("{CameraModel:04}-{hour}", "../x")
+	f.Fuzz(func(t *testing.T, template, value string) {
+		layout, err := parseFolderLayout(template)
+		if err != nil {
+			return
+		}
+		// a valid layout only gives valid folder names, whatever the attributes of the file
+		attributes := map[string]string{"CameraModel": value, CaptureTimeAttribute: value}
+		folder := layout.folder(attributes, time.Unix(0, 0))
+		if err := validFolderName(folder); err != nil {
+			t.Errorf("%q with %q gave %q; %s", template, value, folder, err)
+		}
+	})
+}
+
+func TestRelayout(t *testing.T) {
+	store := storage.NewMemory()
+	s, err := New(Options{Root: t.TempDir(), Storage: store, Logger: testLogger(t), DisableAuth: true, FolderLayout: "{year}/{month:02}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	march := uploadTestFile(t, s, "2024-3-5", []byte("taken in march"), nil)
+	april := uploadTestFile(t, s, "old/nested", []byte("taken in april"), map[string]string{CaptureTimeAttribute: "2024-04-02T10:00:00"})
+	uploadTestFile(t, s, "old", []byte("nested old file"), map[string]string{CaptureTimeAttribute: "2024-04-03T10:00:00"})
+	uploadTestFile(t, s, "2024/04", []byte("already in place"), map[string]string{CaptureTimeAttribute: "2024-04-20T10:00:00"})
+	// a file still being uploaded keeps its folder from being emptied
+	partial := []byte("half way")
+	sum := sha256.Sum256(partial)
+	_, _, err = s.saveFileChunk(FileData{Data: partial[:4], ValidateFile: sum[:], Size: int64(len(partial)), Folder: "uploading"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.background.Wait()
+
+	moved, err := s.Relayout(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 3 {
+		t.Errorf("moved %d files, want 3", moved)
+	}
+	if _, ok := s.index.file("2024/03", hex.EncodeToString(march)); !ok {
+		t.Error("the file of 2024-3-5 was not moved to 2024/03")
+	}
+	if _, ok := s.index.file("2024/04", hex.EncodeToString(april)); !ok {
+		t.Error("the file of old/nested was not moved to 2024/04")
+	}
+	// the folders the files were moved out of are removed, the ones inside others first
+	for _, folder := range []string{"2024-3-5", "old/nested", "old"} {
+		if _, ok := s.index.files(folder); ok {
+			t.Errorf("emptied folder %s is still in the index", folder)
+		}
+		if _, err := store.Stat(folder); err == nil {
+			t.Errorf("emptied folder %s is still in the storage", folder)
+		}
+	}
+	for _, folder := range []string{"2024/03", "2024/04", "uploading"} {
+		if _, ok := s.index.files(folder); !ok {
+			t.Errorf("folder %s is not in the index", folder)
+		}
+	}
+}
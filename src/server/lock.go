@@ -0,0 +1,46 @@
+package server
+
+// lock file to hold the lock file that keeps a running server and the subcommands from using the same root path at once
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockFileName is the name of the lock file inside IndexFolder
+const lockFileName = "server.lock"
+
+// errLockHeld is returned by lockFile when another open file already holds the lock
+var errLockHeld = errors.New("error: lock is held")
+
+// lockRoot takes the lock of a root path, which is held until the file returned is closed.
+// It fails straight away when a running server or a subcommand already holds it.
+// Without a root path there is nothing to lock, and the file is nil.
+// @param root string The root path, or empty
+// @return *os.File The lock file
+// @return error
+func lockRoot(root string) (*os.File, error) {
+	if root == "" {
+		return nil, nil
+	}
+	path := filepath.Join(root, IndexFolder, lockFileName)
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(file)
+	if err != nil {
+		file.Close()
+		if err == errLockHeld {
+			return nil, fmt.Errorf("error: root path %s is in use by a running server or another subcommand", root)
+		}
+		return nil, err
+	}
+	return file, nil
+}
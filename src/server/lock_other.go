@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package server
+
+// lock file to hold the fallback for systems files are not locked on
+
+import "os"
+
+// lockFile does nothing since files are not locked on this system, so nothing stops a subcommand
+// from running next to the server
+// @param file *os.File
+// @return error
+func lockFile(file *os.File) error {
+	return nil
+}
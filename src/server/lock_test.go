@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"sfile"
+	"storage"
+	"strings"
+	"testing"
+)
+
+// newTestServer creates a server of a root path with its files kept in memory
+func newTestServer(t *testing.T, root string) *Server {
+	t.Helper()
+	s, err := New(Options{Root: root, Storage: storage.NewMemory(), Logger: testLogger(t), DisableAuth: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// openTestServer creates and opens a server with its files kept in memory, and shuts it down when the test ends
+func openTestServer(t *testing.T) *Server {
+	t.Helper()
+	s := newTestServer(t, t.TempDir())
+	err := s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+// uploadTestFile uploads data to a folder of a server in a single chunk and returns its hash
+func uploadTestFile(t *testing.T, s *Server, folder string, data []byte, attributes map[string]string) []byte {
+	t.Helper()
+	sum := sha256.Sum256(data)
+	_, _, err := s.saveFileChunk(FileData{Data: data, ValidateFile: sum[:], Size: int64(len(data)), Folder: folder, Attributes: attributes}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sum[:]
+}
+
+func TestRootLock(t *testing.T) {
+	root := t.TempDir()
+	running := newTestServer(t, root)
+	err := running.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a subcommand opening the same root path is refused while the server has it open
+	offline := newTestServer(t, root)
+	if err := offline.Open(); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("Open of a root path in use gave %v", err)
+	}
+	if _, err := offline.Reindex(); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("Reindex of a root path in use gave %v", err)
+	}
+	err = running.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := offline.Reindex(); err != nil {
+		t.Errorf("Reindex after the server stopped gave %v", err)
+	}
+	err = offline.Open()
+	if err != nil {
+		t.Errorf("Open after the server stopped gave %v", err)
+	}
+	offline.Shutdown(context.Background())
+}
+
+func TestChunkAfterFolderDeleted(t *testing.T) {
+	s := newTestServer(t, t.TempDir())
+	err := s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	hash := bytes.Repeat([]byte{1}, 32)
+	data := FileData{Data: []byte("first"), ValidateFile: hash, Size: 10, Folder: "f"}
+	_, _, err = s.saveFileChunk(data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a folder with an upload in progress is not deleted
+	if err := s.DeleteFolder("f", true); err == nil {
+		t.Fatal("deleted a folder with an upload in progress")
+	}
+	err = s.store.RemoveAll("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rest of a file that is gone is refused instead of written as a new file
+	data.Data, data.StartIndex = []byte("later"), 5
+	_, _, err = s.saveFileChunk(data, "")
+	var offsetErr *sfile.OffsetError
+	if !errors.As(err, &offsetErr) || offsetErr.Written != 0 {
+		t.Errorf("chunk of a deleted file gave %v, want an offset error from 0", err)
+	}
+	if _, err := s.store.Stat(string(saveFileName("f", hash))); err == nil {
+		t.Error("chunk of a deleted file created it again")
+	}
+}
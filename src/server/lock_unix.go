@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+
+package server
+
+// lock file to hold how a lock file is locked on systems with flock
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on an open file without waiting for it.
+// The lock is let go of when the file is closed or the process exits.
+// @param file *os.File
+// @return error errLockHeld when another open file holds the lock
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLockHeld
+	}
+	return err
+}
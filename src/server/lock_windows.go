@@ -0,0 +1,35 @@
+package server
+
+// lock file to hold how a lock file is locked on windows
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// lockFileEx locks a range of a file, it is not in the syscall package
+var lockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// the flags of LockFileEx and the error it fails with when the range is locked already
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+// lockFile takes an exclusive lock on an open file without waiting for it.
+// The lock is let go of when the file is closed or the process exits.
+// @param file *os.File
+// @return error errLockHeld when another open file holds the lock
+func lockFile(file *os.File) error {
+	var overlapped syscall.Overlapped
+	ok, _, err := lockFileEx.Call(file.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if ok != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return errLockHeld
+	}
+	return err
+}
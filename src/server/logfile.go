@@ -0,0 +1,164 @@
+package server
+
+// logfile file to hold the log file the server can write its log to, which is rotated when it gets too big
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// rotateRetryAfter is how long writes wait to rotate the file again after rotating it failed,
+// so a file that can not be renamed is not closed and opened again for every line
+const rotateRetryAfter = time.Minute
+
+// LogFile is an object that writes a log to a file and rotates it once it would grow past its max size.
+// Rotating renames server.log to server.log.1, server.log.1 to server.log.2 and so on,
+// removes the ones past the number kept and starts a new server.log.
+// It is safe to use from more than one goroutine.
+type LogFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	// retryAt is when writes try to rotate the file again after rotating it failed
+	retryAt time.Time
+}
+
+// OpenLogFile is a method to open a log file, adding to it if it already exists.
+// @param path string The path of the file, the folders in it are created if they do not exist
+// @param maxSize int64 The size in bytes the file is rotated at, 0 to never rotate it
+// @param maxFiles int How many rotated files are kept, 0 to remove the file when it is rotated
+// @return *LogFile
+// @return error
+func OpenLogFile(path string, maxSize int64, maxFiles int) (*LogFile, error) {
+	if maxSize < 0 || maxFiles < 0 {
+		return nil, fmt.Errorf("error: log file size %d and files kept %d can not be negative", maxSize, maxFiles)
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	f := &LogFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	err = f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file at the path for appending
+// @return error
+func (f *LogFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write is a method to add to the log, rotating the file first when the bytes would not fit in it.
+// A log line is never split between two files.
+// @param p []byte
+// @return int
+// @return error
+func (f *LogFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize && !time.Now().Before(f.retryAt) {
+		err := f.rotate()
+		if err != nil {
+			// keep logging to the file that is there rather than losing the line
+			fmt.Fprintf(os.Stderr, "could not rotate log file %s, trying again in %s; %s\n", f.path, rotateRetryAfter, err)
+			f.retryAt = time.Now().Add(rotateRetryAfter)
+			if f.file == nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate is a method to rotate the file straight away, like when the log is being archived.
+// @return error
+func (f *LogFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return os.ErrClosed
+	}
+	return f.rotate()
+}
+
+// rotate moves the rotated files up one, moves the file to the first one and opens a new file.
+// When the file can not be closed or moved it is opened again, so the log carries on in it.
+// @return error
+func (f *LogFile) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if f.maxFiles == 0 {
+		err = os.Remove(f.path)
+	} else {
+		for i := f.maxFiles - 1; i >= 1; i-- {
+			err = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				break
+			}
+			err = nil
+		}
+		if err == nil {
+			err = os.Rename(f.path, f.path+".1")
+		}
+	}
+	openErr := f.open()
+	if openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// Sync is a method to flush what was written to the file to disk.
+// @return error
+func (f *LogFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return os.ErrClosed
+	}
+	return f.file.Sync()
+}
+
+// Close is a method to close the file.
+// @return error
+func (f *LogFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return os.ErrClosed
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
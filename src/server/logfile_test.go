@@ -0,0 +1,133 @@
+package server
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readLog returns the text of a log file, or empty when it does not exist
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestLogFileRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "server.log")
+	f, err := OpenLogFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n", "six\n"} {
+		_, err = f.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a line is never split, and only the number of rotated files asked for is kept
+	got := []string{readLog(t, path), readLog(t, path+".1"), readLog(t, path+".2"), readLog(t, path+".3")}
+	want := []string{"six\n", "four\nfive\n", "three\n", ""}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("file %d is %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLogFileRotateFailed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	f, err := OpenLogFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// a folder in the way of the rotated file makes the rename fail
+	err = os.MkdirAll(filepath.Join(path+".1", "in the way"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"one\n", "two\n", "three\n"} {
+		_, err = f.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the log carries on in the file, and writes wait before trying to rotate again
+	if got := readLog(t, path); got != "one\ntwo\nthree\n" {
+		t.Errorf("log is %q", got)
+	}
+	if !f.retryAt.After(time.Now()) {
+		t.Errorf("writes try to rotate again at %s", f.retryAt)
+	}
+	err = os.RemoveAll(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("four\n"))
+	if got := readLog(t, path); !strings.HasSuffix(got, "three\nfour\n") {
+		t.Errorf("rotated while waiting to try again, log is %q", got)
+	}
+	f.retryAt = time.Now()
+	f.Write([]byte("five\n"))
+	if got, rotated := readLog(t, path), readLog(t, path+".1"); got != "five\n" || rotated != "one\ntwo\nthree\nfour\n" {
+		t.Errorf("after waiting the log is %q and the rotated one %q", got, rotated)
+	}
+}
+
+func TestLogFileCloseFailed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	f, err := OpenLogFile(path, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("one\n"))
+	// closing the file under the LogFile makes closing it in rotate fail
+	f.file.Close()
+	if err := f.Rotate(); err == nil {
+		t.Error("rotate did not report that closing the file failed")
+	}
+	// the file is opened again and the log carries on in it
+	_, err = f.Write([]byte("two\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readLog(t, path); got != "one\ntwo\n" {
+		t.Errorf("log is %q", got)
+	}
+}
+
+func TestLogFatalLogFile(t *testing.T) {
+	// the test runs itself again to log the fatal message, since LogFatal exits
+	if path := os.Getenv("LANFILES_TEST_FATAL_LOG"); path != "" {
+		f, err := OpenLogFile(path, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		logger, err := NewLogger(f, "info", "text")
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger.LogFatal("could not start")
+		return
+	}
+	path := filepath.Join(t.TempDir(), "server.log")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLogFatalLogFile$")
+	cmd.Env = append(os.Environ(), "LANFILES_TEST_FATAL_LOG="+path)
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("LogFatal exited with %v, want exit status 1", err)
+	}
+	if log := readLog(t, path); !strings.Contains(log, "level=ERROR") || !strings.Contains(log, `msg="could not start"`) {
+		t.Errorf("log file is %q", log)
+	}
+}
@@ -1,59 +1,233 @@
 package server
 
-// logging file to wrap log for later when I create a custom logger
+// logging file to hold the leveled logger of the server, which writes text or JSON lines with fields
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 )
 
+// logLevels are the names of the levels, a message is only logged when its level is at least the level of the Logger
+var logLevels = map[string]slog.Level{"debug": slog.LevelDebug, "info": slog.LevelInfo, "warn": slog.LevelWarn, "error": slog.LevelError}
+
+// Logger is an object that writes the log messages of a Server that are at or above its level.
+// Every line has a time, a level and a message, and the lines about requests also have fields like their ID,
+// status code and duration. Request and response bodies are never logged.
+type Logger struct {
+	logger *slog.Logger
+	// out is where the log is written, which is synced before the program exits on a fatal message
+	out io.Writer
+}
+
+// NewLogger is a method to create a Logger.
+// @param w io.Writer Where the log is written, like os.Stderr or a LogFile
+// @param level string The lowest level that is logged, one of "debug", "info", "warn" or "error"
+// @param format string "text" for key=value lines or "json" for a JSON object on each line
+// @return *Logger
+// @return error
+func NewLogger(w io.Writer, level, format string) (*Logger, error) {
+	l, ok := logLevels[level]
+	if !ok {
+		return nil, fmt.Errorf("error: log level %q is not one of debug, info, warn or error", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return &Logger{logger: slog.New(slog.NewTextHandler(w, opts)), out: w}, nil
+	case "json":
+		return &Logger{logger: slog.New(slog.NewJSONHandler(w, opts)), out: w}, nil
+	}
+	return nil, fmt.Errorf("error: log format %q is not text or json", format)
+}
+
+// defaultLogger is the Logger of the package level log functions, and of servers created without one
+var defaultLogger = &Logger{logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo})), out: os.Stderr}
+
+// SetLogger is a method to make the package level log functions write to a Logger,
+// like the one a Server is given so everything goes to the same log.
+// @param logger *Logger
+func SetLogger(logger *Logger) {
+	defaultLogger = logger
+}
+
+// StandardLogger is a method to get a log.Logger that writes to the Logger at a level, for code that only takes
+// a log.Logger. Giving its writer to log.SetOutput sends the standard log package to the Logger as well.
+// @param level string One of "debug", "info", "warn" or "error", info when it is none of them
+// @return *log.Logger
+func (l *Logger) StandardLogger(level string) *log.Logger {
+	lvl, ok := logLevels[level]
+	if !ok {
+		lvl = slog.LevelInfo
+	}
+	return slog.NewLogLogger(l.logger.Handler(), lvl)
+}
+
+// enabled returns whether messages at a level are logged
+// @param level slog.Level
+// @return bool
+func (l *Logger) enabled(level slog.Level) bool {
+	return l.logger.Enabled(context.Background(), level)
+}
+
 // LogServerCall is used to log messages within the app.
-func LogServerCall(req *http.Request, funcName string) {
+func (l *Logger) LogServerCall(req *http.Request, funcName string) {
 	// right now just logging direct ip.
 	// later might want to add req.Header.Get("X-Forwarded-For") to get possible tail of ips.
-	log.Printf("%s|%s|%s %s", req.Method, funcName, "directly from:", req.RemoteAddr)
+	l.logger.Debug("handling request", "id", requestID(req), "handler", funcName, "method", req.Method, "remote", req.RemoteAddr)
+}
+
+// logRequest logs a request once its response is written
+// @param req *http.Request
+// @param status int The status code of the response
+// @param size int64 The number of bytes in the body of the response
+// @param received int64 The number of bytes read from the body of the request
+// @param duration time.Duration How long the request took
+func (l *Logger) logRequest(req *http.Request, status int, size, received int64, duration time.Duration) {
+	level := slog.LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	l.logger.Log(context.Background(), level, "request",
+		"id", requestID(req),
+		"method", req.Method,
+		"path", req.URL.Path,
+		"status", status,
+		"bytes", size,
+		"received", received,
+		"duration", duration.Round(time.Microsecond).String(),
+		"remote", req.RemoteAddr,
+	)
 }
 
 // WriteOutJSONMessage is a method to take an object json.Marshal it and write it out
-// to the console and the reposewriter.
+// to the reposewriter.
 // @param obj interface{} A struct value
 // @param w http.ResponseWriter
-func WriteOutJSONMessage(obj interface{}, w http.ResponseWriter) {
+func (l *Logger) WriteOutJSONMessage(obj interface{}, w http.ResponseWriter) {
+	l.WriteOutJSONStatus(obj, http.StatusOK, w)
+}
+
+// WriteOutJSONStatus is a method to take an object json.Marshal it and write it out
+// to the reposewriter with a status code, like an error response. Only the size of the response is logged,
+// since it can hold whole files. When the object can not be marshaled the client gets a 500 instead.
+// @param obj interface{} A struct value
+// @param status int The HTTP status code
+// @param w http.ResponseWriter
+func (l *Logger) WriteOutJSONStatus(obj interface{}, status int, w http.ResponseWriter) {
 	b, err := json.Marshal(obj)
 	if err != nil {
-		log.Fatal(err)
+		l.LogErrorf("could not marshal response; %s", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"ErrorCode":"internal","Error":"error: could not create response"}`))
+		return
 	}
-	log.Printf("writeOutJSONMessage: %s", string(b))
+	l.logger.Debug("writing json response", "type", fmt.Sprintf("%T", obj), "status", status, "bytes", len(b))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	w.Write(b)
 }
 
 // Logln logs the text given
 // @param test string
-func Logln(text string) {
-	log.Println(text)
+func (l *Logger) Logln(text string) {
+	l.logger.Info(text)
 }
 
 // LoglnArgs logs text events and handles args
 // @param text string
 // @param args ...interface{}
-func LoglnArgs(text string, args ...interface{}) {
-	log.Print(text)
+func (l *Logger) LoglnArgs(text string, args ...interface{}) {
+	if !l.enabled(slog.LevelInfo) {
+		return
+	}
+	parts := []string{text}
 	for _, a := range args {
-		log.Printf(" %s", a)
+		parts = append(parts, fmt.Sprintf("%s", a))
+	}
+	l.logger.Info(strings.Join(parts, " "))
+}
+
+// Logf logs the text given with the given args placed in the string.
+// @param text string
+// @param args ...interface{}
+func (l *Logger) Logf(text string, args ...interface{}) {
+	l.logf(slog.LevelInfo, text, args...)
+}
+
+// LogDebugf logs detail that is only useful when looking into a problem, with the given args placed in the string.
+// @param text string
+// @param args ...interface{}
+func (l *Logger) LogDebugf(text string, args ...interface{}) {
+	l.logf(slog.LevelDebug, text, args...)
+}
+
+// LogWarnf logs something that went wrong but was worked around, with the given args placed in the string.
+// @param text string
+// @param args ...interface{}
+func (l *Logger) LogWarnf(text string, args ...interface{}) {
+	l.logf(slog.LevelWarn, text, args...)
+}
+
+// LogErrorf logs an error with the given args placed in the string. Errors are logged at every level.
+// @param text string
+// @param args ...interface{}
+func (l *Logger) LogErrorf(text string, args ...interface{}) {
+	l.logf(slog.LevelError, text, args...)
+}
+
+// logf logs text at a level with the given args placed in it, without formatting it when the level is not logged
+// @param level slog.Level
+// @param text string
+// @param args ...interface{}
+func (l *Logger) logf(level slog.Level, text string, args ...interface{}) {
+	if l.enabled(level) {
+		l.logger.Log(context.Background(), level, strings.TrimSuffix(fmt.Sprintf(text, args...), "\n"))
 	}
-	log.Print("\n")
+}
+
+// LogFatal logs text as fatal message and exits. It is only meant for failures while starting up,
+// requests that fail get an error response instead. The log is synced first, since deferred closes do not run.
+// @param text string
+func (l *Logger) LogFatal(text string) {
+	l.logger.Error(text)
+	if syncer, ok := l.out.(interface{ Sync() error }); ok {
+		syncer.Sync()
+	}
+	os.Exit(1)
+}
+
+// WriteOutJSONMessage is a method to take an object json.Marshal it and write it out
+// to the reposewriter.
+// @param obj interface{} A struct value
+// @param w http.ResponseWriter
+func WriteOutJSONMessage(obj interface{}, w http.ResponseWriter) {
+	defaultLogger.WriteOutJSONMessage(obj, w)
+}
+
+// Logln logs the text given
+// @param test string
+func Logln(text string) {
+	defaultLogger.Logln(text)
 }
 
 // Logf logs the text given with the given args placed in the string.
 // @param text string
 // @param args ...interface{}
 func Logf(text string, args ...interface{}) {
-	log.Printf(text, args...)
+	defaultLogger.Logf(text, args...)
 }
 
-// LogFatal logs text as fatal message
+// LogFatal logs text as fatal message and exits. It is only meant for failures while starting up.
 // @param text string
 func LogFatal(text string) {
-	log.Fatal(text)
+	defaultLogger.LogFatal(text)
 }
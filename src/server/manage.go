@@ -0,0 +1,388 @@
+package server
+
+// manage file to hold the logic for deleting and moving files and for creating, renaming and deleting folders
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// validFolderName checks that a folder name is a visible folder inside the server's storage.
+// Nested folders are separated by "/", and no part of the name can be empty or start with a dot.
+// @param name string
+// @return error
+func validFolderName(name string) error {
+	if name == "" {
+		return newAPIError(http.StatusBadRequest, CodeInvalidFolder, "error: folder name is empty")
+	}
+	if strings.ContainsAny(name, "\\\x00") {
+		return newAPIError(http.StatusBadRequest, CodeInvalidFolder, "error: folder name %q can not contain a backslash", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || strings.HasPrefix(part, ".") {
+			return newAPIError(http.StatusBadRequest, CodeInvalidFolder, "error: folder name %q can not have a part that is empty or starts with a dot", name)
+		}
+	}
+	return nil
+}
+
+// removeEmptyParents removes the parent folders of a folder that was moved or deleted
+// for as long as they are empty and are not folders in the index themselves.
+// @param folder string The name of the folder
+func (s *Server) removeEmptyParents(folder string) {
+	for dir := path.Dir(folder); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if _, ok := s.index.files(dir); ok {
+			return
+		}
+		if s.store.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// removeThumbnails removes the cached thumbnails of a file
+// @param folder string The name of the folder the SAVE file is in
+// @param hash []byte The hash of the file
+func (s *Server) removeThumbnails(folder string, hash []byte) {
+	for _, size := range ThumbnailSizes {
+		err := s.store.Remove(thumbnailPath(folder, hash, size))
+		if err != nil && !os.IsNotExist(err) {
+			s.log.LogWarnf("could not remove thumbnail of %x; %s", hash, err)
+		}
+	}
+}
+
+// completeFile looks up a file in the index and checks that it is not still being uploaded
+// @param folder string
+// @param hash []byte The hash of the file
+// @return FileMetadata
+// @return error
+func (s *Server) completeFile(folder string, hash []byte) (FileMetadata, error) {
+	file, ok := s.index.file(folder, hex.EncodeToString(hash))
+	if !ok {
+		return file, newAPIError(http.StatusNotFound, CodeNotFound, "error: no file %x in folder %s", hash, folder)
+	}
+	if !file.Complete {
+		return file, newAPIError(http.StatusConflict, CodeUploadInProgress, "error: file %x in folder %s is still being uploaded", hash, folder)
+	}
+	return file, nil
+}
+
+// completeFolder checks that a folder is in the index and that neither it nor the folders nested in it
+// have uploads in progress
+// @param folder string
+// @return []string The folder and the folders nested in it
+// @return []FileMetadata The files in all of those folders
+// @return error
+func (s *Server) completeFolder(folder string) ([]string, []FileMetadata, error) {
+	folders := s.index.subFolders(folder)
+	if len(folders) == 0 || folders[0] != folder {
+		return nil, nil, newAPIError(http.StatusNotFound, CodeNotFound, "error: folder %s does not exist", folder)
+	}
+	allFiles := make([]FileMetadata, 0)
+	for _, name := range folders {
+		files, _ := s.index.files(name)
+		for _, file := range files {
+			if !file.Complete {
+				return nil, nil, newAPIError(http.StatusConflict, CodeUploadInProgress, "error: folder %s has uploads in progress", name)
+			}
+		}
+		allFiles = append(allFiles, files...)
+	}
+	return folders, allFiles, nil
+}
+
+// DeleteSaveFile is a method to delete a file and its thumbnails.
+// Files that are still being uploaded are not deleted.
+// @param folder string The name of the folder the file is in
+// @param hash []byte The hash of the file
+// @return error
+func (s *Server) DeleteSaveFile(folder string, hash []byte) error {
+	s.manageMu.Lock()
+	defer s.manageMu.Unlock()
+	_, err := s.completeFile(folder, hash)
+	if err != nil {
+		return err
+	}
+	err = s.store.Remove(string(saveFileName(folder, hash)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.removeThumbnails(folder, hash)
+	s.log.Logf("deleted %x from %s", hash, folder)
+	return s.index.deleteFile(folder, hex.EncodeToString(hash))
+}
+
+// MoveSaveFile is a method to move a file into another existing folder.
+// Files that are still being uploaded are not moved, and a file is never moved over one with the same hash.
+// @param folder string The name of the folder the file is in
+// @param toFolder string The name of the folder to move the file to
+// @param hash []byte The hash of the file
+// @return error
+func (s *Server) MoveSaveFile(folder, toFolder string, hash []byte) error {
+	s.manageMu.Lock()
+	defer s.manageMu.Unlock()
+	file, err := s.completeFile(folder, hash)
+	if err != nil {
+		return err
+	}
+	if folder == toFolder {
+		return nil
+	}
+	if _, ok := s.index.files(toFolder); !ok {
+		return newAPIError(http.StatusNotFound, CodeNotFound, "error: folder %s does not exist", toFolder)
+	}
+	if _, ok := s.index.file(toFolder, file.Hash); ok {
+		return newAPIError(http.StatusConflict, CodeAlreadyExists, "error: folder %s already has file %x", toFolder, hash)
+	}
+	err = s.store.Rename(string(saveFileName(folder, hash)), string(saveFileName(toFolder, hash)))
+	if err != nil {
+		return err
+	}
+	// thumbnails are created again in the new folder the first time they are asked for
+	s.removeThumbnails(folder, hash)
+	s.log.Logf("moved %x from %s to %s", hash, folder, toFolder)
+	file.Folder = toFolder
+	err = s.index.putFile(file)
+	if err != nil {
+		return err
+	}
+	return s.index.deleteFile(folder, file.Hash)
+}
+
+// CreateFolder is a method to create an empty folder, along with any parent folders, in the server's storage.
+// @param folder string The name of the folder
+// @return error
+func (s *Server) CreateFolder(folder string) error {
+	err := validFolderName(folder)
+	if err != nil {
+		return err
+	}
+	s.manageMu.Lock()
+	defer s.manageMu.Unlock()
+	_, err = s.createFolder(folder)
+	return err
+}
+
+// RenameFolder is a method to rename a folder in the server's storage, along with the folders nested in it.
+// Folders with uploads in progress are not renamed, and a folder is never renamed over an existing one.
+// @param folder string The name of the folder
+// @param newName string The new name of the folder
+// @return error
+func (s *Server) RenameFolder(folder, newName string) error {
+	err := validFolderName(newName)
+	if err != nil {
+		return err
+	}
+	if newName == folder || strings.HasPrefix(newName, folder+"/") {
+		return newAPIError(http.StatusBadRequest, CodeBadRequest, "error: folder %s can not be moved into itself", folder)
+	}
+	s.manageMu.Lock()
+	defer s.manageMu.Unlock()
+	folders, files, err := s.completeFolder(folder)
+	if err != nil {
+		return err
+	}
+	if _, err := s.store.Stat(newName); err == nil {
+		return newAPIError(http.StatusConflict, CodeAlreadyExists, "error: folder %s already exists", newName)
+	}
+	err = s.store.MkdirAll(path.Dir(newName))
+	if err != nil {
+		return err
+	}
+	err = s.store.Rename(folder, newName)
+	if err != nil {
+		return err
+	}
+	s.log.Logf("renamed folder %s to %s", folder, newName)
+	for _, name := range folders {
+		err = s.index.addFolder(newName + strings.TrimPrefix(name, folder))
+		if err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		file.Folder = newName + strings.TrimPrefix(file.Folder, folder)
+		err = s.index.putFile(file)
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range folders {
+		err = s.index.removeFolder(name)
+		if err != nil {
+			return err
+		}
+	}
+	s.removeEmptyParents(folder)
+	return nil
+}
+
+// DeleteFolder is a method to delete a folder in the server's storage.
+// A folder that still has files or nested folders is only deleted along with them when recursive is set,
+// and folders with uploads in progress are never deleted.
+// @param folder string The name of the folder
+// @param recursive bool
+// @return error
+func (s *Server) DeleteFolder(folder string, recursive bool) error {
+	s.manageMu.Lock()
+	defer s.manageMu.Unlock()
+	folders, files, err := s.completeFolder(folder)
+	if err != nil {
+		return err
+	}
+	if (len(files) > 0 || len(folders) > 1) && !recursive {
+		return newAPIError(http.StatusConflict, CodeNotEmpty, "error: folder %s is not empty", folder)
+	}
+	err = s.store.RemoveAll(folder)
+	if err != nil {
+		return err
+	}
+	s.log.Logf("deleted folder %s with %d files", folder, len(files))
+	for _, name := range folders {
+		err = s.index.removeFolder(name)
+		if err != nil {
+			return err
+		}
+	}
+	s.removeEmptyParents(folder)
+	return nil
+}
+
+// authorizeManagement checks the bearer token of a management request against the server's admin token
+// and writes back an error when it does not match.
+// @param w http.ResponseWriter
+// @param req *http.Request
+// @return bool true if the request can go ahead
+func (s *Server) authorizeManagement(w http.ResponseWriter, req *http.Request) bool {
+	if s.opts.AdminToken == "" {
+		s.writeError(w, req, newAPIError(http.StatusForbidden, CodeDisabled, "error: management endpoints are turned off"))
+		return false
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		s.writeError(w, req, newAPIError(http.StatusUnauthorized, CodeUnauthorized, "error: missing or wrong token"))
+		return false
+	}
+	if req.Method != http.MethodPost {
+		s.writeError(w, req, newAPIError(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "error: management requests have to be POST requests"))
+		return false
+	}
+	return true
+}
+
+// readManageRequest authorizes and decodes a management request, writing back an error when it fails.
+// @param w http.ResponseWriter
+// @param req *http.Request
+// @return ManageRequest
+// @return bool true if the request can go ahead
+func (s *Server) readManageRequest(w http.ResponseWriter, req *http.Request) (ManageRequest, bool) {
+	var data ManageRequest
+	if !s.authorizeManagement(w, req) {
+		return data, false
+	}
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&data)
+	if err != nil {
+		s.writeError(w, req, newAPIError(http.StatusBadRequest, CodeBadRequest, "error: could not parse request; %s", err))
+		return data, false
+	}
+	return data, true
+}
+
+// manageFiles runs an operation on every file in a management request, stopping at the first error.
+// When it stops the error is sent back with the status code of the error and the number of files already changed.
+// @param w http.ResponseWriter
+// @param req *http.Request
+// @param data ManageRequest
+// @param op func(hash []byte) error
+func (s *Server) manageFiles(w http.ResponseWriter, req *http.Request, data ManageRequest, op func(hash []byte) error) {
+	result := ManageResult{}
+	for _, h := range data.Hashes {
+		hash, err := decodeHashParam(h)
+		if err == nil {
+			err = op(hash)
+		}
+		if err != nil {
+			apiErr := asAPIError(err)
+			s.logServerError(req, apiErr)
+			result.ErrorResponse = apiErr.response()
+			s.log.WriteOutJSONStatus(result, apiErr.Status, w)
+			return
+		}
+		result.Count++
+	}
+	s.log.WriteOutJSONMessage(result, w)
+}
+
+// writeManageResult writes back the result of a folder operation
+// @param w http.ResponseWriter
+// @param req *http.Request
+// @param err error
+func (s *Server) writeManageResult(w http.ResponseWriter, req *http.Request, err error) {
+	if err != nil {
+		s.writeError(w, req, err)
+		return
+	}
+	s.log.WriteOutJSONMessage(ManageResult{Count: 1}, w)
+}
+
+// DeleteFiles is a POST request that deletes the files in Hashes from Folder.
+func (s *Server) DeleteFiles(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "DeleteFiles")
+	data, ok := s.readManageRequest(w, req)
+	if !ok {
+		return
+	}
+	s.manageFiles(w, req, data, func(hash []byte) error {
+		return s.DeleteSaveFile(data.Folder, hash)
+	})
+}
+
+// MoveFiles is a POST request that moves the files in Hashes from Folder to ToFolder.
+func (s *Server) MoveFiles(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "MoveFiles")
+	data, ok := s.readManageRequest(w, req)
+	if !ok {
+		return
+	}
+	s.manageFiles(w, req, data, func(hash []byte) error {
+		return s.MoveSaveFile(data.Folder, data.ToFolder, hash)
+	})
+}
+
+// CreateFolderRequest is a POST request that creates the folder Folder.
+func (s *Server) CreateFolderRequest(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "CreateFolder")
+	data, ok := s.readManageRequest(w, req)
+	if !ok {
+		return
+	}
+	s.writeManageResult(w, req, s.CreateFolder(data.Folder))
+}
+
+// RenameFolderRequest is a POST request that renames the folder Folder to ToFolder.
+func (s *Server) RenameFolderRequest(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "RenameFolder")
+	data, ok := s.readManageRequest(w, req)
+	if !ok {
+		return
+	}
+	s.writeManageResult(w, req, s.RenameFolder(data.Folder, data.ToFolder))
+}
+
+// DeleteFolderRequest is a POST request that deletes the folder Folder, along with its files if Recursive is set.
+func (s *Server) DeleteFolderRequest(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "DeleteFolder")
+	data, ok := s.readManageRequest(w, req)
+	if !ok {
+		return
+	}
+	s.writeManageResult(w, req, s.DeleteFolder(data.Folder, data.Recursive))
+}
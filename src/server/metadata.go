@@ -0,0 +1,213 @@
+package server
+
+// metadata file to hold the logic for pulling metadata out of uploaded files and into their headers
+
+import (
+	"bmff"
+	"exif"
+	"io"
+	"sfile"
+	"storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metadataReadSize is how much of the start of a file is read to detect its content type and to find its EXIF block,
+// which JPEG files keep in front of the image data. Videos are read box by box instead.
+const metadataReadSize = 1 << 20
+
+// processCompletedUpload is run once every byte of a file has been uploaded.
+// It merges the metadata found in the file into its header and then creates its thumbnails.
+// The file can be deleted or moved while it is processed, so its header is only rewritten while holding manageMu
+// when it is still in the folder, and thumbnails created for a file that has gone are removed again.
+// @param folder string The name of the folder the SAVE file is in
+// @param hash []byte The hash of the file
+func (s *Server) processCompletedUpload(folder string, hash []byte) {
+	if !s.opts.DisableMetadata {
+		s.manageMu.Lock()
+		if s.saveFileExists(folder, hash) {
+			err := mergeFileMetadata(s.store, folder, hash)
+			if err != nil {
+				s.log.LogWarnf("could not extract metadata for %x; %s", hash, err)
+			}
+			err = s.index.indexSaveFile(folder, hash)
+			if err != nil {
+				s.log.LogWarnf("could not update metadata index for %x; %s", hash, err)
+			}
+		}
+		s.manageMu.Unlock()
+	}
+	if !s.opts.DisableThumbnails {
+		err := GenerateThumbnails(s.store, folder, hash)
+		if err != nil {
+			s.log.LogWarnf("could not generate thumbnails for %x; %s", hash, err)
+		}
+		s.manageMu.Lock()
+		if !s.saveFileExists(folder, hash) {
+			s.removeThumbnails(folder, hash)
+		}
+		s.manageMu.Unlock()
+	}
+}
+
+// saveFileExists checks that a SAVE file is still in a folder
+// @param folder string The name of the folder the SAVE file is in
+// @param hash []byte The hash of the file
+// @return bool
+func (s *Server) saveFileExists(folder string, hash []byte) bool {
+	_, err := s.store.Stat(string(saveFileName(folder, hash)))
+	return err == nil
+}
+
+// mergeFileMetadata reads the metadata out of a SAVE file's data and adds it to the file's header.
+// Attributes the client already set are never overwritten. Only the parts of the data the metadata is in are read,
+// so large videos are not loaded into memory. Headers written in the SimpleHeader format are left as they are,
+// since clients read those by the keys they uploaded them with.
+// @param store storage.Storage The storage the SAVE file is in
+// @param folder string The name of the folder the SAVE file is in
+// @param hash []byte The hash of the file
+// @return error
+func mergeFileMetadata(store storage.Storage, folder string, hash []byte) error {
+	fileName := saveFileName(folder, hash)
+	headerObj := &sfile.KeyedHeader{Attributes: make(map[string]interface{})}
+	reader, err := sfile.OpenSaveFile(store, fileName, headerObj)
+	if err != nil {
+		return err
+	}
+	if headerObj.Legacy {
+		reader.Close()
+		return nil
+	}
+	found, err := readAttributes(reader, headerObj)
+	// the file is closed before its header is rewritten, since that renames a new file over it
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	added := false
+	for k, v := range found {
+		if _, ok := headerObj.Attributes[k]; !ok {
+			headerObj.Attributes[k] = v
+			added = true
+		}
+	}
+	if !added {
+		return nil
+	}
+	return sfile.RewriteHeader(store, fileName, headerObj)
+}
+
+// readAttributes reads the content type and the metadata attributes out of the data of a SAVE file
+// @param reader *sfile.SaveFileReader
+// @param headerObj *sfile.KeyedHeader The header of the file
+// @return map[string]string
+// @return error
+func readAttributes(reader *sfile.SaveFileReader, headerObj *sfile.KeyedHeader) (map[string]string, error) {
+	head := make([]byte, metadataReadSize)
+	n, err := reader.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+	mimeType, _ := headerObj.Attributes[MimeTypeAttribute].(string)
+	if mimeType == "" {
+		// files started before content types were stored
+		mimeType = DetectMimeType(head)
+	}
+	found := map[string]string{MimeTypeAttribute: mimeType}
+	switch {
+	case mimeType == "image/jpeg":
+		found = mergeMaps(found, exifAttributes(head))
+	case strings.HasPrefix(mimeType, "video/"):
+		found = mergeMaps(found, videoAttributes(reader, reader.Size()))
+	}
+	return found, nil
+}
+
+// mergeMaps adds the entries of src to dst and returns dst
+// @param dst map[string]string
+// @param src map[string]string
+// @return map[string]string
+func mergeMaps(dst, src map[string]string) map[string]string {
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
+
+// exifAttributes reads the EXIF block out of JPEG data and returns the fields we keep as header attributes.
+// Nothing is returned if the data is not a JPEG or has no EXIF block.
+// @param data []byte The start of the JPEG file, up to at least the end of its EXIF block
+// @return map[string]string
+func exifAttributes(data []byte) map[string]string {
+	attributes := make(map[string]string)
+	ex, err := exif.ReadJPEG(data)
+	if err != nil {
+		return attributes
+	}
+	if ex.DateTime != "" {
+		// EXIF saves times as "2006:01:02 15:04:05", store it as "2006-01-02T15:04:05"
+		captureTime := strings.Replace(strings.Replace(ex.DateTime, ":", "-", 2), " ", "T", 1)
+		attributes["CaptureTime"] = captureTime + ex.OffsetTime
+	}
+	if ex.Make != "" {
+		attributes["CameraMake"] = ex.Make
+	}
+	if ex.Model != "" {
+		attributes["CameraModel"] = ex.Model
+	}
+	if ex.Orientation != 0 {
+		attributes["Orientation"] = strconv.Itoa(ex.Orientation)
+	}
+	if ex.Width != 0 && ex.Height != 0 {
+		attributes["Width"] = strconv.Itoa(ex.Width)
+		attributes["Height"] = strconv.Itoa(ex.Height)
+	}
+	if ex.HasGPS {
+		attributes["GPSLatitude"] = strconv.FormatFloat(ex.Latitude, 'f', 6, 64)
+		attributes["GPSLongitude"] = strconv.FormatFloat(ex.Longitude, 'f', 6, 64)
+	}
+	if ex.HasAltitude {
+		attributes["GPSAltitude"] = strconv.FormatFloat(ex.Altitude, 'f', 1, 64)
+	}
+	return attributes
+}
+
+// videoAttributes reads the metadata out of MP4 and MOV data and returns the fields we keep as header attributes.
+// Nothing is returned if the data is not an MP4 or MOV file.
+// @param r io.ReaderAt The data of the file
+// @param size int64 The size of the data
+// @return map[string]string
+func videoAttributes(r io.ReaderAt, size int64) map[string]string {
+	attributes := make(map[string]string)
+	meta, err := bmff.Read(r, size)
+	if err != nil {
+		return attributes
+	}
+	if !meta.CreationTime.IsZero() {
+		attributes["CaptureTime"] = meta.CreationTime.Format(time.RFC3339)
+	}
+	if meta.Duration != 0 {
+		attributes["Duration"] = strconv.FormatFloat(meta.Duration.Seconds(), 'f', 3, 64)
+	}
+	if meta.Width != 0 && meta.Height != 0 {
+		attributes["Width"] = strconv.Itoa(meta.Width)
+		attributes["Height"] = strconv.Itoa(meta.Height)
+		attributes["Rotation"] = strconv.Itoa(meta.Rotation)
+	}
+	if meta.VideoCodec != "" {
+		attributes["VideoCodec"] = strings.TrimSpace(meta.VideoCodec)
+	}
+	if meta.AudioCodec != "" {
+		attributes["AudioCodec"] = strings.TrimSpace(meta.AudioCodec)
+	}
+	if meta.HasGPS {
+		attributes["GPSLatitude"] = strconv.FormatFloat(meta.Latitude, 'f', 6, 64)
+		attributes["GPSLongitude"] = strconv.FormatFloat(meta.Longitude, 'f', 6, 64)
+	}
+	if meta.HasAltitude {
+		attributes["GPSAltitude"] = strconv.FormatFloat(meta.Altitude, 'f', 1, 64)
+	}
+	return attributes
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"sfile"
+	"storage"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStorage is a storage that counts the bytes read from its files
+type countingStorage struct {
+	storage.Storage
+	read *int64
+}
+
+// countingFile is a file of a countingStorage
+type countingFile struct {
+	storage.File
+	read *int64
+}
+
+func (s countingStorage) OpenFile(name string, flag int) (storage.File, error) {
+	f, err := s.Storage.OpenFile(name, flag)
+	if err != nil {
+		return nil, err
+	}
+	return countingFile{f, s.read}, nil
+}
+
+func (f countingFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	atomic.AddInt64(f.read, int64(n))
+	return n, err
+}
+
+// renameBlockingStorage is a storage that holds up renaming tmp files until it is released
+type renameBlockingStorage struct {
+	storage.Storage
+	renaming chan struct{}
+	release  chan struct{}
+	once     sync.Once
+}
+
+func (s *renameBlockingStorage) Rename(from, to string) error {
+	if strings.HasSuffix(from, sfile.TempSuffix) {
+		s.once.Do(func() { close(s.renaming) })
+		<-s.release
+	}
+	return s.Storage.Rename(from, to)
+}
+
+// testMovie returns a movie that is 10 seconds long, with an mdat box of a size
+func testMovie(mdatSize int) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 10000)
+	return bytes.Join([][]byte{
+		testBox("ftyp", []byte("isom\x00\x00\x00\x00")),
+		testBox("moov", testBox("mvhd", mvhd)),
+		testBox("mdat", make([]byte, mdatSize)),
+	}, nil)
+}
+
+// testBox returns an ISO base media box holding a body
+func testBox(boxType string, body []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(b, boxType...), body...)
+}
+
+func TestMergeFileMetadataVideo(t *testing.T) {
+	// a movie with a large mdat after the moov box
+	data := testMovie(8 << 20)
+	var read int64
+	store := countingStorage{storage.NewMemory(), &read}
+	hash := writeTestSaveFile(t, store, "f", "video/mp4", data, len(data))
+	err := mergeFileMetadata(store, "f", hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerObj := &sfile.KeyedHeader{Attributes: make(map[string]interface{})}
+	_, err = sfile.ReadSaveFileHeader(store, saveFileName("f", hash), headerObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headerObj.Attributes["Duration"] != "10.000" {
+		t.Errorf("Duration is %v, want 10.000", headerObj.Attributes["Duration"])
+	}
+	// the header rewrite copies the data once, everything else only reads the start of the file and its boxes
+	if limit := int64(len(data)) + 2*metadataReadSize; read > limit {
+		t.Errorf("read %d bytes of a %d byte file, want at most %d", read, len(data), limit)
+	}
+}
+
+func TestMergeFileMetadataKeepsAttributes(t *testing.T) {
+	store := storage.NewMemory()
+	data := testPNG(t, 2, 2)
+	hash := writeTestSaveFile(t, store, "f", "", data, len(data))
+	err := mergeFileMetadata(store, "f", hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerObj := &sfile.KeyedHeader{Attributes: make(map[string]interface{})}
+	reader, err := sfile.OpenSaveFile(store, saveFileName("f", hash), headerObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	// a file without a content type has it sniffed, and its data is left as it was
+	if headerObj.Attributes[MimeTypeAttribute] != "image/png" {
+		t.Errorf("MimeType is %v, want image/png", headerObj.Attributes[MimeTypeAttribute])
+	}
+	got := make([]byte, len(data))
+	_, err = reader.ReadAt(got, 0)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("the data changed when the header was rewritten; %v", err)
+	}
+}
+
+func TestDeleteWhileProcessing(t *testing.T) {
+	store := &renameBlockingStorage{Storage: storage.NewMemory(), renaming: make(chan struct{}), release: make(chan struct{})}
+	s, err := New(Options{Root: t.TempDir(), Storage: store, Logger: testLogger(t), DisableAuth: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	if err := s.CreateFolder("f"); err != nil {
+		t.Fatal(err)
+	}
+	hash := uploadTestFile(t, s, "f", testMovie(1024), nil)
+	// the header of the file is being rewritten with its Duration in the background
+	<-store.renaming
+	deleted := make(chan error, 1)
+	go func() { deleted <- s.DeleteSaveFile("f", hash) }()
+	select {
+	case err := <-deleted:
+		close(store.release)
+		t.Fatalf("the file was deleted in the middle of its header rewrite; %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(store.release)
+	if err := <-deleted; err != nil {
+		t.Fatal(err)
+	}
+	s.background.Wait()
+	if _, err := store.Stat(string(saveFileName("f", hash))); !os.IsNotExist(err) {
+		t.Errorf("the deleted file came back; %v", err)
+	}
+	if file, ok := s.index.file("f", hex.EncodeToString(hash)); ok {
+		t.Errorf("the deleted file is in the index as %+v", file)
+	}
+}
@@ -0,0 +1,235 @@
+package server
+
+// metrics file to hold the counters of what the server does and the /metrics path that reports them
+// in the Prometheus text format
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricsContentType is the content type of version 0.0.4 of the Prometheus text format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// durationBuckets are the upper bounds in seconds of the buckets request durations are counted in
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// requestKey is what requests are counted by
+type requestKey struct {
+	handler string
+	status  int
+}
+
+// histogram is an object that counts how many observations are at or below each of the durationBuckets,
+// along with how many there are and their sum
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// observe adds a value to the histogram
+// @param v float64
+func (h *histogram) observe(v float64) {
+	for i, bound := range durationBuckets {
+		if v <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// metrics is an object that holds the counters of a Server since it was created.
+// It is safe to use from more than one goroutine.
+type metrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[string]*histogram
+	// uploaded is the bytes of files written by uploads, and downloaded the bytes of files and thumbnails sent by downloads
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+	// activeUploads is the chunks being written to SAVE files right now
+	activeUploads atomic.Int64
+	// hashFailures is the files that did not match their hash when they were validated
+	hashFailures atomic.Int64
+}
+
+// newMetrics is a method to create the metrics of a Server with every counter at 0
+// @return *metrics
+func newMetrics() *metrics {
+	return &metrics{requests: make(map[requestKey]uint64), durations: make(map[string]*histogram)}
+}
+
+// observeRequest counts a request to a handler once it is done
+// @param handler string The path pattern the request was served by
+// @param status int The status code of the response
+// @param duration time.Duration How long the request took
+func (m *metrics) observeRequest(handler string, status int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{handler: handler, status: status}]++
+	h, ok := m.durations[handler]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(durationBuckets))}
+		m.durations[handler] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+// routeName returns the path pattern of the server a request is served by, so requests to paths
+// that do not exist are counted together instead of each getting their own metrics
+// @param req *http.Request
+// @return string
+func (s *Server) routeName(req *http.Request) string {
+	path := req.URL.Path
+	if s.prefix != "" {
+		if !strings.HasPrefix(path, s.prefix) {
+			return "other"
+		}
+		path = strings.TrimPrefix(path, s.prefix)
+	}
+	stripped := *req.URL
+	stripped.Path = path
+	r := *req
+	r.URL = &stripped
+	_, pattern := s.mux.Handler(&r)
+	if pattern == "" {
+		return "other"
+	}
+	return pattern
+}
+
+// Metrics is a GET request that returns the counters of the server in the Prometheus text format,
+// along with the files and bytes of every folder and the free space of the disk the storage is on.
+func (s *Server) Metrics(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "Metrics")
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		s.writeError(w, req, newAPIError(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "error: /metrics only takes GET requests"))
+		return
+	}
+	var mw metricsWriter
+	s.writeRequestMetrics(&mw)
+	mw.header("lanfiles_uploaded_bytes_total", "counter", "Bytes of files written by uploads.")
+	mw.sample("lanfiles_uploaded_bytes_total", nil, float64(s.metrics.uploaded.Load()))
+	mw.header("lanfiles_downloaded_bytes_total", "counter", "Bytes of files and thumbnails sent by downloads.")
+	mw.sample("lanfiles_downloaded_bytes_total", nil, float64(s.metrics.downloaded.Load()))
+	mw.header("lanfiles_active_uploads", "gauge", "Chunks being written to files right now.")
+	mw.sample("lanfiles_active_uploads", nil, float64(s.metrics.activeUploads.Load()))
+	mw.header("lanfiles_hash_verification_failures_total", "counter", "Files that did not match their hash when validated.")
+	mw.sample("lanfiles_hash_verification_failures_total", nil, float64(s.metrics.hashFailures.Load()))
+	s.writeFolderMetrics(&mw)
+	if free, size, ok := s.storageSpace(); ok {
+		mw.header("lanfiles_disk_free_bytes", "gauge", "Bytes free on the disk the storage is on.")
+		mw.sample("lanfiles_disk_free_bytes", nil, float64(free))
+		mw.header("lanfiles_disk_size_bytes", "gauge", "Size in bytes of the disk the storage is on.")
+		mw.sample("lanfiles_disk_size_bytes", nil, float64(size))
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	w.Write(mw.buf.Bytes())
+}
+
+// writeRequestMetrics writes the request counts and durations of every handler, in handler and status order
+// @param mw *metricsWriter
+func (s *Server) writeRequestMetrics(mw *metricsWriter) {
+	m := s.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].handler != keys[j].handler {
+			return keys[i].handler < keys[j].handler
+		}
+		return keys[i].status < keys[j].status
+	})
+	mw.header("lanfiles_http_requests_total", "counter", "Requests by handler and status code.")
+	for _, key := range keys {
+		mw.sample("lanfiles_http_requests_total", []string{"handler", key.handler, "code", strconv.Itoa(key.status)}, float64(m.requests[key]))
+	}
+	handlers := make([]string, 0, len(m.durations))
+	for handler := range m.durations {
+		handlers = append(handlers, handler)
+	}
+	sort.Strings(handlers)
+	mw.header("lanfiles_http_request_duration_seconds", "histogram", "How long requests took by handler.")
+	for _, handler := range handlers {
+		h := m.durations[handler]
+		for i, bound := range durationBuckets {
+			mw.sample("lanfiles_http_request_duration_seconds_bucket", []string{"handler", handler, "le", formatMetric(bound)}, float64(h.buckets[i]))
+		}
+		mw.sample("lanfiles_http_request_duration_seconds_bucket", []string{"handler", handler, "le", "+Inf"}, float64(h.count))
+		mw.sample("lanfiles_http_request_duration_seconds_sum", []string{"handler", handler}, h.sum)
+		mw.sample("lanfiles_http_request_duration_seconds_count", []string{"handler", handler}, float64(h.count))
+	}
+}
+
+// writeFolderMetrics writes the files, bytes and partial uploads of every folder from the metadata index
+// @param mw *metricsWriter
+func (s *Server) writeFolderMetrics(mw *metricsWriter) {
+	usages := s.index.usage()
+	partial := 0
+	mw.header("lanfiles_folder_files", "gauge", "Files in each folder, with the ones still being uploaded.")
+	for _, u := range usages {
+		mw.sample("lanfiles_folder_files", []string{"folder", u.Name}, float64(u.Files))
+		partial += u.Partial
+	}
+	mw.header("lanfiles_folder_bytes", "gauge", "Bytes of the files in each folder, with the whole size of the ones still being uploaded.")
+	for _, u := range usages {
+		mw.sample("lanfiles_folder_bytes", []string{"folder", u.Name}, float64(u.Bytes))
+	}
+	mw.header("lanfiles_partial_uploads", "gauge", "Files that are only partly uploaded.")
+	mw.sample("lanfiles_partial_uploads", nil, float64(partial))
+}
+
+// metricsWriter is an object that writes metrics in the Prometheus text format
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+// labelEscaper escapes the characters the text format does not allow in label values
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// header writes the help text and type of a metric, which come before its samples
+// @param name string
+// @param kind string counter, gauge or histogram
+// @param help string
+func (mw *metricsWriter) header(name, kind, help string) {
+	mw.buf.WriteString("# HELP " + name + " " + help + "\n")
+	mw.buf.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// sample writes one value of a metric with its labels
+// @param name string
+// @param labels []string The label names and values in pairs, like {"folder", "2024-01-01"}
+// @param value float64
+func (mw *metricsWriter) sample(name string, labels []string, value float64) {
+	mw.buf.WriteString(name)
+	if len(labels) > 0 {
+		mw.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.buf.WriteByte(',')
+			}
+			mw.buf.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+		}
+		mw.buf.WriteByte('}')
+	}
+	mw.buf.WriteString(" " + formatMetric(value) + "\n")
+}
+
+// formatMetric writes a value the way the text format reads it
+// @param v float64
+// @return string
+func formatMetric(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
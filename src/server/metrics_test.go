@@ -0,0 +1,51 @@
+package server
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	s := openTestServer(t)
+	png := testPNG(t, 8, 8)
+	hash := uploadTestFile(t, s, "pics", png, nil)
+	uploadTestFile(t, s, "notes", []byte("counted once"), nil)
+	s.background.Wait()
+	get := func(path string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s gave status %d; %s", path, w.Code, w.Body)
+		}
+		return w
+	}
+
+	// every way a file or thumbnail is sent adds to the downloaded bytes
+	downloaded := get("/download_file?Folder=pics&Hash=" + hex.EncodeToString(hash)).Body.Len()
+	downloaded += get("/get_thumbnail?Folder=pics&Size=128&Hash=" + hex.EncodeToString(hash)).Body.Len()
+	if w := postJSON(t, s, "/get_files", GetFilesWithAttributes{Folder: "pics", StartIndex: 0, EndIndex: 10}); w.Code != http.StatusOK {
+		t.Fatalf("/get_files gave status %d; %s", w.Code, w.Body)
+	}
+	downloaded += len(png)
+
+	body := get("/metrics").Body.String()
+	for _, want := range []string{
+		"lanfiles_uploaded_bytes_total " + strconv.Itoa(len(png)+len("counted once")),
+		"lanfiles_downloaded_bytes_total " + strconv.Itoa(downloaded),
+		`lanfiles_http_requests_total{handler="/download_file",code="200"} 1`,
+		`lanfiles_http_requests_total{handler="/get_files",code="200"} 1`,
+		`lanfiles_folder_files{folder="pics"} 1`,
+		`lanfiles_folder_bytes{folder="notes"} 12`,
+		"lanfiles_partial_uploads 0",
+		"lanfiles_active_uploads 0",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics do not have %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+// middleware file to hold the handlers every request goes through before it reaches its endpoint
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RequestIDHeader is the header a request ID is read from and sent back in, so a client can match its requests
+// to the lines of the server log. A request without a usable ID is given a new one.
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDKey is the key the ID of a request is kept under in the request context
+type requestIDKey struct{}
+
+// requestID returns the ID of a request, or empty when it did not go through logRequests
+// @param req *http.Request
+// @return string
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID returns whether a request ID sent by a client is short and only has letters, digits, '-', '_' and '.'
+// so it is safe to put in the log
+// @param id string
+// @return bool
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// responseWriter is an object that remembers the status code and size of a response for the log,
+// and whether the response was started so a handler that fails part way is not sent a second status code
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	size        int64
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.status = http.StatusOK
+		w.wroteHeader = true
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Unwrap is used by http.ResponseController to reach the write deadline and flushing of the connection
+// @return http.ResponseWriter
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingBody is an object that counts the bytes read from a request body for the log
+type countingBody struct {
+	io.ReadCloser
+	size int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	return n, err
+}
+
+// logRequests wraps a handler so every request is given an ID and is logged once it is done with its
+// status code, the bytes received and sent and how long it took
+// @param next http.Handler
+// @return http.Handler
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id, _ = randomText(8)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		req = req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id))
+		body := &countingBody{ReadCloser: req.Body}
+		req.Body = body
+		rw := &responseWriter{ResponseWriter: w}
+		defer func() {
+			status := rw.status
+			if !rw.wroteHeader {
+				// nothing was written, which net/http sends as an empty 200
+				status = http.StatusOK
+			}
+			duration := time.Since(start)
+			s.log.logRequest(req, status, rw.size, body.size, duration)
+			s.metrics.observeRequest(s.routeName(req), status, duration)
+		}()
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// recoverPanics wraps a handler so a panic while serving a request is logged with its stack and the client
+// gets a 500, instead of it taking down the connection with nothing in the server log.
+// http.ErrAbortHandler is passed on since handlers panic with it to abort a response on purpose.
+// @param next http.Handler
+// @return http.Handler
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rw, ok := w.(*responseWriter)
+		if !ok {
+			rw = &responseWriter{ResponseWriter: w}
+		}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			s.log.LogErrorf("panic serving %s %s, request %s; %v\n%s", req.Method, req.URL.Path, requestID(req), v, debug.Stack())
+			if !rw.wroteHeader {
+				s.log.WriteOutJSONStatus(ErrorResponse{ErrorCode: CodeInternal, Error: internalErrorMessage}, http.StatusInternalServerError, rw)
+			}
+		}()
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// recoverBackground recovers a panic in work done in the background, like reading the metadata of an upload,
+// and logs it with its stack so a file that trips up a parser does not stop the server. It has to be deferred.
+// @param task string What the background work was doing
+func (s *Server) recoverBackground(task string) {
+	if v := recover(); v != nil {
+		s.log.LogErrorf("panic while %s; %v\n%s", task, v, debug.Stack())
+	}
+}
+
+// plainHTTPPaths are the paths the plain HTTP listener serves, the ones a client needs before it can use HTTPS
+var plainHTTPPaths = map[string]bool{"/ping": true, "/pair_status": true}
+
+// plainHTTP wraps the handler of the plain HTTP listener so only plainHTTPPaths are served over it.
+// Other requests are redirected to the same path over HTTPS, except ones carrying a token, which are refused
+// so the client finds out it sent the token in the clear instead of having it silently resent.
+// @param next http.Handler
+// @return http.Handler
+func (s *Server) plainHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if path, ok := strings.CutPrefix(req.URL.Path, s.prefix); ok && plainHTTPPaths[path] {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if req.Header.Get("Authorization") != "" {
+			s.writeError(w, req, newAPIError(http.StatusForbidden, CodeHTTPSRequired, "error: %s is only served over HTTPS, do not send tokens over plain HTTP", req.URL.Path))
+			return
+		}
+		addr, ok := s.Addr().(*net.TCPAddr)
+		if !ok {
+			s.writeError(w, req, newAPIError(http.StatusServiceUnavailable, CodeUnavailable, "error: server is not listening with HTTPS"))
+			return
+		}
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = req.Host
+		}
+		http.Redirect(w, req, "https://"+net.JoinHostPort(host, strconv.Itoa(addr.Port))+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}
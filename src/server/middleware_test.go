@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"storage"
+	"strconv"
+	"testing"
+)
+
+func TestPlainHTTP(t *testing.T) {
+	s, err := New(Options{
+		Root:        t.TempDir(),
+		Storage:     storage.NewMemory(),
+		Logger:      testLogger(t),
+		Address:     "127.0.0.1:0",
+		TLS:         true,
+		HTTPAddress: "127.0.0.1:0",
+		Prefix:      "/files",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	plain := "http://" + s.HTTPAddr().String()
+	httpsHost := net.JoinHostPort("127.0.0.1", strconv.Itoa(s.Addr().(*net.TCPAddr).Port))
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	tests := []struct {
+		path     string
+		token    string
+		status   int
+		location string
+		code     ErrorCode
+	}{
+		{path: "/files/ping", status: http.StatusOK},
+		// pair_status is served, and fails here only because the token is not one the server knows
+		{path: "/files/pair_status", token: "unknown", status: http.StatusUnauthorized, code: CodeUnauthorized},
+		{path: "/files/get_folders?x=1", status: http.StatusTemporaryRedirect, location: "https://" + httpsHost + "/files/get_folders?x=1"},
+		{path: "/files/ui/", status: http.StatusTemporaryRedirect, location: "https://" + httpsHost + "/files/ui/"},
+		{path: "/ping", status: http.StatusTemporaryRedirect, location: "https://" + httpsHost + "/ping"},
+		{path: "/files/get_folders", token: "secret", status: http.StatusForbidden, code: CodeHTTPSRequired},
+		{path: "/files/pair", token: "secret", status: http.StatusForbidden, code: CodeHTTPSRequired},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, plain+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status || resp.Header.Get("Location") != test.location || body.ErrorCode != test.code {
+			t.Errorf("%s: got %d %q %q, want %d %q %q", test.path, resp.StatusCode, resp.Header.Get("Location"), body.ErrorCode, test.status, test.location, test.code)
+		}
+	}
+}
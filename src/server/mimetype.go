@@ -0,0 +1,214 @@
+package server
+
+// mimetype file to hold the logic for detecting the content type of uploaded files
+
+import (
+	"bytes"
+	"encoding/binary"
+	"exif"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// MimeTypeAttribute is the reserved header attribute the detected content type of a file is stored in.
+// Clients can not set it, a type they declare is only cross checked against it.
+const MimeTypeAttribute = "MimeType"
+
+// defaultMimeType is what http.DetectContentType returns when it does not know the data
+const defaultMimeType = "application/octet-stream"
+
+// ftypBrands maps the major brand of an ISO base media file to its content type.
+// Files with brands that are not listed are left to http.DetectContentType.
+var ftypBrands = map[string]string{
+	"isom": "video/mp4",
+	"iso2": "video/mp4",
+	"iso4": "video/mp4",
+	"iso5": "video/mp4",
+	"iso6": "video/mp4",
+	"mp41": "video/mp4",
+	"mp42": "video/mp4",
+	"avc1": "video/mp4",
+	"dash": "video/mp4",
+	"mmp4": "video/mp4",
+	"MSNV": "video/mp4",
+	"XAVC": "video/mp4",
+	"M4V ": "video/x-m4v",
+	"M4VH": "video/x-m4v",
+	"M4VP": "video/x-m4v",
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"hevc": "image/heic-sequence",
+	"hevx": "image/heic-sequence",
+	"mif1": "image/heif",
+	"msf1": "image/heif-sequence",
+	"avif": "image/avif",
+	"avis": "image/avif",
+	"crx ": "image/x-canon-cr3",
+	"qt  ": "video/quicktime",
+	"3gp4": "video/3gpp",
+	"3gp5": "video/3gpp",
+	"3gp6": "video/3gpp",
+	"3g2a": "video/3gpp2",
+	"M4A ": "audio/mp4",
+	"M4B ": "audio/mp4",
+}
+
+// quickTimeAtoms are atoms old QuickTime files can start with instead of ftyp
+var quickTimeAtoms = []string{"moov", "mdat", "wide", "free", "skip", "pnot"}
+
+// moovChildren are atoms the moov atom of a QuickTime file starts with
+var moovChildren = []string{"mvhd", "cmov", "prfl", "iods", "udta", "trak"}
+
+// rawMakes maps the camera make of a TIFF based raw file to its content type
+var rawMakes = map[string]string{
+	"NIKON":  "image/x-nikon-nef",
+	"SONY":   "image/x-sony-arw",
+	"PENTAX": "image/x-pentax-pef",
+}
+
+// DetectMimeType is a method to sniff the content type of a file from the start of its data.
+// It uses http.DetectContentType, with extra checks for HEIC, MP4/MOV and camera raw files it does not know.
+// @param data []byte The first chunk of the file
+// @return string The content type
+func DetectMimeType(data []byte) string {
+	if mimeType := detectBMFF(data); mimeType != "" {
+		return mimeType
+	}
+	if mimeType := detectRaw(data); mimeType != "" {
+		return mimeType
+	}
+	return http.DetectContentType(data)
+}
+
+// detectBMFF detects ISO base media files (HEIC, AVIF, MP4, MOV, 3GP) from their ftyp box
+// @param data []byte
+// @return string The content type or an empty string if the data is not an ISO base media file
+func detectBMFF(data []byte) string {
+	if len(data) < 16 {
+		return ""
+	}
+	size := int64(binary.BigEndian.Uint32(data))
+	boxType := string(data[4:8])
+	if boxType != "ftyp" {
+		if quickTimeAtom(data, size, boxType) {
+			return "video/quicktime"
+		}
+		return ""
+	}
+	// the ftyp box holds the major brand, the minor version and the compatible brands
+	if size < 16 || size%4 != 0 {
+		return ""
+	}
+	major := string(data[8:12])
+	mimeType := ftypBrands[major]
+	// mif1 is also the major brand of many HEIC files, so check the compatible brands for heic
+	if major == "mif1" && bytes.Contains(data[12:minInt(len(data), 64)], []byte("heic")) {
+		return "image/heic"
+	}
+	return mimeType
+}
+
+// quickTimeAtom checks whether data starts with an atom old QuickTime files start with,
+// and that the atom looks like a real one rather than other data that happens to have its type at offset 4
+// @param data []byte At least 16 bytes
+// @param size int64 The size of the atom
+// @param atomType string
+// @return bool
+func quickTimeAtom(data []byte, size int64, atomType string) bool {
+	switch atomType {
+	case "mdat":
+		// the media data can run to the end of the file, or have a 64 bit size after the type
+		return size == 0 || size == 1 || size >= 8
+	case "moov":
+		return size >= 16 && contains(moovChildren, string(data[12:16]))
+	case "wide", "free", "skip", "pnot":
+		// these are followed by another atom, which has to be in the data to check
+		if size < 8 || size+8 > int64(len(data)) {
+			return false
+		}
+		next := string(data[size+4 : size+8])
+		return contains(quickTimeAtoms, next) || atomType == "pnot" && next == "PICT"
+	}
+	return false
+}
+
+// contains returns whether a list holds a string
+// @param list []string
+// @param s string
+// @return bool
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// detectRaw detects camera raw files
+// @param data []byte
+// @return string The content type or an empty string if the data is not a raw file we know
+func detectRaw(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("FUJIFILMCCD-RAW")):
+		return "image/x-fuji-raf"
+	case bytes.HasPrefix(data, []byte("IIRO")), bytes.HasPrefix(data, []byte("IIRS")), bytes.HasPrefix(data, []byte("MMOR")):
+		return "image/x-olympus-orf"
+	case bytes.HasPrefix(data, []byte("IIU\x00")):
+		return "image/x-panasonic-rw2"
+	case bytes.HasPrefix(data, []byte("II*\x00")) && len(data) > 10 && string(data[8:10]) == "CR":
+		return "image/x-canon-cr2"
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		// other raw formats are plain TIFF files, so look at the tags to tell them apart
+		ex, err := exif.Read(data)
+		if err != nil {
+			return "image/tiff"
+		}
+		if ex.IsDNG {
+			return "image/x-adobe-dng"
+		}
+		for cameraMake, mimeType := range rawMakes {
+			if strings.HasPrefix(strings.ToUpper(ex.Make), cameraMake) {
+				return mimeType
+			}
+		}
+		return "image/tiff"
+	}
+	return ""
+}
+
+// checkDeclaredMimeType cross checks the content type a client declared against the one detected.
+// The detected type is used unless it could not be detected, in which case the declared type is trusted.
+// @param declared string The content type the client declared, can be empty
+// @param detected string The content type detected from the data
+// @return string The content type to store
+// @return bool false if the declared type does not match the detected type
+func checkDeclaredMimeType(declared, detected string) (string, bool) {
+	if declared == "" {
+		return detected, true
+	}
+	declaredType, _, err := mime.ParseMediaType(declared)
+	if err != nil {
+		return detected, false
+	}
+	detectedType, _, _ := mime.ParseMediaType(detected)
+	if detectedType == defaultMimeType {
+		return declaredType, true
+	}
+	// image/jpg is a common misspelling of image/jpeg
+	if declaredType == "image/jpg" {
+		declaredType = "image/jpeg"
+	}
+	return detected, declaredType == detectedType
+}
+
+// minInt returns the smaller of the two ints
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDetectMimeTypeBMFF(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "mp4", data: testMovie(16), want: "video/mp4"},
+		{name: "heic", data: testBox("ftyp", []byte("heic\x00\x00\x00\x00mif1heic")), want: "image/heic"},
+		{name: "mif1 with heic", data: testBox("ftyp", []byte("mif1\x00\x00\x00\x00mif1heic")), want: "image/heic"},
+		{name: "quicktime ftyp", data: testBox("ftyp", []byte("qt  \x00\x00\x00\x00qt  ")), want: "video/quicktime"},
+		{name: "old quicktime moov", data: testBox("moov", testBox("mvhd", make([]byte, 100))), want: "video/quicktime"},
+		{name: "old quicktime wide", data: append(testBox("wide", nil), testBox("mdat", make([]byte, 16))...), want: "video/quicktime"},
+		// the data after an unknown brand is left to http.DetectContentType
+		{name: "unknown brand", data: testBox("ftyp", []byte("abcd\x00\x00\x00\x00abcd")), want: "application/octet-stream"},
+		{name: "unknown brand compatible with mp4", data: testBox("ftyp", []byte("abcd\x00\x00\x00\x00mp42")), want: "video/mp4"},
+		{name: "ftyp with a bad size", data: append([]byte("\x00\x00\x00\x0bftypisom"), make([]byte, 8)...), want: "application/octet-stream"},
+		{name: "text with free at offset 4", data: []byte("The free and open source software"), want: "text/plain; charset=utf-8"},
+		{name: "text with moov at offset 4", data: []byte("Somemoov that is not a movie at all"), want: "text/plain; charset=utf-8"},
+		{name: "free not followed by an atom", data: append(testBox("free", nil), bytes.Repeat([]byte{0xff}, 16)...), want: "application/octet-stream"},
+		{name: "skip bigger than the data", data: append([]byte("\x00\x10\x00\x00skip"), make([]byte, 16)...), want: "application/octet-stream"},
+		{name: "short", data: []byte("\x00\x00\x00\x08moov"), want: "application/octet-stream"},
+	}
+	for _, test := range tests {
+		if got := DetectMimeType(test.data); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -10,7 +10,11 @@ type FileData struct {
 	ValidateFile []byte
 	StartIndex   int
 	Size         int64
-	Attributes   map[string]string
+	// ContentType is the content type the client declares when uploading, and the detected one when listing
+	ContentType string
+	// Folder is the folder to upload the file into, today's date folder when empty
+	Folder     string
+	Attributes map[string]string
 }
 
 // GetFilesWithAttributes is an object to hold the folder you wish to grab files from,
@@ -36,16 +40,33 @@ func (g *GetFilesWithAttributes) SortedAttributeKeys() []string {
 	return sortedKeys
 }
 
+// ErrorResponse is an object that holds why a request failed, and is what every endpoint sends back
+// with its error status code. The results of the endpoints have it too, empty when they succeed.
+// ErrorCode is one of the ErrorCode values for programs to act on, Error is a message for people.
+type ErrorResponse struct {
+	ErrorCode ErrorCode
+	Error     string
+}
+
+// UploadResult is an object to store the result of writing a chunk of a file.
+// Count is the position in the file written up to, which is where an upload resumes from after an
+// offset_mismatch error. Folder is the folder the file was written to.
+type UploadResult struct {
+	Count  int
+	Folder string
+	ErrorResponse
+}
+
 // FileDataList is an object to store a list of FileData objects
 type FileDataList struct {
 	Files []FileData
-	Error string
+	ErrorResponse
 }
 
 // FoldersList is an object to store a list of Folder objects
 type FoldersList struct {
 	Folders []Folder
-	Error   string
+	ErrorResponse
 }
 
 // Folder is an object to store the name of the folder and the count of files it holds
@@ -53,3 +74,107 @@ type Folder struct {
 	Name  string
 	Count int
 }
+
+// AttributeFilter is an object to match a header attribute against a value.
+// Match is how the attribute is compared to Value and is one of
+// "equals"(the default), "prefix" or "contains". The comparison ignores case when IgnoreCase is set.
+type AttributeFilter struct {
+	Key        string
+	Match      string
+	Value      string
+	IgnoreCase bool
+}
+
+// SearchRequest is an object to hold the filters of a search across all folders.
+// Every filter that is set has to match for a file to be returned.
+// Sizes of 0 and empty times are not used as filters.
+// Times are RFC3339 or "2006-01-02" dates.
+// StartIndex and EndIndex(exclusively) select the page of results to return.
+type SearchRequest struct {
+	Folders        []string
+	Attributes     []AttributeFilter
+	MimeType       string
+	MinSize        int64
+	MaxSize        int64
+	UploadedAfter  string
+	UploadedBefore string
+	CapturedAfter  string
+	CapturedBefore string
+	StartIndex     int
+	EndIndex       int
+}
+
+// FileMetadata is an object that holds what we know about a stored file without its data.
+// Hash is the hex encoded sha256 hash of the file.
+type FileMetadata struct {
+	Folder      string
+	Hash        string
+	Size        int64
+	Complete    bool
+	Uploaded    string
+	ContentType string
+	Attributes  map[string]string
+}
+
+// SearchResults is an object to store a page of search results.
+// Total is the number of files that matched, across all pages.
+type SearchResults struct {
+	Files []FileMetadata
+	Total int
+	ErrorResponse
+}
+
+// ZipRequest is an object to hold the files to download as a ZIP archive.
+// Hashes are hex or base64 encoded sha256 hashes. When Hashes is empty the whole Folder is downloaded,
+// otherwise the files are looked up in Folder, or in every folder if Folder is empty.
+type ZipRequest struct {
+	Folder string
+	Hashes []string
+}
+
+// ManageRequest is an object to hold a request to delete or move files, or to create, rename or delete a folder.
+// Hashes are hex or base64 encoded sha256 hashes of files in Folder. ToFolder is the folder files are moved to,
+// or the new name of a renamed folder. Recursive lets a folder be deleted along with its files.
+type ManageRequest struct {
+	Folder    string
+	Hashes    []string
+	ToFolder  string
+	Recursive bool
+}
+
+// ManageResult is an object to store the result of a management request.
+// Count is the number of files or folders the request changed before it stopped.
+type ManageResult struct {
+	Count int
+	ErrorResponse
+}
+
+// Device is an object that holds a device that asked to be paired with the server.
+// Status is "pending" until the operator approves it, then "approved" until it is revoked.
+// Code is shown on the device and to the operator so they can check they approve the right device.
+// Only the sha256 hash of the token of the device is kept.
+type Device struct {
+	ID        string
+	Name      string
+	Status    string
+	Code      string
+	Address   string
+	Requested string
+	Approved  string
+	TokenHash string
+}
+
+// PairRequest is an object to hold the name of a device that asks to be paired with the server.
+type PairRequest struct {
+	Name string
+}
+
+// PairResult is an object to store the result of a pairing request or the status of a paired device.
+// Token is only sent back once, when the device asks to be paired.
+type PairResult struct {
+	DeviceID string
+	Token    string
+	Code     string
+	Status   string
+	ErrorResponse
+}
@@ -0,0 +1,82 @@
+package server
+
+// quota file to hold the checks a new upload has to pass, that there is disk space for it and that it fits in the quotas
+
+import (
+	"encoding/hex"
+	"net/http"
+	"sfile"
+	"storage"
+)
+
+// DeviceAttribute is the reserved header attribute the ID of the device that started an upload is stored in,
+// which the device quota is counted by. Clients can not set it.
+const DeviceAttribute = "UploadedBy"
+
+// storageSpace returns the bytes free and the size in bytes of the space the server's storage is kept in.
+// It is not known for storage that is not a storage.Spacer, or when reading it fails.
+// @return uint64 The bytes free
+// @return uint64 The size in bytes
+// @return bool Whether the space is known
+func (s *Server) storageSpace() (uint64, uint64, bool) {
+	spacer, ok := s.store.(storage.Spacer)
+	if !ok {
+		return 0, 0, false
+	}
+	free, size, err := spacer.Space()
+	if err != nil {
+		s.log.LogWarnf("could not read free disk space of %s; %s", s.root, err)
+		return 0, 0, false
+	}
+	return free, size, true
+}
+
+// checkNewUpload checks that a file that is not on the server yet fits on the disk without going into the reserve,
+// and that it fits in the quotas of its folder and of the device uploading it
+// @param folder string The name of the folder the file is uploaded to
+// @param device string The ID of the device uploading the file, empty when it is not known
+// @param size int64 The size the client says the file is
+// @return error
+func (s *Server) checkNewUpload(folder, device string, size int64) error {
+	// when the free space is not known the upload fails when the disk is full instead
+	free, _, ok := s.storageSpace()
+	if ok {
+		unwritten := s.unwrittenBytes()
+		reserved := uint64(s.opts.MinFreeSpace) + unwritten
+		if free < reserved || uint64(size) > free-reserved {
+			return newAPIError(http.StatusInsufficientStorage, CodeInsufficientStorage, "error: not enough disk space for a file of %d bytes, %d bytes are free, %d of them are kept in reserve and %d are still to be written by uploads in progress", size, free, s.opts.MinFreeSpace, unwritten)
+		}
+	}
+	if s.opts.FolderQuota > 0 {
+		used := s.index.folderBytes(folder)
+		if used+size > s.opts.FolderQuota {
+			return newAPIError(http.StatusInsufficientStorage, CodeQuotaExceeded, "error: a file of %d bytes does not fit in the quota of folder %s, %d of %d bytes are used", size, folder, used, s.opts.FolderQuota)
+		}
+	}
+	if s.opts.DeviceQuota > 0 && device != "" {
+		used := s.index.deviceBytes(device)
+		if used+size > s.opts.DeviceQuota {
+			return newAPIError(http.StatusInsufficientStorage, CodeQuotaExceeded, "error: a file of %d bytes does not fit in the quota of the device, %d of %d bytes are used", size, used, s.opts.DeviceQuota)
+		}
+	}
+	return nil
+}
+
+// unwrittenBytes returns the bytes the uploads in progress still have to write. Their SAVE files are created at
+// their full size, but a file system only takes the space of the parts that have been written from the free space.
+// @return uint64
+func (s *Server) unwrittenBytes() uint64 {
+	var unwritten uint64
+	for _, file := range s.index.partialUploads() {
+		written := 0
+		if hash, err := hex.DecodeString(file.Hash); err == nil {
+			if saveFile, err := sfile.ReadSaveFileHeader(s.store, saveFileName(file.Folder, hash), nil); err == nil {
+				written = saveFile.Size
+			}
+		}
+		if file.Size > int64(written) {
+			unwritten += uint64(file.Size - int64(written))
+		}
+	}
+	return unwritten
+}
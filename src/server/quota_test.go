@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"storage"
+	"testing"
+)
+
+// spaceStorage is a storage with a fixed amount of free space, which does not go down as files are written,
+// like the disk of a file system that keeps the unwritten parts of files sparse
+type spaceStorage struct {
+	storage.Storage
+	free uint64
+}
+
+// Space is a method to get the fixed free space of the storage
+// @return uint64 The bytes free
+// @return uint64 The size in bytes
+// @return error
+func (st spaceStorage) Space() (uint64, uint64, error) {
+	return st.free, st.free, nil
+}
+
+func TestCheckUploadLimits(t *testing.T) {
+	s, err := New(Options{Root: t.TempDir(), Storage: storage.NewMemory(), Logger: testLogger(t), MaxFileSize: 100, MaxChunkSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		data   FileData
+		status int
+	}{
+		{name: "first chunk", data: FileData{Data: make([]byte, 10), Size: 100}},
+		{name: "last chunk", data: FileData{Data: make([]byte, 10), StartIndex: 90, Size: 100}},
+		{name: "empty file", data: FileData{}},
+		{name: "negative size", data: FileData{Size: -1}, status: http.StatusBadRequest},
+		{name: "negative start", data: FileData{Data: make([]byte, 1), StartIndex: -1, Size: 10}, status: http.StatusBadRequest},
+		{name: "past the end", data: FileData{Data: make([]byte, 10), StartIndex: 91, Size: 100}, status: http.StatusBadRequest},
+		{name: "chunk bigger than the file", data: FileData{Data: make([]byte, 5), Size: 4}, status: http.StatusBadRequest},
+		{name: "file too big", data: FileData{Data: make([]byte, 10), Size: 101}, status: http.StatusRequestEntityTooLarge},
+		{name: "chunk too big", data: FileData{Data: make([]byte, 11), Size: 100}, status: http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		err := s.checkUploadLimits(test.data)
+		status := 0
+		if err != nil {
+			status = asAPIError(err).Status
+		}
+		if status != test.status {
+			t.Errorf("%s: got %v, want status %d", test.name, err, test.status)
+		}
+	}
+}
+
+func TestFreeSpaceKeptForUploads(t *testing.T) {
+	s, err := New(Options{
+		Root:         t.TempDir(),
+		Storage:      spaceStorage{Storage: storage.NewMemory(), free: 1100},
+		Logger:       testLogger(t),
+		DisableAuth:  true,
+		MinFreeSpace: 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	partial := FileData{Data: make([]byte, 10), ValidateFile: bytes.Repeat([]byte{1}, 32), Size: 80, Folder: "f"}
+	_, _, err = s.saveFileChunk(partial, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 70 bytes of the partial upload are still to be written, which leaves 30 of the 100 above the reserve
+	if err := s.checkNewUpload("f", "", 31); err == nil || asAPIError(err).Code != CodeInsufficientStorage {
+		t.Errorf("upload of 31 bytes gave %v, want it refused", err)
+	}
+	if err := s.checkNewUpload("f", "", 30); err != nil {
+		t.Errorf("upload of 30 bytes gave %v", err)
+	}
+	partial.Data, partial.StartIndex = make([]byte, 40), 10
+	_, _, err = s.saveFileChunk(partial, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.checkNewUpload("f", "", 31); err != nil {
+		t.Errorf("upload of 31 bytes after more of the partial upload was written gave %v", err)
+	}
+	// the rest of the upload has to keep the size it was started with
+	partial.Data, partial.StartIndex, partial.Size = make([]byte, 10), 50, 60
+	_, _, err = s.saveFileChunk(partial, "")
+	if err == nil || asAPIError(err).Status != http.StatusBadRequest {
+		t.Errorf("chunk with another size gave %v, want a bad request", err)
+	}
+}
@@ -0,0 +1,238 @@
+package server
+
+// search file to hold the logic for searching files across all folders by their metadata
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultSearchPageSize is the number of results returned when EndIndex is not set.
+const defaultSearchPageSize = 100
+
+// maxSearchPageSize is the most results that are returned in one page.
+const maxSearchPageSize = 1000
+
+// CaptureTimeAttribute is the header attribute the capture time of a file is read from.
+const CaptureTimeAttribute = "CaptureTime"
+
+// captureTimeFormats are the formats the CaptureTime attribute can be in
+var captureTimeFormats = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"}
+
+// fileSearch is a SearchRequest with its times parsed
+type fileSearch struct {
+	SearchRequest
+	uploadedAfter  time.Time
+	uploadedBefore time.Time
+	capturedAfter  time.Time
+	capturedBefore time.Time
+}
+
+// parseTimeParam parses a time given in a request as either RFC3339 or a "2006-01-02" date.
+// An empty string returns the zero time.
+// @param value string
+// @return time.Time
+// @return error
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return t, newAPIError(http.StatusBadRequest, CodeBadRequest, "error: time %s must be RFC3339 or 2006-01-02", value)
+	}
+	return t, nil
+}
+
+// parseCaptureTime parses the CaptureTime attribute of a file.
+// Times without a UTC offset are taken as server local time.
+// @param value string
+// @return time.Time
+// @return bool false if the value could not be parsed
+func parseCaptureTime(value string) (time.Time, bool) {
+	for _, format := range captureTimeFormats {
+		t, err := time.ParseInLocation(format, value, time.Local)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// newFileSearch validates a SearchRequest and parses its times
+// @param req SearchRequest
+// @return *fileSearch
+// @return error
+func newFileSearch(req SearchRequest) (*fileSearch, error) {
+	s := &fileSearch{SearchRequest: req}
+	var err error
+	if s.uploadedAfter, err = parseTimeParam(req.UploadedAfter); err != nil {
+		return nil, err
+	}
+	if s.uploadedBefore, err = parseTimeParam(req.UploadedBefore); err != nil {
+		return nil, err
+	}
+	if s.capturedAfter, err = parseTimeParam(req.CapturedAfter); err != nil {
+		return nil, err
+	}
+	if s.capturedBefore, err = parseTimeParam(req.CapturedBefore); err != nil {
+		return nil, err
+	}
+	for _, f := range req.Attributes {
+		switch f.Match {
+		case "", "equals", "prefix", "contains":
+		default:
+			return nil, newAPIError(http.StatusBadRequest, CodeBadRequest, "error: attribute match %s must be equals, prefix or contains", f.Match)
+		}
+	}
+	if s.StartIndex < 0 || s.EndIndex < 0 || (s.EndIndex != 0 && s.EndIndex < s.StartIndex) {
+		return nil, newAPIError(http.StatusBadRequest, CodeOutOfRange, "error: either start or end index is incorrect. startIndex: %d, endIndex: %d", s.StartIndex, s.EndIndex)
+	}
+	if s.EndIndex == 0 {
+		s.EndIndex = s.StartIndex + defaultSearchPageSize
+	}
+	if s.EndIndex-s.StartIndex > maxSearchPageSize {
+		s.EndIndex = s.StartIndex + maxSearchPageSize
+	}
+	return s, nil
+}
+
+// matchesFolder checks the folder against the Folders filter
+func (s *fileSearch) matchesFolder(folder string) bool {
+	if len(s.Folders) == 0 {
+		return true
+	}
+	for _, f := range s.Folders {
+		if f == folder {
+			return true
+		}
+	}
+	return false
+}
+
+// matches checks if the file matches every filter of the search
+// @param file FileMetadata
+// @return bool
+func (s *fileSearch) matches(file FileMetadata) bool {
+	if !s.matchesFolder(file.Folder) {
+		return false
+	}
+	if s.MinSize != 0 && file.Size < s.MinSize {
+		return false
+	}
+	if s.MaxSize != 0 && file.Size > s.MaxSize {
+		return false
+	}
+	if s.MimeType != "" && !matchMimeType(s.MimeType, file.ContentType) {
+		return false
+	}
+	if !s.uploadedAfter.IsZero() || !s.uploadedBefore.IsZero() {
+		uploaded, err := time.Parse(time.RFC3339, file.Uploaded)
+		if err != nil || !inTimeRange(uploaded, s.uploadedAfter, s.uploadedBefore) {
+			return false
+		}
+	}
+	if !s.capturedAfter.IsZero() || !s.capturedBefore.IsZero() {
+		captured, ok := parseCaptureTime(file.Attributes[CaptureTimeAttribute])
+		if !ok || !inTimeRange(captured, s.capturedAfter, s.capturedBefore) {
+			return false
+		}
+	}
+	for _, f := range s.Attributes {
+		value, ok := file.Attributes[f.Key]
+		if !ok || !matchAttribute(f, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// inTimeRange checks if t is at or after after and before before. Zero times are not checked.
+func inTimeRange(t, after, before time.Time) bool {
+	if !after.IsZero() && t.Before(after) {
+		return false
+	}
+	if !before.IsZero() && !t.Before(before) {
+		return false
+	}
+	return true
+}
+
+// matchMimeType checks a content type against a filter.
+// A filter ending in "/" or "/*" such as "video/" matches every type under it.
+// @param filter string
+// @param mimeType string
+// @return bool
+func matchMimeType(filter, mimeType string) bool {
+	filter = strings.ToLower(strings.TrimSuffix(filter, "*"))
+	mimeType = strings.ToLower(mimeType)
+	if strings.HasSuffix(filter, "/") {
+		return strings.HasPrefix(mimeType, filter)
+	}
+	// ignore parameters such as "; charset=utf-8"
+	mimeType = strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0])
+	return filter == mimeType
+}
+
+// matchAttribute checks an attribute value against a filter
+// @param f AttributeFilter
+// @param value string
+// @return bool
+func matchAttribute(f AttributeFilter, value string) bool {
+	want := f.Value
+	if f.IgnoreCase {
+		want = strings.ToLower(want)
+		value = strings.ToLower(value)
+	}
+	switch f.Match {
+	case "prefix":
+		return strings.HasPrefix(value, want)
+	case "contains":
+		return strings.Contains(value, want)
+	}
+	return value == want
+}
+
+// searchFiles goes through every file in the metadata index and returns the ones that match the search
+// @param search *fileSearch
+// @return []FileMetadata Every match, in folder and then file order
+func (s *Server) searchFiles(search *fileSearch) []FileMetadata {
+	matches := make([]FileMetadata, 0)
+	for _, file := range s.index.allFiles() {
+		if search.matches(file) {
+			matches = append(matches, file)
+		}
+	}
+	return matches
+}
+
+// Search is a method to accept a POST request with a SearchRequest and return the page of
+// files across all folders that match every filter given.
+func (s *Server) Search(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "Search")
+	decoder := json.NewDecoder(req.Body)
+	var data SearchRequest
+	err := decoder.Decode(&data)
+	defer req.Body.Close()
+	if err != nil {
+		s.writeError(w, req, newAPIError(http.StatusBadRequest, CodeBadRequest, "error: could not parse search request; %s", err))
+		return
+	}
+	search, err := newFileSearch(data)
+	if err != nil {
+		s.writeError(w, req, err)
+		return
+	}
+	matches := s.searchFiles(search)
+	results := SearchResults{Files: make([]FileMetadata, 0), Total: len(matches)}
+	if search.StartIndex < len(matches) {
+		results.Files = matches[search.StartIndex:minInt(search.EndIndex, len(matches))]
+	}
+	s.log.WriteOutJSONMessage(results, w)
+}
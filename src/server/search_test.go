@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// postJSON sends a POST request with a json body to a path of a server
+// @return *httptest.ResponseRecorder
+func postJSON(t *testing.T, s *Server, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data)))
+	return w
+}
+
+func TestSearch(t *testing.T) {
+	s := openTestServer(t)
+	uploadTestFile(t, s, "trip", []byte("beach day"), map[string]string{"Name": "Beach.txt", CaptureTimeAttribute: "2024-07-14T10:00:00Z"})
+	uploadTestFile(t, s, "trip", testPNG(t, 4, 4), map[string]string{"Name": "beach.png", CaptureTimeAttribute: "2024-08-01"})
+	uploadTestFile(t, s, "home", []byte("a longer note from home"), map[string]string{"Name": "note.txt"})
+	s.background.Wait()
+	tests := []struct {
+		name    string
+		request SearchRequest
+		want    []string
+		total   int
+	}{
+		{name: "everything", request: SearchRequest{}, want: []string{"Beach.txt", "beach.png", "note.txt"}},
+		{name: "folder", request: SearchRequest{Folders: []string{"home"}}, want: []string{"note.txt"}},
+		{name: "name prefix", request: SearchRequest{Attributes: []AttributeFilter{{Key: "Name", Value: "beach", Match: "prefix", IgnoreCase: true}}}, want: []string{"Beach.txt", "beach.png"}},
+		{name: "name with case", request: SearchRequest{Attributes: []AttributeFilter{{Key: "Name", Value: "beach", Match: "prefix"}}}, want: []string{"beach.png"}},
+		{name: "content type", request: SearchRequest{MimeType: "text/*"}, want: []string{"Beach.txt", "note.txt"}},
+		{name: "size", request: SearchRequest{MimeType: "text/plain", MinSize: 10}, want: []string{"note.txt"}},
+		{name: "capture time", request: SearchRequest{CapturedAfter: "2024-07-01", CapturedBefore: "2024-07-31"}, want: []string{"Beach.txt"}},
+		{name: "page", request: SearchRequest{StartIndex: 1, EndIndex: 2}, total: 3},
+	}
+	for _, test := range tests {
+		w := postJSON(t, s, "/search", test.request)
+		var results SearchResults
+		if err := json.NewDecoder(w.Body).Decode(&results); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, %v", test.name, w.Code, err)
+		}
+		if test.total != 0 {
+			if results.Total != test.total || len(results.Files) != 1 {
+				t.Errorf("%s: got %d of %d files", test.name, len(results.Files), results.Total)
+			}
+			continue
+		}
+		names := make([]string, 0, len(results.Files))
+		for _, file := range results.Files {
+			names = append(names, file.Attributes["Name"])
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, test.want) || results.Total != len(test.want) {
+			t.Errorf("%s: got %v of %d, want %v", test.name, names, results.Total, test.want)
+		}
+	}
+	w := postJSON(t, s, "/search", SearchRequest{Attributes: []AttributeFilter{{Key: "Name", Value: "a", Match: "regexp"}}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown match gave %d", w.Code)
+	}
+}
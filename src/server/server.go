@@ -0,0 +1,597 @@
+package server
+
+// server file to hold the Server type that carries everything one instance of the file server needs
+
+import (
+	"context"
+	"crypto/tls"
+	"discovery"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"storage"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Options is an object that holds the settings a Server is created with.
+// The zero value is a usable server saving files under "Data" with every feature turned on.
+type Options struct {
+	// Root is the root path files are saved under, "Data" when it and Storage are empty. The paired devices,
+	// the certificate and the metadata index are kept here, even when the files themselves are kept in Storage.
+	// When Storage is given without a Root nothing is kept on the local disk: the index is built from the storage
+	// whenever the server is opened, the paired devices and a generated certificate only last until it stops,
+	// and the root path is not locked.
+	Root string
+	// Storage is where the folders, files and thumbnails are kept, a storage.FileSystem of Root when nil
+	Storage storage.Storage
+	// Address is the address Start listens on, like ":8080". When empty Start does not listen
+	// and the server is only reached through its Handler.
+	Address string
+	// TLS serves Address over HTTPS. The certificate is the one in CertFile and KeyFile, or a self-signed
+	// one generated and saved under the root path the first time when they are empty.
+	TLS bool
+	// CertFile is the PEM certificate file served with TLS
+	CertFile string
+	// KeyFile is the PEM key file of CertFile
+	KeyFile string
+	// HTTPAddress is an address Start also listens on with plain HTTP when TLS is on, like ":8081", empty for none
+	HTTPAddress string
+	// MDNSAddress is the address Start advertises the server with mDNS on, like "224.0.0.251:5353", empty for none
+	MDNSAddress string
+	// DiscoveryAddress is the address Start answers UDP discovery broadcasts on, like ":8089", empty for none
+	DiscoveryAddress string
+	// Prefix is the path the Handler is mounted under, like "/files", empty for the root
+	Prefix string
+	// Logger is the Logger the server logs to, the package Logger when nil
+	Logger *Logger
+	// Clock returns the current time, time.Now when nil
+	Clock func() time.Time
+	// FolderLayout is the template that decides which folder new uploads are put into, DefaultFolderLayout when empty
+	FolderLayout string
+	// AdminToken is the token the management endpoints need, they are turned off when it is empty.
+	// It is also accepted everywhere a device token is.
+	AdminToken string
+	// DisableAuth lets every request in without the token of a paired device
+	DisableAuth bool
+	// MaxFileSize is the largest file in bytes that can be uploaded, 0 for no limit
+	MaxFileSize int64
+	// MaxChunkSize is the largest chunk of a file in bytes that can be sent to /post_file, 64MB when 0
+	MaxChunkSize int64
+	// ReadTimeout is how long a request, with its body, can take to read, 5 minutes when 0
+	ReadTimeout time.Duration
+	// WriteTimeout is how long a response can take to write, 2 minutes when 0. Downloads can take longer
+	// as long as the client does not stop reading for this long.
+	WriteTimeout time.Duration
+	// IdleTimeout is how long a kept alive connection waits for the next request, 2 minutes when 0
+	IdleTimeout time.Duration
+	// DisableGallery turns the web gallery off
+	DisableGallery bool
+	// DisableThumbnails turns generating and serving thumbnails off
+	DisableThumbnails bool
+	// DisableMetadata turns reading EXIF and video metadata into the headers of uploaded files off
+	DisableMetadata bool
+	// DisableZip turns ZIP downloads off
+	DisableZip bool
+	// DisableMetrics turns the /metrics path off
+	DisableMetrics bool
+	// MinFreeSpace is the disk space in bytes kept free, new uploads that would leave less are rejected
+	MinFreeSpace int64
+	// FolderQuota is the most bytes the files of a folder can take up, 0 for no limit
+	FolderQuota int64
+	// DeviceQuota is the most bytes the files uploaded by one device can take up, 0 for no limit
+	DeviceQuota int64
+}
+
+// Server is an object that holds one instance of the file server with its own root path,
+// metadata index, logger and clock. Its Handler can be served on its own or mounted in another mux.
+type Server struct {
+	opts    Options
+	root    string
+	store   storage.Storage
+	prefix  string
+	log     *Logger
+	now     func() time.Time
+	layout  *folderLayout
+	handler http.Handler
+	// plainHandler is the handler of the plain HTTP listener next to TLS, which only serves plainHTTPPaths
+	plainHandler http.Handler
+	// mux is what the paths of the server are routed with, which requests are counted by in metrics
+	mux     *http.ServeMux
+	metrics *metrics
+	// templates are the pages of the gallery
+	templates map[string]*template.Template
+	// index is the metadata index of root, opened by Start
+	index *metadataIndex
+	// lock is the lock file of root, held from Open until Shutdown so subcommands do not change the files under a running server
+	lock *os.File
+	// devices are the devices paired with the server, read the first time they are needed
+	devices *deviceStore
+	// manageMu makes sure only one management operation changes the folders at a time
+	manageMu sync.Mutex
+	// uploadMu makes sure new uploads are checked and created one at a time,
+	// so two of them can not both take the last of the disk space or a quota
+	uploadMu sync.Mutex
+	// background is the work, like extracting metadata, still running after a request returned
+	background sync.WaitGroup
+	// writes are the chunks being written to SAVE files, which Shutdown always lets finish.
+	// Once draining is set no new writes are started.
+	writes   sync.WaitGroup
+	writeMu  sync.Mutex
+	draining bool
+	// tlsConfig holds the certificate of the server once it is loaded, with its fingerprint
+	tlsConfig   *tls.Config
+	fingerprint string
+	// httpServers are the servers Start listens with when Address is set, the first one on Address
+	httpServers []*http.Server
+	listeners   []net.Listener
+	// mdns and broadcast advertise the server on the LAN once it listens
+	mdns      *discovery.MDNSResponder
+	broadcast *discovery.BroadcastResponder
+	// served gets the error each of the httpServers stopped with
+	served chan error
+	mu     sync.Mutex
+}
+
+// defaultMaxChunkSize is the MaxChunkSize used when none is set
+const defaultMaxChunkSize = 64 << 20
+
+// the timeouts used when none are set
+const (
+	defaultReadTimeout  = 5 * time.Minute
+	defaultWriteTimeout = 2 * time.Minute
+	defaultIdleTimeout  = 2 * time.Minute
+	// readHeaderTimeout is how long the headers of a request can take, so idle connections are dropped quickly
+	readHeaderTimeout = 10 * time.Second
+)
+
+// errShuttingDown is returned when a chunk is sent after the server started shutting down
+var errShuttingDown = errors.New("error: server is shutting down, try again later")
+
+// New is a method to create a Server from its options. Nothing is read or written until Start is called.
+// @param opts Options
+// @return *Server
+// @return error
+func New(opts Options) (*Server, error) {
+	if opts.Root == "" && opts.Storage == nil {
+		opts.Root = "Data"
+	}
+	if opts.Logger == nil {
+		opts.Logger = defaultLogger
+	}
+	if opts.Clock == nil {
+		opts.Clock = time.Now
+	}
+	if opts.Storage == nil {
+		opts.Storage = storage.NewFileSystem(opts.Root)
+	}
+	if opts.FolderLayout == "" {
+		opts.FolderLayout = DefaultFolderLayout
+	}
+	if opts.MaxChunkSize == 0 {
+		opts.MaxChunkSize = defaultMaxChunkSize
+	}
+	if opts.ReadTimeout == 0 {
+		opts.ReadTimeout = defaultReadTimeout
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = defaultWriteTimeout
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = defaultIdleTimeout
+	}
+	if opts.MaxFileSize < 0 || opts.MaxChunkSize < 0 || opts.MinFreeSpace < 0 || opts.FolderQuota < 0 || opts.DeviceQuota < 0 {
+		return nil, errors.New("error: upload limits can not be negative")
+	}
+	if opts.ReadTimeout < 0 || opts.WriteTimeout < 0 || opts.IdleTimeout < 0 {
+		return nil, errors.New("error: timeouts can not be negative")
+	}
+	if opts.Prefix != "" && (!strings.HasPrefix(opts.Prefix, "/") || strings.HasSuffix(opts.Prefix, "/")) {
+		return nil, errors.New("error: prefix must start with a / and not end with one, like /files")
+	}
+	layout, err := parseFolderLayout(opts.FolderLayout)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		opts:    opts,
+		root:    opts.Root,
+		store:   opts.Storage,
+		prefix:  opts.Prefix,
+		log:     opts.Logger,
+		now:     opts.Clock,
+		layout:  layout,
+		metrics: newMetrics(),
+	}
+	s.handler = s.routes()
+	return s, nil
+}
+
+// Root is a method to get the root path the server saves files under, empty when it keeps nothing on the local disk.
+// @return string
+func (s *Server) Root() string {
+	return s.root
+}
+
+// Storage is a method to get the storage the server keeps its folders and files in.
+// @return storage.Storage
+func (s *Server) Storage() storage.Storage {
+	return s.store
+}
+
+// routes builds the handler of every path of the server
+// @return http.Handler
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", s.PingServ)
+	mux.HandleFunc("/pair", s.Pair)
+	mux.HandleFunc("/pair_status", s.PairStatus)
+	mux.HandleFunc("/post_file", s.authenticate(s.WriteFile))
+	mux.HandleFunc("/get_folders", s.authenticate(s.GetFolders))
+	mux.HandleFunc("/get_files", s.authenticate(s.GetFiles))
+	mux.HandleFunc("/validate_file", s.authenticate(s.ValidateFile))
+	mux.HandleFunc("/search", s.authenticate(s.Search))
+	mux.HandleFunc("/download_file", s.authenticate(s.DownloadFile))
+	mux.HandleFunc("/delete_files", s.authenticate(s.DeleteFiles))
+	mux.HandleFunc("/move_files", s.authenticate(s.MoveFiles))
+	mux.HandleFunc("/create_folder", s.authenticate(s.CreateFolderRequest))
+	mux.HandleFunc("/rename_folder", s.authenticate(s.RenameFolderRequest))
+	mux.HandleFunc("/delete_folder", s.authenticate(s.DeleteFolderRequest))
+	if !s.opts.DisableThumbnails {
+		mux.HandleFunc("/get_thumbnail", s.authenticate(s.GetThumbnail))
+	}
+	if !s.opts.DisableZip {
+		mux.HandleFunc("/download_zip", s.authenticate(s.DownloadZip))
+	}
+	if !s.opts.DisableMetrics {
+		mux.HandleFunc("/metrics", s.authenticate(s.Metrics))
+	}
+	if !s.opts.DisableGallery {
+		// the gallery checks the token itself so it can show the pairing page instead
+		s.parseGalleryTemplates()
+		mux.HandleFunc("/ui/", s.Gallery)
+	}
+	s.mux = mux
+	var handler http.Handler = mux
+	if s.prefix != "" {
+		handler = http.StripPrefix(s.prefix, mux)
+	}
+	serve := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if s.openIndex() == nil {
+			s.writeError(w, req, newAPIError(http.StatusServiceUnavailable, CodeUnavailable, "error: server is not started"))
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+	s.plainHandler = s.logRequests(s.recoverPanics(s.plainHTTP(serve)))
+	return s.logRequests(s.recoverPanics(serve))
+}
+
+// Handler is a method to get the http.Handler that serves every path of the server under its prefix.
+// Start has to be called before it can serve requests.
+// @return http.Handler
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// openIndex returns the metadata index if the server is started
+// @return *metadataIndex
+func (s *Server) openIndex() *metadataIndex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.index
+}
+
+// Open is a method to create the root path and the root of the storage if they do not exist, take the lock of the root path
+// and open the metadata index, without listening. The subcommands use it to work on the files of a stopped server,
+// and it fails while another server or subcommand has the root path open.
+// @return error
+func (s *Server) Open() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.index != nil {
+		return nil
+	}
+	// Check if Data Folder exists and if not, create it.
+	if s.root != "" {
+		_, err := os.Stat(s.root)
+		if err != nil {
+			s.log.Logln("creating Initial Data folder")
+			err = os.MkdirAll(s.root, 0777)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	lock, err := lockRoot(s.root)
+	if err != nil {
+		return err
+	}
+	err = s.store.MkdirAll("")
+	if err != nil {
+		lock.Close()
+		return err
+	}
+	ix, err := openMetadataIndex(s.root, s.store, s.log)
+	if err != nil {
+		lock.Close()
+		return err
+	}
+	s.index = ix
+	s.lock = lock
+	// a server that was shut down takes writes again once it is opened
+	s.writeMu.Lock()
+	s.draining = false
+	s.writeMu.Unlock()
+	return nil
+}
+
+// loadTLS loads the certificate of the server, generating it if needed, the first time it is called
+// @return *tls.Config
+// @return error
+func (s *Server) loadTLS() (*tls.Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tlsConfig != nil {
+		return s.tlsConfig, nil
+	}
+	cert, err := loadCertificate(s.root, s.opts.CertFile, s.opts.KeyFile, s.log)
+	if err != nil {
+		return nil, err
+	}
+	s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	s.fingerprint = CertificateFingerprint(cert.Certificate[0])
+	return s.tlsConfig, nil
+}
+
+// Fingerprint is a method to get the SHA-256 fingerprint of the server's TLS certificate that clients can pin,
+// loading or generating the certificate if it has not been yet.
+// @return string
+// @return error
+func (s *Server) Fingerprint() (string, error) {
+	if !s.opts.TLS {
+		return "", errors.New("error: TLS is not turned on")
+	}
+	_, err := s.loadTLS()
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fingerprint, nil
+}
+
+// Start is a method to open the server's storage and, when Address is set, start listening on it in the background.
+// With TLS on the certificate is loaded and its fingerprint logged, and HTTPAddress is listened on as well when set.
+// HTTPAddress only serves /ping and /pair_status, and sends every other request to HTTPS.
+// Once it listens the server is advertised on MDNSAddress and DiscoveryAddress when they are set.
+// @return error
+func (s *Server) Start() error {
+	err := s.Open()
+	if err != nil {
+		return err
+	}
+	if !s.opts.DisableAuth {
+		_, err = s.openDevices()
+		if err != nil {
+			return err
+		}
+	}
+	if s.opts.Address == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", s.opts.Address)
+	if err != nil {
+		return err
+	}
+	listeners := []net.Listener{listener}
+	if s.opts.TLS {
+		tlsConfig, err := s.loadTLS()
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listeners[0] = tls.NewListener(listener, tlsConfig)
+		fingerprint, _ := s.Fingerprint()
+		s.log.Logln("starting up server on https://" + listener.Addr().String())
+		s.log.Logln("TLS certificate SHA-256 fingerprint: " + fingerprint)
+		if s.opts.HTTPAddress != "" {
+			plain, err := net.Listen("tcp", s.opts.HTTPAddress)
+			if err != nil {
+				listener.Close()
+				return err
+			}
+			s.log.Logln("starting up plain HTTP server on http://" + plain.Addr().String())
+			listeners = append(listeners, plain)
+		}
+	} else {
+		s.log.Logln("starting up server on http://" + listener.Addr().String())
+	}
+	served := make(chan error, len(listeners))
+	s.mu.Lock()
+	s.listeners = listeners
+	s.served = served
+	for i, l := range listeners {
+		handler := s.handler
+		if i > 0 {
+			handler = s.plainHandler
+		}
+		httpServer := &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: readHeaderTimeout,
+			ReadTimeout:       s.opts.ReadTimeout,
+			WriteTimeout:      s.opts.WriteTimeout,
+			IdleTimeout:       s.opts.IdleTimeout,
+			ErrorLog:          s.log.StandardLogger("warn"),
+		}
+		s.httpServers = append(s.httpServers, httpServer)
+		go func(l net.Listener) {
+			err := httpServer.Serve(l)
+			if err != nil && err != http.ErrServerClosed {
+				s.log.LogWarnf("server on %s stopped; %s", l.Addr(), err)
+			}
+			served <- err
+		}(l)
+	}
+	s.mu.Unlock()
+	if s.opts.MDNSAddress != "" || s.opts.DiscoveryAddress != "" {
+		err = s.startDiscovery()
+		if err != nil {
+			// clients can still be given the address by hand
+			s.log.LogWarnf("could not advertise the server on the LAN; %s", err)
+		}
+	}
+	return nil
+}
+
+// Addr is a method to get the address the server is listening on, or nil if it is not listening.
+// @return net.Addr
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Addr()
+}
+
+// HTTPAddr is a method to get the address the server is listening on with plain HTTP next to TLS,
+// or nil if it is not.
+// @return net.Addr
+func (s *Server) HTTPAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.listeners) < 2 {
+		return nil
+	}
+	return s.listeners[1].Addr()
+}
+
+// Shutdown is a method to stop listening and wait for the requests and background work in progress to finish
+// or the context to end, and then flush and close the server's storage. Connections still open when the context
+// ends are closed, but chunks already being written to SAVE files are always finished first.
+// The server can be opened or started again afterwards.
+// @param ctx context.Context
+// @return error
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stopDiscovery()
+	s.mu.Lock()
+	httpServers := s.httpServers
+	s.httpServers = nil
+	s.listeners = nil
+	s.mu.Unlock()
+	var err error
+	for _, httpServer := range httpServers {
+		if shutdownErr := httpServer.Shutdown(ctx); err == nil {
+			err = shutdownErr
+		}
+	}
+	if err != nil {
+		for _, httpServer := range httpServers {
+			httpServer.Close()
+		}
+	}
+	s.writeMu.Lock()
+	s.draining = true
+	s.writeMu.Unlock()
+	s.writes.Wait()
+	done := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		select {
+		case <-done:
+		default:
+			if err == nil {
+				err = ctx.Err()
+			}
+			s.log.LogWarnf("stopped waiting for background work, files still being processed may be missing their metadata")
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.index != nil {
+		if closeErr := s.index.close(); err == nil {
+			err = closeErr
+		}
+		s.index = nil
+	}
+	if s.lock != nil {
+		s.lock.Close()
+		s.lock = nil
+	}
+	return err
+}
+
+// beginWrite is called before a chunk is written to a SAVE file and endWrite after it, so Shutdown can wait for it
+// @return error errShuttingDown once the server is shutting down
+func (s *Server) beginWrite() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.draining {
+		return errShuttingDown
+	}
+	s.writes.Add(1)
+	s.metrics.activeUploads.Add(1)
+	return nil
+}
+
+// endWrite is called after a chunk written after beginWrite
+func (s *Server) endWrite() {
+	s.metrics.activeUploads.Add(-1)
+	s.writes.Done()
+}
+
+// streamingWriter is an object that moves the write deadline of a response forward before every write,
+// so a long download is only cut off when the client stops reading for the write timeout.
+type streamingWriter struct {
+	http.ResponseWriter
+	controller *http.ResponseController
+	timeout    time.Duration
+	// sent counts the bytes written for the metrics
+	sent *atomic.Int64
+}
+
+// streaming wraps the writer of a response that can take longer than the write timeout
+// @param w http.ResponseWriter
+// @return http.ResponseWriter
+func (s *Server) streaming(w http.ResponseWriter) http.ResponseWriter {
+	return streamingWriter{ResponseWriter: w, controller: http.NewResponseController(w), timeout: s.opts.WriteTimeout, sent: &s.metrics.downloaded}
+}
+
+func (w streamingWriter) Write(p []byte) (int, error) {
+	// not every writer supports deadlines, like the one of httptest, and then there is nothing to move
+	w.controller.SetWriteDeadline(time.Now().Add(w.timeout))
+	n, err := w.ResponseWriter.Write(p)
+	w.sent.Add(int64(n))
+	return n, err
+}
+
+// ListenAndServe is a method to start the server and block until it stops listening on any of its addresses.
+// Like http.Server, it returns as soon as Shutdown is called, so Shutdown has to be waited on as well.
+// @return error
+func (s *Server) ListenAndServe() error {
+	if s.opts.Address == "" {
+		return errors.New("error: no address to listen on")
+	}
+	err := s.Start()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	served := s.served
+	s.mu.Unlock()
+	err = <-served
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
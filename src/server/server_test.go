@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"storage"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerWithoutRoot(t *testing.T) {
+	// anything written to the local disk would end up in the working folder
+	dir := t.TempDir()
+	t.Chdir(dir)
+	store := storage.NewMemory()
+	s, err := New(Options{Storage: store, Logger: testLogger(t), Address: "127.0.0.1:0", TLS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Root() != "" {
+		t.Errorf("root is %q", s.Root())
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint, err := s.Fingerprint(); err != nil || fingerprint == "" {
+		t.Errorf("fingerprint is %q, %v", fingerprint, err)
+	}
+	if devices, err := s.Devices(); err != nil || len(devices) != 0 {
+		t.Errorf("devices are %v, %v", devices, err)
+	}
+	hash := bytes.Repeat([]byte{2}, 32)
+	_, _, err = s.saveFileChunk(FileData{Data: []byte("some data"), ValidateFile: hash, Size: 9, Folder: "f"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("the server wrote %v to the local disk, %v", entries, err)
+	}
+	// the index is built from the storage again when the server is opened
+	s, err = New(Options{Storage: store, Logger: testLogger(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	if file, ok := s.index.file("f", hex.EncodeToString(hash)); !ok || file.Size != 9 {
+		t.Errorf("file is %+v, %v after opening again", file, ok)
+	}
+	if count, err := s.Reindex(); err == nil || count != 0 {
+		t.Errorf("Reindex of an open server gave %d, %v", count, err)
+	}
+}
+
+// openBlockingStorage is a storage that holds up opening one object until it is released
+type openBlockingStorage struct {
+	storage.Storage
+	name    string
+	opening chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (s *openBlockingStorage) OpenFile(name string, flag int) (storage.File, error) {
+	if name == s.name {
+		s.once.Do(func() {
+			close(s.opening)
+			<-s.release
+		})
+	}
+	return s.Storage.OpenFile(name, flag)
+}
+
+// postChunk posts a whole file as one chunk to a running server
+// @return int The status code
+// @return UploadResult
+func postChunk(t *testing.T, s *Server, folder string, data []byte) (int, UploadResult) {
+	t.Helper()
+	sum := sha256.Sum256(data)
+	body, err := json.Marshal(FileData{Data: data, ValidateFile: sum[:], Size: int64(len(data)), Folder: folder})
+	if err != nil {
+		t.Error(err)
+		return 0, UploadResult{}
+	}
+	resp, err := http.Post("http://"+s.Addr().String()+"/post_file", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Error(err)
+		return 0, UploadResult{}
+	}
+	defer resp.Body.Close()
+	var result UploadResult
+	json.NewDecoder(resp.Body).Decode(&result)
+	return resp.StatusCode, result
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	data := []byte("written during shutdown")
+	sum := sha256.Sum256(data)
+	store := &openBlockingStorage{Storage: storage.NewMemory(), name: string(saveFileName("f", sum[:])), opening: make(chan struct{}), release: make(chan struct{})}
+	s, err := New(Options{Root: t.TempDir(), Storage: store, Logger: testLogger(t), Address: "127.0.0.1:0", DisableAuth: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	addr := s.Addr().String()
+	posted := make(chan UploadResult, 1)
+	go func() {
+		code, result := postChunk(t, s, "f", data)
+		if code != http.StatusOK {
+			t.Errorf("upload during shutdown gave status %d, %+v", code, result)
+		}
+		posted <- result
+	}()
+	<-store.opening
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdown:
+		close(store.release)
+		t.Fatalf("Shutdown returned in the middle of a write; %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// no new connections are taken while the write finishes
+	if resp, err := http.Get("http://" + addr + "/ping"); err == nil {
+		resp.Body.Close()
+		t.Error("the server took a request after Shutdown was called")
+	}
+	close(store.release)
+	if result := <-posted; result.Count != len(data) {
+		t.Errorf("upload during shutdown wrote %d bytes", result.Count)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+
+	// the server takes uploads again once it is started again
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, result := postChunk(t, s, "f", []byte("written after a restart")); code != http.StatusOK {
+		t.Errorf("upload after a restart gave status %d, %+v", code, result)
+	}
+	if file, ok := s.index.file("f", hex.EncodeToString(sum[:])); !ok || !file.Complete {
+		t.Errorf("file written during shutdown is %+v, %t", file, ok)
+	}
+}
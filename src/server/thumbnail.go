@@ -0,0 +1,254 @@
+package server
+
+// thumbnail file to hold the logic for generating and serving image thumbnails
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"path"
+	"sfile"
+	"storage"
+	"strconv"
+)
+
+// ThumbnailSizes is the list of sizes(in pixels of the longest edge) thumbnails are generated for.
+var ThumbnailSizes = []int{128, 512}
+
+// ThumbnailFolder is the name of the folder inside each data folder that thumbnails are cached in.
+const ThumbnailFolder = ".thumbs"
+
+// thumbnailQuality is the jpeg quality used when encoding thumbnails.
+const thumbnailQuality = 80
+
+// maxThumbnailPixels is the most pixels an image can have to get thumbnails. The size an image claims is checked
+// before it is decoded, so a small file that claims to be huge can not make the server allocate gigabytes.
+const maxThumbnailPixels = 100 * 1000 * 1000
+
+// thumbnailMimeTypes are the content types thumbnails can be made from
+var thumbnailMimeTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/gif": true}
+
+// errNotAnImage is returned when a thumbnail is asked for a file that is not an image we can decode
+var errNotAnImage = errors.New("error: the file is not a JPEG, PNG or GIF image")
+
+// isThumbnailSize checks if the size given is one of the configured ThumbnailSizes.
+// @param size int
+// @return bool
+func isThumbnailSize(size int) bool {
+	for _, s := range ThumbnailSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// thumbnailPath returns the storage name of the cached thumbnail for a file.
+// @param folder string The name of the folder the SAVE file is in
+// @param hash []byte The hash of the file
+// @param size int The size of the thumbnail
+// @return string
+func thumbnailPath(folder string, hash []byte, size int) string {
+	return path.Join(folder, ThumbnailFolder, fmt.Sprintf("%s_%d.jpg", hex.EncodeToString(hash), size))
+}
+
+// GenerateThumbnails creates a thumbnail for every size in ThumbnailSizes from the SAVE file given.
+// Files that are not JPEG, PNG or GIF images are skipped without an error.
+// @param store storage.Storage The storage the SAVE file is in
+// @param folder string The name of the folder the SAVE file is in
+// @param hash []byte The hash of the file
+// @return error
+func GenerateThumbnails(store storage.Storage, folder string, hash []byte) error {
+	img, err := decodeImage(store, folder, hash)
+	if err == errNotAnImage {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, size := range ThumbnailSizes {
+		err = writeThumbnail(store, img, thumbnailPath(folder, hash, size), size)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readThumbnail returns the cached thumbnail for a file, generating it first if it does not exist yet.
+// @param store storage.Storage The storage the SAVE file is in
+// @param folder string The name of the folder the SAVE file is in
+// @param hash []byte The hash of the file
+// @param size int The size of the thumbnail
+// @return []byte The jpeg encoded thumbnail
+// @return error
+func readThumbnail(store storage.Storage, folder string, hash []byte, size int) ([]byte, error) {
+	name := thumbnailPath(folder, hash, size)
+	data, err := storage.ReadFile(store, name)
+	if err == nil {
+		return data, nil
+	}
+	img, err := decodeImage(store, folder, hash)
+	if err != nil {
+		return nil, err
+	}
+	err = writeThumbnail(store, img, name, size)
+	if err != nil {
+		return nil, err
+	}
+	return storage.ReadFile(store, name)
+}
+
+// decodeImage decodes the image in a SAVE file. Files whose MimeType attribute is not an image type are
+// not read at all, and images that claim more than maxThumbnailPixels are refused before they are decoded.
+// @param store storage.Storage The storage the SAVE file is in
+// @param folder string The name of the folder the SAVE file is in
+// @param hash []byte The hash of the file
+// @return image.Image
+// @return error errNotAnImage when the file is not an image we can decode
+func decodeImage(store storage.Storage, folder string, hash []byte) (image.Image, error) {
+	headerObj := &sfile.KeyedHeader{Attributes: make(map[string]interface{})}
+	reader, err := sfile.OpenSaveFile(store, saveFileName(folder, hash), headerObj)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	// files started before content types were stored have no MimeType and are sniffed by the decoder instead
+	if mimeType, _ := headerObj.Attributes[MimeTypeAttribute].(string); mimeType != "" && !thumbnailMimeTypes[mimeType] {
+		return nil, errNotAnImage
+	}
+	if int64(reader.SaveFile.Size) < reader.SaveFile.TotalSize {
+		return nil, errors.New("error: the file is still being uploaded")
+	}
+	config, _, err := image.DecodeConfig(bufio.NewReader(reader))
+	if err != nil {
+		return nil, errNotAnImage
+	}
+	if int64(config.Width)*int64(config.Height) > maxThumbnailPixels {
+		return nil, fmt.Errorf("error: the image is %dx%d, more than the %d pixels thumbnails are made from", config.Width, config.Height, maxThumbnailPixels)
+	}
+	_, err = reader.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bufio.NewReader(reader))
+	return img, err
+}
+
+// writeThumbnail scales the image down and writes it out as a jpeg file.
+// @param store storage.Storage The storage to write the thumbnail to
+// @param img image.Image
+// @param name string The storage name to write the thumbnail to
+// @param size int The size of the longest edge of the thumbnail
+// @return error
+func writeThumbnail(store storage.Storage, img image.Image, name string, size int) error {
+	err := store.MkdirAll(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer([]byte(""))
+	err = jpeg.Encode(buf, scaleImage(img, size), &jpeg.Options{Quality: thumbnailQuality})
+	if err != nil {
+		return err
+	}
+	// write to a temp file first so a partially written thumbnail is never served. The name is unique so
+	// a background and a lazy generation of the same thumbnail do not write over each other.
+	suffix, err := randomText(8)
+	if err != nil {
+		return err
+	}
+	tmpName := name + "." + suffix + ".tmp"
+	err = storage.WriteFile(store, tmpName, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return store.Rename(tmpName, name)
+}
+
+// scaleImage scales an image so its longest edge is size pixels by averaging
+// the source pixels each destination pixel covers. Images already smaller than size are left alone.
+// @param img image.Image
+// @param size int
+// @return image.Image
+func scaleImage(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW <= size && srcH <= size {
+		return img
+	}
+	dstW, dstH := size, size
+	if srcW > srcH {
+		dstH = srcH * size / srcW
+	} else {
+		dstW = srcW * size / srcH
+	}
+	if dstW < 1 {
+		dstW = 1
+	}
+	if dstH < 1 {
+		dstH = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0 := bounds.Min.Y + y*srcH/dstH
+		y1 := bounds.Min.Y + (y+1)*srcH/dstH
+		for x := 0; x < dstW; x++ {
+			x0 := bounds.Min.X + x*srcW/dstW
+			x1 := bounds.Min.X + (x+1)*srcW/dstW
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					b += uint64(cb)
+					a += uint64(ca)
+					count++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / count), G: uint16(g / count), B: uint16(b / count), A: uint16(a / count)})
+		}
+	}
+	return dst
+}
+
+// GetThumbnail is a GET request that takes in a folder, file hash and size
+// and writes back the jpeg thumbnail of that file.
+func (s *Server) GetThumbnail(w http.ResponseWriter, req *http.Request) {
+	s.log.LogServerCall(req, "GetThumbnail")
+	folder := req.URL.Query().Get("Folder")
+	hash, err := decodeHashParam(req.URL.Query().Get("Hash"))
+	if err != nil {
+		s.writeError(w, req, err)
+		return
+	}
+	size, err := strconv.Atoi(req.URL.Query().Get("Size"))
+	if err != nil || !isThumbnailSize(size) {
+		s.writeError(w, req, newAPIError(http.StatusBadRequest, CodeBadRequest, "error: size must be one of %v", ThumbnailSizes))
+		return
+	}
+	err = validFolderName(folder)
+	if err != nil {
+		s.writeError(w, req, err)
+		return
+	}
+	thumb, err := readThumbnail(s.store, folder, hash, size)
+	if err != nil {
+		// files that are not images, or that are still being uploaded, have no thumbnail
+		s.log.LogWarnf("thumbnail error for %x in %s; %s", hash, folder, err)
+		s.writeError(w, req, newAPIError(http.StatusNotFound, CodeNotFound, "error: could not create thumbnail for file"))
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	n, _ := w.Write(thumb)
+	s.metrics.downloaded.Add(int64(n))
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"sfile"
+	"storage"
+	"strings"
+	"testing"
+)
+
+// writeTestSaveFile writes data as a SAVE file in a folder of a storage with a MimeType attribute
+// and returns the hash it is saved under. Only the first upTo bytes are written when upTo is less than the data.
+func writeTestSaveFile(t *testing.T, store storage.Storage, folder, mimeType string, data []byte, upTo int) []byte {
+	t.Helper()
+	hash := []byte(strings.Repeat("h", 32))
+	attributes := map[string]string{}
+	if mimeType != "" {
+		attributes[MimeTypeAttribute] = mimeType
+	}
+	writeSaveFileWithHash(t, store, folder, hash, attributes, data, upTo)
+	return hash
+}
+
+// writeSaveFileWithHash writes the first upTo bytes of data as a SAVE file with a hash and attributes in a folder of a storage
+func writeSaveFileWithHash(t *testing.T, store storage.Storage, folder string, hash []byte, attributes map[string]string, data []byte, upTo int) {
+	t.Helper()
+	err := store.MkdirAll(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sfile.WriteSaveFile(store, saveFileName(folder, hash), data[:upTo], createHeaderObject(attributes), 0, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testPNG encodes a PNG image of a size
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		img.Set(x, x%h, color.RGBA{R: 255, A: 255})
+	}
+	buf := &bytes.Buffer{}
+	err := png.Encode(buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// hugePNG returns a PNG signature and IHDR chunk that claim a size, with no pixel data after them
+func hugePNG(w, h uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], w)
+	binary.BigEndian.PutUint32(ihdr[8:], h)
+	// 8 bit RGBA
+	ihdr[12], ihdr[13] = 8, 6
+	data := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d")
+	data = append(data, ihdr...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestGenerateThumbnails(t *testing.T) {
+	store := storage.NewMemory()
+	data := testPNG(t, 600, 300)
+	hash := writeTestSaveFile(t, store, "f", "image/png", data, len(data))
+	err := GenerateThumbnails(store, "f", hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range ThumbnailSizes {
+		thumb, err := storage.ReadFile(store, thumbnailPath("f", hash, size))
+		if err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(thumb))
+		if err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+		want := size
+		if want > 600 {
+			want = 600
+		}
+		if cfg.Width != want || cfg.Height != want/2 {
+			t.Errorf("size %d: thumbnail is %dx%d, want %dx%d", size, cfg.Width, cfg.Height, want, want/2)
+		}
+	}
+	// the temp files the thumbnails were written to are renamed away
+	infos, err := store.ReadDir("f/" + ThumbnailFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != len(ThumbnailSizes) {
+		t.Errorf("thumbnail folder has %d entries, want %d", len(infos), len(ThumbnailSizes))
+	}
+}
+
+func TestDecodeImage(t *testing.T) {
+	small := testPNG(t, 4, 4)
+	tests := []struct {
+		name     string
+		mimeType string
+		data     []byte
+		upTo     int
+		notImage bool
+		errText  string
+	}{
+		{name: "png", mimeType: "image/png", data: small, upTo: len(small)},
+		{name: "no mime type", data: small, upTo: len(small)},
+		{name: "video", mimeType: "video/mp4", data: small, upTo: len(small), notImage: true},
+		{name: "not an image", mimeType: "image/png", data: []byte("plain text, not a png"), upTo: 21, notImage: true},
+		{name: "huge", mimeType: "image/png", data: hugePNG(50000, 50000), upTo: 33, errText: "pixels"},
+		{name: "uploading", mimeType: "image/png", data: small, upTo: 10, errText: "uploaded"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := storage.NewMemory()
+			hash := writeTestSaveFile(t, store, "f", test.mimeType, test.data, test.upTo)
+			img, err := decodeImage(store, "f", hash)
+			switch {
+			case test.notImage:
+				if err != errNotAnImage {
+					t.Fatalf("got %v, want errNotAnImage", err)
+				}
+			case test.errText != "":
+				if err == nil || !strings.Contains(err.Error(), test.errText) {
+					t.Fatalf("got %v, want an error about %q", err, test.errText)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case img.Bounds().Dx() != 4:
+				t.Fatalf("decoded image is %v", img.Bounds())
+			}
+		})
+	}
+}
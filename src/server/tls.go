@@ -0,0 +1,179 @@
+package server
+
+// tls file to hold the logic to load the TLS certificate of the server, or generate and save a self-signed one
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TLSFolder is the name of the folder inside the root path the generated certificate is kept in.
+const TLSFolder = ".tls"
+
+// names of the certificate and key files inside TLSFolder
+const (
+	certFileName = "cert.pem"
+	keyFileName  = "key.pem"
+)
+
+// certificateLifetime is how long a generated certificate is valid for
+const certificateLifetime = 10 * 365 * 24 * time.Hour
+
+// loadCertificate loads the certificate of the server. When no certificate files are given the one
+// in the TLSFolder of the root path is loaded, and generated first if it does not exist yet.
+// Without a root path a new one is generated every time and not saved.
+// @param root string The root path, or empty
+// @param certFile string The PEM certificate file given, or empty
+// @param keyFile string The PEM key file given, or empty
+// @param logger *Logger
+// @return tls.Certificate
+// @return error
+func loadCertificate(root, certFile, keyFile string, logger *Logger) (tls.Certificate, error) {
+	if (certFile == "") != (keyFile == "") {
+		return tls.Certificate{}, errors.New("error: a TLS certificate file and key file have to be given together")
+	}
+	if certFile == "" && root == "" {
+		logger.Logln("generating self-signed TLS certificate")
+		certPEM, keyPEM, err := generateCertificate()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		return tls.X509KeyPair(certPEM, keyPEM)
+	}
+	if certFile == "" {
+		certFile = filepath.Join(root, TLSFolder, certFileName)
+		keyFile = filepath.Join(root, TLSFolder, keyFileName)
+		_, err := os.Stat(certFile)
+		if os.IsNotExist(err) {
+			logger.Logf("generating self-signed TLS certificate %s", certFile)
+			err = saveCertificate(certFile, keyFile)
+		}
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error: could not load TLS certificate %s; %s", certFile, err)
+	}
+	return cert, nil
+}
+
+// saveCertificate generates a certificate and saves it and its key as PEM files.
+// @param certFile string
+// @param keyFile string
+// @return error
+func saveCertificate(certFile, keyFile string) error {
+	certPEM, keyPEM, err := generateCertificate()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(certFile), 0700)
+	if err != nil {
+		return err
+	}
+	// the key is written first so a certificate is never left without its key
+	err = os.WriteFile(keyFile, keyPEM, 0600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, certPEM, 0644)
+}
+
+// generateCertificate creates a self-signed ECDSA certificate for the names and addresses of this machine.
+// @return []byte The PEM certificate
+// @return []byte The PEM key
+// @return error
+func generateCertificate() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"LAN File Server"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certificateLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              certificateNames(hostname),
+		IPAddresses:           certificateAddresses(),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// certificateNames returns the host names a generated certificate is valid for
+// @param hostname string
+// @return []string
+func certificateNames(hostname string) []string {
+	names := []string{"localhost"}
+	if hostname != "localhost" {
+		names = append(names, hostname)
+		if !strings.Contains(hostname, ".") {
+			names = append(names, hostname+".local")
+		}
+	}
+	return names
+}
+
+// certificateAddresses returns the IP addresses of this machine a generated certificate is valid for
+// @return []net.IP
+func certificateAddresses() []net.IP {
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+// CertificateFingerprint is a method to get the SHA-256 fingerprint of a certificate the way clients pin it,
+// as upper case hex bytes separated by colons like "AB:CD:...".
+// @param der []byte The DER encoded certificate
+// @return string
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,154 @@
+package sfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// keyedHeaderMagic is written at the start of a KeyedHeader so it can be told apart from a SimpleHeader.
+var keyedHeaderMagic = []byte("KEYS")
+
+// KeyedHeader is an object that holds a map object of the attributes like SimpleHeader
+// and implements the HeaderFormat interface.
+// Unlike SimpleHeader the keys are saved with their values, so the header can be read back
+// without knowing the keys ahead of time and attributes can be added to a file after it was written.
+// The header starts with "KEYS" followed by each attribute in the keys' alphabetical order
+// as the size of the key, the key, the size of the value and the value.
+// Headers that were written by SimpleHeader can still be read. When the Attributes map holds the keys
+// the SimpleHeader was written with the values are stored under them, otherwise they are stored under
+// LegacyAttributeKey keys in the order they were written.
+type KeyedHeader struct {
+	Attributes map[string]interface{}
+	// Legacy is set by Write when the header was written by a SimpleHeader
+	Legacy bool
+}
+
+// LegacyAttributeKey is the key a value of a SimpleHeader is stored under when it is read without knowing its key.
+// The number is padded with zeros to the width of the number of values, so the keys sort in the order
+// the values were written.
+// @param i int The position of the value in the header, starting at 0
+// @param count int The number of values in the header
+// @return string
+func LegacyAttributeKey(i, count int) string {
+	return fmt.Sprintf("Value%0*d", len(strconv.Itoa(count-1)), i)
+}
+
+// GetHeader is the method to grab the attributes out of the object.
+// The values of the Attribute's map are returned in the keys' alphabetical order.
+func (kh *KeyedHeader) GetHeader() []string {
+	headerList := make([]string, len(kh.Attributes))
+	for i, v := range kh.sortedAttributeKeys() {
+		headerList[i] = fmt.Sprintf("%s", kh.Attributes[v])
+	}
+	return headerList
+}
+
+// GetHeaderSize is the method to grab the size of the header for a byte slice
+func (kh *KeyedHeader) GetHeaderSize() (n int, err error) {
+	_, n, err = kh.bufferFromAttributes()
+	return
+}
+
+// Read is the method that will go through the attributes in the KeyedHeader object
+// and populate the []byte parameter with the keys and values of the attributes and their sizes.
+// Read KeyedHeader description to see how attributes are written to.
+func (kh *KeyedHeader) Read(b []byte) (n int, err error) {
+	headBuf, n, err := kh.bufferFromAttributes()
+	if err != nil {
+		return
+	}
+	if len(b) < n {
+		err = fmt.Errorf("error: b only has room for %d while Header has size %d", len(b), n)
+		return
+	}
+	copy(b, headBuf.Bytes())
+	return
+}
+
+// Write is the Method that extracts out the attributes and stores them as strings.
+// When the header was written by a KeyedHeader the Attributes map is replaced with every attribute
+// in the header, otherwise the header is read like a SimpleHeader using the keys already in the map,
+// or under LegacyAttributeKey keys when the map is empty.
+// Read KeyedHeader description to see how attributes are written to.
+func (kh *KeyedHeader) Write(b []byte) (n int, err error) {
+	improperHeader := errors.New("error: header not formatted properly")
+	if !bytes.HasPrefix(b, keyedHeaderMagic) {
+		kh.Legacy = true
+		if len(kh.Attributes) > 0 {
+			return (&SimpleHeader{Attributes: kh.Attributes}).Write(b)
+		}
+		values := make([]string, 0)
+		for n < len(b) {
+			val, count, ok := readSizedString(b[n:])
+			if !ok {
+				return n, improperHeader
+			}
+			n += count
+			values = append(values, val)
+		}
+		kh.Attributes = make(map[string]interface{}, len(values))
+		for i, val := range values {
+			kh.Attributes[LegacyAttributeKey(i, len(values))] = val
+		}
+		return
+	}
+	kh.Legacy = false
+	attributes := make(map[string]interface{})
+	n = len(keyedHeaderMagic)
+	for n < len(b) {
+		key, count, ok := readSizedString(b[n:])
+		if !ok {
+			return n, improperHeader
+		}
+		n += count
+		val, count, ok := readSizedString(b[n:])
+		if !ok {
+			return n, improperHeader
+		}
+		n += count
+		attributes[key] = val
+	}
+	kh.Attributes = attributes
+	return
+}
+
+// readSizedString reads a string that is prefixed with its size.
+// @return string The string read
+// @return int The number of bytes read
+// @return bool false if b is too short
+func readSizedString(b []byte) (string, int, bool) {
+	if len(b) < 4 {
+		return "", 0, false
+	}
+	size := bytesToInt(b[0], b[1], b[2], b[3])
+	if size < 0 || len(b)-4 < size {
+		return "", 0, false
+	}
+	return string(b[4 : 4+size]), 4 + size, true
+}
+
+func (kh *KeyedHeader) bufferFromAttributes() (headBuf *bytes.Buffer, n int, err error) {
+	headBuf = bytes.NewBuffer([]byte(""))
+	headBuf.Write(keyedHeaderMagic)
+	for _, k := range kh.sortedAttributeKeys() {
+		val := fmt.Sprintf("%s", kh.Attributes[k])
+		headBuf.Write(intToBytes(len(k)))
+		headBuf.WriteString(k)
+		headBuf.Write(intToBytes(len(val)))
+		headBuf.WriteString(val)
+	}
+	n = headBuf.Len()
+	return
+}
+
+func (kh *KeyedHeader) sortedAttributeKeys() []string {
+	sortedKeys := make([]string, 0, len(kh.Attributes))
+	for k := range kh.Attributes {
+		sortedKeys = append(sortedKeys, k)
+	}
+	sort.Strings(sortedKeys)
+	return sortedKeys
+}
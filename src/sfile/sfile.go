@@ -7,8 +7,30 @@ import (
 	"io"
 	"log"
 	"os"
+	"storage"
 )
 
+// ErrComplete is returned by WriteSaveFile when the whole file has already been written.
+var ErrComplete = errors.New("error: the size of the data matches the size of the original file. The Entire file should already exist.")
+
+// ErrSizeMismatch is returned by WriteSaveFile when the size given is not the size the file was created with.
+var ErrSizeMismatch = errors.New("error: the size given does not match the size the file was created with")
+
+// ErrPastEnd is returned by WriteSaveFile when a chunk runs past the end of the file.
+var ErrPastEnd = errors.New("error: the data runs past the end of the file")
+
+// OffsetError is returned by WriteSaveFile when a chunk does not start where the data written so far ends.
+type OffsetError struct {
+	Written  int
+	Received int
+}
+
+// Error is a method to describe the offset error
+// @return string
+func (e *OffsetError) Error() string {
+	return fmt.Sprintf("error: last received index was %d; current received index was %d", e.Written, e.Received)
+}
+
 func intToBytes(n int) (a []byte) {
 	a = make([]byte, 4)
 	a[0] = byte(n)
@@ -43,34 +65,99 @@ type SaveFile struct {
 	FileHash []byte
 	// The Size of the Data
 	Size int
+	// The Size the Data will be once the whole file has been uploaded
+	TotalSize int64
 	// The Header for the File. Contains Attributes of the file (name, type, etc..)
 	Header HeaderFormat
 }
 
 // ReadSaveFile is a method to extract data from save file and return a SaveFile object with that data.
 // Method should only be used when user is querying for file to return a SaveFile object
-// that can be sent as json to user.
-func ReadSaveFile(fileName []byte, head HeaderFormat) (*SaveFile, error) {
-	log.Printf("accessing file for read: %s", string(fileName))
+// that can be sent as json to user. The file name is a name in the storage.
+func ReadSaveFile(store storage.Storage, fileName []byte, head HeaderFormat) (*SaveFile, error) {
+	log.Printf("accessing file for read: %q", fileName)
 	sf := &SaveFile{Data: []byte{}, FileHash: fileName, Size: 0, Header: head}
-	fileNameStr := string(fileName)
-	improperFileFormat := errors.New("error: file not formatted properly")
-	file, err := os.Open(string(fileNameStr))
+	file, err := storage.Open(store, string(fileName))
+	if err != nil {
+		return nil, errors.New("error: file could not be read")
+	}
+	defer file.Close()
+	offset, err := readSaveFileHeader(file, sf)
+	if err != nil {
+		return nil, err
+	}
+	sf.Data = make([]byte, sf.Size)
+	n, err := file.ReadAt(sf.Data, offset)
+	if err == io.EOF && n == sf.Size {
+		err = nil
+	}
+	if err != nil {
+		return nil, errors.New("error: could not read all of the data")
+	}
+	return sf, nil
+}
+
+// ReadSaveFileHeader is a method to extract only the header and sizes from a save file.
+// The Data of the returned SaveFile object is left empty, so this should be used when the data is not needed.
+func ReadSaveFileHeader(store storage.Storage, fileName []byte, head HeaderFormat) (*SaveFile, error) {
+	sf := &SaveFile{Data: []byte{}, FileHash: fileName, Size: 0, Header: head}
+	file, err := storage.Open(store, string(fileName))
 	if err != nil {
 		return nil, errors.New("error: file could not be read")
 	}
 	defer file.Close()
+	_, err = readSaveFileHeader(file, sf)
+	if err != nil {
+		return nil, err
+	}
+	return sf, nil
+}
+
+// SaveFileReader object reads the data of a save file without loading all of it into memory.
+// It only reads the part of the data that has been uploaded.
+type SaveFileReader struct {
+	*io.SectionReader
+	// The header and sizes of the save file. Its Data is left empty.
+	SaveFile *SaveFile
+	file     storage.File
+}
+
+// OpenSaveFile is a method to open a save file for reading its data.
+// The returned SaveFileReader must be closed when done with it.
+func OpenSaveFile(store storage.Storage, fileName []byte, head HeaderFormat) (*SaveFileReader, error) {
+	sf := &SaveFile{Data: []byte{}, FileHash: fileName, Size: 0, Header: head}
+	file, err := storage.Open(store, string(fileName))
+	if err != nil {
+		return nil, errors.New("error: file could not be read")
+	}
+	offset, err := readSaveFileHeader(file, sf)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &SaveFileReader{SectionReader: io.NewSectionReader(file, offset, int64(sf.Size)), SaveFile: sf, file: file}, nil
+}
+
+// Close closes the save file
+func (r *SaveFileReader) Close() error {
+	return r.file.Close()
+}
+
+// readSaveFileHeader reads the header and the sizes of the save file into sf.
+// It returns the offset the data starts at.
+func readSaveFileHeader(file storage.File, sf *SaveFile) (int64, error) {
+	improperFileFormat := errors.New("error: file not formatted properly")
 	data := make([]byte, 8)
 	var offset int64 = 8
-	count, err := file.Read(data)
+	count, err := file.ReadAt(data, 0)
 	if count < 8 {
-		return nil, improperFileFormat
-	} else if err != nil {
-		return nil, improperFileFormat
+		return 0, improperFileFormat
+	} else if err != nil && err != io.EOF {
+		return 0, improperFileFormat
 	}
 
 	if bytes.Compare(data[0:4], []byte("SAVE")) != 0 {
-		return nil, improperFileFormat
+		return 0, improperFileFormat
 	}
 
 	headSize := bytesToInt(data[4], data[5], data[6], data[7])
@@ -78,23 +165,23 @@ func ReadSaveFile(fileName []byte, head HeaderFormat) (*SaveFile, error) {
 		headerInfo := make([]byte, headSize)
 		count, err = file.ReadAt(headerInfo, int64(count))
 		if err != nil {
-			return nil, errors.New("error: could not read header")
+			return 0, errors.New("error: could not read header")
 		}
 		_, err = sf.Header.Write(headerInfo)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
 	}
 
 	offset += int64(headSize)
 	dataInfo := make([]byte, 8)
-	count, err = file.ReadAt(dataInfo, offset)
+	_, err = file.ReadAt(dataInfo, offset)
 	if err != nil {
-		return nil, improperFileFormat
+		return 0, improperFileFormat
 	}
 
 	if bytes.Compare(dataInfo[0:4], []byte("DATA")) != 0 {
-		return nil, improperFileFormat
+		return 0, improperFileFormat
 	}
 
 	offset += 4
@@ -102,27 +189,37 @@ func ReadSaveFile(fileName []byte, head HeaderFormat) (*SaveFile, error) {
 	offset += 4
 
 	sf.Size = dataSize
-	sf.Data = make([]byte, dataSize)
-	count, err = file.ReadAt(sf.Data, offset)
+	// the file is truncated to its full size when it is created, so whatever follows the data offset is the data
+	fileSize, err := file.Size()
 	if err != nil {
-		return nil, errors.New("error: could not read all of the data")
+		return 0, err
 	}
-	return sf, nil
+	sf.TotalSize = fileSize - offset
+	return offset, nil
 }
 
 // WriteSaveFile is a method to write out data to save file format.
 // This method should only be used to take data from user and write to file.
-func WriteSaveFile(fileName []byte, data []byte, head HeaderFormat, lastPos int, size int64) (int, error) {
-	log.Printf("accessing file for write: %s", string(fileName))
-	_, fileAlreadyExists := os.Stat(string(fileName))
-	fileObj, err := os.OpenFile(string(fileName), os.O_RDWR|os.O_CREATE, 0777)
+// The size has to be the size the file was created with, and the data can not run past it.
+// Once the whole file is written it is published with storage.Publish.
+func WriteSaveFile(store storage.Storage, fileName []byte, data []byte, head HeaderFormat, lastPos int, size int64) (int, error) {
+	log.Printf("accessing file for write: %q", fileName)
+	if size < 0 || lastPos < 0 || int64(lastPos)+int64(len(data)) > size {
+		return 0, ErrPastEnd
+	}
+	_, fileAlreadyExists := store.Stat(string(fileName))
+	if fileAlreadyExists != nil && lastPos != 0 {
+		// a file is only created by its first chunk, a later one means the file was deleted under the upload
+		return 0, &OffsetError{Written: 0, Received: lastPos}
+	}
+	fileObj, err := store.OpenFile(string(fileName), os.O_RDWR|os.O_CREATE)
 	newPos := 0
 	if err != nil {
 		return 0, err
 	}
 	defer fileObj.Close()
 	if fileAlreadyExists != nil {
-		log.Println("FileName to create:", string(fileName))
+		log.Printf("FileName to create: %q", fileName)
 		saveFile := bytes.NewBuffer([]byte(""))
 		saveFile.WriteString("SAVE")
 		headerSize, err := head.GetHeaderSize()
@@ -147,7 +244,11 @@ func WriteSaveFile(fileName []byte, data []byte, head HeaderFormat, lastPos int,
 			return 0, err
 		}
 		saveFile.Write(data)
-		_, err = fileObj.Write(saveFile.Bytes())
+		_, err = fileObj.WriteAt(saveFile.Bytes(), 0)
+		if err != nil {
+			return 0, err
+		}
+		err = fileObj.Sync()
 		if err != nil {
 			return 0, err
 		}
@@ -165,25 +266,120 @@ func WriteSaveFile(fileName []byte, data []byte, head HeaderFormat, lastPos int,
 		// grab DATA size
 		_, err = fileObj.ReadAt(fileData, int64(offset))
 		origSize := bytesToInt(fileData[0], fileData[1], fileData[2], fileData[3])
+		// the file was truncated to its full size when it was created
+		fileSize, err := fileObj.Size()
+		if err != nil {
+			return 0, err
+		}
+		if totalSize := fileSize - int64(offset+4); size != totalSize {
+			return origSize, ErrSizeMismatch
+		}
 		if int64(origSize) == size {
-			errMsg := fmt.Sprintf("error: the size of the data matches the size of the original file. The Entire file should already exist.")
-			return 0, errors.New(errMsg)
+			return origSize, ErrComplete
 		}
 		if origSize != lastPos {
-			errMsg := fmt.Sprintf("error: last received index was %d; current received index was %d", origSize, lastPos)
-			return origSize, errors.New(errMsg)
+			return origSize, &OffsetError{Written: origSize, Received: lastPos}
 		}
 		newDataSize := origSize + len(data)
 		newPos = newDataSize
+		// the data is written and flushed before the data size is moved past it, so a write that is cut off
+		// leaves the size at the last chunk that was written whole and the upload resumes from there
+		_, err = fileObj.WriteAt(data, int64(offset+4+origSize))
+		if err != nil {
+			return origSize, err
+		}
+		err = fileObj.Sync()
+		if err != nil {
+			return origSize, err
+		}
 		_, err = fileObj.WriteAt(intToBytes(newDataSize), int64(offset))
-		offset += 4
 		if err != nil {
-			return 0, err
+			return origSize, err
 		}
-		_, err = fileObj.WriteAt(data, int64(offset+origSize))
+		err = fileObj.Sync()
 		if err != nil {
-			return 0, err
+			return origSize, err
+		}
+	}
+	if int64(newPos) == size {
+		// storage that stages the objects being written sends the file to where it is kept once it is complete
+		err = fileObj.Close()
+		if err == nil {
+			err = storage.Publish(store, string(fileName))
+		}
+		if err != nil {
+			return newPos, err
 		}
 	}
 	return newPos, nil
 }
+
+// TempSuffix is added to the name of a save file while it is being rewritten.
+const TempSuffix = ".tmp"
+
+// RewriteHeader is a method to replace the header of an existing save file.
+// The data is copied over to a temporary file with the new header, which is then renamed over the original file
+// so readers never see a partially written file. A complete file is published again with storage.Publish.
+func RewriteHeader(store storage.Storage, fileName []byte, head HeaderFormat) error {
+	log.Printf("accessing file for header rewrite: %q", fileName)
+	improperFileFormat := errors.New("error: file not formatted properly")
+	file, err := storage.Open(store, string(fileName))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fileSize, err := file.Size()
+	if err != nil {
+		return err
+	}
+	fileData := make([]byte, 8)
+	_, err = file.ReadAt(fileData, 0)
+	if err != nil || bytes.Compare(fileData[0:4], []byte("SAVE")) != 0 {
+		return improperFileFormat
+	}
+	// the data section starts with "DATA" and the data size after the header
+	dataOffset := 8 + int64(bytesToInt(fileData[4], fileData[5], fileData[6], fileData[7]))
+	_, err = file.ReadAt(fileData, dataOffset)
+	if err != nil || bytes.Compare(fileData[0:4], []byte("DATA")) != 0 {
+		return improperFileFormat
+	}
+	complete := int64(bytesToInt(fileData[4], fileData[5], fileData[6], fileData[7])) == fileSize-dataOffset-8
+	headerSize, err := head.GetHeaderSize()
+	if err != nil {
+		return err
+	}
+	headerBuffer := make([]byte, headerSize)
+	count, err := head.Read(headerBuffer)
+	if err != nil {
+		return err
+	}
+	saveFile := bytes.NewBuffer([]byte(""))
+	saveFile.WriteString("SAVE")
+	saveFile.Write(intToBytes(count))
+	saveFile.Write(headerBuffer[:count])
+	tmpName := string(fileName) + TempSuffix
+	tmpFile, err := store.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.WriteAt(saveFile.Bytes(), 0)
+	if err == nil {
+		// copy "DATA", the data size and the data (including any space not uploaded yet) as is
+		_, err = io.Copy(io.NewOffsetWriter(tmpFile, int64(saveFile.Len())), io.NewSectionReader(file, dataOffset, fileSize-dataOffset))
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		store.Remove(tmpName)
+		return err
+	}
+	err = store.Rename(tmpName, string(fileName))
+	if err != nil || !complete {
+		return err
+	}
+	return storage.Publish(store, string(fileName))
+}
@@ -0,0 +1,116 @@
+package sfile
+
+import (
+	"errors"
+	"fmt"
+	"storage"
+	"testing"
+)
+
+// publishStorage is a storage that counts how many times its objects are published
+type publishStorage struct {
+	*storage.Memory
+	published map[string]int
+}
+
+// Publish is a method to count a publish of an object
+// @param name string
+// @return error
+func (st *publishStorage) Publish(name string) error {
+	st.published[name]++
+	return nil
+}
+
+func TestWriteSaveFile(t *testing.T) {
+	store := &publishStorage{Memory: storage.NewMemory(), published: make(map[string]int)}
+	name := []byte("file")
+	head := func() *KeyedHeader {
+		return &KeyedHeader{Attributes: map[string]interface{}{"Name": "a.txt"}}
+	}
+	var offsetErr *OffsetError
+	steps := []struct {
+		name    string
+		data    string
+		lastPos int
+		size    int64
+		n       int
+		err     error
+		offset  bool
+		// published is how many times the file has been published after the step
+		published int
+	}{
+		{name: "later chunk of a file that is not there", data: "fgh", lastPos: 5, size: 10, offset: true},
+		{name: "first chunk bigger than the file", data: "abcdefghijk", size: 10, err: ErrPastEnd},
+		{name: "negative size", data: "a", size: -1, err: ErrPastEnd},
+		{name: "first chunk", data: "abcde", size: 10, n: 5},
+		{name: "other size", data: "fgh", lastPos: 5, size: 11, n: 5, err: ErrSizeMismatch},
+		{name: "wrong offset", data: "fgh", lastPos: 3, size: 10, n: 5, offset: true},
+		{name: "past the end", data: "fghijk", lastPos: 5, size: 10, err: ErrPastEnd},
+		{name: "negative offset", data: "fgh", lastPos: -5, size: 10, err: ErrPastEnd},
+		{name: "second chunk", data: "fgh", lastPos: 5, size: 10, n: 8},
+		{name: "last chunk", data: "ij", lastPos: 8, size: 10, n: 10, published: 1},
+		{name: "complete", data: "ij", lastPos: 8, size: 10, n: 10, err: ErrComplete, published: 1},
+	}
+	for _, step := range steps {
+		n, err := WriteSaveFile(store, name, []byte(step.data), head(), step.lastPos, step.size)
+		switch {
+		case step.offset:
+			if !errors.As(err, &offsetErr) || offsetErr.Written != step.n {
+				t.Fatalf("%s: got %d, %v, want an offset error at %d", step.name, n, err, step.n)
+			}
+		case err != step.err || n != step.n:
+			t.Fatalf("%s: got %d, %v, want %d, %v", step.name, n, err, step.n, step.err)
+		}
+		if published := store.published[string(name)]; published != step.published {
+			t.Fatalf("%s: the file was published %d times, want %d", step.name, published, step.published)
+		}
+	}
+	// rewriting the header of the complete file publishes it again
+	err := RewriteHeader(store, name, head())
+	if err != nil || store.published[string(name)] != 2 {
+		t.Errorf("header rewrite gave %v and published the file %d times", err, store.published[string(name)])
+	}
+	sf, err := ReadSaveFile(store, name, head())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sf.Data) != "abcdefghij" || sf.TotalSize != 10 || sf.Header.(*KeyedHeader).Attributes["Name"] != "a.txt" {
+		t.Errorf("read back %q of %d with header %+v", sf.Data, sf.TotalSize, sf.Header)
+	}
+}
+
+func TestKeyedHeaderReadsSimpleHeader(t *testing.T) {
+	values := make(map[string]interface{})
+	for i := 0; i < 11; i++ {
+		values[fmt.Sprintf("Key%c", 'a'+i)] = fmt.Sprintf("value %d", i)
+	}
+	simple := &SimpleHeader{Attributes: values}
+	size, err := simple.GetHeaderSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, size)
+	if _, err := simple.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	// without keys the values are kept in the order they were written
+	kh := &KeyedHeader{}
+	if n, err := kh.Write(b); err != nil || n != size || !kh.Legacy {
+		t.Fatalf("got %d, %v, legacy %t", n, err, kh.Legacy)
+	}
+	if len(kh.Attributes) != 11 || kh.Attributes["Value00"] != "value 0" || kh.Attributes["Value10"] != "value 10" {
+		t.Errorf("attributes are %v", kh.Attributes)
+	}
+	// with keys the values are stored under them
+	kh = &KeyedHeader{Attributes: map[string]interface{}{"Keya": "", "Keyb": ""}}
+	if _, err := kh.Write(b); err != nil || kh.Attributes["Keya"] != "value 0" || kh.Attributes["Keyb"] != "value 1" {
+		t.Errorf("got %v, %v", kh.Attributes, err)
+	}
+	// a cut off header is an error instead of a panic
+	if _, err := (&KeyedHeader{}).Write(b[:size-2]); err == nil {
+		t.Error("a cut off header was read")
+	}
+	if _, err := (&SimpleHeader{Attributes: map[string]interface{}{"Keya": ""}}).Write(b[:2]); err == nil {
+		t.Error("a cut off simple header was read")
+	}
+}
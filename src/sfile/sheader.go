@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"log"
 	"sort"
 )
 
@@ -43,7 +42,6 @@ func (sh *SimpleHeader) Read(b []byte) (n int, err error) {
 	}
 	if cap(b) < n {
 		errMsg := fmt.Sprintf("error: b only has capacity for %d while Header has size %d", cap(b), n)
-		log.Fatal(errMsg)
 		err = errors.New(errMsg)
 		return
 	}
@@ -66,10 +64,13 @@ func (sh *SimpleHeader) Write(b []byte) (n int, err error) {
 		if n >= bLength {
 			return
 		}
-		size := bytesToInt(b[n], b[n+1], b[n+2], b[n+3])
-		n += 4
-		sh.Attributes[k] = string(b[n : n+size])
-		n += size
+		val, count, ok := readSizedString(b[n:])
+		if !ok {
+			err = errors.New("error: header not formatted properly")
+			return
+		}
+		sh.Attributes[k] = val
+		n += count
 	}
 	return
 }
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package storage
+
+// diskspace file to hold the fallback for systems the free space of a disk is not read on
+
+import "errors"
+
+// diskSpace returns an error since the free space of a disk is not read on this system
+// @param path string
+// @return uint64 The bytes free
+// @return uint64 The size in bytes
+// @return error
+func diskSpace(path string) (uint64, uint64, error) {
+	return 0, 0, errors.New("error: free disk space is not known on this system")
+}
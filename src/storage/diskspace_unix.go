@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+// diskspace file to hold how the free space of a disk is read on systems with statfs
+
+import "syscall"
+
+// diskSpace returns the bytes free to the server and the size of the disk a path is on
+// @param path string
+// @return uint64 The bytes free
+// @return uint64 The size in bytes
+// @return error
+func diskSpace(path string) (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), uint64(stat.Blocks) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,29 @@
+package storage
+
+// diskspace file to hold how the free space of a disk is read on windows
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// getDiskFreeSpaceEx reads the free space of a disk, it is not in the syscall package
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// diskSpace returns the bytes free to the server and the size of the disk a path is on
+// @param path string
+// @return uint64 The bytes free
+// @return uint64 The size in bytes
+// @return error
+func diskSpace(path string) (uint64, uint64, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var free, total, totalFree uint64
+	ok, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), uintptr(unsafe.Pointer(&total)), uintptr(unsafe.Pointer(&totalFree)))
+	if ok == 0 {
+		return 0, 0, err
+	}
+	return free, total, nil
+}
@@ -0,0 +1,142 @@
+package storage
+
+// filesystem file to hold the Storage that keeps objects as files in a folder of the local file system
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// FileSystem is a Storage that keeps objects as files and folders under a root path of the local file system.
+type FileSystem struct {
+	root string
+}
+
+// NewFileSystem is a method to create a FileSystem storage. The root path is created by MkdirAll("").
+// @param root string The root path
+// @return *FileSystem
+func NewFileSystem(root string) *FileSystem {
+	return &FileSystem{root: root}
+}
+
+// Root is a method to get the root path of the storage.
+// @return string
+func (f *FileSystem) Root() string {
+	return f.root
+}
+
+// path returns the path of a name under the root path
+// @param name string
+// @return string
+func (f *FileSystem) path(name string) string {
+	return filepath.Join(f.root, filepath.FromSlash(clean(name)))
+}
+
+// fsFile is an open file of a FileSystem
+type fsFile struct {
+	*os.File
+}
+
+// Size returns the size of the file
+// @return int64
+// @return error
+func (f fsFile) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// OpenFile is a method to open a file under the root path.
+// @param name string
+// @param flag int
+// @return File
+// @return error
+func (f *FileSystem) OpenFile(name string, flag int) (File, error) {
+	file, err := os.OpenFile(f.path(name), flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return fsFile{File: file}, nil
+}
+
+// Stat is a method to describe a file or folder under the root path.
+// @param name string
+// @return Info
+// @return error
+func (f *FileSystem) Stat(name string) (Info, error) {
+	info, err := os.Stat(f.path(name))
+	if err != nil {
+		return Info{}, err
+	}
+	return fileInfo(info), nil
+}
+
+// ReadDir is a method to list a folder under the root path in name order.
+// @param folder string
+// @return []Info
+// @return error
+func (f *FileSystem) ReadDir(folder string) ([]Info, error) {
+	entries, err := os.ReadDir(f.path(folder))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]Info, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			// removed since the folder was read
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, fileInfo(info))
+	}
+	return infos, nil
+}
+
+// MkdirAll is a method to create a folder under the root path along with its parents.
+// @param folder string
+// @return error
+func (f *FileSystem) MkdirAll(folder string) error {
+	return os.MkdirAll(f.path(folder), 0777)
+}
+
+// Remove is a method to remove a file or empty folder under the root path.
+// @param name string
+// @return error
+func (f *FileSystem) Remove(name string) error {
+	return os.Remove(f.path(name))
+}
+
+// RemoveAll is a method to remove a file or a folder with everything in it under the root path.
+// @param name string
+// @return error
+func (f *FileSystem) RemoveAll(name string) error {
+	return os.RemoveAll(f.path(name))
+}
+
+// Rename is a method to move a file or folder under the root path.
+// @param from string
+// @param to string
+// @return error
+func (f *FileSystem) Rename(from, to string) error {
+	return os.Rename(f.path(from), f.path(to))
+}
+
+// Space is a method to get the bytes free and the size of the disk the root path is on.
+// @return uint64 The bytes free
+// @return uint64 The size in bytes
+// @return error
+func (f *FileSystem) Space() (uint64, uint64, error) {
+	return diskSpace(f.root)
+}
+
+// fileInfo turns the info of a file into an Info
+// @param info os.FileInfo
+// @return Info
+func fileInfo(info os.FileInfo) Info {
+	return Info{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}
+}
@@ -0,0 +1,356 @@
+package storage
+
+// memory file to hold the Storage that keeps objects in memory, for tests and servers that do not need to keep files
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is a Storage that keeps objects in memory. Everything in it is lost when the program stops.
+// It is safe to use from more than one goroutine.
+type Memory struct {
+	mu      sync.Mutex
+	objects map[string]*memObject
+	// folders are the folders with the time they were created, the root is always there
+	folders map[string]time.Time
+	now     func() time.Time
+}
+
+// memObject is the data of an object of a Memory storage
+type memObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemory is a method to create an empty Memory storage.
+// @return *Memory
+func NewMemory() *Memory {
+	return &Memory{objects: make(map[string]*memObject), folders: map[string]time.Time{"": time.Now()}, now: time.Now}
+}
+
+// memFile is an open object of a Memory storage. It keeps working on the data of the object
+// when the object is renamed or removed while it is open, like a file does.
+type memFile struct {
+	m        *Memory
+	name     string
+	obj      *memObject
+	writable bool
+	closed   bool
+}
+
+// OpenFile is a method to open an object.
+// @param name string
+// @param flag int
+// @return File
+// @return error
+func (m *Memory) OpenFile(name string, flag int) (File, error) {
+	name = clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.folders[name]; ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a folder")}
+	}
+	obj, ok := m.objects[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, notExist("open", name)
+	case !ok:
+		if _, ok := m.folders[parent(name)]; !ok {
+			return nil, notExist("open", name)
+		}
+		obj = &memObject{modTime: m.now()}
+		m.objects[name] = obj
+	}
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if writable && flag&os.O_TRUNC != 0 {
+		obj.data = nil
+		obj.modTime = m.now()
+	}
+	return &memFile{m: m, name: name, obj: obj, writable: writable}, nil
+}
+
+// ReadAt reads from the object at an offset
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("negative offset")}
+	}
+	if off >= int64(len(f.obj.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.obj.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes to the object at an offset, growing it when the write goes past its end
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if !f.writable {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: errors.New("negative offset")}
+	}
+	end := off + int64(len(p))
+	if end > int64(len(f.obj.data)) {
+		f.obj.resize(end)
+	}
+	copy(f.obj.data[off:], p)
+	f.obj.modTime = f.m.now()
+	return len(p), nil
+}
+
+// Size returns the size of the object
+func (f *memFile) Size() (int64, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	return int64(len(f.obj.data)), nil
+}
+
+// Truncate changes the size of the object
+func (f *memFile) Truncate(size int64) error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	if !f.writable {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrPermission}
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: errors.New("negative size")}
+	}
+	f.obj.resize(size)
+	f.obj.modTime = f.m.now()
+	return nil
+}
+
+// Sync does nothing since the writes are already in the storage
+func (f *memFile) Sync() error {
+	return nil
+}
+
+// Close closes the object
+func (f *memFile) Close() error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// resize changes the size of the data, adding zeros when it grows
+// @param size int64
+func (o *memObject) resize(size int64) {
+	if size <= int64(len(o.data)) {
+		o.data = o.data[:size]
+		return
+	}
+	data := make([]byte, size)
+	copy(data, o.data)
+	o.data = data
+}
+
+// Stat is a method to describe an object or folder.
+// @param name string
+// @return Info
+// @return error
+func (m *Memory) Stat(name string) (Info, error) {
+	name = clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.statLocked(name)
+}
+
+func (m *Memory) statLocked(name string) (Info, error) {
+	base := name[strings.LastIndex(name, "/")+1:]
+	if created, ok := m.folders[name]; ok {
+		return Info{Name: base, ModTime: created, IsDir: true}, nil
+	}
+	if obj, ok := m.objects[name]; ok {
+		return Info{Name: base, Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+	}
+	return Info{}, notExist("stat", name)
+}
+
+// ReadDir is a method to list a folder in name order.
+// @param folder string
+// @return []Info
+// @return error
+func (m *Memory) ReadDir(folder string) ([]Info, error) {
+	folder = clean(folder)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.folders[folder]; !ok {
+		return nil, notExist("readdir", folder)
+	}
+	infos := make([]Info, 0)
+	for name := range m.folders {
+		if name != "" && parent(name) == folder {
+			info, _ := m.statLocked(name)
+			infos = append(infos, info)
+		}
+	}
+	for name := range m.objects {
+		if parent(name) == folder {
+			info, _ := m.statLocked(name)
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// MkdirAll is a method to create a folder along with its parents.
+// @param folder string
+// @return error
+func (m *Memory) MkdirAll(folder string) error {
+	folder = clean(folder)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir := folder; dir != ""; dir = parent(dir) {
+		if _, ok := m.objects[dir]; ok {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a folder")}
+		}
+	}
+	for dir := folder; dir != ""; dir = parent(dir) {
+		if _, ok := m.folders[dir]; !ok {
+			m.folders[dir] = m.now()
+		}
+	}
+	return nil
+}
+
+// Remove is a method to remove an object or an empty folder.
+// @param name string
+// @return error
+func (m *Memory) Remove(name string) error {
+	name = clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.objects[name]; ok {
+		delete(m.objects, name)
+		return nil
+	}
+	if _, ok := m.folders[name]; !ok || name == "" {
+		return notExist("remove", name)
+	}
+	if m.hasChildrenLocked(name) {
+		return &fs.PathError{Op: "remove", Path: name, Err: ErrNotEmpty}
+	}
+	delete(m.folders, name)
+	return nil
+}
+
+// RemoveAll is a method to remove an object or a folder along with everything in it.
+// @param name string
+// @return error
+func (m *Memory) RemoveAll(name string) error {
+	name = clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, name)
+	for _, key := range m.underLocked(name) {
+		delete(m.objects, key)
+		delete(m.folders, key)
+	}
+	if name != "" {
+		delete(m.folders, name)
+	}
+	return nil
+}
+
+// Rename is a method to move an object or a folder.
+// @param from string
+// @param to string
+// @return error
+func (m *Memory) Rename(from, to string) error {
+	from, to = clean(from), clean(to)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.folders[parent(to)]; !ok {
+		return notExist("rename", to)
+	}
+	if obj, ok := m.objects[from]; ok {
+		if _, ok := m.folders[to]; ok {
+			return &fs.PathError{Op: "rename", Path: to, Err: fs.ErrExist}
+		}
+		delete(m.objects, from)
+		m.objects[to] = obj
+		return nil
+	}
+	created, ok := m.folders[from]
+	if !ok || from == "" {
+		return notExist("rename", from)
+	}
+	if _, err := m.statLocked(to); err == nil || to == from || strings.HasPrefix(to, from+"/") {
+		return &fs.PathError{Op: "rename", Path: to, Err: fs.ErrExist}
+	}
+	for _, key := range m.underLocked(from) {
+		newKey := to + strings.TrimPrefix(key, from)
+		if obj, ok := m.objects[key]; ok {
+			delete(m.objects, key)
+			m.objects[newKey] = obj
+		} else {
+			m.folders[newKey] = m.folders[key]
+			delete(m.folders, key)
+		}
+	}
+	delete(m.folders, from)
+	m.folders[to] = created
+	return nil
+}
+
+// hasChildrenLocked returns whether a folder has objects or folders in it
+// @param folder string
+// @return bool
+func (m *Memory) hasChildrenLocked(folder string) bool {
+	return len(m.underLocked(folder)) > 0
+}
+
+// underLocked returns the names of every object and folder inside a folder, however deep
+// @param folder string
+// @return []string
+func (m *Memory) underLocked(folder string) []string {
+	prefix := folder + "/"
+	if folder == "" {
+		prefix = ""
+	}
+	names := make([]string, 0)
+	for name := range m.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	for name := range m.folders {
+		if name != "" && name != folder && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
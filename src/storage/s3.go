@@ -0,0 +1,1171 @@
+package storage
+
+// s3 file to hold the Storage that keeps objects in a bucket of an S3 compatible object store, like MinIO
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Options are the settings of an S3 storage
+type S3Options struct {
+	// Endpoint is the URL of the object store, like "https://s3.eu-west-1.amazonaws.com" or "http://nas.local:9000"
+	Endpoint string
+	// Bucket is the bucket objects are kept in, it has to exist
+	Bucket string
+	// Region is the region requests are signed for, "us-east-1" when empty
+	Region string
+	// AccessKey and SecretKey sign the requests, requests are not signed when AccessKey is empty
+	AccessKey string
+	SecretKey string
+	// Prefix is put in front of every key, like "photos", so the bucket can be shared
+	Prefix string
+	// Client sends the requests, http.DefaultClient when nil
+	Client *http.Client
+	// StagingDir is the local folder objects are kept in while they are being written, until they are published.
+	// A folder named after the bucket in the temporary folder when empty, which is lost when it is cleaned.
+	StagingDir string
+}
+
+// the sizes uploads and copies are split into parts at
+const (
+	// s3PartSize is the size of the parts objects bigger than it are uploaded in
+	s3PartSize = 64 << 20
+	// s3MaxParts is the most parts an object can be uploaded in, bigger objects are uploaded in bigger parts
+	s3MaxParts = 10000
+	// s3MaxCopySize is the biggest object that can be copied in a single request, and the size of the parts bigger ones are copied in
+	s3MaxCopySize = 5 << 30
+)
+
+// S3 is a Storage that keeps objects in a bucket of an S3 compatible object store. Requests use path style URLs
+// like http://nas.local:9000/bucket/key, which MinIO and most other stores take.
+// Object stores can not change part of an object, so an object that is written to is downloaded into the staging
+// folder first, or created there, and kept there until it is published, when it is uploaded whole, in parts when it is big.
+// Reading a range of an object that is not staged only downloads that range.
+// Folders are kept as empty objects whose key ends in "/", and names are escaped so any bytes can be used in them.
+type S3 struct {
+	opts     S3Options
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+	// partSize and maxCopySize are s3PartSize and s3MaxCopySize, smaller in tests
+	partSize    int64
+	maxCopySize int64
+}
+
+// NewS3 is a method to create an S3 storage. Nothing is sent to the object store until it is used.
+// @param opts S3Options
+// @return *S3
+// @return error
+func NewS3(opts S3Options) (*S3, error) {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("error: S3 endpoint %q is not an http or https URL", opts.Endpoint)
+	}
+	if opts.Bucket == "" {
+		return nil, errors.New("error: S3 bucket is empty")
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	opts.Prefix = strings.Trim(opts.Prefix, "/")
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if opts.StagingDir == "" {
+		opts.StagingDir = filepath.Join(os.TempDir(), "s3-staging-"+escapeStagingPart(opts.Bucket))
+	}
+	return &S3{opts: opts, endpoint: endpoint, client: client, now: time.Now, partSize: s3PartSize, maxCopySize: s3MaxCopySize}, nil
+}
+
+// key returns the key of the object of a name
+// @param name string
+// @return string
+func (s *S3) key(name string) string {
+	parts := make([]string, 0)
+	if s.opts.Prefix != "" {
+		parts = append(parts, s.opts.Prefix)
+	}
+	if name = clean(name); name != "" {
+		for _, part := range strings.Split(name, "/") {
+			parts = append(parts, escapeKeyPart(part))
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// folderKey returns the key the objects in a folder start with, which is also the key of the folder object
+// @param name string
+// @return string
+func (s *S3) folderKey(name string) string {
+	key := s.key(name)
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+// escapeKeyPart escapes every byte of a part of a name that is not a letter, a digit or one of "-._~"
+// @param part string
+// @return string
+func escapeKeyPart(part string) string {
+	var b strings.Builder
+	for i := 0; i < len(part); i++ {
+		c := part[i]
+		if isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// unescapeKeyPart undoes escapeKeyPart
+// @param part string
+// @return string
+func unescapeKeyPart(part string) string {
+	name, err := url.PathUnescape(part)
+	if err != nil {
+		return part
+	}
+	return name
+}
+
+// isUnreserved returns whether a byte is left as is in keys and signed URLs
+// @param c byte
+// @return bool
+func isUnreserved(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~'
+}
+
+// s3Error is the error body an object store sends back
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// request sends a signed request about a key of the bucket
+// @param method string
+// @param key string The key, empty for the bucket itself
+// @param query url.Values
+// @param header http.Header Extra headers, which are signed as well
+// @param body io.ReadSeeker The body, nil for none
+// @return *http.Response A response with a 2xx status code, or one for a HEAD request
+// @return error
+func (s *S3) request(method, key string, query url.Values, header http.Header, body io.ReadSeeker) (*http.Response, error) {
+	payloadHash, size, err := hashBody(body)
+	if err != nil {
+		return nil, err
+	}
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.opts.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if size > 0 {
+		req.Body = io.NopCloser(body)
+		req.ContentLength = size
+	} else if body != nil {
+		// an empty body is sent with a Content-Length of 0 instead of chunked, which object stores reject
+		req.Body = http.NoBody
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	s.sign(req, payloadHash)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 || method == http.MethodHead && resp.StatusCode == http.StatusNotFound {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, notExist(strings.ToLower(method), key)
+	}
+	var apiErr s3Error
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &apiErr) != nil || apiErr.Code == "" {
+		return nil, fmt.Errorf("error: S3 %s %s failed with %s", method, key, resp.Status)
+	}
+	return nil, fmt.Errorf("error: S3 %s %s failed with %s; %s: %s", method, key, resp.Status, apiErr.Code, apiErr.Message)
+}
+
+// hashBody returns the hex encoded sha256 hash and the size of a body, and seeks it back to its start
+// @param body io.ReadSeeker
+// @return string
+// @return int64
+// @return error
+func hashBody(body io.ReadSeeker) (string, int64, error) {
+	hasher := sha256.New()
+	if body == nil {
+		return hex.EncodeToString(hasher.Sum(nil)), 0, nil
+	}
+	size, err := io.Copy(hasher, body)
+	if err != nil {
+		return "", 0, err
+	}
+	_, err = body.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// sign signs a request with AWS signature version 4
+// @param req *http.Request
+// @param payloadHash string The hex encoded sha256 hash of the body
+func (s *S3) sign(req *http.Request, payloadHash string) {
+	if s.opts.AccessKey == "" {
+		return
+	}
+	t := s.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		name := strings.ToLower(k)
+		names = append(names, name)
+		values[name] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + values[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers.String(), signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + s.opts.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := hmacSHA256([]byte("AWS4"+s.opts.SecretKey), date)
+	for _, part := range []string{s.opts.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.opts.AccessKey, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of text with a key
+// @param key []byte
+// @param text string
+// @return []byte
+func hmacSHA256(key []byte, text string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(text))
+	return mac.Sum(nil)
+}
+
+// uriEncode escapes text the way signature version 4 wants, every byte but the unreserved ones
+// @param text string
+// @param encodeSlash bool Whether "/" is escaped as well, which it is everywhere but in the path
+// @return string
+func uriEncode(text string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if isUnreserved(c) || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery writes a query sorted by key with its keys and values escaped, the way signature version 4 wants
+// @param query url.Values
+// @return string
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// head returns the size and modification time of an object
+// @param key string
+// @return int64
+// @return time.Time
+// @return bool false if the object does not exist
+// @return error
+func (s *S3) head(key string) (int64, time.Time, bool, error) {
+	resp, err := s.request(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return 0, time.Time{}, false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, time.Time{}, false, nil
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.ContentLength, modTime, true, nil
+}
+
+// put uploads an object
+// @param key string
+// @param body io.ReadSeeker
+// @return error
+func (s *S3) put(key string, body io.ReadSeeker) error {
+	resp, err := s.request(http.MethodPut, key, nil, nil, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// remove deletes an object, it is not an error when it does not exist
+// @param key string
+// @return error
+func (s *S3) remove(key string) error {
+	resp, err := s.request(http.MethodDelete, key, nil, nil, nil)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// copy copies an object to another key in the bucket, in parts when it is bigger than s3MaxCopySize
+// @param from string
+// @param to string
+// @param size int64 The size of the object
+// @return error
+func (s *S3) copy(from, to string, size int64) error {
+	source := uriEncode("/"+s.opts.Bucket+"/"+from, false)
+	op := fmt.Sprintf("copy of %s to %s", from, to)
+	if size <= s.maxCopySize {
+		resp, err := s.request(http.MethodPut, to, nil, http.Header{"X-Amz-Copy-Source": {source}}, nil)
+		if err != nil {
+			return err
+		}
+		return readResult(resp, op, nil)
+	}
+	return s.multipart(to, size, s.maxCopySize, func(number int, uploadID string, off, n int64) (string, error) {
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		header := http.Header{"X-Amz-Copy-Source": {source}, "X-Amz-Copy-Source-Range": {fmt.Sprintf("bytes=%d-%d", off, off+n-1)}}
+		resp, err := s.request(http.MethodPut, to, query, header, nil)
+		if err != nil {
+			return "", err
+		}
+		var result copyPartResult
+		err = readResult(resp, op, &result)
+		return result.ETag, err
+	})
+}
+
+// readResult reads the XML body of a response into a result, which can be nil to only check it.
+// Copies and multipart uploads can fail after the status code is sent, with the error in the body.
+// @param resp *http.Response
+// @param op string What the request was for, like "copy of a to b"
+// @param result interface{}
+// @return error
+func readResult(resp *http.Response, op string, result interface{}) error {
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	var apiErr s3Error
+	if xml.Unmarshal(data, &apiErr) == nil && apiErr.Code != "" {
+		return fmt.Errorf("error: S3 %s failed; %s: %s", op, apiErr.Code, apiErr.Message)
+	}
+	if result == nil {
+		return nil
+	}
+	err = xml.Unmarshal(data, result)
+	if err != nil {
+		return fmt.Errorf("error: could not read S3 response to %s; %s", op, err)
+	}
+	return nil
+}
+
+// initiateResult is the body of the response to starting a multipart upload
+type initiateResult struct {
+	UploadId string
+}
+
+// copyPartResult is the body of the response to copying a part of a multipart upload
+type copyPartResult struct {
+	ETag string
+}
+
+// completeMultipartUpload is the body of the request that finishes a multipart upload
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// completedPart is a part of a completeMultipartUpload
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// multipart writes an object in parts with a multipart upload, which is aborted when it fails.
+// The parts are partSize, or bigger when the object does not fit in s3MaxParts of them.
+// @param key string
+// @param size int64 The size of the object
+// @param partSize int64
+// @param part func(number int, uploadID string, off, n int64) (string, error) Sends the part of n bytes at off and returns its ETag
+// @return error
+func (s *S3) multipart(key string, size, partSize int64, part func(number int, uploadID string, off, n int64) (string, error)) error {
+	op := "multipart upload of " + key
+	resp, err := s.request(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	var initiate initiateResult
+	err = readResult(resp, op, &initiate)
+	if err != nil {
+		return err
+	}
+	if initiate.UploadId == "" {
+		return fmt.Errorf("error: S3 %s did not get an upload ID", op)
+	}
+	if size > partSize*s3MaxParts {
+		partSize = (size + s3MaxParts - 1) / s3MaxParts
+	}
+	complete := completeMultipartUpload{}
+	for off, number := int64(0), 1; off < size && err == nil; off, number = off+partSize, number+1 {
+		n := partSize
+		if off+n > size {
+			n = size - off
+		}
+		var etag string
+		etag, err = part(number, initiate.UploadId, off, n)
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: number, ETag: etag})
+	}
+	if err == nil {
+		var body []byte
+		body, err = xml.Marshal(complete)
+		if err == nil {
+			resp, err = s.request(http.MethodPost, key, url.Values{"uploadId": {initiate.UploadId}}, nil, bytes.NewReader(body))
+		}
+		if err == nil {
+			err = readResult(resp, op, nil)
+		}
+	}
+	if err != nil {
+		// the parts sent so far are kept, and paid for, until the upload is aborted
+		resp, abortErr := s.request(http.MethodDelete, key, url.Values{"uploadId": {initiate.UploadId}}, nil, nil)
+		if abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// s3Object is an object in a listing
+type s3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// listResult is the body of a ListObjectsV2 response
+type listResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []s3Object
+	CommonPrefixes        []struct {
+		Prefix string
+	}
+}
+
+// list lists the objects whose key starts with a prefix. With a delimiter the objects below the next
+// delimiter are only listed as the prefix they share.
+// @param prefix string
+// @param delimiter string
+// @param max int The most objects and prefixes to list, 0 for all of them
+// @return []s3Object
+// @return []string The prefixes
+// @return error
+func (s *S3) list(prefix, delimiter string, max int) ([]s3Object, []string, error) {
+	objects := make([]s3Object, 0)
+	prefixes := make([]string, 0)
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if max > 0 {
+			query.Set("max-keys", strconv.Itoa(max))
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.request(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error: could not read S3 listing of %s; %s", prefix, err)
+		}
+		objects = append(objects, result.Contents...)
+		for _, p := range result.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" || max > 0 {
+			return objects, prefixes, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// isFolder returns whether a name is a folder, which it is when its folder object or anything in it exists
+// @param name string
+// @return bool
+// @return error
+func (s *S3) isFolder(name string) (bool, error) {
+	prefix := s.folderKey(name)
+	if prefix == "" {
+		return true, nil
+	}
+	objects, prefixes, err := s.list(prefix, "/", 1)
+	if err != nil {
+		return false, err
+	}
+	return len(objects) > 0 || len(prefixes) > 0, nil
+}
+
+// stagingPath returns the path of the staged copy of a name in the staging folder. Every byte of the parts of the
+// name but lower case letters, digits, "-" and "_" is escaped, so names that only differ in case do not share
+// a file on file systems that ignore case, and no part starts with a ".".
+// @param name string
+// @return string
+func (s *S3) stagingPath(name string) string {
+	path := s.opts.StagingDir
+	if name = clean(name); name != "" {
+		for _, part := range strings.Split(name, "/") {
+			path = filepath.Join(path, escapeStagingPart(part))
+		}
+	}
+	return path
+}
+
+// escapeStagingPart escapes a part of a name for the staging folder, it is undone by unescapeKeyPart
+// @param part string
+// @return string
+func escapeStagingPart(part string) string {
+	var b strings.Builder
+	for i := 0; i < len(part); i++ {
+		c := part[i]
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// statStaged describes the staged copy of a name
+// @param name string
+// @return os.FileInfo
+// @return bool false if the name has no staged copy
+// @return error
+func (s *S3) statStaged(name string) (os.FileInfo, bool, error) {
+	info, err := os.Stat(s.stagingPath(name))
+	if os.IsNotExist(err) || err == nil && info.IsDir() {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return info, true, nil
+}
+
+// hasStaged returns whether there are staged objects in a folder or the folders in it
+// @param folder string
+// @return bool
+// @return error
+func (s *S3) hasStaged(folder string) (bool, error) {
+	found := false
+	err := filepath.WalkDir(s.stagingPath(folder), func(path string, entry fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found, err
+}
+
+// OpenFile is a method to open an object. Opening it does not download it, an object that is written to is
+// downloaded into the staging folder first, and an object that is created or truncated is created there.
+// @param name string
+// @param flag int
+// @return File
+// @return error
+func (s *S3) OpenFile(name string, flag int) (File, error) {
+	name = clean(name)
+	if name == "" {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a folder")}
+	}
+	f := &s3File{s: s, name: name, key: s.key(name), staged: s.stagingPath(name), writable: flag&(os.O_WRONLY|os.O_RDWR) != 0}
+	localFlag := os.O_RDONLY
+	if f.writable {
+		localFlag = os.O_RDWR
+		if flag&os.O_TRUNC != 0 {
+			localFlag |= os.O_TRUNC
+		}
+	}
+	_, staged, err := s.statStaged(name)
+	if err != nil {
+		return nil, err
+	}
+	if staged {
+		if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+		}
+		f.local, err = os.OpenFile(f.staged, localFlag, 0)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	size, _, ok, err := s.head(f.key)
+	if err != nil {
+		return nil, err
+	}
+	f.size = size
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, notExist("open", name)
+	case !ok || f.writable && flag&os.O_TRUNC != 0:
+		if !ok {
+			isFolder, err := s.isFolder(parent(name))
+			if err != nil {
+				return nil, err
+			}
+			if !isFolder {
+				return nil, notExist("open", name)
+			}
+		}
+		err = os.MkdirAll(filepath.Dir(f.staged), 0777)
+		if err != nil {
+			return nil, err
+		}
+		f.local, err = os.OpenFile(f.staged, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return nil, err
+		}
+		f.size = 0
+	}
+	return f, nil
+}
+
+// s3File is an open object of an S3 storage
+type s3File struct {
+	s        *S3
+	name     string
+	key      string
+	writable bool
+	// size is the size of the object while it is read from the object store
+	size int64
+	// staged is the path of the staged copy of the object, and local is the staged copy once it is opened.
+	// It is kept when the object is closed, until the object is published.
+	staged string
+	local  *os.File
+	closed bool
+}
+
+// ReadAt reads a range of the object, from the staged copy when there is one
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.local != nil {
+		return f.local.ReadAt(p, off)
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > f.size {
+		end = f.size
+	}
+	if end == off {
+		return 0, nil
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, end-1)}}
+	resp, err := f.s.request(http.MethodGet, f.key, nil, header, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.ReadFull(resp.Body, p[:end-off])
+	if err != nil {
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes to the staged copy of the object, downloading it first
+func (f *s3File) WriteAt(p []byte, off int64) (int, error) {
+	err := f.stage("write")
+	if err != nil {
+		return 0, err
+	}
+	return f.local.WriteAt(p, off)
+}
+
+// Size returns the size of the object
+func (f *s3File) Size() (int64, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.local != nil {
+		info, err := f.local.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	return f.size, nil
+}
+
+// Truncate changes the size of the staged copy of the object, downloading it first
+func (f *s3File) Truncate(size int64) error {
+	err := f.stage("truncate")
+	if err != nil {
+		return err
+	}
+	return f.local.Truncate(size)
+}
+
+// Sync makes the writes to the staged copy durable. It does not upload the object, Publish does.
+func (f *s3File) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.local == nil || !f.writable {
+		return nil
+	}
+	return f.local.Sync()
+}
+
+// Close closes the staged copy of the object, which is kept until the object is published
+func (f *s3File) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	if f.local != nil {
+		return f.local.Close()
+	}
+	return nil
+}
+
+// stage downloads the object into its staged copy the first time it is changed
+// @param op string What the object is staged for, like "write"
+// @return error
+func (f *s3File) stage(op string) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if !f.writable {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrPermission}
+	}
+	if f.local != nil {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(f.staged), 0777)
+	if err != nil {
+		return err
+	}
+	// the object is downloaded next to its staged copy and renamed over it once it is whole, the name of
+	// the download starts with a "." so it is not taken for a staged object
+	download, err := os.CreateTemp(filepath.Dir(f.staged), ".download-*")
+	if err != nil {
+		return err
+	}
+	if f.size > 0 {
+		var resp *http.Response
+		resp, err = f.s.request(http.MethodGet, f.key, nil, nil, nil)
+		if err == nil {
+			_, err = io.Copy(download, resp.Body)
+			resp.Body.Close()
+		}
+	}
+	if closeErr := download.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(download.Name(), f.staged)
+	}
+	if err != nil {
+		os.Remove(download.Name())
+		return err
+	}
+	f.local, err = os.OpenFile(f.staged, os.O_RDWR, 0)
+	return err
+}
+
+// Publish is a method to upload the staged copy of an object and remove it. Objects bigger than
+// s3PartSize are uploaded in parts.
+// @param name string
+// @return error
+func (s *S3) Publish(name string) error {
+	name = clean(name)
+	info, staged, err := s.statStaged(name)
+	if err != nil || !staged || name == "" {
+		return err
+	}
+	local, err := os.Open(s.stagingPath(name))
+	if err != nil {
+		return err
+	}
+	err = s.upload(s.key(name), local, info.Size())
+	local.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(s.stagingPath(name))
+}
+
+// upload uploads an object from a file, in parts when it is bigger than s3PartSize
+// @param key string
+// @param file io.ReaderAt
+// @param size int64
+// @return error
+func (s *S3) upload(key string, file io.ReaderAt, size int64) error {
+	if size <= s.partSize {
+		return s.put(key, io.NewSectionReader(file, 0, size))
+	}
+	return s.multipart(key, size, s.partSize, func(number int, uploadID string, off, n int64) (string, error) {
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		resp, err := s.request(http.MethodPut, key, query, nil, io.NewSectionReader(file, off, n))
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		return resp.Header.Get("ETag"), nil
+	})
+}
+
+// Stat is a method to describe an object or folder, the staged copy of an object when there is one.
+// @param name string
+// @return Info
+// @return error
+func (s *S3) Stat(name string) (Info, error) {
+	name = clean(name)
+	base := name[strings.LastIndex(name, "/")+1:]
+	if name != "" {
+		info, staged, err := s.statStaged(name)
+		if err != nil {
+			return Info{}, err
+		}
+		if staged {
+			return Info{Name: base, Size: info.Size(), ModTime: info.ModTime()}, nil
+		}
+		size, modTime, ok, err := s.head(s.key(name))
+		if err != nil {
+			return Info{}, err
+		}
+		if ok {
+			return Info{Name: base, Size: size, ModTime: modTime}, nil
+		}
+	}
+	isFolder, err := s.isFolder(name)
+	if err != nil {
+		return Info{}, err
+	}
+	if !isFolder {
+		return Info{}, notExist("stat", name)
+	}
+	return Info{Name: base, IsDir: true}, nil
+}
+
+// ReadDir is a method to list a folder in name order, with the staged copies of objects in place of the objects.
+// @param folder string
+// @return []Info
+// @return error
+func (s *S3) ReadDir(folder string) ([]Info, error) {
+	folder = clean(folder)
+	prefix := s.folderKey(folder)
+	objects, prefixes, err := s.list(prefix, "/", 0)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(s.stagingPath(folder))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	staged := make(map[string]Info)
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			// published since the folder was read
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := unescapeKeyPart(entry.Name())
+		staged[name] = Info{Name: name, Size: info.Size(), ModTime: info.ModTime()}
+	}
+	if folder != "" && len(objects) == 0 && len(prefixes) == 0 && len(staged) == 0 {
+		return nil, notExist("readdir", folder)
+	}
+	infos := make([]Info, 0, len(objects)+len(prefixes)+len(staged))
+	for _, object := range objects {
+		if object.Key == prefix {
+			// the folder object itself
+			continue
+		}
+		name := unescapeKeyPart(strings.TrimPrefix(object.Key, prefix))
+		if _, ok := staged[name]; !ok {
+			infos = append(infos, Info{Name: name, Size: object.Size, ModTime: object.LastModified})
+		}
+	}
+	for _, info := range staged {
+		infos = append(infos, info)
+	}
+	for _, p := range prefixes {
+		infos = append(infos, Info{Name: unescapeKeyPart(strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/")), IsDir: true})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// MkdirAll is a method to create a folder along with its parents, as folder objects.
+// @param folder string
+// @return error
+func (s *S3) MkdirAll(folder string) error {
+	for dir := clean(folder); dir != ""; dir = parent(dir) {
+		err := s.put(s.folderKey(dir), bytes.NewReader(nil))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove is a method to remove an object along with its staged copy, or an empty folder.
+// @param name string
+// @return error
+func (s *S3) Remove(name string) error {
+	name = clean(name)
+	if name == "" {
+		return notExist("remove", name)
+	}
+	_, staged, err := s.statStaged(name)
+	if err != nil {
+		return err
+	}
+	if staged {
+		err = os.Remove(s.stagingPath(name))
+		if err != nil {
+			return err
+		}
+	}
+	_, _, ok, err := s.head(s.key(name))
+	if err != nil {
+		return err
+	}
+	if ok {
+		return s.remove(s.key(name))
+	}
+	if staged {
+		return nil
+	}
+	prefix := s.folderKey(name)
+	objects, prefixes, err := s.list(prefix, "/", 2)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 && len(prefixes) == 0 {
+		return notExist("remove", name)
+	}
+	hasStaged, err := s.hasStaged(name)
+	if err != nil {
+		return err
+	}
+	if hasStaged || len(prefixes) > 0 || len(objects) > 1 || objects[0].Key != prefix {
+		return &fs.PathError{Op: "remove", Path: name, Err: ErrNotEmpty}
+	}
+	err = s.remove(prefix)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(s.stagingPath(name))
+}
+
+// RemoveAll is a method to remove an object or a folder along with everything in it, staged or not.
+// @param name string
+// @return error
+func (s *S3) RemoveAll(name string) error {
+	name = clean(name)
+	err := os.RemoveAll(s.stagingPath(name))
+	if err != nil {
+		return err
+	}
+	if name != "" {
+		err = s.remove(s.key(name))
+		if err != nil {
+			return err
+		}
+	}
+	objects, _, err := s.list(s.folderKey(name), "", 0)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		err = s.remove(object.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameStaged moves the staged copy of a name, or the staged copies in a folder, to another name
+// @param from string
+// @param to string
+// @return error
+func (s *S3) renameStaged(from, to string) error {
+	_, err := os.Stat(s.stagingPath(from))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(s.stagingPath(to))
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(s.stagingPath(to)), 0777)
+	if err != nil {
+		return err
+	}
+	return os.Rename(s.stagingPath(from), s.stagingPath(to))
+}
+
+// Rename is a method to move an object or a folder, by moving the staged copies and copying every object
+// in the object store and then deleting it.
+// @param from string
+// @param to string
+// @return error
+func (s *S3) Rename(from, to string) error {
+	from, to = clean(from), clean(to)
+	isFolder, err := s.isFolder(parent(to))
+	if err != nil {
+		return err
+	}
+	if !isFolder {
+		return notExist("rename", to)
+	}
+	_, staged, err := s.statStaged(from)
+	if err != nil {
+		return err
+	}
+	size, _, ok, err := s.head(s.key(from))
+	if err != nil {
+		return err
+	}
+	if (staged || ok) && from != "" {
+		if staged {
+			err = s.renameStaged(from, to)
+		} else {
+			// the staged copy of the object that is replaced would hide the object moved over it
+			err = os.RemoveAll(s.stagingPath(to))
+			if err == nil {
+				err = s.copy(s.key(from), s.key(to), size)
+			}
+		}
+		if err != nil || !ok {
+			return err
+		}
+		return s.remove(s.key(from))
+	}
+	if _, err := s.Stat(to); err == nil || from == "" || to == from || strings.HasPrefix(to, from+"/") {
+		return &fs.PathError{Op: "rename", Path: to, Err: fs.ErrExist}
+	}
+	prefix := s.folderKey(from)
+	objects, _, err := s.list(prefix, "", 0)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return notExist("rename", from)
+	}
+	newPrefix := s.folderKey(to)
+	for _, object := range objects {
+		err = s.copy(object.Key, newPrefix+strings.TrimPrefix(object.Key, prefix), object.Size)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.renameStaged(from, to)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		err = s.remove(object.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an object store that keeps the objects of a bucket in memory and answers the requests an S3 storage sends
+type fakeS3 struct {
+	bucket string
+	mu     sync.Mutex
+	// objects are the objects by key, and uploads the parts of the multipart uploads in progress by upload ID
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	// puts is how many objects were uploaded whole, parts how many parts were uploaded or copied,
+	// and putData how many bytes of object data were uploaded
+	puts    int
+	putData int64
+	parts   int
+}
+
+// newFakeS3 starts a fake object store and returns an S3 storage of it
+// @param t *testing.T
+// @return *S3
+// @return *fakeS3
+func newFakeS3(t *testing.T) (*S3, *fakeS3) {
+	t.Helper()
+	fake := &fakeS3{bucket: "bucket", objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	st, err := NewS3(S3Options{Endpoint: server.URL, Bucket: fake.bucket, AccessKey: "key", SecretKey: "secret", StagingDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st, fake
+}
+
+// ServeHTTP answers a request of an S3 storage
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key, ok := strings.CutPrefix(req.URL.Path, "/"+f.bucket)
+	if !ok || req.Header.Get("Authorization") == "" {
+		http.Error(w, "wrong bucket or not signed", http.StatusForbidden)
+		return
+	}
+	key = strings.TrimPrefix(key, "/")
+	query := req.URL.Query()
+	body, _ := io.ReadAll(req.Body)
+	uploadID := query.Get("uploadId")
+	switch {
+	case key == "" && req.Method == http.MethodGet:
+		f.list(w, query)
+	case req.Method == http.MethodHead || req.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		start, end := 0, len(data)
+		if r := req.Header.Get("Range"); r != "" {
+			fmt.Sscanf(r, "bytes=%d-%d", &start, &end)
+			end++
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(end-start))
+		if req.Method == http.MethodGet {
+			w.Write(data[start:end])
+		}
+	case req.Method == http.MethodPut && req.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(req.Header.Get("X-Amz-Copy-Source"))
+		data, ok := f.objects[strings.TrimPrefix(source, "/"+f.bucket+"/")]
+		if !ok {
+			http.Error(w, "no such source", http.StatusNotFound)
+			return
+		}
+		if uploadID == "" {
+			f.objects[key] = append([]byte(nil), data...)
+			w.Write([]byte("<CopyObjectResult><ETag>copy</ETag></CopyObjectResult>"))
+			return
+		}
+		var start, end int
+		fmt.Sscanf(req.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end)
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[uploadID][number] = append([]byte(nil), data[start:end+1]...)
+		f.parts++
+		fmt.Fprintf(w, "<CopyPartResult><ETag>%d</ETag></CopyPartResult>", number)
+	case req.Method == http.MethodPut && uploadID != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[uploadID][number] = body
+		f.parts++
+		f.putData += int64(len(body))
+		w.Header().Set("ETag", strconv.Itoa(number))
+	case req.Method == http.MethodPut:
+		f.objects[key] = body
+		if !strings.HasSuffix(key, "/") {
+			f.puts++
+			f.putData += int64(len(body))
+		}
+	case req.Method == http.MethodPost && query.Has("uploads"):
+		uploadID = strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[uploadID] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+	case req.Method == http.MethodPost && uploadID != "":
+		var complete completeMultipartUpload
+		xml.Unmarshal(body, &complete)
+		data := make([]byte, 0)
+		for i, part := range complete.Parts {
+			if part.PartNumber != i+1 || part.ETag != strconv.Itoa(part.PartNumber) {
+				w.Write([]byte("<Error><Code>InvalidPart</Code><Message>wrong part</Message></Error>"))
+				return
+			}
+			data = append(data, f.uploads[uploadID][part.PartNumber]...)
+		}
+		delete(f.uploads, uploadID)
+		f.objects[key] = data
+		w.Write([]byte("<CompleteMultipartUploadResult></CompleteMultipartUploadResult>"))
+	case req.Method == http.MethodDelete && uploadID != "":
+		delete(f.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not supported", http.StatusNotImplemented)
+	}
+}
+
+// list answers a ListObjectsV2 request
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	max, _ := strconv.Atoi(query.Get("max-keys"))
+	keys := make([]string, 0)
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var result listResult
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			if p := prefix + rest[:i+1]; !seen[p] {
+				seen[p] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{p})
+			}
+		} else {
+			result.Contents = append(result.Contents, s3Object{Key: key, Size: int64(len(f.objects[key])), LastModified: time.Now()})
+		}
+		if max > 0 && len(result.Contents)+len(result.CommonPrefixes) >= max {
+			break
+		}
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func TestS3(t *testing.T) {
+	st, _ := newFakeS3(t)
+	testStorage(t, st)
+}
+
+// TestS3Endpoint runs the storage tests against a real object store, like MinIO, when LANFILES_TEST_S3_ENDPOINT is set.
+// The bucket in LANFILES_TEST_S3_BUCKET has to exist, and the objects are written under a prefix that is removed afterwards.
+func TestS3Endpoint(t *testing.T) {
+	endpoint := os.Getenv("LANFILES_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("LANFILES_TEST_S3_ENDPOINT is not set")
+	}
+	st, err := NewS3(S3Options{
+		Endpoint:   endpoint,
+		Bucket:     os.Getenv("LANFILES_TEST_S3_BUCKET"),
+		Region:     os.Getenv("LANFILES_TEST_S3_REGION"),
+		AccessKey:  os.Getenv("LANFILES_TEST_S3_ACCESS_KEY"),
+		SecretKey:  os.Getenv("LANFILES_TEST_S3_SECRET_KEY"),
+		Prefix:     fmt.Sprintf("lanfiles-test-%d", time.Now().UnixNano()),
+		StagingDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.RemoveAll("") })
+	testStorage(t, st)
+}
+
+func TestS3Staging(t *testing.T) {
+	st, fake := newFakeS3(t)
+	st.partSize, st.maxCopySize = 4, 3
+	err := st.MkdirAll("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the object is created at its full size, written a chunk at a time and synced after every write,
+	// and nothing of it is uploaded until it is published
+	file, err := st.OpenFile("f/big", os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = file.Truncate(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	for i, chunk := range []string{"abc", "def", "ghij"} {
+		file, err := st.OpenFile("f/big", os.O_RDWR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = file.WriteAt([]byte(chunk), int64(i*3))
+		if err == nil {
+			err = file.Sync()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+	if fake.puts != 0 || fake.parts != 0 || len(fake.objects) != 1 {
+		t.Fatalf("%d objects and %d parts were uploaded before publishing, the store has %d objects", fake.puts, fake.parts, len(fake.objects))
+	}
+	err = st.Publish("f/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an object bigger than the part size is uploaded in parts, once
+	if fake.puts != 0 || fake.parts != 3 || fake.putData != 10 || len(fake.uploads) != 0 {
+		t.Errorf("publishing uploaded %d objects and %d parts of %d bytes, %d uploads are left", fake.puts, fake.parts, fake.putData, len(fake.uploads))
+	}
+	if data := fake.objects[st.key("f/big")]; string(data) != "abcdefghij" {
+		t.Errorf("uploaded object is %q", data)
+	}
+	if _, staged, _ := st.statStaged("f/big"); staged {
+		t.Error("published object is still staged")
+	}
+	// publishing again has nothing to send
+	err = st.Publish("f/big")
+	if err != nil || fake.parts != 3 {
+		t.Errorf("publishing again gave %v and uploaded %d parts", err, fake.parts-3)
+	}
+	// an object bigger than the biggest copy is copied in parts
+	err = st.Rename("f/big", "f/moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := fake.objects[st.key("f/moved")]; string(data) != "abcdefghij" || fake.parts != 7 {
+		t.Errorf("moved object is %q after %d parts", data, fake.parts-3)
+	}
+	// a small object is uploaded whole
+	err = WriteFile(st, "f/small", []byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.puts != 1 || string(fake.objects[st.key("f/small")]) != "abc" {
+		t.Errorf("small object was uploaded %d times as %q", fake.puts, fake.objects[st.key("f/small")])
+	}
+	// changing an object that was published downloads it into the staging folder and leaves the object as it was until it is published again
+	file, err = st.OpenFile("f/small", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteAt([]byte("X"), 1)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(st, "f/small"); err != nil || string(data) != "aXc" || string(fake.objects[st.key("f/small")]) != "abc" {
+		t.Errorf("changed object reads %q, %v and is %q in the store", data, err, fake.objects[st.key("f/small")])
+	}
+}
@@ -0,0 +1,171 @@
+package storage
+
+// storage file to hold the Storage interface the server keeps its folders and SAVE files in
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+)
+
+// ErrNotEmpty is returned by Remove for a folder that still has objects or folders in it
+var ErrNotEmpty = errors.New("folder is not empty")
+
+// File is an object of a Storage opened with OpenFile. Objects opened read only can not be written to.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	// Size returns the size of the object in bytes
+	Size() (int64, error)
+	// Truncate changes the size of the object, adding zeros when it grows
+	Truncate(size int64) error
+	// Sync makes the writes so far durable. Storage that stages objects makes them durable in its staging folder.
+	Sync() error
+}
+
+// Info is an object that describes an object or folder of a Storage
+type Info struct {
+	// Name is the last part of the name, like "2024-01-01" for the folder "photos/2024-01-01"
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// Storage is where a server keeps its folders, its SAVE files and the files that go with them like thumbnails.
+// Names are relative to the root of the storage and use "/" to separate folders, like "2024/07/14/name".
+// The root itself is "". Errors for names that do not exist match fs.ErrNotExist, so os.IsNotExist works with them.
+type Storage interface {
+	// OpenFile opens an object with os.O_RDONLY or os.O_RDWR, along with os.O_CREATE, os.O_EXCL and os.O_TRUNC.
+	// The folder the object is in has to exist.
+	OpenFile(name string, flag int) (File, error)
+	// Stat describes an object or folder
+	Stat(name string) (Info, error)
+	// ReadDir lists the objects and folders in a folder in name order
+	ReadDir(folder string) ([]Info, error)
+	// MkdirAll creates a folder along with any parent folders, it is not an error when it exists
+	MkdirAll(folder string) error
+	// Remove removes an object or an empty folder
+	Remove(name string) error
+	// RemoveAll removes an object or a folder along with everything in it, it is not an error when it does not exist
+	RemoveAll(name string) error
+	// Rename moves an object or a folder. The folder it is moved to has to exist, an object there is replaced.
+	Rename(from, to string) error
+}
+
+// Spacer is a Storage that knows how much space it has left, like the disk a FileSystem is on
+type Spacer interface {
+	// Space returns the bytes free and the size in bytes of the space the storage is kept in
+	Space() (uint64, uint64, error)
+}
+
+// Publisher is a Storage that keeps the objects being written in a local staging folder until they are published,
+// like an S3 storage, which can not change part of an object. OpenFile, Stat and ReadDir see the staged copy
+// of an object until then.
+type Publisher interface {
+	// Publish sends the staged copy of an object to where the storage keeps it, it is not an error when there is none
+	Publish(name string) error
+}
+
+// Publish is a method to send an object that is done being written to where a storage keeps it.
+// It does nothing for storage that is not a Publisher, which keeps every write where it is made.
+// @param st Storage
+// @param name string
+// @return error
+func Publish(st Storage, name string) error {
+	publisher, ok := st.(Publisher)
+	if !ok {
+		return nil
+	}
+	return publisher.Publish(name)
+}
+
+// Open is a method to open an object of a storage for reading.
+// @param st Storage
+// @param name string
+// @return File
+// @return error
+func Open(st Storage, name string) (File, error) {
+	return st.OpenFile(name, os.O_RDONLY)
+}
+
+// ReadFile is a method to read the whole of an object of a storage.
+// @param st Storage
+// @param name string
+// @return []byte
+// @return error
+func ReadFile(st Storage, name string) ([]byte, error) {
+	file, err := Open(st, name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	size, err := file.Size()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	n, err := file.ReadAt(data, 0)
+	if err == io.EOF && int64(n) == size {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteFile is a method to write an object of a storage, replacing it if it exists, and publish it.
+// @param st Storage
+// @param name string
+// @param data []byte
+// @return error
+func WriteFile(st Storage, name string, data []byte) error {
+	file, err := st.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt(data, 0)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return Publish(st, name)
+}
+
+// clean returns a name with its "." and ".." parts resolved, without a leading "/", and "" for the root.
+// A name can not go above the root.
+// @param name string
+// @return string
+func clean(name string) string {
+	name = path.Clean("/" + name)
+	return name[1:]
+}
+
+// parent returns the folder a cleaned name is in, "" for the root
+// @param name string
+// @return string
+func parent(name string) string {
+	dir := path.Dir(name)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// notExist returns the error for a name that does not exist
+// @param op string What was being done, like "open"
+// @param name string
+// @return error
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
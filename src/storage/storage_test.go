@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// testStorage checks that a storage behaves the way the Storage interface says,
+// so FileSystem, Memory and S3 can be used in place of each other
+func testStorage(t *testing.T, st Storage) {
+	t.Helper()
+	check := func(what string, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: %s", what, err)
+		}
+	}
+	check("create root", st.MkdirAll(""))
+	check("create folders", st.MkdirAll("a/b"))
+	if info, err := st.Stat("a"); err != nil || !info.IsDir || info.Name != "a" {
+		t.Errorf("Stat of a folder gave %+v, %v", info, err)
+	}
+	if info, err := st.Stat(""); err != nil || !info.IsDir {
+		t.Errorf("Stat of the root gave %+v, %v", info, err)
+	}
+	check("write", WriteFile(st, "a/b/x", []byte("some data")))
+	if data, err := ReadFile(st, "a/b/x"); err != nil || string(data) != "some data" {
+		t.Errorf("read %q, %v", data, err)
+	}
+	if info, err := st.Stat("a/b/x"); err != nil || info.IsDir || info.Size != 9 || info.Name != "x" {
+		t.Errorf("Stat of an object gave %+v, %v", info, err)
+	}
+
+	// an object written in parts, the way SAVE files are, can be read and written again before it is published
+	file, err := st.OpenFile("a/y", os.O_RDWR|os.O_CREATE)
+	check("create", err)
+	check("truncate", file.Truncate(10))
+	_, err = file.WriteAt([]byte("abc"), 0)
+	check("write at", err)
+	check("sync", file.Sync())
+	check("close", file.Close())
+	if info, err := st.Stat("a/y"); err != nil || info.Size != 10 {
+		t.Errorf("Stat of an object being written gave %+v, %v", info, err)
+	}
+	file, err = st.OpenFile("a/y", os.O_RDWR)
+	check("open again", err)
+	_, err = file.WriteAt([]byte("defghij"), 3)
+	check("write at", err)
+	if size, err := file.Size(); err != nil || size != 10 {
+		t.Errorf("size is %d, %v", size, err)
+	}
+	check("close", file.Close())
+	check("publish", Publish(st, "a/y"))
+	if data, err := ReadFile(st, "a/y"); err != nil || string(data) != "abcdefghij" {
+		t.Errorf("read %q, %v", data, err)
+	}
+	file, err = Open(st, "a/y")
+	check("open", err)
+	buf := make([]byte, 4)
+	if n, err := file.ReadAt(buf, 8); n != 2 || err == nil || string(buf[:n]) != "ij" {
+		t.Errorf("read past the end gave %d %q, %v", n, buf[:n], err)
+	}
+	if _, err := file.WriteAt([]byte("x"), 0); err == nil {
+		t.Error("wrote to an object opened read only")
+	}
+	file.Close()
+
+	if _, err := st.OpenFile("a/y", os.O_RDWR|os.O_CREATE|os.O_EXCL); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("exclusive create of an object that exists gave %v", err)
+	}
+	if _, err := Open(st, "a/missing"); !os.IsNotExist(err) {
+		t.Errorf("open of a missing object gave %v", err)
+	}
+	if _, err := st.OpenFile("missing/x", os.O_RDWR|os.O_CREATE); !os.IsNotExist(err) {
+		t.Errorf("create in a missing folder gave %v", err)
+	}
+	if _, err := st.Stat("a/missing"); !os.IsNotExist(err) {
+		t.Errorf("Stat of a missing object gave %v", err)
+	}
+	odd := "name with spaces, %41 and é"
+	check("write odd name", WriteFile(st, "a/"+odd, nil))
+	infos, err := st.ReadDir("a")
+	check("read folder", err)
+	names := make([]string, 0)
+	for _, info := range infos {
+		names = append(names, info.Name)
+		if info.IsDir != (info.Name == "b") {
+			t.Errorf("%s IsDir is %v", info.Name, info.IsDir)
+		}
+	}
+	if want := []string{"b", odd, "y"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("folder has %q, want %q", names, want)
+	}
+	if _, err := st.ReadDir("missing"); !os.IsNotExist(err) {
+		t.Errorf("listing of a missing folder gave %v", err)
+	}
+
+	check("rename object", st.Rename("a/y", "a/b/z"))
+	if _, err := st.Stat("a/y"); !os.IsNotExist(err) {
+		t.Errorf("renamed object is still there, %v", err)
+	}
+	check("rename folder", st.Rename("a/b", "c"))
+	for name, want := range map[string]string{"c/x": "some data", "c/z": "abcdefghij"} {
+		if data, err := ReadFile(st, name); err != nil || string(data) != want {
+			t.Errorf("%s is %q, %v after the rename", name, data, err)
+		}
+	}
+	if _, err := st.Stat("a/b"); !os.IsNotExist(err) {
+		t.Errorf("renamed folder is still there, %v", err)
+	}
+	if err := st.Remove("c"); err == nil {
+		t.Error("removed a folder that is not empty")
+	}
+	check("remove object", st.Remove("c/x"))
+	check("remove all", st.RemoveAll("c"))
+	check("remove all of a missing folder", st.RemoveAll("c"))
+	if _, err := st.Stat("c"); !os.IsNotExist(err) {
+		t.Errorf("removed folder is still there, %v", err)
+	}
+	check("remove object", st.Remove("a/"+odd))
+	check("remove empty folder", st.Remove("a"))
+	if infos, err := st.ReadDir(""); err != nil || len(infos) != 0 {
+		t.Errorf("root has %+v, %v after everything was removed", infos, err)
+	}
+
+	// an object being written that is moved or removed goes with its folder
+	check("create folder", st.MkdirAll("d"))
+	file, err = st.OpenFile("d/partial", os.O_RDWR|os.O_CREATE)
+	check("create", err)
+	_, err = file.WriteAt([]byte("part"), 0)
+	check("write at", err)
+	check("close", file.Close())
+	check("create folder", st.MkdirAll("e"))
+	check("rename folder", st.Rename("d", "e/d"))
+	if data, err := ReadFile(st, "e/d/partial"); err != nil || !bytes.Equal(data, []byte("part")) {
+		t.Errorf("moved object being written is %q, %v", data, err)
+	}
+	check("remove all", st.RemoveAll("e"))
+	if _, err := st.Stat("e/d/partial"); !os.IsNotExist(err) {
+		t.Errorf("removed object being written is still there, %v", err)
+	}
+}
+
+func TestFileSystem(t *testing.T) {
+	testStorage(t, NewFileSystem(t.TempDir()))
+}
+
+func TestMemory(t *testing.T) {
+	testStorage(t, NewMemory())
+}